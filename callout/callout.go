@@ -0,0 +1,209 @@
+package callout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Result string
+
+const (
+	Valid   Result = "valid"   // The MX accepted the recipient
+	Invalid Result = "invalid" // The MX rejected the recipient with a 5xx reply
+	Unknown Result = "unknown" // The recipient could not be verified
+)
+
+// sweepInterval is how often expired results are dropped from the cache
+const sweepInterval = time.Minute
+
+// Resolver is the subset of *net.Resolver used to find MX hosts
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type Config struct {
+	Hostname    string        // Name sent in EHLO
+	Port        string        // MX port, default "25"
+	Timeout     time.Duration // Time allowed for one callout
+	CacheTTL    time.Duration // How long a valid result is remembered
+	NegativeTTL time.Duration // How long an invalid result is remembered
+	Resolver    Resolver      // Defaults to net.DefaultResolver
+}
+
+type entry struct {
+	result  Result
+	expires time.Time
+}
+
+// Verifier checks that recipients exist by asking their MX hosts, caching
+// the answers so repeated recipients do not cause repeated callouts
+type Verifier struct {
+	config    Config
+	cache     map[string]entry
+	nextSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewVerifier(config *Config) *Verifier {
+	v := &Verifier{config: *config, cache: make(map[string]entry)}
+	if v.config.Port == "" {
+		v.config.Port = "25"
+	}
+	if v.config.Resolver == nil {
+		v.config.Resolver = net.DefaultResolver
+	}
+	return v
+}
+
+// Verify reports whether the recipient's MX accepts address, using a cached
+// result when there is one. The callout sends MAIL FROM:<> and RCPT TO for
+// the address, then resets and quits without sending a message. Unknown
+// results, such as an unreachable MX or a 4xx reply, are not cached.
+func (v *Verifier) Verify(ctx context.Context, address string) (Result, error) {
+	key := strings.ToLower(address)
+	if result, ok := v.cached(key); ok {
+		if result == Invalid {
+			return result, fmt.Errorf("%s was rejected by an earlier callout", address)
+		}
+		return result, nil
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return Unknown, fmt.Errorf("invalid address %q", address)
+	}
+	domain := strings.ToLower(strings.TrimSuffix(address[at+1:], "."))
+
+	ctx, cancel := context.WithTimeout(ctx, v.config.Timeout)
+	defer cancel()
+	hosts, err := v.mxHosts(ctx, domain)
+	if err != nil {
+		return Unknown, err
+	}
+
+	for _, host := range hosts {
+		var result Result
+		result, err = v.ask(ctx, host, address)
+		switch result {
+		case Valid:
+			v.store(key, result, v.config.CacheTTL)
+			return result, nil
+		case Invalid:
+			v.store(key, result, v.config.NegativeTTL)
+			return result, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return Unknown, err
+}
+
+func (v *Verifier) cached(key string) (Result, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	e, ok := v.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.result, true
+}
+
+func (v *Verifier) store(key string, result Result, ttl time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if now.After(v.nextSweep) {
+		for k, e := range v.cache {
+			if now.After(e.expires) {
+				delete(v.cache, k)
+			}
+		}
+		v.nextSweep = now.Add(sweepInterval)
+	}
+	v.cache[key] = entry{result: result, expires: now.Add(ttl)}
+}
+
+// mxHosts returns the addresses to call out to for domain in MX preference
+// order, falling back to the domain itself when it has no MX records
+func (v *Verifier) mxHosts(ctx context.Context, domain string) ([]string, error) {
+	records, err := v.config.Resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("MX lookup for %s failed: %w", domain, err)
+		}
+	}
+	if len(records) == 0 {
+		if _, err := v.config.Resolver.LookupHost(ctx, domain); err != nil {
+			return nil, fmt.Errorf("no MX or address records for %s: %w", domain, err)
+		}
+		return []string{net.JoinHostPort(domain, v.config.Port)}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	var hosts []string
+	for _, record := range records {
+		// A null MX (RFC 7505) means the domain does not accept mail
+		if host := strings.TrimSuffix(record.Host, "."); host != "" {
+			hosts = append(hosts, net.JoinHostPort(host, v.config.Port))
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("domain %s does not accept mail", domain)
+	}
+	return hosts, nil
+}
+
+// ask runs one callout against host. Only a 5xx reply to RCPT makes the
+// address invalid; a host refusing the null sender says nothing about it.
+func (v *Verifier) ask(ctx context.Context, host, address string) (Result, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return Unknown, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	hostname, _, _ := net.SplitHostPort(host)
+	c, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		conn.Close()
+		return Unknown, fmt.Errorf("callout to %s failed: %w", host, err)
+	}
+	defer c.Close()
+
+	if err := c.Hello(v.config.Hostname); err != nil {
+		return Unknown, fmt.Errorf("callout to %s failed: %w", host, err)
+	}
+	if err := c.Mail(""); err != nil {
+		return Unknown, fmt.Errorf("callout to %s failed: %w", host, err)
+	}
+	err = c.Rcpt(address)
+	c.Reset()
+	c.Quit()
+
+	var protoErr *textproto.Error
+	switch {
+	case err == nil:
+		return Valid, nil
+	case errors.As(err, &protoErr) && protoErr.Code >= 500:
+		return Invalid, fmt.Errorf("%s rejected %s: %w", host, address, err)
+	default:
+		return Unknown, fmt.Errorf("callout to %s failed: %w", host, err)
+	}
+}
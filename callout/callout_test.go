@@ -0,0 +1,226 @@
+package callout
+
+import (
+	"context"
+	"errors"
+	"go-relay-server/smtptest"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers MX and host lookups from maps; names it does not
+// know are not found
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, notFound(host)
+}
+
+// startMX starts a mock MX that rejects recipients starting with "unknown"
+// permanently and those starting with "busy" temporarily
+func startMX(t *testing.T) *smtptest.Server {
+	t.Helper()
+	mx := smtptest.NewUnstartedServer()
+	mx.Reply = func(verb, line string) string {
+		switch {
+		case verb == "RCPT" && strings.Contains(line, "<unknown"):
+			return "550 No such user"
+		case verb == "RCPT" && strings.Contains(line, "<busy"):
+			return "450 Try again later"
+		}
+		return ""
+	}
+	mx.Start()
+	t.Cleanup(mx.Close)
+	return mx
+}
+
+// rcpts returns the RCPT commands mx received
+func rcpts(mx *smtptest.Server) []string {
+	var commands []string
+	for _, command := range mx.Commands() {
+		if strings.HasPrefix(strings.ToUpper(command), "RCPT") {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// newTestVerifier returns a verifier whose MX for example.org is mx
+func newTestVerifier(t *testing.T, mx *smtptest.Server, resolver fakeResolver) *Verifier {
+	t.Helper()
+	_, port, _ := net.SplitHostPort(mx.Addr)
+	if resolver.mx == nil {
+		resolver.mx = map[string][]*net.MX{"example.org": {{Host: "127.0.0.1.", Pref: 10}}}
+	}
+	return NewVerifier(&Config{
+		Hostname:    "relay.test",
+		Port:        port,
+		Timeout:     5 * time.Second,
+		CacheTTL:    time.Hour,
+		NegativeTTL: time.Hour,
+		Resolver:    resolver,
+	})
+}
+
+func TestVerify(t *testing.T) {
+	mx := startMX(t)
+	v := newTestVerifier(t, mx, fakeResolver{})
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		address string
+		want    Result
+	}{
+		{"user@example.org", Valid},
+		{"unknown@example.org", Invalid},
+		{"busy@example.org", Unknown},
+		{"user@nowhere.test", Unknown},
+		{"no-domain", Unknown},
+	} {
+		result, err := v.Verify(ctx, tt.address)
+		if result != tt.want {
+			t.Errorf("Verify(%q) = %s, %v, want %s", tt.address, result, err, tt.want)
+		}
+		if (err == nil) != (tt.want == Valid) {
+			t.Errorf("Verify(%q) returned error %v", tt.address, err)
+		}
+	}
+
+	// The callout never sends a message, and uses the null sender
+	if n := len(mx.Messages()); n != 0 {
+		t.Errorf("MX received %d messages", n)
+	}
+	for _, command := range mx.Commands() {
+		if strings.HasPrefix(command, "MAIL") && !strings.HasPrefix(command, "MAIL FROM:<> ") {
+			t.Errorf("callout sent %q, want the null sender", command)
+		}
+		if strings.HasPrefix(command, "DATA") {
+			t.Error("callout sent DATA")
+		}
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	mx := startMX(t)
+	v := newTestVerifier(t, mx, fakeResolver{})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		for _, address := range []string{"user@example.org", "USER@Example.org", "unknown@example.org", "busy@example.org"} {
+			v.Verify(ctx, address)
+		}
+	}
+	// Valid and invalid answers are reused, however the address is cased;
+	// temporary failures are asked again
+	want := []string{
+		"RCPT TO:<user@example.org>",
+		"RCPT TO:<unknown@example.org>",
+		"RCPT TO:<busy@example.org>",
+		"RCPT TO:<busy@example.org>",
+		"RCPT TO:<busy@example.org>",
+	}
+	if got := rcpts(mx); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("MX received %q, want %q", got, want)
+	}
+	if result, err := v.Verify(ctx, "unknown@example.org"); result != Invalid || err == nil {
+		t.Errorf("cached invalid result = %s, %v, want invalid with an error", result, err)
+	}
+}
+
+func TestVerifyCacheExpiry(t *testing.T) {
+	mx := startMX(t)
+	v := newTestVerifier(t, mx, fakeResolver{})
+	v.config.CacheTTL = 50 * time.Millisecond
+	v.config.NegativeTTL = time.Hour
+	ctx := context.Background()
+
+	v.Verify(ctx, "user@example.org")
+	v.Verify(ctx, "unknown@example.org")
+	time.Sleep(100 * time.Millisecond)
+	v.Verify(ctx, "user@example.org")
+	v.Verify(ctx, "unknown@example.org")
+
+	// Valid results expired, invalid ones are kept for their own TTL
+	if got := rcpts(mx); len(got) != 3 {
+		t.Errorf("MX received %q, want the valid recipient asked twice", got)
+	}
+}
+
+func TestVerifyMXSelection(t *testing.T) {
+	mx := startMX(t)
+	ctx := context.Background()
+
+	t.Run("preference order", func(t *testing.T) {
+		// Nothing listens on 127.0.0.2, so the callout moves on to the next MX
+		v := newTestVerifier(t, mx, fakeResolver{mx: map[string][]*net.MX{
+			"example.org": {{Host: "127.0.0.1.", Pref: 20}, {Host: "127.0.0.2.", Pref: 10}},
+		}})
+		if result, err := v.Verify(ctx, "first@example.org"); result != Valid {
+			t.Fatalf("Verify = %s, %v, want valid from the second MX", result, err)
+		}
+	})
+
+	t.Run("no MX", func(t *testing.T) {
+		// Without MX records the domain itself is asked
+		v := newTestVerifier(t, mx, fakeResolver{
+			mx:    map[string][]*net.MX{},
+			hosts: map[string][]string{"127.0.0.1": {"127.0.0.1"}},
+		})
+		if result, err := v.Verify(ctx, "implicit@127.0.0.1"); result != Valid {
+			t.Fatalf("Verify = %s, %v, want valid from the implicit MX", result, err)
+		}
+	})
+
+	t.Run("null MX", func(t *testing.T) {
+		v := newTestVerifier(t, mx, fakeResolver{mx: map[string][]*net.MX{"example.org": {{Host: ".", Pref: 0}}}})
+		result, err := v.Verify(ctx, "nullmx@example.org")
+		if result != Unknown || err == nil || !strings.Contains(err.Error(), "does not accept mail") {
+			t.Fatalf("Verify = %s, %v, want unknown for a null MX", result, err)
+		}
+	})
+
+	t.Run("lookup failure", func(t *testing.T) {
+		v := newTestVerifier(t, mx, fakeResolver{})
+		v.config.Resolver = failingResolver{}
+		if result, err := v.Verify(ctx, "fail@example.org"); result != Unknown || err == nil {
+			t.Fatalf("Verify = %s, %v, want unknown", result, err)
+		}
+	})
+
+	for _, rcpt := range rcpts(mx) {
+		if strings.Contains(rcpt, "nullmx") || strings.Contains(rcpt, "fail@") {
+			t.Errorf("MX asked about %q", rcpt)
+		}
+	}
+}
+
+// failingResolver fails every lookup with a temporary error
+type failingResolver struct{}
+
+func (failingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, errors.New("server misbehaving")
+}
+
+func (failingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, errors.New("server misbehaving")
+}
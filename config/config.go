@@ -4,39 +4,243 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ListenerConfig struct {
 	Host        string `json:"host"`
 	Port        string `json:"port"`
-	Encryption  string `json:"encryption"`   // "none", "tls", or "starttls"
-	RequireAuth bool   `json:"require_auth"` // Whether to require authentication
+	Encryption  string `json:"encryption"`    // "none", "tls", or "starttls"
+	RequireAuth bool   `json:"require_auth"`  // Whether to require authentication
+	TLSCertFile string `json:"tls_cert_file"` // Optional per-listener certificate, selected via SNI
+	TLSKeyFile  string `json:"tls_key_file"`  // Optional per-listener private key
+	// TLSClientCAFile requires clients to present a certificate issued by one of these PEM CAs
+	TLSClientCAFile string `json:"tls_client_ca_file"`
+	// ProxyProtocol expects a PROXY protocol v1 header carrying the real client address
+	ProxyProtocol bool `json:"proxy_protocol"`
+	Acceptors     int  `json:"acceptors"` // Concurrent accept loops, default 1
+	// RateLimiting replaces the global rate_limiting for connections on this listener
+	RateLimiting *RateLimiting `json:"rate_limiting,omitempty"`
 }
 
 type Config struct {
-	Listeners     []ListenerConfig  `json:"listeners"`
-	DefaultRelay  string            `json:"default_relay"`
-	AllowList     []string          `json:"allow_list"`
-	BlockList     []string          `json:"block_list"`
-	DomainRouting map[string]string `json:"domain_routing"`
-	TLSCertFile   string            `json:"tls_cert_file"`
-	TLSKeyFile    string            `json:"tls_key_file"`
-	AuthUsername  string            `json:"auth_username"`
-	AuthPassword  string            `json:"auth_password"`
-	LogFile       string            `json:"log_file"`
-	LogLevel      string            `json:"log_level"`
-	RateLimiting  RateLimiting      `json:"rate_limiting"`
-	Queue         QueueConfig       `json:"queue"`
+	Listeners     []ListenerConfig     `json:"listeners"`
+	DefaultRelay  RelayList            `json:"default_relay"` // One relay or a failover list tried in order
+	AllowList     []string             `json:"allow_list"`
+	BlockList     []string             `json:"block_list"`
+	DomainRouting map[string]RelayList `json:"domain_routing"`
+	// SenderRouting routes by envelope sender address, local part ("billing@") or domain, ahead of domain_routing
+	SenderRouting map[string]RelayList `json:"sender_routing"`
+	// SenderRewrite replaces the envelope sender of relayed mail, e.g. with a bounce address on the relay's domain
+	SenderRewrite SenderRewriteConfig `json:"sender_rewrite"`
+	// RelayCredentials holds SMTP AUTH credentials keyed by relay address, e.g. "smtp.sendgrid.net:587"
+	RelayCredentials map[string]RelayCredential `json:"relay_credentials"`
+	TLSCertFile      string                     `json:"tls_cert_file"`
+	TLSKeyFile       string                     `json:"tls_key_file"`
+	TLSMinVersion    string                     `json:"tls_min_version"`   // "1.2" (default) or "1.3"
+	TLSCipherSuites  []string                   `json:"tls_cipher_suites"` // TLS 1.2 suites named as in crypto/tls, empty for the defaults
+	AuthUsername     string                     `json:"auth_username"`
+	AuthPassword     string                     `json:"auth_password"`
+	LogFile          string                     `json:"log_file"`
+	LogLevel         string                     `json:"log_level"`
+	LogFormat        string                     `json:"log_format"` // "text" (default) or "json"
+	LogDir           string                     `json:"log_dir"`
+	LogRetentionDays int                        `json:"log_retention_days"` // Days to keep rotated logs, default 7
+	LogCompress      bool                       `json:"log_compress"`       // Gzip rotated log files
+	LogConsole       bool                       `json:"log_console"`        // Also log to stderr, colorized on a terminal
+	AccessLog        string                     `json:"access_log"`         // Path of the per-message access log; empty disables it
+	RateLimiting     RateLimiting               `json:"rate_limiting"`
+	Queue            QueueConfig                `json:"queue"`
+	Greylist         GreylistConfig             `json:"greylist"`
+	SPF              SPFConfig                  `json:"spf"`
+	Callout          CalloutConfig              `json:"callout"`
+	DNSBL            DNSBLConfig                `json:"dnsbl"`
+	ReverseDNS       ReverseDNSConfig           `json:"reverse_dns"`
+	DKIM             DKIMConfig                 `json:"dkim"`
+	Append           AppendConfig               `json:"append"`
+	// RelayTargetHeader lets trusted clients choose the upstream relay per message
+	RelayTargetHeader RelayTargetHeaderConfig `json:"relay_target_header"`
+	// ListPrecedence decides entries on both allow_list and block_list: "block-wins" (default) or "allow-wins"
+	ListPrecedence string `json:"list_precedence"`
+	// DisabledCommands are SMTP verbs rejected with 502, e.g. "HELO" and "BDAT"
+	DisabledCommands []string `json:"disabled_commands"`
+	// LocalPartCase is "preserve" (default) to keep the case of the local part of envelope addresses or "lower" to lowercase it
+	LocalPartCase string `json:"local_part_case"`
+	// MessageChecks enables optional structural validation of DATA
+	MessageChecks MessageChecksConfig `json:"message_checks"`
+	// HeaderPolicy controls messages missing Date or From: "lenient" (default) adds them, "strict" rejects
+	HeaderPolicy string `json:"header_policy"`
+	// AdminAddr is the listen address of the admin HTTP endpoints, e.g. "127.0.0.1:8025"; empty disables them
+	AdminAddr string `json:"admin_addr"`
+	// PIDFile is where the running server records its process ID, default "smtp-relay.pid"
+	PIDFile string `json:"pid_file"`
+	// ControlSocket is the unix socket used by the CLI to query the running server, default "smtp-relay.sock"
+	ControlSocket string `json:"control_socket"`
+	// ShutdownTimeout bounds how long Stop waits for active connections to drain, e.g. "30s"
+	ShutdownTimeout string `json:"shutdown_timeout"`
+	// RelayPool keeps upstream connections open for reuse across messages
+	RelayPool RelayPoolConfig `json:"relay_pool"`
+	// RelayTimeout bounds connecting to and waiting on relays and MX hosts
+	RelayTimeout RelayTimeoutConfig `json:"relay_timeout"`
+	// RelayRetry retries refused connections within one delivery attempt
+	RelayRetry RelayRetryConfig `json:"relay_retry"`
+	// UpstreamTLS controls STARTTLS on connections to relays and MX hosts
+	UpstreamTLS UpstreamTLSConfig `json:"upstream_tls"`
+	// DryRun runs the SMTP dialogue and routing but logs the relay decision instead of sending
+	DryRun bool `json:"dry_run"`
+	// Hostname identifies this relay in the greeting, EHLO replies and Received headers, default the OS hostname
+	Hostname string `json:"hostname"`
+	// Greeting is the text after the hostname in the 220 banner, default "ESMTP ready"
+	Greeting string `json:"greeting"`
+	// Spool controls where DATA is buffered while a message is handled
+	Spool SpoolConfig `json:"spool"`
+	// MaxConnections caps concurrent connections across all listeners; 0 for no limit
+	MaxConnections int `json:"max_connections"`
+	// MaxConnectionsPerIP caps concurrent connections from a single client IP; 0 for no limit
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// MaxConnectionLifetime closes connections this long after they were accepted, however active, e.g. "30m"; empty for no limit
+	MaxConnectionLifetime string `json:"max_connection_lifetime"`
+	// TarpitDelay delays replies to blocked and rate-limited clients, e.g. "10s"; empty to disable
+	TarpitDelay string `json:"tarpit_delay"`
+	// BannerDelay holds back the greeting and rejects clients that send data before it, e.g. "5s"; empty to disable
+	BannerDelay string `json:"banner_delay"`
+	// MaxAcceptRate caps how many new connections are accepted per second across all listeners; 0 for no limit
+	MaxAcceptRate int `json:"max_accept_rate"`
+	// MaxRecipients caps the RCPT TO commands accepted per message; 0 for no limit
+	MaxRecipients int `json:"max_recipients"`
+	// Responses overrides the reply sent for a rejection reason, keyed by one of ResponseReasons
+	Responses map[string]ResponseConfig `json:"responses"`
+	// Comment holds free-form notes, since JSON has no comments; it is ignored
+	Comment json.RawMessage `json:"_comment"`
 }
 
 type QueueConfig struct {
-	StoragePath     string
-	MaxRetries      int
-	RetryInterval   string
-	MaxQueueSize    int
-	PersistInterval string
+	StoragePath     string `json:"storage_path"`
+	MaxRetries      int    `json:"max_retries"`
+	RetryInterval   string `json:"retry_interval"`
+	MaxQueueSize    int    `json:"max_queue_size"`
+	MaxQueueBytes   int64  `json:"max_queue_bytes"` // 0 for no limit
+	PersistInterval string `json:"persist_interval"`
+	DedupWindow     string `json:"dedup_window"`    // Suppress identical messages enqueued within this window, empty to disable
+	DrainTimeout    string `json:"drain_timeout"`   // How long deliveries in progress may finish on shutdown, default "10s"
+	MaxConcurrency  int    `json:"max_concurrency"` // Queued messages delivered at once, 0 for no limit
+}
+
+type RelayPoolConfig struct {
+	Size        int    `json:"size"`         // Idle connections kept per upstream address; 0 disables pooling
+	IdleTimeout string `json:"idle_timeout"` // How long an idle connection is kept, default "30s"
+}
+
+type RelayTimeoutConfig struct {
+	Dial    string `json:"dial"`    // Time allowed to connect, default "30s"
+	Command string `json:"command"` // Time allowed for each read or write on the session, default "5m"
+}
+
+type RelayRetryConfig struct {
+	ConnectRetries int    `json:"connect_retries"` // Extra connection attempts after a refused or reset connection; 0 disables
+	Backoff        string `json:"backoff"`         // Wait before the first retry, doubled for each further one, default "1s"
+}
+
+type UpstreamTLSConfig struct {
+	RequireTLS         bool   `json:"require_tls"`          // Fail delivery to hosts that do not offer STARTTLS
+	CAFile             string `json:"ca_file"`              // PEM bundle used instead of the system roots
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Accept any upstream certificate
+}
+
+type SpoolConfig struct {
+	Dir             string `json:"dir"`              // Directory for spilled messages, default the system temp directory
+	MemoryThreshold int64  `json:"memory_threshold"` // Bytes held in memory before spilling to disk, default 10 MiB
+	// ProgressInterval logs DATA progress at DEBUG level each time this many more bytes arrive; 0 disables
+	ProgressInterval int64 `json:"progress_interval"`
+}
+
+type RelayCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type SenderRewriteConfig struct {
+	Address     string   `json:"address"`      // New sender, may use {local} and {domain} of the original; empty disables
+	SkipDomains []string `json:"skip_domains"` // Sender domains, and their subdomains, relayed unchanged
+}
+
+type RelayTargetHeaderConfig struct {
+	Enabled        bool     `json:"enabled"`
+	TrustedClients []string `json:"trusted_clients"` // IPs or CIDRs whose header is honoured
+	AllowedTargets []string `json:"allowed_targets"` // Relays a message may be routed to, e.g. "smarthost-b:587"
+}
+
+type GreylistConfig struct {
+	Enabled         bool   `json:"enabled"`
+	StoragePath     string `json:"storage_path"`     // Defaults to queue.storage_path
+	InitialDelay    string `json:"initial_delay"`    // How long a new triple must wait before a retry is accepted, e.g. "5m"
+	WhitelistPeriod string `json:"whitelist_period"` // How long an accepted triple stays whitelisted, e.g. "720h"
+	PersistInterval string `json:"persist_interval"` // Defaults to queue.persist_interval
+}
+
+type MessageChecksConfig struct {
+	MaxLineLength          int  `json:"max_line_length"`          // Longest allowed line including CRLF, RFC 5321 sets 1000; 0 disables
+	RequireHeaderSeparator bool `json:"require_header_separator"` // Require a blank line between headers and body
+	RequireFrom            bool `json:"require_from"`             // Reject messages without a valid From header
+}
+
+type SPFConfig struct {
+	Mode string `json:"mode"` // "off" (default), "monitor" to only log results, or "enforce" to reject failures
+}
+
+type DNSBLConfig struct {
+	Mode     string   `json:"mode"`      // "off" (default), "monitor" to only log listings, or "enforce" to reject listed clients
+	Zones    []string `json:"zones"`     // Blocklist zones queried in order, e.g. "zen.spamhaus.org"
+	Timeout  string   `json:"timeout"`   // Time allowed for the lookups of one connection, default "5s"
+	CacheTTL string   `json:"cache_ttl"` // How long an answer is remembered, default "1h"
+}
+
+type ReverseDNSConfig struct {
+	Mode     string `json:"mode"`      // "off" (default), "monitor" to only log the client's PTR name, or "enforce" to also reject clients failing require
+	Require  string `json:"require"`   // "ptr" (default) for any PTR record, or "fcrdns" for a PTR name that resolves back to the client IP
+	Timeout  string `json:"timeout"`   // Time allowed for the lookups of one connection, default "5s"
+	CacheTTL string `json:"cache_ttl"` // How long a result is remembered, default "1h"
+}
+
+type CalloutConfig struct {
+	Enabled          bool     `json:"enabled"`
+	Domains          []string `json:"domains"`            // Recipient domains to verify, and their subdomains; empty verifies all
+	Timeout          string   `json:"timeout"`            // Time allowed for one callout, default "30s"
+	CacheTTL         string   `json:"cache_ttl"`          // How long an existing recipient is remembered, default "24h"
+	NegativeCacheTTL string   `json:"negative_cache_ttl"` // How long a rejected recipient is remembered, default "1h"
+}
+
+type AppendConfig struct {
+	Header string `json:"header"` // Header line added to every relayed message, e.g. "X-Relayed-By: relay1"
+	Footer string `json:"footer"` // Text appended to the text/plain body, e.g. a legal disclaimer
+}
+
+type DKIMConfig struct {
+	KeyFile  string `json:"key_file"` // PEM encoded RSA private key
+	Selector string `json:"selector"`
+	Domain   string `json:"domain"`
+}
+
+// ResponseConfig is the SMTP reply sent for a rejection
+type ResponseConfig struct {
+	Code    int    `json:"code"`    // 4xx or 5xx reply code
+	Message string `json:"message"` // Reply text, default the built-in text for the reason
+}
+
+// DisableableCommands are the SMTP verbs disabled_commands may name. MAIL,
+// RCPT, DATA, QUIT and STARTTLS are needed to relay mail securely and cannot
+// be disabled. Verbs the server does not implement, such as VRFY, are always
+// answered as unrecognized and are not listed.
+var DisableableCommands = []string{"HELO", "EHLO", "AUTH", "BDAT", "NOOP", "RSET"}
+
+// ResponseReasons are the rejection reasons whose replies can be set in responses
+var ResponseReasons = []string{
+	"connection_blocked", "dnsbl_listed", "no_reverse_dns", "rate_limited", "early_talker", "too_many_connections",
+	"sender_blocked", "sender_not_allowed", "recipient_blocked", "recipient_not_allowed",
+	"spf_fail", "greylisted", "no_such_user", "too_many_recipients", "auth_required", "auth_failed",
 }
 
 type RateLimiting struct {
@@ -45,26 +249,61 @@ type RateLimiting struct {
 	ExemptIPs         []string `json:"exempt_ips"`
 }
 
+// RelayList is an ordered list of relays, tried until one accepts the
+// message. In config it may be written as a single string or an array.
+type RelayList []string
+
+func (l *RelayList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*l = nil
+		} else {
+			*l = RelayList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("relay must be a string or a list of strings")
+	}
+	*l = list
+	return nil
+}
+
 type LogLevel string
 
 const (
+	LogLevelDebug LogLevel = "DEBUG"
 	LogLevelInfo  LogLevel = "INFO"
 	LogLevelWarn  LogLevel = "WARN"
 	LogLevelError LogLevel = "ERROR"
 )
 
+// LoadConfig reads, decodes and validates the config from filename, which
+// may also be Stdin or an http:// or https:// URL
 func LoadConfig(filename string) (Config, error) {
 	var config Config
-	file, err := os.Open(filename)
+	data, isYAML, err := readSource(filename)
 	if err != nil {
-		return config, fmt.Errorf("failed to open config file: %v", err)
+		return config, err
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	if err != nil {
-		return config, fmt.Errorf("failed to decode config file: %v", err)
+	lines := true
+	if isYAML {
+		if data, err = yamlToJSON(data); err != nil {
+			return config, fmt.Errorf("failed to decode config file: %v", err)
+		}
+		lines = false
+	}
+
+	if err := decodeConfig(data, &config, lines); err != nil {
+		return config, fmt.Errorf("failed to decode config file %s: %v", sourceName(filename), err)
+	}
+
+	if err := expandEnv(&config); err != nil {
+		return config, fmt.Errorf("failed to expand config file: %v", err)
 	}
 
 	if err := validateConfig(config); err != nil {
@@ -74,15 +313,16 @@ func LoadConfig(filename string) (Config, error) {
 	return config, nil
 }
 
+// Validate checks a config built in code the way LoadConfig checks a file
+func Validate(config Config) error {
+	return validateConfig(config)
+}
+
 func validateConfig(config Config) error {
 	if len(config.Listeners) == 0 {
 		return errors.New("at least one listener configuration is required")
 	}
 
-	if config.DefaultRelay == "" {
-		return errors.New("default_relay is required")
-	}
-
 	// Validate listeners
 	for _, listener := range config.Listeners {
 		port, err := strconv.Atoi(listener.Port)
@@ -92,22 +332,283 @@ func validateConfig(config Config) error {
 		if listener.Encryption != "none" && listener.Encryption != "tls" && listener.Encryption != "starttls" {
 			return errors.New("listener encryption must be one of: none, tls, starttls")
 		}
+		if (listener.TLSCertFile == "") != (listener.TLSKeyFile == "") {
+			return errors.New("listener tls_cert_file and tls_key_file must be set together")
+		}
+		if listener.TLSClientCAFile != "" && listener.Encryption == "none" {
+			return fmt.Errorf("listener %s tls_client_ca_file requires tls or starttls encryption", listener.Port)
+		}
+		if listener.Acceptors < 0 {
+			return errors.New("listener acceptors must not be negative")
+		}
+		if listener.RateLimiting != nil {
+			if err := validateRateLimiting("listener "+listener.Port+" rate_limiting", *listener.RateLimiting); err != nil {
+				return err
+			}
+		}
 		if (listener.Encryption == "tls" || listener.Encryption == "starttls") &&
-			(config.TLSCertFile == "" || config.TLSKeyFile == "") {
+			(config.TLSCertFile == "" || config.TLSKeyFile == "") &&
+			listener.TLSCertFile == "" {
 			return errors.New("tls_cert_file and tls_key_file are required for encrypted listeners")
 		}
 	}
 
-	// Validate rate limiting configuration
-	if config.RateLimiting.RequestsPerMinute <= 0 {
-		return errors.New("rate_limiting.requests_per_minute must be positive")
+	if _, err := TLSMinVersion(config); err != nil {
+		return err
 	}
-	if config.RateLimiting.BurstLimit <= 0 {
-		return errors.New("rate_limiting.burst_limit must be positive")
+	if _, err := TLSCipherSuites(config); err != nil {
+		return err
 	}
-	if config.RateLimiting.BurstLimit > config.RateLimiting.RequestsPerMinute {
-		return errors.New("rate_limiting.burst_limit cannot be greater than requests_per_minute")
+
+	for relay, credential := range config.RelayCredentials {
+		if credential.Username == "" || credential.Password == "" {
+			return fmt.Errorf("relay_credentials for %s require both username and password", relay)
+		}
 	}
 
+	if address := config.SenderRewrite.Address; address != "" &&
+		(!strings.Contains(address, "@") || strings.ContainsAny(address, "<> \r\n")) {
+		return fmt.Errorf("sender_rewrite.address must be an address such as \"bounces@example.com\", got %q", address)
+	}
+
+	if config.RelayTargetHeader.Enabled && len(config.RelayTargetHeader.AllowedTargets) == 0 {
+		return errors.New("relay_target_header.allowed_targets is required when the header is enabled")
+	}
+
+	if err := validateQueueConfig(config.Queue); err != nil {
+		return err
+	}
+
+	if config.Greylist.Enabled {
+		if err := validateGreylistConfig(config.Greylist); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range map[string]string{"timeout": config.Callout.Timeout, "cache_ttl": config.Callout.CacheTTL, "negative_cache_ttl": config.Callout.NegativeCacheTTL} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("callout.%s must be a positive duration such as \"30s\", got %q", name, value)
+		}
+	}
+
+	if config.DNSBL.Mode != "" && config.DNSBL.Mode != "off" && config.DNSBL.Mode != "monitor" && config.DNSBL.Mode != "enforce" {
+		return errors.New("dnsbl.mode must be one of: off, monitor, enforce")
+	}
+	for name, value := range map[string]string{"timeout": config.DNSBL.Timeout, "cache_ttl": config.DNSBL.CacheTTL} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("dnsbl.%s must be a positive duration such as \"5s\", got %q", name, value)
+		}
+	}
+
+	if config.ReverseDNS.Mode != "" && config.ReverseDNS.Mode != "off" && config.ReverseDNS.Mode != "monitor" && config.ReverseDNS.Mode != "enforce" {
+		return errors.New("reverse_dns.mode must be one of: off, monitor, enforce")
+	}
+	if config.ReverseDNS.Require != "" && config.ReverseDNS.Require != "ptr" && config.ReverseDNS.Require != "fcrdns" {
+		return errors.New("reverse_dns.require must be one of: ptr, fcrdns")
+	}
+	for name, value := range map[string]string{"timeout": config.ReverseDNS.Timeout, "cache_ttl": config.ReverseDNS.CacheTTL} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("reverse_dns.%s must be a positive duration such as \"5s\", got %q", name, value)
+		}
+	}
+
+	if config.SPF.Mode != "" && config.SPF.Mode != "off" && config.SPF.Mode != "monitor" && config.SPF.Mode != "enforce" {
+		return errors.New("spf.mode must be one of: off, monitor, enforce")
+	}
+
+	if config.Append.Header != "" {
+		name, _, ok := strings.Cut(config.Append.Header, ":")
+		if !ok || name == "" || strings.ContainsAny(config.Append.Header, "\r\n") ||
+			strings.IndexFunc(name, func(c rune) bool { return c <= ' ' || c > '~' }) >= 0 {
+			return fmt.Errorf("append.header must be a single \"Name: value\" header line, got %q", config.Append.Header)
+		}
+	}
+
+	if config.DKIM != (DKIMConfig{}) && (config.DKIM.KeyFile == "" || config.DKIM.Selector == "" || config.DKIM.Domain == "") {
+		return errors.New("dkim.key_file, dkim.selector and dkim.domain must be set together")
+	}
+
+	if config.LogRetentionDays < 0 {
+		return errors.New("log_retention_days cannot be negative")
+	}
+
+	if config.LogFormat != "" && config.LogFormat != "text" && config.LogFormat != "json" {
+		return errors.New("log_format must be one of: text, json")
+	}
+
+	if config.ListPrecedence != "" && config.ListPrecedence != "block-wins" && config.ListPrecedence != "allow-wins" {
+		return errors.New("list_precedence must be one of: block-wins, allow-wins")
+	}
+	for _, command := range config.DisabledCommands {
+		if !slices.Contains(DisableableCommands, strings.ToUpper(command)) {
+			return fmt.Errorf("disabled_commands: %q cannot be disabled, expected one of %s", command, strings.Join(DisableableCommands, ", "))
+		}
+	}
+	if slices.ContainsFunc(config.DisabledCommands, func(c string) bool { return strings.EqualFold(c, "HELO") }) &&
+		slices.ContainsFunc(config.DisabledCommands, func(c string) bool { return strings.EqualFold(c, "EHLO") }) {
+		return errors.New("disabled_commands cannot contain both HELO and EHLO")
+	}
+	if config.LocalPartCase != "" && config.LocalPartCase != "preserve" && config.LocalPartCase != "lower" {
+		return errors.New("local_part_case must be one of: preserve, lower")
+	}
+
+	if config.MessageChecks.MaxLineLength < 0 || (config.MessageChecks.MaxLineLength > 0 && config.MessageChecks.MaxLineLength < 3) {
+		return errors.New("message_checks.max_line_length must be 0 or at least 3")
+	}
+
+	if config.HeaderPolicy != "" && config.HeaderPolicy != "lenient" && config.HeaderPolicy != "strict" {
+		return errors.New("header_policy must be one of: lenient, strict")
+	}
+
+	if config.ShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(config.ShutdownTimeout)
+		if err != nil || timeout <= 0 {
+			return errors.New("shutdown_timeout must be a positive duration such as \"30s\"")
+		}
+	}
+
+	if config.RelayPool.Size < 0 {
+		return errors.New("relay_pool.size must not be negative")
+	}
+	if config.RelayPool.IdleTimeout != "" {
+		timeout, err := time.ParseDuration(config.RelayPool.IdleTimeout)
+		if err != nil || timeout <= 0 {
+			return errors.New("relay_pool.idle_timeout must be a positive duration such as \"30s\"")
+		}
+	}
+	for name, value := range map[string]string{"dial": config.RelayTimeout.Dial, "command": config.RelayTimeout.Command} {
+		if value == "" {
+			continue
+		}
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			return fmt.Errorf("relay_timeout.%s must be a positive duration such as \"30s\", got %q", name, value)
+		}
+	}
+	if config.RelayRetry.ConnectRetries < 0 {
+		return errors.New("relay_retry.connect_retries must not be negative")
+	}
+	if config.RelayRetry.Backoff != "" {
+		backoff, err := time.ParseDuration(config.RelayRetry.Backoff)
+		if err != nil || backoff <= 0 {
+			return errors.New("relay_retry.backoff must be a positive duration such as \"1s\"")
+		}
+	}
+
+	if config.Spool.MemoryThreshold < 0 {
+		return errors.New("spool.memory_threshold must not be negative")
+	}
+	if config.Spool.ProgressInterval < 0 {
+		return errors.New("spool.progress_interval must not be negative")
+	}
+
+	if config.MaxConnections < 0 || config.MaxConnectionsPerIP < 0 {
+		return errors.New("max_connections and max_connections_per_ip must not be negative")
+	}
+	if config.MaxConnectionLifetime != "" {
+		if lifetime, err := time.ParseDuration(config.MaxConnectionLifetime); err != nil || lifetime <= 0 {
+			return fmt.Errorf("max_connection_lifetime must be a positive duration such as \"30m\", got %q", config.MaxConnectionLifetime)
+		}
+	}
+	if config.MaxRecipients < 0 {
+		return errors.New("max_recipients must not be negative")
+	}
+	if config.MaxAcceptRate < 0 {
+		return errors.New("max_accept_rate must not be negative")
+	}
+	if config.BannerDelay != "" {
+		if delay, err := time.ParseDuration(config.BannerDelay); err != nil || delay < 0 {
+			return fmt.Errorf("banner_delay must be a non-negative duration such as \"5s\", got %q", config.BannerDelay)
+		}
+	}
+	if config.TarpitDelay != "" {
+		if delay, err := time.ParseDuration(config.TarpitDelay); err != nil || delay < 0 {
+			return fmt.Errorf("tarpit_delay must be a non-negative duration such as \"10s\", got %q", config.TarpitDelay)
+		}
+	}
+
+	for reason, response := range config.Responses {
+		if !slices.Contains(ResponseReasons, reason) {
+			return fmt.Errorf("responses.%s is not a known rejection reason, expected one of: %s", reason, strings.Join(ResponseReasons, ", "))
+		}
+		if response.Code < 400 || response.Code > 599 {
+			return fmt.Errorf("responses.%s.code must be a 4xx or 5xx SMTP reply code, got %d", reason, response.Code)
+		}
+		if strings.ContainsAny(response.Message, "\r\n") {
+			return fmt.Errorf("responses.%s.message must be a single line", reason)
+		}
+	}
+
+	return validateRateLimiting("rate_limiting", config.RateLimiting)
+}
+
+func validateRateLimiting(name string, rateLimiting RateLimiting) error {
+	if rateLimiting.RequestsPerMinute <= 0 {
+		return fmt.Errorf("%s.requests_per_minute must be positive", name)
+	}
+	if rateLimiting.BurstLimit <= 0 {
+		return fmt.Errorf("%s.burst_limit must be positive", name)
+	}
+	if rateLimiting.BurstLimit > rateLimiting.RequestsPerMinute {
+		return fmt.Errorf("%s.burst_limit cannot be greater than requests_per_minute", name)
+	}
+	return nil
+}
+
+func validateQueueConfig(queue QueueConfig) error {
+	if queue.StoragePath == "" {
+		return errors.New("queue.storage_path is required")
+	}
+	if queue.MaxRetries < 0 {
+		return errors.New("queue.max_retries cannot be negative")
+	}
+	if queue.MaxQueueSize <= 0 {
+		return errors.New("queue.max_queue_size must be positive")
+	}
+	if queue.MaxQueueBytes < 0 {
+		return errors.New("queue.max_queue_bytes cannot be negative")
+	}
+	if queue.MaxConcurrency < 0 {
+		return errors.New("queue.max_concurrency cannot be negative")
+	}
+	if interval, err := time.ParseDuration(queue.RetryInterval); err != nil || interval <= 0 {
+		return fmt.Errorf("queue.retry_interval must be a positive duration such as \"5m\", got %q", queue.RetryInterval)
+	}
+	if interval, err := time.ParseDuration(queue.PersistInterval); err != nil || interval <= 0 {
+		return fmt.Errorf("queue.persist_interval must be a positive duration such as \"1m\", got %q", queue.PersistInterval)
+	}
+	if queue.DedupWindow != "" {
+		if window, err := time.ParseDuration(queue.DedupWindow); err != nil || window < 0 {
+			return fmt.Errorf("queue.dedup_window must be a non-negative duration such as \"10m\", got %q", queue.DedupWindow)
+		}
+	}
+	if queue.DrainTimeout != "" {
+		if timeout, err := time.ParseDuration(queue.DrainTimeout); err != nil || timeout < 0 {
+			return fmt.Errorf("queue.drain_timeout must be a non-negative duration such as \"10s\", got %q", queue.DrainTimeout)
+		}
+	}
+	return nil
+}
+
+func validateGreylistConfig(greylist GreylistConfig) error {
+	if delay, err := time.ParseDuration(greylist.InitialDelay); err != nil || delay < 0 {
+		return fmt.Errorf("greylist.initial_delay must be a duration such as \"5m\", got %q", greylist.InitialDelay)
+	}
+	if period, err := time.ParseDuration(greylist.WhitelistPeriod); err != nil || period <= 0 {
+		return fmt.Errorf("greylist.whitelist_period must be a positive duration such as \"720h\", got %q", greylist.WhitelistPeriod)
+	}
+	if greylist.PersistInterval != "" {
+		if interval, err := time.ParseDuration(greylist.PersistInterval); err != nil || interval <= 0 {
+			return fmt.Errorf("greylist.persist_interval must be a positive duration such as \"1m\", got %q", greylist.PersistInterval)
+		}
+	}
 	return nil
 }
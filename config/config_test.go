@@ -0,0 +1,225 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validConfig returns a minimal config that passes validation
+func validConfig() Config {
+	return Config{
+		Listeners:    []ListenerConfig{{Host: "127.0.0.1", Port: "2525", Encryption: "none"}},
+		DefaultRelay: RelayList{"smtp.example.com:25"},
+		LogDir:       "logs",
+		LogFile:      "smtp-relay",
+		LogLevel:     "info",
+		RateLimiting: RateLimiting{RequestsPerMinute: 60, BurstLimit: 10},
+		Queue: QueueConfig{
+			StoragePath:     "queue",
+			MaxRetries:      3,
+			RetryInterval:   "5m",
+			MaxQueueSize:    100,
+			PersistInterval: "1m",
+		},
+	}
+}
+
+func TestValidConfig(t *testing.T) {
+	if err := Validate(validConfig()); err != nil {
+		t.Fatalf("minimal config rejected: %v", err)
+	}
+}
+
+func TestListenerAcceptors(t *testing.T) {
+	for acceptors, ok := range map[int]bool{0: true, 1: true, 8: true, -1: false} {
+		cfg := validConfig()
+		cfg.Listeners[0].Acceptors = acceptors
+		if err := Validate(cfg); (err == nil) != ok {
+			t.Errorf("acceptors %d: got error %v", acceptors, err)
+		}
+	}
+}
+
+func TestDisabledCommands(t *testing.T) {
+	for _, test := range []struct {
+		commands []string
+		err      string // Substring of the error, empty for a valid config
+	}{
+		{[]string{"HELO", "bdat", "AUTH", "NOOP", "RSET"}, ""},
+		{[]string{"EHLO"}, ""},
+		{[]string{"VRFY"}, `"VRFY" cannot be disabled`},
+		{[]string{"EXPN"}, `"EXPN" cannot be disabled`},
+		{[]string{"MAIL"}, `"MAIL" cannot be disabled`},
+		{[]string{"STARTTLS"}, `"STARTTLS" cannot be disabled`},
+		{[]string{"helo", "EHLO"}, "both HELO and EHLO"},
+	} {
+		t.Run(strings.Join(test.commands, ","), func(t *testing.T) {
+			cfg := validConfig()
+			cfg.DisabledCommands = test.commands
+			err := Validate(cfg)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("got error %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestQueueConfigValidation(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		modify func(*QueueConfig)
+		err    string
+	}{
+		{"missing storage path", func(q *QueueConfig) { q.StoragePath = "" }, "queue.storage_path is required"},
+		{"negative retries", func(q *QueueConfig) { q.MaxRetries = -1 }, "queue.max_retries cannot be negative"},
+		{"zero queue size", func(q *QueueConfig) { q.MaxQueueSize = 0 }, "queue.max_queue_size must be positive"},
+		{"negative queue bytes", func(q *QueueConfig) { q.MaxQueueBytes = -1 }, "queue.max_queue_bytes cannot be negative"},
+		{"malformed retry interval", func(q *QueueConfig) { q.RetryInterval = "5 minutes" }, `queue.retry_interval must be a positive duration such as "5m", got "5 minutes"`},
+		{"missing retry interval", func(q *QueueConfig) { q.RetryInterval = "" }, "queue.retry_interval must be a positive duration"},
+		{"zero retry interval", func(q *QueueConfig) { q.RetryInterval = "0s" }, "queue.retry_interval must be a positive duration"},
+		{"malformed persist interval", func(q *QueueConfig) { q.PersistInterval = "1" }, `queue.persist_interval must be a positive duration such as "1m", got "1"`},
+		{"negative persist interval", func(q *QueueConfig) { q.PersistInterval = "-1m" }, "queue.persist_interval must be a positive duration"},
+		{"malformed dedup window", func(q *QueueConfig) { q.DedupWindow = "soon" }, "queue.dedup_window must be a non-negative duration"},
+		{"malformed drain timeout", func(q *QueueConfig) { q.DrainTimeout = "10" }, "queue.drain_timeout must be a non-negative duration"},
+		{"negative concurrency", func(q *QueueConfig) { q.MaxConcurrency = -1 }, "queue.max_concurrency cannot be negative"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			test.modify(&cfg.Queue)
+			if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestResponsesValidation(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		responses map[string]ResponseConfig
+		err       string // Substring of the error, empty for a valid config
+	}{
+		{"custom code and message", map[string]ResponseConfig{"sender_blocked": {Code: 554, Message: "Go away"}}, ""},
+		{"code only", map[string]ResponseConfig{"rate_limited": {Code: 450}}, ""},
+		{"unknown reason", map[string]ResponseConfig{"sender_banned": {Code: 550}}, "responses.sender_banned is not a known rejection reason"},
+		{"success code", map[string]ResponseConfig{"spf_fail": {Code: 250}}, "responses.spf_fail.code must be a 4xx or 5xx SMTP reply code, got 250"},
+		{"missing code", map[string]ResponseConfig{"spf_fail": {Message: "No"}}, "got 0"},
+		{"four digits", map[string]ResponseConfig{"greylisted": {Code: 4510}}, "got 4510"},
+		{"multi-line message", map[string]ResponseConfig{"auth_failed": {Code: 535, Message: "Bad\r\n250 OK"}}, "responses.auth_failed.message must be a single line"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Responses = test.responses
+			err := Validate(cfg)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("got error %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSenderRewriteValidation(t *testing.T) {
+	for address, ok := range map[string]bool{
+		"":                                 true,
+		"bounces@example.com":              true,
+		"srs+{local}={domain}@example.com": true,
+		"bounces":                          false,
+		"<bounces@example.com>":            false,
+		"bounces@example.com\r\nBcc: x":    false,
+	} {
+		cfg := validConfig()
+		cfg.SenderRewrite.Address = address
+		err := Validate(cfg)
+		if ok && err != nil {
+			t.Errorf("%q rejected: %v", address, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "sender_rewrite.address")) {
+			t.Errorf("%q got error %v, want a sender_rewrite.address error", address, err)
+		}
+	}
+}
+
+// writeConfig writes content to a file named name and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// minimalJSON is a valid config file; %s is replaced by extra fields
+const minimalJSON = `{
+	"listeners": [{"host": "127.0.0.1", "port": "2525", "encryption": "none"}],
+	"default_relay": "smtp.example.com:25",
+	"log_dir": "logs",
+	"log_file": "smtp-relay",
+	"log_level": "info",
+	"rate_limiting": {"requests_per_minute": 60, "burst_limit": 10},
+	"queue": {"storage_path": "queue", "max_retries": 3, "retry_interval": "5m", "max_queue_size": 100, "persist_interval": "1m"}%s
+}`
+
+func TestListenerRateLimiting(t *testing.T) {
+	for _, tt := range []struct {
+		limit *RateLimiting
+		ok    bool
+	}{
+		{nil, true},
+		{&RateLimiting{RequestsPerMinute: 600, BurstLimit: 50}, true},
+		{&RateLimiting{RequestsPerMinute: 0, BurstLimit: 0}, false},
+		{&RateLimiting{RequestsPerMinute: 10, BurstLimit: 0}, false},
+		{&RateLimiting{RequestsPerMinute: 10, BurstLimit: 20}, false},
+	} {
+		cfg := validConfig()
+		cfg.Listeners[0].RateLimiting = tt.limit
+		err := Validate(cfg)
+		if (err == nil) != tt.ok {
+			t.Errorf("rate_limiting %+v: got error %v", tt.limit, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "listener 2525 rate_limiting") {
+			t.Errorf("rate_limiting %+v: error %q does not name the listener", tt.limit, err)
+		}
+	}
+}
+
+func TestAppendHeaderValidation(t *testing.T) {
+	for header, ok := range map[string]bool{
+		"":                                true,
+		"X-Relayed-By: relay1":            true,
+		"X-Disclaimer:":                   true,
+		"no colon":                        false,
+		": no name":                       false,
+		"X Relayed: relay1":               false,
+		"X-Relayed-By: relay1\r\nBcc: me": false,
+		"X-Relayed-By: relay1\n":          false,
+		"X-Relayé: relay1":                false,
+	} {
+		cfg := validConfig()
+		cfg.Append.Header = header
+		if err := Validate(cfg); (err == nil) != ok {
+			t.Errorf("append.header %q: got error %v", header, err)
+		}
+	}
+}
+
+func TestClientCAValidation(t *testing.T) {
+	for encryption, ok := range map[string]bool{"tls": true, "starttls": true, "none": false} {
+		cfg := validConfig()
+		cfg.TLSCertFile, cfg.TLSKeyFile = "relay.pem", "relay.key"
+		cfg.Listeners[0].Encryption = encryption
+		cfg.Listeners[0].TLSClientCAFile = "clients.pem"
+		err := Validate(cfg)
+		if (err == nil) != ok || (err != nil && !strings.Contains(err.Error(), "tls_client_ca_file requires tls or starttls")) {
+			t.Errorf("encryption %s: got error %v", encryption, err)
+		}
+	}
+}
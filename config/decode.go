@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// unknownField matches the error the decoder returns for a key that no
+// config field has
+var unknownField = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// decodeConfig decodes JSON config data into config, rejecting unknown
+// fields so that a misspelled key fails instead of being ignored. Errors
+// name the offending field and, if lines is set, the line it is on; YAML
+// configs pass no lines since the JSON is converted and has none of its own.
+func decodeConfig(data []byte, config *Config, lines bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(config)
+	if err == nil {
+		return nil
+	}
+
+	at := func(offset int64) string {
+		if !lines || offset < 0 {
+			return ""
+		}
+		return fmt.Sprintf("line %d: ", bytes.Count(data[:offset], []byte("\n"))+1)
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%s%v", at(syntaxErr.Offset), err)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%s%s must be %s, got %s", at(typeErr.Offset), typeErr.Field, jsonKind(typeErr.Type), typeErr.Value)
+	}
+	if m := unknownField.FindStringSubmatch(err.Error()); m != nil {
+		msg := fmt.Sprintf("unknown field %q", m[1])
+		if suggestion := closestField(m[1]); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %q?", suggestion)
+		}
+		return fmt.Errorf("%s%s", at(keyOffset(data, m[1])), msg)
+	}
+	return err
+}
+
+// jsonKind describes the JSON value expected for a Go type
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// keyOffset returns the offset of the first occurrence of name as an object
+// key in data, or -1
+func keyOffset(data []byte, name string) int64 {
+	key := regexp.MustCompile(regexp.QuoteMeta(fmt.Sprintf("%q", name)) + `\s*:`)
+	loc := key.FindIndex(data)
+	if loc == nil {
+		return -1
+	}
+	return int64(loc[0])
+}
+
+// closestField returns the config key nearest to name, if one is within a
+// couple of typos of it
+func closestField(name string) string {
+	best, bestDistance := "", 3
+	for _, field := range fieldNames(reflect.TypeOf(Config{}), map[reflect.Type]bool{}) {
+		if d := editDistance(strings.ToLower(name), field); d < bestDistance {
+			best, bestDistance = field, d
+		}
+	}
+	return best
+}
+
+// fieldNames lists the JSON keys of t and of the structs nested in it
+func fieldNames(t reflect.Type, seen map[reflect.Type]bool) []string {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Pointer:
+		return fieldNames(t.Elem(), seen)
+	case reflect.Struct:
+	default:
+		return nil
+	}
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+			names = append(names, name)
+		}
+		names = append(names, fieldNames(field.Type, seen)...)
+	}
+	return names
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDecodeErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		extra string // Added after the queue on line 8, so starting line 9
+		err   string
+	}{
+		{"misspelled field", `,
+	"block_lst": ["192.0.2.1"]`, `line 9: unknown field "block_lst", did you mean "block_list"?`},
+		{"unknown field", `,
+	"max_recipients": 10,
+	"frobnicate": true`, `line 10: unknown field "frobnicate"`},
+		{"unknown nested field", `,
+	"relay_pool": {"size": 2, "idle": "30s"}`, `line 9: unknown field "idle"`},
+		{"string for a number", `,
+	"max_recipients": "10"`, "line 9: max_recipients must be a number, got string"},
+		{"number for a string", `,
+	"banner_delay": 5`, "line 9: banner_delay must be a string, got number"},
+		{"nested wrong type", `,
+	"relay_pool": {"size": true}`, "line 9: relay_pool.size must be a number, got bool"},
+		{"string for a list", `,
+	"block_list": "192.0.2.1"`, "line 9: block_list must be a list, got string"},
+		{"syntax error", `,
+	"max_recipients": 10
+	"banner_delay": "5s"`, "line 10: invalid character"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "config.json", fmt.Sprintf(minimalJSON, tt.extra)))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeErrorsYAML(t *testing.T) {
+	// YAML is converted to JSON first, so errors name the field but no line
+	_, err := LoadConfig(writeConfig(t, "config.yaml", "log_levl: info\n"))
+	if err == nil || !strings.Contains(err.Error(), `unknown field "log_levl", did you mean "log_level"?`) || strings.Contains(err.Error(), "line ") {
+		t.Fatalf("got error %v, want the unknown field without a line", err)
+	}
+}
+
+func TestClosestField(t *testing.T) {
+	for name, want := range map[string]string{
+		"block_lst":       "block_list",
+		"BLOCK_LIST":      "block_list",
+		"storage-path":    "storage_path",
+		"retry_intervals": "retry_interval",
+		"completely_new":  "",
+	} {
+		if got := closestField(name); got != want {
+			t.Errorf("closestField(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+)
+
+// envRef matches ${NAME} references; a bare $NAME is left alone so that
+// secrets containing "$" survive unchanged
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} references in every string field of config,
+// including string slices and map keys and values, with the value of the
+// environment variable. It fails if a referenced variable is unset.
+func expandEnv(config *Config) error {
+	return expandValue(reflect.ValueOf(config).Elem())
+}
+
+func expandValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		expanded, err := expandString(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(expanded)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := expandValue(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandValue(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		expanded := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := reflect.New(v.Type().Key()).Elem()
+			key.Set(iter.Key())
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			if err := expandValue(key); err != nil {
+				return err
+			}
+			if err := expandValue(value); err != nil {
+				return err
+			}
+			expanded.SetMapIndex(key, value)
+		}
+		v.Set(expanded)
+	}
+	return nil
+}
+
+func expandString(s string) (string, error) {
+	var missing string
+	expanded := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set", missing)
+	}
+	return expanded, nil
+}
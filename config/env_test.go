@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("TEST_RELAY_HOST", "smtp.example.net")
+	t.Setenv("TEST_RELAY_PASSWORD", "s3cret")
+	t.Setenv("TEST_LOG_DIR", "/var/log/relay")
+
+	content := strings.NewReplacer(
+		`"smtp.example.com:25"`, `"${TEST_RELAY_HOST}:587"`,
+		`"logs"`, `"${TEST_LOG_DIR}/smtp"`,
+	).Replace(minimalJSON)
+	path := writeConfig(t, "env.json", fmt.Sprintf(content, `,
+	"relay_credentials": {"${TEST_RELAY_HOST}:587": {"username": "relay", "password": "${TEST_RELAY_PASSWORD}"}},
+	"hostname": "pa$$word-$HOME"`))
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config.DefaultRelay; len(got) != 1 || got[0] != "smtp.example.net:587" {
+		t.Errorf("default_relay %v, want [smtp.example.net:587]", got)
+	}
+	if got := config.RelayCredentials["smtp.example.net:587"].Password; got != "s3cret" {
+		t.Errorf("credential password %q, want s3cret in the expanded key", got)
+	}
+	if config.LogDir != "/var/log/relay/smtp" {
+		t.Errorf("log_dir %q, want /var/log/relay/smtp", config.LogDir)
+	}
+	// Only ${NAME} is expanded and other fields are left alone
+	if config.Hostname != "pa$$word-$HOME" {
+		t.Errorf("hostname %q, want it unchanged", config.Hostname)
+	}
+	if config.Queue.MaxRetries != 3 || config.RateLimiting.BurstLimit != 10 {
+		t.Errorf("numeric fields changed: %+v %+v", config.Queue, config.RateLimiting)
+	}
+}
+
+func TestExpandEnvUnset(t *testing.T) {
+	path := writeConfig(t, "env.json", fmt.Sprintf(minimalJSON, `,
+	"relay_credentials": {"smtp.example.com:25": {"username": "relay", "password": "${TEST_UNSET_PASSWORD}"}}`))
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "TEST_UNSET_PASSWORD is not set") {
+		t.Fatalf("LoadConfig with an unset variable returned %v, want an error naming it", err)
+	}
+
+	// Set but empty counts as set
+	t.Setenv("TEST_UNSET_PASSWORD", "")
+	if _, err := LoadConfig(path); err == nil || strings.Contains(err.Error(), "not set") {
+		t.Fatalf("LoadConfig with an empty variable returned %v, want the validation error for the empty password", err)
+	}
+}
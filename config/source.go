@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stdin is the config source name that reads the config from standard input
+const Stdin = "-"
+
+const (
+	// fetchTimeout bounds fetching a config from a URL
+	fetchTimeout = 30 * time.Second
+	// maxConfigBytes bounds the size of a config read from stdin or a URL
+	maxConfigBytes = 10 << 20
+)
+
+// isURL reports whether a config source names an HTTP or HTTPS URL
+func isURL(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// readSource returns the config data of source, a file path, Stdin or a URL,
+// and whether it is YAML. Files and URLs are YAML when they end in .yaml or
+// .yml, and URLs also when served as YAML. Data from stdin is YAML unless it
+// starts with a JSON object.
+func readSource(source string) ([]byte, bool, error) {
+	switch {
+	case source == Stdin:
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, maxConfigBytes+1))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read config from stdin: %v", err)
+		}
+		if len(data) > maxConfigBytes {
+			return nil, false, fmt.Errorf("config from stdin exceeds %d bytes", maxConfigBytes)
+		}
+		return data, !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")), nil
+	case isURL(source):
+		return fetchSource(source)
+	default:
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to open config file: %v", err)
+		}
+		return data, yamlExt(filepath.Ext(source)), nil
+	}
+}
+
+// fetchSource downloads a config, failing on any status other than 200
+func fetchSource(source string) ([]byte, bool, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid config URL: %v", err)
+	}
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch config: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed to fetch config from %s: %s", u.Redacted(), resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigBytes+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch config from %s: %v", u.Redacted(), err)
+	}
+	if len(data) > maxConfigBytes {
+		return nil, false, fmt.Errorf("config from %s exceeds %d bytes", u.Redacted(), maxConfigBytes)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return data, yamlExt(path.Ext(u.Path)) || strings.HasSuffix(mediaType, "yaml"), nil
+}
+
+// sourceName returns source for messages, without any password in a URL
+func sourceName(source string) string {
+	if source == Stdin {
+		return "from stdin"
+	}
+	if u, err := url.Parse(source); err == nil && isURL(source) {
+		return u.Redacted()
+	}
+	return source
+}
+
+func yamlExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
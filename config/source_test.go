@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// minimalYAML is minimalJSON without extra fields, written as YAML
+const minimalYAML = `listeners:
+  - {host: 127.0.0.1, port: "2525", encryption: none}
+default_relay: smtp.example.com:25
+log_dir: logs
+log_file: smtp-relay
+log_level: info
+rate_limiting: {requests_per_minute: 60, burst_limit: 10}
+queue: {storage_path: queue, max_retries: 3, retry_interval: 5m, max_queue_size: 100, persist_interval: 1m}
+`
+
+// minimalConfig returns minimalJSON loaded from a file
+func minimalConfig(t *testing.T) Config {
+	t.Helper()
+	cfg, err := LoadConfig(writeConfig(t, "config.json", fmt.Sprintf(minimalJSON, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// withStdin makes content the standard input for the rest of the test
+func withStdin(t *testing.T, content string) {
+	t.Helper()
+	file, err := os.Open(writeConfig(t, "stdin", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = file
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		file.Close()
+	})
+}
+
+func TestLoadConfigStdin(t *testing.T) {
+	want := minimalConfig(t)
+	for name, content := range map[string]string{
+		"JSON": "\n  " + fmt.Sprintf(minimalJSON, ""),
+		"YAML": minimalYAML,
+	} {
+		t.Run(name, func(t *testing.T) {
+			withStdin(t, content)
+			got, err := LoadConfig(Stdin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded to\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		withStdin(t, fmt.Sprintf(minimalJSON, `,
+	"max_recipients": "10"`))
+		if _, err := LoadConfig(Stdin); err == nil || !strings.Contains(err.Error(), "config file from stdin: line 9") {
+			t.Fatalf("got error %v, want a decode error for stdin", err)
+		}
+		withStdin(t, strings.Replace(minimalYAML, "burst_limit: 10", "burst_limit: 100", 1))
+		if _, err := LoadConfig(Stdin); err == nil || !strings.Contains(err.Error(), "burst_limit cannot be greater") {
+			t.Fatalf("got error %v, want the validation error", err)
+		}
+	})
+}
+
+func TestLoadConfigURL(t *testing.T) {
+	want := minimalConfig(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, minimalJSON, "")
+	})
+	mux.HandleFunc("/config.yml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, minimalYAML)
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		fmt.Fprint(w, minimalYAML)
+	})
+	mux.HandleFunc("/invalid.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, minimalJSON, `,
+	"max_recipients": -1`)
+	})
+	mux.HandleFunc("/large.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat(" ", maxConfigBytes+1))
+	})
+	source := httptest.NewServer(mux)
+	defer source.Close()
+
+	for _, path := range []string{"/config.json", "/config.yml", "/config"} {
+		got, err := LoadConfig(source.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded to\n%+v\nwant\n%+v", path, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		source string
+		err    string
+	}{
+		{source.URL + "/missing.json", "404 Not Found"},
+		{source.URL + "/invalid.json", "max_recipients"},
+		{source.URL + "/large.json", fmt.Sprintf("exceeds %d bytes", maxConfigBytes)},
+		{strings.Replace(source.URL, "://", "://user:secret@", 1) + "/missing.json", "user:xxxxx@"},
+	} {
+		_, err := LoadConfig(tt.source)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.source, err, tt.err)
+		}
+		if err != nil && strings.Contains(err.Error(), "secret") {
+			t.Errorf("%s: error %q shows the password", tt.source, err)
+		}
+	}
+
+	// The source is down
+	source.Close()
+	if _, err := LoadConfig(source.URL + "/config.json"); err == nil || !strings.Contains(err.Error(), "failed to fetch config") {
+		t.Fatalf("got error %v, want a fetch failure", err)
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+)
+
+// tlsVersions maps the accepted tls_min_version values to their versions.
+// TLS 1.0 and 1.1 are deliberately missing.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSMinVersion returns the minimum TLS version listeners accept, TLS 1.2
+// unless tls_min_version says otherwise
+func TLSMinVersion(config Config) (uint16, error) {
+	if config.TLSMinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return 0, fmt.Errorf("tls_min_version must be \"1.2\" or \"1.3\", got %q", config.TLSMinVersion)
+	}
+	return version, nil
+}
+
+// TLSCipherSuites returns the IDs of the tls_cipher_suites, or nil for Go's
+// defaults. Only secure TLS 1.2 suites can be chosen: TLS 1.3 suites are not
+// configurable, so a list is refused when tls_min_version is "1.3".
+func TLSCipherSuites(config Config) ([]uint16, error) {
+	if len(config.TLSCipherSuites) == 0 {
+		return nil, nil
+	}
+	if config.TLSMinVersion == "1.3" {
+		return nil, fmt.Errorf("tls_cipher_suites cannot be used with tls_min_version \"1.3\", whose cipher suites are fixed")
+	}
+
+	var ids []uint16
+	for _, name := range config.TLSCipherSuites {
+		suite := findCipherSuite(tls.CipherSuites(), name)
+		if suite == nil {
+			if findCipherSuite(tls.InsecureCipherSuites(), name) != nil {
+				return nil, fmt.Errorf("tls_cipher_suites: %s is insecure", name)
+			}
+			return nil, fmt.Errorf("tls_cipher_suites: unknown cipher suite %q", name)
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("tls_cipher_suites: %s is a TLS 1.3 suite, which is not configurable", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func findCipherSuite(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, suite := range suites {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
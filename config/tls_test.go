@@ -0,0 +1,61 @@
+package config
+
+import (
+	"crypto/tls"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTLSMinVersion(t *testing.T) {
+	for value, want := range map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		cfg := validConfig()
+		cfg.TLSMinVersion = value
+		if got, err := TLSMinVersion(cfg); err != nil || got != want {
+			t.Errorf("tls_min_version %q = %x, %v, want %x", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"1.0", "1.1", "TLS1.3", "1.4"} {
+		cfg := validConfig()
+		cfg.TLSMinVersion = value
+		if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), "tls_min_version must be") {
+			t.Errorf("tls_min_version %q: got error %v", value, err)
+		}
+	}
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+	cfg := validConfig()
+	if ids, err := TLSCipherSuites(cfg); err != nil || ids != nil {
+		t.Fatalf("no tls_cipher_suites = %v, %v, want the defaults", ids, err)
+	}
+
+	cfg.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}
+	if ids, err := TLSCipherSuites(cfg); err != nil || !slices.Equal(ids, want) {
+		t.Fatalf("tls_cipher_suites = %v, %v, want %v in order", ids, err, want)
+	}
+	cfg.TLSMinVersion = "1.2"
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("TLS 1.2 with cipher suites: %v", err)
+	}
+
+	for _, tt := range []struct {
+		version string
+		suite   string
+		err     string
+	}{
+		{"", "TLS_RSA_WITH_RC4_128_SHA", "TLS_RSA_WITH_RC4_128_SHA is insecure"},
+		{"", "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256", "is insecure"},
+		{"", "TLS_AES_128_GCM_SHA256", "is a TLS 1.3 suite"},
+		{"", "ECDHE-RSA-AES128-GCM-SHA256", "unknown cipher suite"},
+		{"1.3", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "cannot be used with tls_min_version \"1.3\""},
+	} {
+		cfg := validConfig()
+		cfg.TLSMinVersion = tt.version
+		cfg.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", tt.suite}
+		if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s with tls_min_version %q: got error %v, want one containing %q", tt.suite, tt.version, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package config
+
+import (
+	"encoding/json"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlToJSON re-encodes a YAML document as JSON so that YAML configs are
+// decoded through the same json struct tags and rules as JSON configs
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
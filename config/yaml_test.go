@@ -0,0 +1,91 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestYAMLMatchesJSON(t *testing.T) {
+	jsonPath := writeConfig(t, "config.json", `{
+	"listeners": [
+		{"host": "0.0.0.0", "port": "25", "encryption": "none"},
+		{"host": "0.0.0.0", "port": "2525", "encryption": "none", "proxy_protocol": true}
+	],
+	"default_relay": ["smtp1.example.com:25", "smtp2.example.com:25"],
+	"domain_routing": {"example.org": "mx.example.org:25"},
+	"relay_credentials": {"smtp1.example.com:25": {"username": "relay", "password": "p@ss: word"}},
+	"block_list": ["192.0.2.0/24", "spam@example.com"],
+	"log_dir": "logs",
+	"log_file": "smtp-relay",
+	"log_level": "info",
+	"rate_limiting": {"requests_per_minute": 60, "burst_limit": 10},
+	"queue": {"storage_path": "queue", "max_retries": 3, "retry_interval": "5m", "max_queue_size": 100, "persist_interval": "1m"},
+	"spf": {"mode": "monitor"},
+	"message_checks": {"max_line_length": 1000, "require_from": true}
+}`)
+	yamlContent := `# Same settings as the JSON file
+listeners:
+  - host: 0.0.0.0
+    port: "25"
+    encryption: none
+  - host: 0.0.0.0
+    port: "2525"
+    encryption: none
+    proxy_protocol: true
+default_relay:
+  - smtp1.example.com:25
+  - smtp2.example.com:25
+domain_routing:
+  example.org: mx.example.org:25
+relay_credentials:
+  smtp1.example.com:25:
+    username: relay
+    password: "p@ss: word"
+block_list: [192.0.2.0/24, spam@example.com]
+log_dir: logs
+log_file: smtp-relay
+log_level: info
+rate_limiting:
+  requests_per_minute: 60
+  burst_limit: 10
+queue:
+  storage_path: queue
+  max_retries: 3
+  retry_interval: 5m
+  max_queue_size: 100
+  persist_interval: 1m
+spf:
+  mode: monitor
+message_checks:
+  max_line_length: 1000
+  require_from: true
+`
+
+	want, err := LoadConfig(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		got, err := LoadConfig(writeConfig(t, name, yamlContent))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded to\n%+v\nwant\n%+v", name, got, want)
+		}
+	}
+}
+
+func TestYAMLErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+	}{
+		{"syntax", "listeners: [unclosed\n"},
+		{"invalid config", "log_level: info\n"},
+	} {
+		if _, err := LoadConfig(writeConfig(t, "config.yaml", tt.content)); err == nil {
+			t.Errorf("%s: LoadConfig accepted %q", tt.name, tt.content)
+		}
+	}
+}
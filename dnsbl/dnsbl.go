@@ -0,0 +1,123 @@
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often expired results are dropped from the cache
+const sweepInterval = time.Minute
+
+// Resolver is the subset of *net.Resolver used for DNSBL queries
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type entry struct {
+	listed  bool
+	expires time.Time
+}
+
+// Checker queries DNS blocklists for client IPs and caches the answers
+type Checker struct {
+	resolver  Resolver
+	cache     map[string]entry
+	nextSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewChecker(resolver Resolver) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Checker{resolver: resolver, cache: make(map[string]entry)}
+}
+
+// Listed reports whether zone lists ip, remembering the answer for cacheTTL.
+// A zone lists an address by resolving its query name to 127.0.0.0/8;
+// answers in 127.255.255.0/24 are the zone's error codes, e.g. for queries
+// through public resolvers, and do not count. Lookup failures other than
+// NXDOMAIN are returned and not cached.
+func (c *Checker) Listed(ctx context.Context, ip net.IP, zone string, cacheTTL time.Duration) (bool, error) {
+	name := queryName(ip, zone)
+	if name == "" {
+		return false, fmt.Errorf("invalid IP address %v", ip)
+	}
+	if listed, ok := c.cached(name); ok {
+		return listed, nil
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return false, fmt.Errorf("DNSBL lookup for %s failed: %w", name, err)
+		}
+	}
+
+	listed := false
+	for _, addr := range addrs {
+		answer := net.ParseIP(addr).To4()
+		if answer != nil && answer[0] == 127 && !(answer[1] == 255 && answer[2] == 255) {
+			listed = true
+			break
+		}
+	}
+	c.store(name, listed, cacheTTL)
+	return listed, nil
+}
+
+// queryName builds the DNSBL query for ip: the IPv4 octets, or the IPv6
+// nibbles, in reverse order followed by the zone
+func queryName(ip net.IP, zone string) string {
+	zone = strings.Trim(zone, ".")
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(v6) - 1; i >= 0; i-- {
+		b.WriteByte(hex[v6[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[v6[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString(zone)
+	return b.String()
+}
+
+func (c *Checker) cached(name string) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.cache[name]
+	if !ok || time.Now().After(e.expires) {
+		return false, false
+	}
+	return e.listed, true
+}
+
+func (c *Checker) store(name string, listed bool, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.cache {
+			if now.After(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+		c.nextSweep = now.Add(sweepInterval)
+	}
+	c.cache[name] = entry{listed: listed, expires: now.Add(ttl)}
+}
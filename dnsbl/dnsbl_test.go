@@ -0,0 +1,126 @@
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers DNSBL queries from a table and counts them.
+// Names without an entry do not exist.
+type fakeResolver struct {
+	answers map[string][]string
+	err     error
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queries == nil {
+		r.queries = make(map[string]int)
+	}
+	r.queries[host]++
+	if r.err != nil {
+		return nil, r.err
+	}
+	if addrs, ok := r.answers[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[host]
+}
+
+func TestListed(t *testing.T) {
+	resolver := &fakeResolver{answers: map[string][]string{
+		"1.2.0.192.bl.test": {"127.0.0.2"},
+		"2.2.0.192.bl.test": {"127.255.255.254"},
+		"3.2.0.192.bl.test": {"192.0.2.3"},
+		"4.2.0.192.bl.test": {"127.255.255.252", "127.0.0.4"},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.test": {"127.0.0.10"},
+	}}
+	c := NewChecker(resolver)
+
+	for _, tt := range []struct {
+		ip, zone string
+		want     bool
+	}{
+		{"192.0.2.1", "bl.test", true},
+		{"192.0.2.1", ".bl.test.", true},
+		{"192.0.2.1", "other.test", false},
+		{"192.0.2.5", "bl.test", false},
+		// Error codes and answers outside 127.0.0.0/8 are not listings
+		{"192.0.2.2", "bl.test", false},
+		{"192.0.2.3", "bl.test", false},
+		{"192.0.2.4", "bl.test", true},
+		{"2001:db8::1", "bl.test", true},
+		{"2001:db8::2", "bl.test", false},
+	} {
+		listed, err := c.Listed(context.Background(), net.ParseIP(tt.ip), tt.zone, time.Hour)
+		if err != nil || listed != tt.want {
+			t.Errorf("Listed(%s, %s) = %v, %v, want %v", tt.ip, tt.zone, listed, err, tt.want)
+		}
+	}
+
+	if _, err := c.Listed(context.Background(), nil, "bl.test", time.Hour); err == nil {
+		t.Error("Listed accepted an invalid IP address")
+	}
+}
+
+func TestListedCache(t *testing.T) {
+	const name = "1.2.0.192.bl.test"
+	resolver := &fakeResolver{answers: map[string][]string{name: {"127.0.0.2"}}}
+	c := NewChecker(resolver)
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		if listed, err := c.Listed(context.Background(), ip, "bl.test", time.Hour); err != nil || !listed {
+			t.Fatalf("lookup %d = %v, %v, want listed", i+1, listed, err)
+		}
+	}
+	if n := resolver.count(name); n != 1 {
+		t.Fatalf("resolver was queried %d times, want once", n)
+	}
+
+	// Answers that are not listings are cached as well
+	for i := 0; i < 2; i++ {
+		c.Listed(context.Background(), net.ParseIP("192.0.2.5"), "bl.test", time.Hour)
+	}
+	if n := resolver.count("5.2.0.192.bl.test"); n != 1 {
+		t.Fatalf("resolver was queried %d times for an unlisted address, want once", n)
+	}
+
+	// An expired answer is looked up again
+	c = NewChecker(resolver)
+	c.Listed(context.Background(), ip, "bl.test", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	c.Listed(context.Background(), ip, "bl.test", 50*time.Millisecond)
+	if n := resolver.count(name); n != 3 {
+		t.Fatalf("resolver was queried %d times, want the expired answer looked up again", n)
+	}
+}
+
+func TestListedLookupFailure(t *testing.T) {
+	resolver := &fakeResolver{err: errors.New("server misbehaving")}
+	c := NewChecker(resolver)
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 2; i++ {
+		if listed, err := c.Listed(context.Background(), ip, "bl.test", time.Hour); err == nil || listed {
+			t.Fatalf("failed lookup = %v, %v, want an error", listed, err)
+		}
+	}
+	// Failures are not cached
+	if n := resolver.count("1.2.0.192.bl.test"); n != 2 {
+		t.Fatalf("resolver was queried %d times, want each failure retried", n)
+	}
+}
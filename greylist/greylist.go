@@ -0,0 +1,157 @@
+package greylist
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-relay-server/logger"
+	"os"
+	"sync"
+	"time"
+)
+
+// pendingLifetime is how long an unconfirmed triple waits for a retry
+// before it is forgotten and the next attempt is greylisted again
+const pendingLifetime = 24 * time.Hour
+
+type Config struct {
+	StoragePath     string
+	InitialDelay    time.Duration
+	WhitelistPeriod time.Duration
+	PersistInterval time.Duration
+	// Logger receives persist failures, nil to discard them
+	Logger *logger.Logger
+}
+
+type Greylist struct {
+	entries         map[string]*Entry
+	storagePath     string
+	initialDelay    time.Duration
+	whitelistPeriod time.Duration
+	persistInterval time.Duration
+	logger          *logger.Logger
+	mu              sync.Mutex
+}
+
+type Entry struct {
+	FirstSeen        time.Time
+	WhitelistedUntil time.Time
+}
+
+func NewGreylist(config *Config) (*Greylist, error) {
+	if err := os.MkdirAll(config.StoragePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create greylist storage: %w", err)
+	}
+
+	g := &Greylist{
+		entries:         make(map[string]*Entry),
+		storagePath:     config.StoragePath,
+		initialDelay:    config.InitialDelay,
+		whitelistPeriod: config.WhitelistPeriod,
+		persistInterval: config.PersistInterval,
+		logger:          config.Logger,
+	}
+
+	if err := g.loadFromDisk(); err != nil {
+		return nil, fmt.Errorf("failed to load greylist from disk: %w", err)
+	}
+
+	go g.startPersistWorker()
+
+	return g, nil
+}
+
+// Check records a delivery attempt for the (ip, from, to) triple and reports
+// whether it may proceed. The first attempt is refused; a retry after the
+// initial delay is accepted and whitelists the triple for the whitelist period.
+func (g *Greylist) Check(ip, from, to string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	key := ip + "|" + from + "|" + to
+	entry, ok := g.entries[key]
+
+	switch {
+	case ok && now.Before(entry.WhitelistedUntil):
+		entry.WhitelistedUntil = now.Add(g.whitelistPeriod)
+		return true
+	case ok && entry.WhitelistedUntil.IsZero() && now.Sub(entry.FirstSeen) < pendingLifetime:
+		if now.Sub(entry.FirstSeen) < g.initialDelay {
+			return false
+		}
+		entry.WhitelistedUntil = now.Add(g.whitelistPeriod)
+		return true
+	default:
+		// Unknown, expired or abandoned triple
+		g.entries[key] = &Entry{FirstSeen: now}
+		return false
+	}
+}
+
+func (g *Greylist) startPersistWorker() {
+	ticker := time.NewTicker(g.persistInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		g.expire()
+		if err := g.Persist(); err != nil && g.logger != nil {
+			g.logger.Log(logger.LogLevelError, "Failed to persist greylist: %v", err)
+		}
+	}
+}
+
+// expire drops whitelisted triples past their period and abandoned retries
+func (g *Greylist) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range g.entries {
+		if entry.WhitelistedUntil.IsZero() {
+			if now.Sub(entry.FirstSeen) >= pendingLifetime {
+				delete(g.entries, key)
+			}
+		} else if now.After(entry.WhitelistedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+func (g *Greylist) loadFromDisk() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entriesFile := fmt.Sprintf("%s/greylist.dat", g.storagePath)
+	if _, err := os.Stat(entriesFile); err == nil {
+		data, err := os.ReadFile(entriesFile)
+		if err != nil {
+			return fmt.Errorf("failed to read greylist entries: %w", err)
+		}
+		if err := json.Unmarshal(data, &g.entries); err != nil {
+			return fmt.Errorf("failed to decode greylist entries: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Persist writes the greylist state to disk
+func (g *Greylist) Persist() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := os.MkdirAll(g.storagePath, 0755); err != nil {
+		return fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	entriesFile := fmt.Sprintf("%s/greylist.dat", g.storagePath)
+	data, err := json.Marshal(g.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode greylist entries: %w", err)
+	}
+	if err := os.WriteFile(entriesFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to save greylist entries: %w", err)
+	}
+
+	return nil
+}
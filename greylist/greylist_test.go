@@ -0,0 +1,137 @@
+package greylist
+
+import (
+	"go-relay-server/logger"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGreylist(t *testing.T, dir string, delay, whitelist time.Duration) *Greylist {
+	t.Helper()
+	g, err := NewGreylist(&Config{
+		StoragePath:     dir,
+		InitialDelay:    delay,
+		WhitelistPeriod: whitelist,
+		PersistInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestFirstAttemptRejectedThenAccepted(t *testing.T) {
+	g := newTestGreylist(t, t.TempDir(), 50*time.Millisecond, time.Hour)
+
+	if g.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("first attempt accepted")
+	}
+	if g.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("retry before the initial delay accepted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !g.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("retry after the initial delay rejected")
+	}
+	// Whitelisted from now on, without another delay
+	if !g.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("whitelisted triple rejected")
+	}
+
+	// Each part of the triple counts
+	for _, triple := range [][3]string{
+		{"192.0.2.2", "a@example.com", "b@example.org"},
+		{"192.0.2.1", "c@example.com", "b@example.org"},
+		{"192.0.2.1", "a@example.com", "d@example.org"},
+	} {
+		if g.Check(triple[0], triple[1], triple[2]) {
+			t.Errorf("first attempt for %v accepted", triple)
+		}
+	}
+}
+
+func TestWhitelistExpiry(t *testing.T) {
+	g := newTestGreylist(t, t.TempDir(), 0, 50*time.Millisecond)
+
+	g.Check("192.0.2.1", "a@example.com", "b@example.org")
+	if !g.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("retry rejected")
+	}
+	time.Sleep(60 * time.Millisecond)
+	g.expire()
+	if len(g.entries) != 0 {
+		t.Fatalf("%d entries remain after the whitelist period", len(g.entries))
+	}
+	if g.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("triple past its whitelist period accepted without a new delay")
+	}
+}
+
+func TestAbandonedRetryExpires(t *testing.T) {
+	g := newTestGreylist(t, t.TempDir(), time.Minute, time.Hour)
+	g.Check("192.0.2.1", "a@example.com", "b@example.org")
+	g.entries["192.0.2.1|a@example.com|b@example.org"].FirstSeen = time.Now().Add(-pendingLifetime)
+
+	g.expire()
+	if len(g.entries) != 0 {
+		t.Fatal("abandoned triple kept")
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir := t.TempDir()
+	g := newTestGreylist(t, dir, 0, time.Hour)
+	g.Check("192.0.2.1", "a@example.com", "b@example.org")
+	g.Check("192.0.2.1", "a@example.com", "b@example.org")
+	if err := g.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart keeps the whitelist
+	reloaded := newTestGreylist(t, dir, time.Hour, time.Hour)
+	if !reloaded.Check("192.0.2.1", "a@example.com", "b@example.org") {
+		t.Fatal("whitelisted triple lost on reload")
+	}
+}
+
+func TestPersistWorkerLogsFailures(t *testing.T) {
+	logDir := t.TempDir()
+	log, err := logger.NewLogger(logger.Config{LogDir: logDir, LogFile: "greylist", LogLevel: logger.LogLevelInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "greylist")
+	if _, err := NewGreylist(&Config{
+		StoragePath:     dir,
+		InitialDelay:    time.Minute,
+		WhitelistPeriod: time.Hour,
+		PersistInterval: 20 * time.Millisecond,
+		Logger:          log,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file in place of the storage directory makes every write fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(filepath.Join(logDir, "greylist-"+time.Now().Format("2006-01-02")+".log"))
+		if strings.Contains(string(data), "[ERROR] Failed to persist greylist: failed to create storage directory") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("persist failure not logged:\n%s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
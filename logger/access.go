@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AccessLog records one JSON line per message handled, independent of the
+// application log and its level
+type AccessLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// AccessEntry is one line of the access log
+type AccessEntry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Size     int64     `json:"size"`
+	Subject  string    `json:"subject"`
+	Relay    []string  `json:"relay"`   // Relays the message was routed to, "mx" for direct delivery
+	Outcome  string    `json:"outcome"` // "delivered", "queued", "bounced", "duplicate", "rejected" or "failed"
+	Reply    string    `json:"reply"`   // SMTP reply sent to the client
+}
+
+func NewAccessLog(path string) (*AccessLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %v", err)
+	}
+	return &AccessLog{file: file}, nil
+}
+
+// Record appends an entry, stamping it with the current time if unset
+func (a *AccessLog) Record(entry AccessEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+func (a *AccessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"os"
+)
+
+// ANSI color codes used for console output
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// colorize wraps line in the color for its level
+func colorize(level LogLevel, line string) string {
+	var color string
+	switch level {
+	case LogLevelInfo:
+		color = colorGreen
+	case LogLevelWarn:
+		color = colorYellow
+	case LogLevelError:
+		color = colorRed
+	default:
+		return line
+	}
+	return color + line + colorReset
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConsoleColors(t *testing.T) {
+	for _, tty := range []bool{true, false} {
+		l := newTestLogger(t, Config{Console: true, LogLevel: LogLevelDebug})
+		var console bytes.Buffer
+		l.console = log.New(&console, "", 0)
+		l.color = tty
+
+		l.Log(LogLevelInfo, "delivered")
+		l.Log(LogLevelWarn, "slow relay")
+		l.Log(LogLevelError, "relay down")
+		l.Log(LogLevelDebug, "details")
+
+		got := strings.Split(strings.TrimSuffix(console.String(), "\n"), "\n")
+		want := []string{"[INFO] delivered", "[WARN] slow relay", "[ERROR] relay down", "[DEBUG] details"}
+		if tty {
+			want = []string{
+				colorGreen + "[INFO] delivered" + colorReset,
+				colorYellow + "[WARN] slow relay" + colorReset,
+				colorRed + "[ERROR] relay down" + colorReset,
+				"[DEBUG] details",
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("tty=%v: console got %q, want %q", tty, got, want)
+		}
+
+		// The file log never carries color codes
+		for _, line := range logLines(t, l) {
+			if strings.Contains(line, "\033[") {
+				t.Errorf("tty=%v: file log line %q is colorized", tty, line)
+			}
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if isTerminal(file) {
+		t.Error("regular file reported as a terminal")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if isTerminal(w) {
+		t.Error("pipe reported as a terminal")
+	}
+}
+
+func TestConsoleOff(t *testing.T) {
+	l := newTestLogger(t, Config{})
+	if l.console != nil {
+		t.Fatal("console mirror enabled without Config.Console")
+	}
+	l.Log(LogLevelInfo, "file only")
+	if lines := logLines(t, l); len(lines) != 1 || !strings.HasSuffix(lines[0], "[INFO] file only") {
+		t.Fatalf("file log = %q", lines)
+	}
+}
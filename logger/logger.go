@@ -1,43 +1,76 @@
 package logger
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Logger struct {
+	// mu guards logFile and logger, which are swapped on rotation
+	mu      sync.Mutex
 	logFile *os.File
 	logger  *log.Logger
 	config  Config
+	console *log.Logger // stderr mirror, nil unless Config.Console is set
+	color   bool        // Colorize console lines, only when stderr is a terminal
+
+	rotating atomic.Bool
 }
 
 type Config struct {
-	LogFile  string
-	LogLevel LogLevel
+	LogFile       string
+	LogDir        string // Directory for log files; LogFile may also carry its own path
+	LogLevel      LogLevel
+	LogFormat     LogFormat
+	RetentionDays int  // Days to keep rotated logs, defaults to DefaultRetentionDays
+	Compress      bool // Gzip log files once they have been rotated out
+	Console       bool // Mirror log lines to stderr, colorized by level when it is a terminal
 }
 
+// DefaultRetentionDays is used when Config.RetentionDays is not set
+const DefaultRetentionDays = 7
+
 type LogLevel string
 
 const (
+	LogLevelDebug LogLevel = "DEBUG"
 	LogLevelInfo  LogLevel = "INFO"
 	LogLevelWarn  LogLevel = "WARN"
 	LogLevelError LogLevel = "ERROR"
 )
 
-func NewLogger(logFile string, logLevel LogLevel) (*Logger, error) {
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+func NewLogger(config Config) (*Logger, error) {
 	logger := &Logger{
-		config: Config{
-			LogFile:  logFile,
-			LogLevel: logLevel,
-		},
+		config: config,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logger.basePath()), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
 	}
 
 	if err := logger.setupLogger(); err != nil {
 		return nil, fmt.Errorf("failed to setup logger: %v", err)
 	}
+	if config.Console {
+		logger.console = log.New(os.Stderr, "", log.LstdFlags)
+		logger.color = isTerminal(os.Stderr)
+	}
 
 	go logger.DailyLogRotation()
 
@@ -51,18 +84,59 @@ func (l *Logger) setupLogger() error {
 		return fmt.Errorf("failed to open log file: %v", err)
 	}
 
+	flags := log.LstdFlags
+	if l.config.LogFormat == LogFormatJSON {
+		// JSON entries carry their own timestamp
+		flags = 0
+	}
+
+	// Swap in the new file before closing the old one so concurrent
+	// writers never see a closed file
+	l.mu.Lock()
+	oldFile := l.logFile
 	l.logFile = logFile
-	l.logger = log.New(logFile, "", log.LstdFlags)
+	l.logger = log.New(logFile, "", flags)
+	l.mu.Unlock()
+
+	if oldFile != nil {
+		oldFile.Close()
+	}
 
 	return nil
 }
 
+// basePath returns the log file path without the date suffix
+func (l *Logger) basePath() string {
+	if l.config.LogDir != "" {
+		return filepath.Join(l.config.LogDir, l.config.LogFile)
+	}
+	return l.config.LogFile
+}
+
 func (l *Logger) getLogFileName() string {
 	currentDate := time.Now().Format("2006-01-02")
-	return fmt.Sprintf("%s-%s.log", l.config.LogFile, currentDate)
+	return fmt.Sprintf("%s-%s.log", l.basePath(), currentDate)
 }
 
+// isLogFileName reports whether name is a dated log file for base, e.g.
+// "smtp-relay-2024-01-31.log" or "smtp-relay-2024-01-31.log.gz" for base "smtp-relay"
+func isLogFileName(name, base string) bool {
+	name = strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(name, base+"-") || !strings.HasSuffix(name, ".log") {
+		return false
+	}
+	date := strings.TrimSuffix(strings.TrimPrefix(name, base+"-"), ".log")
+	_, err := time.Parse("2006-01-02", date)
+	return err == nil
+}
+
+// DailyLogRotation rotates the log file at midnight. NewLogger already runs
+// it; further calls return immediately so only one rotation loop exists.
 func (l *Logger) DailyLogRotation() {
+	if !l.rotating.CompareAndSwap(false, true) {
+		return
+	}
+
 	for {
 		now := time.Now()
 		nextMidnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
@@ -70,21 +144,70 @@ func (l *Logger) DailyLogRotation() {
 
 		select {
 		case <-time.After(durationUntilMidnight):
-			if l.logFile != nil {
-				l.logFile.Close()
-			}
+			l.mu.Lock()
+			previous := l.logFile.Name()
+			l.mu.Unlock()
 
 			if err := l.setupLogger(); err != nil {
 				l.Log(LogLevelError, "Error rotating log file: %v", err)
+			} else if l.config.Compress && previous != l.getLogFileName() {
+				// Compress off the logging path; writers already use the new file
+				go l.compressLog(previous)
 			}
 
-			l.deleteOldLogs(7)
+			l.deleteOldLogs(l.retentionDays())
 		}
 	}
 }
 
+// compressLog gzips a rotated log file into <name>.gz and removes the original
+func (l *Logger) compressLog(path string) {
+	if err := gzipFile(path, path+".gz"); err != nil {
+		os.Remove(path + ".gz")
+		l.Log(LogLevelError, "Error compressing log file %s: %v", path, err)
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		l.Log(LogLevelError, "Error removing compressed log file %s: %v", path, err)
+	}
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func (l *Logger) retentionDays() int {
+	if l.config.RetentionDays > 0 {
+		return l.config.RetentionDays
+	}
+	return DefaultRetentionDays
+}
+
 func (l *Logger) deleteOldLogs(days int) {
-	files, err := os.ReadDir(".")
+	dir := filepath.Dir(l.basePath())
+	base := filepath.Base(l.basePath())
+
+	files, err := os.ReadDir(dir)
 	if err != nil {
 		l.Log(LogLevelError, "Error reading log directory: %v", err)
 		return
@@ -96,7 +219,7 @@ func (l *Logger) deleteOldLogs(days int) {
 			continue
 		}
 
-		if strings.HasPrefix(file.Name(), l.config.LogFile) && strings.HasSuffix(file.Name(), ".log") {
+		if isLogFileName(file.Name(), base) {
 			fileInfo, err := file.Info()
 			if err != nil {
 				l.Log(LogLevelError, "Error getting file info for %s: %v", file.Name(), err)
@@ -104,10 +227,11 @@ func (l *Logger) deleteOldLogs(days int) {
 			}
 
 			if fileInfo.ModTime().Before(cutoffTime) {
-				if err := os.Remove(file.Name()); err != nil {
-					l.Log(LogLevelError, "Error deleting old log file %s: %v", file.Name(), err)
+				path := filepath.Join(dir, file.Name())
+				if err := os.Remove(path); err != nil {
+					l.Log(LogLevelError, "Error deleting old log file %s: %v", path, err)
 				} else {
-					l.Log(LogLevelInfo, "Deleted old log file: %s", file.Name())
+					l.Log(LogLevelInfo, "Deleted old log file: %s", path)
 				}
 			}
 		}
@@ -116,20 +240,90 @@ func (l *Logger) deleteOldLogs(days int) {
 
 func (l *Logger) Log(level LogLevel, format string, args ...interface{}) {
 	if l.shouldLog(level) {
-		message := fmt.Sprintf(format, args...)
-		l.logger.Printf("[%s] %s\n", level, message)
+		l.write(level, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+// LogWith logs a message with structured key/value pairs, e.g.
+// LogWith(LogLevelInfo, "Email relayed", "from", from, "to", to)
+func (l *Logger) LogWith(level LogLevel, message string, keysAndValues ...interface{}) {
+	if l.shouldLog(level) {
+		l.write(level, message, keysAndValues)
+	}
+}
+
+func (l *Logger) write(level LogLevel, message string, keysAndValues []interface{}) {
+	if l.config.LogFormat == LogFormatJSON {
+		entry := map[string]interface{}{
+			"timestamp": time.Now().Format(time.RFC3339Nano),
+			"level":     level,
+			"message":   message,
+		}
+		if fields := toFields(keysAndValues); len(fields) > 0 {
+			entry["fields"] = fields
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{
+				"timestamp": time.Now().Format(time.RFC3339Nano),
+				"level":     level,
+				"message":   message,
+				"error":     fmt.Sprintf("failed to encode fields: %v", err),
+			})
+		}
+		l.output(level, string(data))
+		return
 	}
+
+	var b strings.Builder
+	b.WriteString(message)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], fieldValue(keysAndValues, i+1))
+	}
+	l.output(level, fmt.Sprintf("[%s] %s", level, b.String()))
+}
+
+func (l *Logger) output(level LogLevel, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger.Println(line)
+	if l.console != nil {
+		if l.color {
+			line = colorize(level, line)
+		}
+		l.console.Println(line)
+	}
+}
+
+// toFields pairs up keys and values; a trailing key without a value maps to nil
+func toFields(keysAndValues []interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(keysAndValues)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		value := fieldValue(keysAndValues, i+1)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[fmt.Sprint(keysAndValues[i])] = value
+	}
+	return fields
+}
+
+func fieldValue(keysAndValues []interface{}, i int) interface{} {
+	if i < len(keysAndValues) {
+		return keysAndValues[i]
+	}
+	return nil
 }
 
 func (l *Logger) shouldLog(level LogLevel) bool {
 	switch l.config.LogLevel {
-	case LogLevelInfo:
+	case LogLevelDebug:
 		return true
 	case LogLevelWarn:
 		return level == LogLevelWarn || level == LogLevelError
 	case LogLevelError:
 		return level == LogLevelError
 	default:
-		return true
+		return level != LogLevelDebug
 	}
 }
\ No newline at end of file
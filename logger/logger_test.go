@@ -0,0 +1,272 @@
+package logger
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestLogger returns a logger writing to a temp dir, with the LogDir and
+// LogFile defaults filled in
+func newTestLogger(t *testing.T, config Config) *Logger {
+	t.Helper()
+	if config.LogDir == "" {
+		config.LogDir = t.TempDir()
+	}
+	if config.LogFile == "" {
+		config.LogFile = "smtp-relay"
+	}
+	l, err := NewLogger(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// logLines returns the lines written to the current log file of l
+func logLines(t *testing.T, l *Logger) []string {
+	t.Helper()
+	data, err := os.ReadFile(l.getLogFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestTextFormat(t *testing.T) {
+	l := newTestLogger(t, Config{})
+	l.Log(LogLevelInfo, "Relayed %d messages", 2)
+	l.LogWith(LogLevelWarn, "Slow relay", "relay", "smtp.example.com:25", "seconds", 12)
+
+	lines := logLines(t, l)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), lines)
+	}
+	if !strings.HasSuffix(lines[0], " [INFO] Relayed 2 messages") {
+		t.Errorf("unexpected text line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " [WARN] Slow relay relay=smtp.example.com:25 seconds=12") {
+		t.Errorf("unexpected text line with fields %q", lines[1])
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	l := newTestLogger(t, Config{LogFormat: LogFormatJSON})
+	l.Log(LogLevelError, "Relay %s failed", "smtp.example.com:25")
+	l.LogWith(LogLevelInfo, "Email relayed", "from", "a@example.com", "to", []string{"b@example.org"}, "err", os.ErrClosed, "dangling")
+
+	lines := logLines(t, l)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), lines)
+	}
+	var entries [2]struct {
+		Timestamp string                 `json:"timestamp"`
+		Level     string                 `json:"level"`
+		Message   string                 `json:"message"`
+		Fields    map[string]interface{} `json:"fields"`
+	}
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &entries[i]); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v\n%s", i, err, line)
+		}
+		if entries[i].Timestamp == "" {
+			t.Errorf("line %d has no timestamp: %s", i, line)
+		}
+	}
+
+	if entries[0].Level != "ERROR" || entries[0].Message != "Relay smtp.example.com:25 failed" || entries[0].Fields != nil {
+		t.Errorf("unexpected entry %s", lines[0])
+	}
+	fields := entries[1].Fields
+	if entries[1].Level != "INFO" || entries[1].Message != "Email relayed" ||
+		fields["from"] != "a@example.com" || fields["err"] != os.ErrClosed.Error() {
+		t.Errorf("unexpected entry %s", lines[1])
+	}
+	if to, ok := fields["to"].([]interface{}); !ok || len(to) != 1 || to[0] != "b@example.org" {
+		t.Errorf("list field not encoded as a JSON array: %s", lines[1])
+	}
+	if value, ok := fields["dangling"]; !ok || value != nil {
+		t.Errorf("key without a value not encoded as null: %s", lines[1])
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	l := newTestLogger(t, Config{LogLevel: LogLevelWarn})
+	l.Log(LogLevelDebug, "debug")
+	l.Log(LogLevelInfo, "info")
+	l.Log(LogLevelWarn, "warn")
+	l.Log(LogLevelError, "error")
+
+	lines := logLines(t, l)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "warn") || !strings.HasSuffix(lines[1], "error") {
+		t.Fatalf("warn level logged %q, want only the warning and the error", lines)
+	}
+}
+
+func TestConcurrentLogDuringRotation(t *testing.T) {
+	l := newTestLogger(t, Config{})
+
+	const writers, lines = 16, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				l.LogWith(LogLevelInfo, "line", "writer", i, "n", j)
+			}
+		}()
+	}
+	// Reopening the file is what rotation does at midnight
+	for i := 0; i < 20; i++ {
+		if err := l.setupLogger(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	// Every line reaches the file whole, whichever handle it was written to
+	got := logLines(t, l)
+	if len(got) != writers*lines {
+		t.Fatalf("got %d lines, want %d", len(got), writers*lines)
+	}
+	for _, line := range got {
+		if !strings.Contains(line, "[INFO] line writer=") {
+			t.Fatalf("garbled line %q", line)
+		}
+	}
+}
+
+func TestSingleRotationLoop(t *testing.T) {
+	l := newTestLogger(t, Config{})
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.rotating.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("NewLogger did not start the rotation loop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A second loop would block until midnight; this call must return
+	done := make(chan struct{})
+	go func() {
+		l.DailyLogRotation()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DailyLogRotation started a second rotation loop")
+	}
+}
+
+func TestLogFileWithDirectory(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLogger(Config{LogFile: filepath.Join(dir, "nested", "relay")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(LogLevelInfo, "hello")
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "nested", "relay-*.log"))
+	if len(matches) != 1 {
+		t.Fatalf("log file not created in the directory of log_file, found %v", matches)
+	}
+}
+
+func TestDeleteOldLogs(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestLogger(t, Config{LogDir: dir, RetentionDays: 3})
+
+	age := func(days int) time.Time { return time.Now().AddDate(0, 0, -days) }
+	files := map[string]time.Time{
+		"smtp-relay-2020-01-01.log":    age(5),
+		"smtp-relay-2020-01-02.log.gz": age(4),
+		"smtp-relay-2020-01-05.log":    age(2),
+		"smtp-relay-2020-01-06.log.gz": age(1),
+		// Not log files of this logger, however old
+		"other-2020-01-01.log":      age(30),
+		"smtp-relay-backup.log":     age(30),
+		"smtp-relay-2020-01-01.txt": age(30),
+		"smtp-relay-2020-13-45.log": age(30),
+	}
+	for name, modTime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.deleteOldLogs(l.retentionDays())
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		deleted := os.IsNotExist(err)
+		wantDeleted := name == "smtp-relay-2020-01-01.log" || name == "smtp-relay-2020-01-02.log.gz"
+		if deleted != wantDeleted {
+			t.Errorf("%s: deleted is %v, want %v", name, deleted, wantDeleted)
+		}
+	}
+	if _, err := os.Stat(l.getLogFileName()); err != nil {
+		t.Errorf("current log file removed: %v", err)
+	}
+}
+
+func TestRetentionDaysDefault(t *testing.T) {
+	if days := newTestLogger(t, Config{}).retentionDays(); days != DefaultRetentionDays {
+		t.Fatalf("retention without a setting is %d days, want %d", days, DefaultRetentionDays)
+	}
+}
+
+func TestCompressLog(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestLogger(t, Config{LogDir: dir, Compress: true})
+	rotated := filepath.Join(dir, "smtp-relay-2020-01-01.log")
+	content := strings.Repeat("[INFO] rotated line\n", 1000)
+	if err := os.WriteFile(rotated, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l.compressLog(rotated)
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Fatalf("rotated file kept after compression: %v", err)
+	}
+	f, err := os.Open(rotated + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("compressed file is not gzip: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Fatal("compressed file does not hold the rotated log")
+	}
+}
+
+func TestCompressLogFailure(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestLogger(t, Config{LogDir: dir, Compress: true})
+	missing := filepath.Join(dir, "smtp-relay-2020-01-01.log")
+
+	l.compressLog(missing)
+	if _, err := os.Stat(missing + ".gz"); !os.IsNotExist(err) {
+		t.Fatalf("partial compressed file left behind: %v", err)
+	}
+	if lines := logLines(t, l); !strings.Contains(lines[len(lines)-1], "Error compressing log file") {
+		t.Fatalf("compression failure not logged: %q", lines)
+	}
+}
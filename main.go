@@ -1,12 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go-relay-server/config"
+	"go-relay-server/replay"
 	"go-relay-server/server"
 	"log"
+	"net"
+	"net/smtp"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -15,8 +23,27 @@ var (
 	restartCmd = flag.NewFlagSet("restart", flag.ExitOnError)
 	statusCmd  = flag.NewFlagSet("status", flag.ExitOnError)
 	versionCmd = flag.NewFlagSet("version", flag.ExitOnError)
+	ctlCmd     = flag.NewFlagSet("ctl", flag.ExitOnError)
+	failedCmd  = flag.NewFlagSet("failed", flag.ExitOnError)
+	replayCmd  = flag.NewFlagSet("replay", flag.ExitOnError)
 )
 
+// defaultConfigPath is used when no -config flag is given
+const defaultConfigPath = "config/config.json"
+
+// configPath is set by the -config flag of each subcommand
+var configPath string
+
+func init() {
+	for _, cmd := range []*flag.FlagSet{startCmd, stopCmd, restartCmd, statusCmd, ctlCmd, failedCmd, replayCmd} {
+		cmd.StringVar(&configPath, "config", defaultConfigPath, "path or http(s) URL of the configuration file, or - for stdin")
+	}
+}
+
+// stopWaitMargin is how much longer than the server's own shutdown timeouts
+// the stop command waits for it to save its state and exit
+const stopWaitMargin = 10 * time.Second
+
 // Define the banner constant
 const banner = `
 ██╗    ██╗██╗██╗  ██╗██╗██╗  ██╗ █████╗  ██████╗██╗  ██╗███████╗██████╗ 
@@ -26,18 +53,20 @@ const banner = `
 ╚███╔███╔╝██║██║  ██╗██║██║  ██║██║  ██║╚██████╗██║  ██╗███████╗██║  ██║
  ╚══╝╚══╝ ╚═╝╚═╝  ╚═╝╚═╝╚═╝  ╚═╝╚═╝  ╚═╝ ╚═════╝╚═╝  ╚═╝╚══════╝╚═╝  ╚═╝
 Multi-Relay SMTP Server - simple SMTP Server Written in GO!
-Version: 1.0.0
-`
+Version: 1.0.0`
 
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println(banner)
-		fmt.Println("Usage: smtp-relay <command>")
+		fmt.Println("Usage: smtp-relay <command> [-config path]")
 		fmt.Println("\nCommands:")
 		fmt.Println("  start\t\tStart the SMTP relay server")
 		fmt.Println("  stop\t\tStop the SMTP relay server")
 		fmt.Println("  restart\tRestart the SMTP relay server")
 		fmt.Println("  status\tCheck server status")
+		fmt.Println("  ctl\t\tSend a command to the control socket, e.g. \"ctl queue list\"")
+		fmt.Println("  failed\tList, requeue or clear failed messages: failed list|requeue <id>|clear")
+		fmt.Println("  replay\tSubmit stored message files or queue files to the running server")
 		fmt.Println("  version\tShow version information")
 		os.Exit(1)
 	}
@@ -48,13 +77,30 @@ func main() {
 		startServer()
 	case "stop":
 		stopCmd.Parse(os.Args[2:])
-		stopServer()
+		if err := stopServer(); err != nil {
+			log.Fatalf("Failed to stop server: %v", err)
+		}
 	case "restart":
 		restartCmd.Parse(os.Args[2:])
 		restartServer()
 	case "status":
 		statusCmd.Parse(os.Args[2:])
 		checkStatus()
+	case "ctl":
+		ctlCmd.Parse(os.Args[2:])
+		runControl(ctlCmd.Args())
+	case "failed":
+		failedCmd.Parse(os.Args[2:])
+		if failedCmd.NArg() == 0 {
+			log.Fatalf("Usage: smtp-relay failed [-config path] list|requeue <id>|clear")
+		}
+		runControl(append([]string{"failed"}, failedCmd.Args()...))
+	case "replay":
+		replayCmd.Parse(os.Args[2:])
+		if replayCmd.NArg() == 0 {
+			log.Fatalf("Usage: smtp-relay replay [-config path] <file>...")
+		}
+		replayFiles(replayCmd.Args())
 	case "version":
 		versionCmd.Parse(os.Args[2:])
 		fmt.Println(banner)
@@ -67,66 +113,206 @@ func main() {
 func startServer() {
 	fmt.Println(banner)
 
-	config, err := config.LoadConfig("config/config.json")
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	server, err := server.NewServer(config)
+	server, err := server.NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize server: %v", err)
 	}
+	server.ConfigPath = configPath
+
+	if err := server.Start(); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
 
-	go func() {
-		if err := server.Start(); err != nil {
-			log.Fatalf("Server error: %v", err)
+	// Reload config on SIGHUP, shut down gracefully on interrupt
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if configPath == config.Stdin {
+			log.Printf("Not reloading config: it was read from standard input")
+			continue
 		}
-	}()
 
-	// Wait for interrupt signal to gracefully shutdown the server
-	<-make(chan struct{})
+		newConfig, err := config.LoadConfig(configPath)
+		if err != nil {
+			log.Printf("Failed to reload config: %v", err)
+			continue
+		}
+		server.Reload(newConfig)
+	}
 	server.Stop()
 }
 
-func stopServer() {
-	server, err := getServerInstance()
+// stopServer stops the running server and waits for it to exit, which takes
+// at most the shutdown timeouts of its config
+func stopServer() error {
+	cfg := loadCLIConfig()
+	pid, err := server.RunningPID(cfg.pidFile)
 	if err != nil {
-		log.Fatalf("Failed to initialize server: %v", err)
+		server.RemovePIDFile(cfg.pidFile)
+		fmt.Println("Server is not running")
+		return nil
 	}
 
-	fmt.Println("Stopping server...")
-	server.Stop()
-	fmt.Println("Server stopped successfully")
-}
+	fmt.Printf("Stopping server (PID %d)...\n", pid)
+	if err := server.TerminateProcess(pid); err != nil {
+		return err
+	}
 
-func restartServer() {
-	server, err := getServerInstance()
-	if err != nil {
-		log.Fatalf("Failed to initialize server: %v", err)
+	// Wait for the process to drain its connections and exit
+	deadline := time.Now().Add(cfg.stopTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := server.RunningPID(cfg.pidFile); err != nil {
+			fmt.Println("Server stopped successfully")
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
 	}
+	return fmt.Errorf("server (PID %d) did not stop within %s", pid, cfg.stopTimeout)
+}
 
+func restartServer() {
 	fmt.Println("Restarting server...")
-	if err := server.Restart(); err != nil {
+	if err := stopServer(); err != nil {
 		log.Fatalf("Failed to restart server: %v", err)
 	}
-	fmt.Println("Server restarted successfully")
+	startServer()
 }
 
 func checkStatus() {
-	server, err := getServerInstance()
+	cfg := loadCLIConfig()
+	pid, err := server.RunningPID(cfg.pidFile)
 	if err != nil {
-		log.Fatalf("Failed to initialize server: %v", err)
+		fmt.Println("Server status: stopped")
+		return
 	}
+	fmt.Printf("Server status: running (PID %d)\n", pid)
 
-	status := server.Status()
-	fmt.Printf("Server status: %s\n", status)
+	output, err := server.QueryControl(cfg.controlSocket, "status")
+	if err != nil {
+		fmt.Printf("Details unavailable: %v\n", err)
+		return
+	}
+	var snapshot server.Snapshot
+	if err := json.Unmarshal([]byte(output), &snapshot); err != nil {
+		fmt.Printf("Details unavailable: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Uptime: %s\n", time.Duration(snapshot.UptimeSeconds)*time.Second)
+	fmt.Printf("Listeners: %d\n", len(snapshot.Listeners))
+	for _, listener := range snapshot.Listeners {
+		fmt.Printf("  port %s (%s): %d active, %d total connections\n",
+			listener.Port, listener.Encryption, listener.ActiveConnections, listener.TotalConnections)
+	}
+	if snapshot.Queue != nil {
+		fmt.Printf("Queue: %d pending, %d failed\n", snapshot.Queue.Pending, snapshot.Queue.Failed)
+	}
+	fmt.Printf("Relayed: %d delivered, %d failed\n", snapshot.Relay.Delivered, snapshot.Relay.Failed)
 }
 
-func getServerInstance() (*server.Server, error) {
-	config, err := config.LoadConfig("config/config.json")
+func runControl(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: smtp-relay ctl [-config path] <command> [args...]")
+	}
+	output, err := server.QueryControl(loadCLIConfig().controlSocket, strings.Join(args, " "))
+	if err != nil {
+		log.Fatalf("Control command failed: %v", err)
+	}
+	fmt.Print(output)
+}
+
+// cliConfig holds the paths the CLI needs to reach a running server
+type cliConfig struct {
+	pidFile       string
+	controlSocket string
+	stopTimeout   time.Duration
+}
+
+func loadCLIConfig() cliConfig {
+	config, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	cfg := cliConfig{
+		pidFile:       config.PIDFile,
+		controlSocket: config.ControlSocket,
+		stopTimeout:   server.StopTimeout(config) + stopWaitMargin,
+	}
+	if cfg.pidFile == "" {
+		cfg.pidFile = server.DefaultPIDFile
+	}
+	if cfg.controlSocket == "" {
+		cfg.controlSocket = server.DefaultControlSocket
+	}
+	return cfg
+}
+
+// replayFiles submits the messages stored in files to the running server
+// through its first listener without implicit TLS, exiting with an error if
+// any message could not be submitted
+func replayFiles(files []string) {
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load config: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	var listener *config.ListenerConfig
+	for i := range cfg.Listeners {
+		if cfg.Listeners[i].Encryption != "tls" {
+			listener = &cfg.Listeners[i]
+			break
+		}
+	}
+	if listener == nil {
+		log.Fatalf("Cannot replay: no listener without implicit TLS")
 	}
+	host := listener.Host
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	addr := net.JoinHostPort(host, listener.Port)
 
-	return server.NewServer(config)
+	var auth smtp.Auth
+	if listener.RequireAuth {
+		auth = smtp.PlainAuth("", cfg.AuthUsername, cfg.AuthPassword, host)
+	}
+	helo := cfg.Hostname
+	if helo == "" {
+		helo = "localhost"
+	}
+
+	failures := 0
+	for _, file := range files {
+		msgs, err := replay.Load(file)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", file, err)
+			failures++
+			continue
+		}
+		for _, msg := range msgs {
+			accepted, rejected, err := replay.Submit(addr, helo, auth, msg)
+			for _, rcptErr := range rejected {
+				log.Printf("Failed to replay %s: %v", msg.Name, rcptErr)
+				failures++
+			}
+			if err != nil {
+				log.Printf("Failed to replay %s: %v", msg.Name, err)
+				failures++
+				continue
+			}
+			fmt.Printf("Replayed %s: From=%s, To=%s\n", msg.Name, msg.From, strings.Join(accepted, ","))
+		}
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go-relay-server/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigFlag(t *testing.T) {
+	t.Cleanup(func() { configPath = defaultConfigPath })
+
+	for _, cmd := range []*flag.FlagSet{startCmd, stopCmd, restartCmd, statusCmd, ctlCmd, failedCmd, replayCmd} {
+		configPath = defaultConfigPath
+		if err := cmd.Parse([]string{"-config", "/etc/smtp-relay/" + cmd.Name() + ".json", "queue", "list"}); err != nil {
+			t.Fatalf("%s: %v", cmd.Name(), err)
+		}
+		if want := "/etc/smtp-relay/" + cmd.Name() + ".json"; configPath != want {
+			t.Errorf("%s -config set the path to %q, want %q", cmd.Name(), configPath, want)
+		}
+		if cmd.NArg() != 2 || cmd.Arg(0) != "queue" {
+			t.Errorf("%s left arguments %v, want [queue list]", cmd.Name(), cmd.Args())
+		}
+	}
+
+	// Without the flag the default path is kept
+	configPath = defaultConfigPath
+	if err := statusCmd.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if configPath != defaultConfigPath {
+		t.Errorf("path without -config is %q, want %q", configPath, defaultConfigPath)
+	}
+}
+
+func TestLoadCLIConfig(t *testing.T) {
+	t.Cleanup(func() { configPath = defaultConfigPath })
+
+	dir := t.TempDir()
+	cfg := config.Config{
+		Listeners:       []config.ListenerConfig{{Host: "127.0.0.1", Port: "2525", Encryption: "none"}},
+		DefaultRelay:    config.RelayList{"smtp.example.com:25"},
+		LogDir:          dir,
+		LogFile:         "smtp-relay",
+		LogLevel:        "info",
+		PIDFile:         filepath.Join(dir, "custom.pid"),
+		ControlSocket:   filepath.Join(dir, "custom.sock"),
+		RateLimiting:    config.RateLimiting{RequestsPerMinute: 60, BurstLimit: 10},
+		ShutdownTimeout: "90s",
+		Queue: config.QueueConfig{
+			StoragePath:     dir,
+			MaxRetries:      3,
+			RetryInterval:   "5m",
+			MaxQueueSize:    100,
+			PersistInterval: "1m",
+			DrainTimeout:    "20s",
+		},
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "custom.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stopCmd.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	got := loadCLIConfig()
+	if got.pidFile != cfg.PIDFile || got.controlSocket != cfg.ControlSocket {
+		t.Fatalf("loaded %+v from %s, want its pid file and control socket", got, path)
+	}
+	// The stop command waits out the shutdown timeouts of the config
+	if want := 90*time.Second + 5*time.Second + 20*time.Second + stopWaitMargin; got.stopTimeout != want {
+		t.Errorf("got stop timeout %s, want %s", got.stopTimeout, want)
+	}
+}
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"slices"
+	"time"
+)
+
+// dedupKey identifies a message by its envelope and content. Leading
+// Received headers are left out because they carry the time the message was
+// received, which differs between retries of the same DATA.
+func dedupKey(envelope Envelope, data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(envelope.From))
+	h.Write([]byte{0})
+	h.Write([]byte(envelope.To))
+	h.Write([]byte{0})
+	h.Write(stripTrace(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// transactionKey identifies a mail transaction by its sender, its
+// recipients in any order and the message read from message
+func transactionKey(from string, to []string, message io.Reader) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	recipients := slices.Clone(to)
+	slices.Sort(recipients)
+	for _, rcpt := range recipients {
+		h.Write([]byte(rcpt))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{0})
+	if _, err := io.Copy(h, message); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Claim records a mail transaction before it is delivered or queued and
+// reports whether it is new, that is not identical to one claimed within the
+// dedup window. message should be read as the client sent it, before the
+// relay adds any header, so that a repeated DATA matches. The key is passed
+// to Unclaim if the transaction is not accepted after all. With dedup
+// disabled every transaction is new and the key is empty. Claims are only
+// kept in memory.
+func (q *Queue) Claim(from string, to []string, message io.Reader) (key string, fresh bool, err error) {
+	if q.dedupWindow <= 0 {
+		return "", true, nil
+	}
+	key, err = transactionKey(from, to, message)
+	if err != nil {
+		return "", false, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.pruneSeen(now)
+	if _, ok := q.seen[key]; ok {
+		return key, false, nil
+	}
+	q.seen[key] = now
+	return key, true, nil
+}
+
+// Unclaim forgets a transaction recorded by Claim, so that it can be sent
+// again
+func (q *Queue) Unclaim(key string) {
+	if key == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.seen, key)
+}
+
+// stripTrace returns data without its leading Received header fields
+func stripTrace(data []byte) []byte {
+	inTrace := false
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			end = len(data) - 1
+		}
+		line := data[:end+1]
+		switch {
+		case hasPrefixFold(line, "Received:"):
+			inTrace = true
+		case inTrace && (line[0] == ' ' || line[0] == '\t'):
+		default:
+			return data
+		}
+		data = data[end+1:]
+	}
+	return data
+}
+
+func hasPrefixFold(line []byte, prefix string) bool {
+	return len(line) >= len(prefix) && bytes.EqualFold(line[:len(prefix)], []byte(prefix))
+}
+
+// pruneSeen forgets dedup keys older than the dedup window. The caller must
+// hold q.mu.
+func (q *Queue) pruneSeen(now time.Time) {
+	for key, at := range q.seen {
+		if now.Sub(at) >= q.dedupWindow {
+			delete(q.seen, key)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnqueueDuplicate(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	data := []byte("Subject: twice\r\n\r\nBody\r\n")
+	if err := q.Enqueue(envelope("b@example.org"), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(envelope("b@example.org"), data); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("second Enqueue returned %v, want ErrDuplicate", err)
+	}
+
+	// A fresh trace header does not make a retried DATA a new message
+	traced := append([]byte("Received: from client.test\r\n\tby relay.test; now\r\n"), data...)
+	if err := q.Enqueue(envelope("b@example.org"), traced); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("Enqueue with a new Received header returned %v, want ErrDuplicate", err)
+	}
+	if err := q.Enqueue(envelope("c@example.org"), data); err != nil {
+		t.Fatalf("Enqueue for another recipient: %v", err)
+	}
+	if n := len(q.Items()); n != 2 {
+		t.Fatalf("queue holds %d items, want 2", n)
+	}
+}
+
+func TestEnqueueDuplicateAfterWindow(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.dedupWindow = 50 * time.Millisecond
+	data := []byte("Subject: later\r\n\r\n")
+	if err := q.Enqueue(envelope("b@example.org"), data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := q.Enqueue(envelope("b@example.org"), data); err != nil {
+		t.Fatalf("Enqueue after the window: %v", err)
+	}
+	if n := len(q.seen); n != 1 {
+		t.Fatalf("dedup index holds %d keys, want the expired one pruned", n)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	message := "Subject: claim\r\n\r\nBody\r\n"
+	claim := func(to ...string) (string, bool) {
+		t.Helper()
+		key, fresh, err := q.Claim("a@example.com", to, strings.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, fresh
+	}
+
+	key, fresh := claim("b@example.org", "c@example.org")
+	if !fresh {
+		t.Fatal("first claim is not new")
+	}
+	if _, fresh := claim("c@example.org", "b@example.org"); fresh {
+		t.Fatal("repeated transaction with the recipients reordered is new")
+	}
+	if _, fresh := claim("b@example.org"); !fresh {
+		t.Fatal("transaction for fewer recipients is not new")
+	}
+
+	// A transaction that was not accepted can be sent again
+	q.Unclaim(key)
+	if _, fresh := claim("b@example.org", "c@example.org"); !fresh {
+		t.Fatal("transaction is not new after Unclaim")
+	}
+}
+
+func TestClaimDisabled(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.dedupWindow = 0
+	for i := 0; i < 2; i++ {
+		key, fresh, err := q.Claim("a@example.com", []string{"b@example.org"}, strings.NewReader("Subject: x\r\n\r\n"))
+		if err != nil || !fresh || key != "" {
+			t.Fatalf("claim %d = %q, %v, %v; want a new transaction without a key", i, key, fresh, err)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package queue
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go-relay-server/logger"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,9 +21,27 @@ type Config struct {
 	MaxRetries      int
 	RetryInterval   time.Duration
 	MaxQueueSize    int
+	MaxQueueBytes   int64 // Limit on the total message size of queued items, 0 for no limit
 	PersistInterval time.Duration
+	// DedupWindow is how long an enqueued message suppresses identical ones, 0 to disable
+	DedupWindow time.Duration
+	// Logger receives persist failures and worker events, nil to discard them
+	Logger *logger.Logger
 }
 
+var (
+	// ErrQueueFull is returned by Enqueue when the item count limit is reached
+	ErrQueueFull = errors.New("queue is full")
+	// ErrQueueBytesExceeded is returned by Enqueue when the item would exceed the byte limit
+	ErrQueueBytesExceeded = errors.New("queue byte limit exceeded")
+	// ErrMaxRetriesExceeded is returned by Retry when the item has been moved
+	// to the failed items
+	ErrMaxRetriesExceeded = errors.New("max retries exceeded")
+	// ErrDuplicate is returned by Enqueue for a message identical to one
+	// enqueued within the dedup window
+	ErrDuplicate = errors.New("duplicate message")
+)
+
 type Queue struct {
 	items           []*QueueItem
 	failedItems     []FailedItem
@@ -24,10 +49,26 @@ type Queue struct {
 	maxRetries      int
 	retryInterval   time.Duration
 	maxQueueSize    int
+	maxQueueBytes   int64
+	bytes           int64
 	persistTimer    *time.Timer
-	persistChannel  chan struct{}
+	persistChannel  chan struct{} // Closed by Close to stop the persist worker
+	closeOnce       sync.Once
 	persistInterval time.Duration
+	dedupWindow     time.Duration
+	seen            map[string]time.Time // Dedup keys and when they were enqueued
+	logger          *logger.Logger
 	mu              sync.Mutex
+
+	// Changes are group committed: each bumps gen under mu and then waits in
+	// commit until a write covering it has reached disk. Writes are made by
+	// one caller at a time under flushMu, outside mu, so a write picks up
+	// every change made while the previous one was being synced.
+	flushMu   sync.Mutex
+	gen       uint64 // Count of changes so far
+	itemsGen  uint64 // Value of gen when the pending items last changed
+	failedGen uint64 // Value of gen when the failed items last changed
+	durable   uint64 // Value of gen the files on disk reflect
 }
 
 type FailedItem struct {
@@ -37,12 +78,34 @@ type FailedItem struct {
 	Retries   int
 }
 
+// Envelope is the SMTP envelope of a queued message
+type Envelope struct {
+	From  string
+	To    string
+	Relay string // Relay chosen for the message, empty for normal routing
+}
+
+// Domain returns the lowercased recipient domain, which partitions the queue
+func (e Envelope) Domain() string {
+	at := strings.LastIndex(e.To, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(e.To[at+1:])
+}
+
 type QueueItem struct {
-	ID        string
+	ID string
+	Envelope
 	Data      []byte
 	Attempts  int
 	NextRetry time.Time
 	CreatedAt time.Time
+	// InFlight marks an item handed out by Dequeue and not yet completed or
+	// retried. It stays on disk so a crash during delivery redelivers it.
+	InFlight bool
+	// LastError is the most recent delivery error, recorded by Retry and Fail
+	LastError string
 }
 
 func NewQueue(config *Config) (*Queue, error) {
@@ -55,115 +118,424 @@ func NewQueue(config *Config) (*Queue, error) {
 		maxRetries:      config.MaxRetries,
 		retryInterval:   config.RetryInterval,
 		maxQueueSize:    config.MaxQueueSize,
+		maxQueueBytes:   config.MaxQueueBytes,
 		persistInterval: config.PersistInterval,
+		dedupWindow:     config.DedupWindow,
+		seen:            make(map[string]time.Time),
 		items:           make([]*QueueItem, 0),
+		persistChannel:  make(chan struct{}),
+		logger:          config.Logger,
 	}
 
 	if err := q.loadFromDisk(); err != nil {
 		return nil, fmt.Errorf("failed to load queue from disk: %w", err)
 	}
+	if q.dedupWindow > 0 {
+		for _, item := range q.items {
+			q.seen[dedupKey(item.Envelope, item.Data)] = item.CreatedAt
+		}
+	}
 
 	go q.startPersistWorker()
 
 	return q, nil
 }
 
-func (q *Queue) Enqueue(data []byte) error {
+// Enqueue adds a message whose delivery has just failed. Its first retry is
+// due after the retry interval.
+func (q *Queue) Enqueue(envelope Envelope, data []byte) error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
-
 	if len(q.items) >= q.maxQueueSize {
-		return errors.New("queue is full")
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	if q.maxQueueBytes > 0 && q.bytes+int64(len(data)) > q.maxQueueBytes {
+		q.mu.Unlock()
+		return ErrQueueBytesExceeded
+	}
+	key := ""
+	if q.dedupWindow > 0 {
+		q.pruneSeen(time.Now())
+		key = dedupKey(envelope, data)
+		if _, ok := q.seen[key]; ok {
+			q.mu.Unlock()
+			return ErrDuplicate
+		}
 	}
 
 	item := &QueueItem{
 		ID:        generateID(),
+		Envelope:  envelope,
 		Data:      data,
 		Attempts:  0,
-		NextRetry: time.Now(),
+		NextRetry: time.Now().Add(q.retryInterval),
 		CreatedAt: time.Now(),
 	}
 
 	q.items = append(q.items, item)
+	q.bytes += int64(len(data))
+	if key != "" {
+		q.seen[key] = item.CreatedAt
+	}
+	gen := q.changedLocked(true, false)
+	q.mu.Unlock()
+
+	if err := q.commit(gen); err != nil {
+		q.mu.Lock()
+		q.removeItem(item.ID)
+		delete(q.seen, key)
+		q.changedLocked(true, false)
+		q.mu.Unlock()
+		return err
+	}
 	return nil
 }
 
 func (q *Queue) startPersistWorker() {
 	ticker := time.NewTicker(q.persistInterval)
 	defer ticker.Stop()
-
-	for range ticker.C {
+	q.log(logger.LogLevelDebug, "Queue persist worker started, writing to %s every %s", q.storagePath, q.persistInterval)
+
+	failing := false
+	for {
+		select {
+		case <-q.persistChannel:
+			q.log(logger.LogLevelDebug, "Queue persist worker stopped")
+			return
+		case <-ticker.C:
+		}
 		if err := q.persistToDisk(); err != nil {
-			// Log error
+			q.log(logger.LogLevelError, "Failed to persist queue: %v", err)
+			failing = true
+		} else if failing {
+			q.log(logger.LogLevelInfo, "Queue persisted to %s again", q.storagePath)
+			failing = false
 		}
 	}
 }
 
+// log writes to the configured logger, if any
+func (q *Queue) log(level logger.LogLevel, format string, args ...interface{}) {
+	if q.logger != nil {
+		q.logger.Log(level, format, args...)
+	}
+}
+
+// Close stops the periodic persist worker and writes the queue to disk a
+// final time. Changes made afterwards are still written as they happen.
+func (q *Queue) Close() error {
+	q.closeOnce.Do(func() { close(q.persistChannel) })
+	return q.persistToDisk()
+}
+
+// minCompactCapacity is the backing array size below which compaction
+// leaves the item slices alone
+const minCompactCapacity = 64
+
+// compactLocked reallocates the item slices once removals have left them
+// with more than twice the capacity they use, so a burst of mail does not
+// pin a large backing array for the life of the process. The caller must
+// hold q.mu.
+func (q *Queue) compactLocked() {
+	if cap(q.items) > minCompactCapacity && cap(q.items) > 2*len(q.items) {
+		q.items = slices.Clone(q.items)
+	}
+	if cap(q.failedItems) > minCompactCapacity && cap(q.failedItems) > 2*len(q.failedItems) {
+		q.failedItems = slices.Clone(q.failedItems)
+	}
+}
+
+// idCounter makes IDs generated within the same nanosecond distinct
+var idCounter atomic.Uint64
+
+// generateID returns a unique item ID made of the creation time, a process
+// wide counter and a random suffix, e.g. "1700000000000000000-42-9f86d081884c7d65"
 func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		// The counter alone keeps IDs unique within this process
+		return fmt.Sprintf("%d-%d", time.Now().UnixNano(), idCounter.Add(1))
+	}
+	return fmt.Sprintf("%d-%d-%s", time.Now().UnixNano(), idCounter.Add(1), hex.EncodeToString(suffix[:]))
 }
 
+// Dequeue hands out the next ready item. The item stays in the queue,
+// marked in flight, until Complete or Retry is called for it.
 func (q *Queue) Dequeue() (*QueueItem, error) {
+	return q.dequeue(func(*QueueItem) bool { return true })
+}
+
+// DequeueDomain is like Dequeue but only hands out items for the given
+// recipient domain, so each domain can be worked on independently
+func (q *Queue) DequeueDomain(domain string) (*QueueItem, error) {
+	return q.dequeue(func(item *QueueItem) bool { return item.Domain() == domain })
+}
+
+// ReadyDomains returns the recipient domains that have items ready for
+// delivery
+func (q *Queue) ReadyDomains() []string {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
 	now := time.Now()
-	for i, item := range q.items {
-		if item.NextRetry.Before(now) {
-			q.items = append(q.items[:i], q.items[i+1:]...)
+	seen := make(map[string]bool)
+	var domains []string
+	for _, item := range q.items {
+		domain := item.Domain()
+		if !item.InFlight && item.NextRetry.Before(now) && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func (q *Queue) dequeue(match func(*QueueItem) bool) (*QueueItem, error) {
+	q.mu.Lock()
+	now := time.Now()
+	for _, item := range q.items {
+		if !item.InFlight && item.NextRetry.Before(now) && match(item) {
+			item.InFlight = true
+			gen := q.changedLocked(true, false)
+			q.mu.Unlock()
+
+			if err := q.commit(gen); err != nil {
+				q.mu.Lock()
+				item.InFlight = false
+				q.changedLocked(true, false)
+				q.mu.Unlock()
+				return nil, err
+			}
 			return item, nil
 		}
 	}
+	q.mu.Unlock()
 
 	return nil, errors.New("no items ready for processing")
 }
 
-func (q *Queue) Retry(item *QueueItem) error {
+// Complete removes a delivered item from the queue
+func (q *Queue) Complete(item *QueueItem) error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	q.removeItem(item.ID)
+	gen := q.changedLocked(true, false)
+	q.mu.Unlock()
+	return q.commit(gen)
+}
 
+// Release returns an in-flight item to the queue without counting an
+// attempt, for deliveries that were interrupted rather than failed
+func (q *Queue) Release(item *QueueItem) error {
+	q.mu.Lock()
+	item.InFlight = false
+	gen := q.changedLocked(true, false)
+	q.mu.Unlock()
+	return q.commit(gen)
+}
+
+// Retry schedules the next attempt of a dequeued item whose delivery failed
+// with lastError, or moves it to the failed items once its retries are
+// exhausted. The error is recorded under the lock, as other goroutines may
+// be reading the item.
+func (q *Queue) Retry(item *QueueItem, lastError string) error {
+	q.mu.Lock()
+	item.InFlight = false
+	if lastError != "" {
+		item.LastError = lastError
+	}
 	if item.Attempts >= q.maxRetries {
-		q.failedItems = append(q.failedItems, FailedItem{
-			Item:      item,
-			Error:     "max retries exceeded",
-			Timestamp: time.Now(),
-			Retries:   item.Attempts,
-		})
-		return errors.New("max retries exceeded")
+		gen := q.failLocked(item, "max retries exceeded")
+		q.mu.Unlock()
+		if err := q.commit(gen); err != nil {
+			return err
+		}
+		return ErrMaxRetriesExceeded
 	}
 
 	item.Attempts++
 	item.NextRetry = time.Now().Add(q.retryInterval)
-	q.items = append(q.items, item)
-	return nil
+	if !q.hasItem(item.ID) {
+		q.items = append(q.items, item)
+		q.bytes += int64(len(item.Data))
+	}
+	gen := q.changedLocked(true, false)
+	q.mu.Unlock()
+	return q.commit(gen)
 }
 
+// Fail moves an item straight to the failed items, for deliveries that
+// failed permanently and are not worth retrying. An item that was never
+// queued, such as a message whose first delivery failed, is given an ID.
+// A non-empty lastError replaces the item's recorded error.
+func (q *Queue) Fail(item *QueueItem, lastError string) error {
+	q.mu.Lock()
+	if lastError != "" {
+		item.LastError = lastError
+	}
+	if item.ID == "" {
+		item.ID = generateID()
+		item.CreatedAt = time.Now()
+	}
+	item.InFlight = false
+	gen := q.failLocked(item, "permanent failure")
+	q.mu.Unlock()
+	return q.commit(gen)
+}
+
+// failLocked moves item to the failed items and returns the change to commit
+func (q *Queue) failLocked(item *QueueItem, reason string) uint64 {
+	q.removeItem(item.ID)
+	if item.LastError != "" {
+		reason += ": " + item.LastError
+	}
+	q.failedItems = append(q.failedItems, FailedItem{
+		Item:      item,
+		Error:     reason,
+		Timestamp: time.Now(),
+		Retries:   item.Attempts,
+	})
+	return q.changedLocked(true, true)
+}
+
+func (q *Queue) hasItem(id string) bool {
+	for _, item := range q.items {
+		if item.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue) removeItem(id string) {
+	for i, item := range q.items {
+		if item.ID == id {
+			// Delete clears the vacated slot so the item's data can be collected
+			q.items = slices.Delete(q.items, i, i+1)
+			q.bytes -= int64(len(item.Data))
+			return
+		}
+	}
+}
+
+// GetFailedItems returns a copy of the failed items
 func (q *Queue) GetFailedItems() []FailedItem {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	return q.failedItems
+
+	failed := make([]FailedItem, len(q.failedItems))
+	for i, failedItem := range q.failedItems {
+		item := *failedItem.Item
+		failedItem.Item = &item
+		failed[i] = failedItem
+	}
+	return failed
 }
 
-func (q *Queue) ClearFailedItems() {
+// ClearFailedItems removes all failed items and returns how many it removed
+func (q *Queue) ClearFailedItems() (int, error) {
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	count := len(q.failedItems)
 	q.failedItems = []FailedItem{}
+	gen := q.changedLocked(false, true)
+	q.mu.Unlock()
+	return count, q.commit(gen)
 }
 
-func (q *Queue) RequeueFailedItem(id string) error {
+// Items returns a copy of the pending items, in flight included
+func (q *Queue) Items() []QueueItem {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
+	items := make([]QueueItem, len(q.items))
+	for i, item := range q.items {
+		items[i] = *item
+	}
+	return items
+}
+
+// QueueItemView is the JSON form of a queued message. It carries the
+// envelope and delivery state but never the message data.
+type QueueItemView struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Relay      string    `json:"relay,omitempty"`
+	Size       int       `json:"size"`
+	Attempts   int       `json:"attempts"`
+	NextRetry  time.Time `json:"next_retry"`
+	AgeSeconds int64     `json:"age_seconds"`
+	InFlight   bool      `json:"in_flight"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// FailedItemView is the JSON form of a message that failed permanently
+type FailedItemView struct {
+	QueueItemView
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func newItemView(item *QueueItem, now time.Time) QueueItemView {
+	return QueueItemView{
+		ID:         item.ID,
+		From:       item.From,
+		To:         item.To,
+		Relay:      item.Relay,
+		Size:       len(item.Data),
+		Attempts:   item.Attempts,
+		NextRetry:  item.NextRetry,
+		AgeSeconds: int64(now.Sub(item.CreatedAt).Seconds()),
+		InFlight:   item.InFlight,
+		LastError:  item.LastError,
+	}
+}
+
+// ListPending returns views of the pending items, in flight included
+func (q *Queue) ListPending() []QueueItemView {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	views := make([]QueueItemView, len(q.items))
+	for i, item := range q.items {
+		views[i] = newItemView(item, now)
+	}
+	return views
+}
+
+// ListFailed returns views of the items that failed permanently
+func (q *Queue) ListFailed() []FailedItemView {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	views := make([]FailedItemView, len(q.failedItems))
+	for i, failedItem := range q.failedItems {
+		views[i] = FailedItemView{
+			QueueItemView: newItemView(failedItem.Item, now),
+			Error:         failedItem.Error,
+			FailedAt:      failedItem.Timestamp,
+		}
+	}
+	return views
+}
+
+func (q *Queue) RequeueFailedItem(id string) error {
+	q.mu.Lock()
 	for i, failedItem := range q.failedItems {
 		if failedItem.Item.ID == id {
 			// Reset attempts and retry immediately
 			failedItem.Item.Attempts = 0
 			failedItem.Item.NextRetry = time.Now()
 			q.items = append(q.items, failedItem.Item)
-			q.failedItems = append(q.failedItems[:i], q.failedItems[i+1:]...)
-			return nil
+			q.bytes += int64(len(failedItem.Item.Data))
+			q.failedItems = slices.Delete(q.failedItems, i, i+1)
+			gen := q.changedLocked(true, true)
+			q.mu.Unlock()
+			return q.commit(gen)
 		}
 	}
+	q.mu.Unlock()
 	return fmt.Errorf("failed item with ID %s not found", id)
 }
 
@@ -181,6 +553,11 @@ func (q *Queue) loadFromDisk() error {
 		if err := json.Unmarshal(data, &q.items); err != nil {
 			return fmt.Errorf("failed to decode queue items: %w", err)
 		}
+		// Deliveries interrupted by a crash are retried
+		for _, item := range q.items {
+			item.InFlight = false
+			q.bytes += int64(len(item.Data))
+		}
 	}
 
 	// Load failed items
@@ -198,34 +575,157 @@ func (q *Queue) loadFromDisk() error {
 	return nil
 }
 
+// persistToDisk compacts the queue and writes it to disk
 func (q *Queue) persistToDisk() error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	q.compactLocked()
+	gen := q.changedLocked(true, true)
+	q.mu.Unlock()
+	return q.commit(gen)
+}
+
+// changedLocked records a change to the pending items, the failed items or
+// both and returns its generation, to be passed to commit once q.mu is
+// released. The caller must hold q.mu.
+func (q *Queue) changedLocked(items, failed bool) uint64 {
+	q.gen++
+	if items {
+		q.itemsGen = q.gen
+	}
+	if failed {
+		q.failedGen = q.gen
+	}
+	return q.gen
+}
+
+// commit returns once the change numbered gen is on disk. Callers that
+// arrive while another write is in progress are usually covered by the next
+// one, so concurrent changes share a single fsync. The caller must not hold
+// q.mu.
+func (q *Queue) commit(gen uint64) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	if q.durable >= gen {
+		q.mu.Unlock()
+		return nil
+	}
+	target := q.gen
+	var itemsData, failedData []byte
+	var err error
+	if q.itemsGen > q.durable {
+		if itemsData, err = json.Marshal(q.items); err != nil {
+			q.mu.Unlock()
+			return fmt.Errorf("failed to encode queue items: %w", err)
+		}
+	}
+	if q.failedGen > q.durable {
+		if failedData, err = json.Marshal(q.failedItems); err != nil {
+			q.mu.Unlock()
+			return fmt.Errorf("failed to encode failed items: %w", err)
+		}
+	}
+	q.mu.Unlock()
 
 	// Create storage directory if it doesn't exist
 	if err := os.MkdirAll(q.storagePath, 0755); err != nil {
 		return fmt.Errorf("failed to create storage directory: %w", err)
 	}
-
-	// Save regular queue items
-	itemsFile := fmt.Sprintf("%s/items.dat", q.storagePath)
-	itemsData, err := json.Marshal(q.items)
-	if err != nil {
-		return fmt.Errorf("failed to encode queue items: %w", err)
+	if itemsData != nil {
+		itemsFile := fmt.Sprintf("%s/items.dat", q.storagePath)
+		if err := writeFileAtomic(itemsFile, itemsData, 0644); err != nil {
+			return fmt.Errorf("failed to save queue items: %w", err)
+		}
 	}
-	if err := os.WriteFile(itemsFile, itemsData, 0644); err != nil {
-		return fmt.Errorf("failed to save queue items: %w", err)
+	if failedData != nil {
+		failedFile := fmt.Sprintf("%s/failed_items.dat", q.storagePath)
+		if err := writeFileAtomic(failedFile, failedData, 0644); err != nil {
+			return fmt.Errorf("failed to save failed items: %w", err)
+		}
 	}
 
-	// Save failed items
-	failedFile := fmt.Sprintf("%s/failed_items.dat", q.storagePath)
-	failedData, err := json.Marshal(q.failedItems)
+	q.mu.Lock()
+	q.durable = target
+	q.mu.Unlock()
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// fsyncs it and renames it over path, so a crash mid-write leaves the
+// previous file intact.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
 	if err != nil {
-		return fmt.Errorf("failed to encode failed items: %w", err)
+		return err
 	}
-	if err := os.WriteFile(failedFile, failedData, 0644); err != nil {
-		return fmt.Errorf("failed to save failed items: %w", err)
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
 	}
 
+	// Persist the rename itself; not supported on every platform
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
 	return nil
 }
+
+// Stats is a point-in-time summary of the queue. Timestamps are zero when
+// there are no matching items.
+type Stats struct {
+	Pending       int       `json:"pending"`   // Items awaiting delivery, in flight included
+	InFlight      int       `json:"in_flight"` // Items currently handed out by Dequeue
+	Failed        int       `json:"failed"`
+	Retries       int       `json:"retries"` // Delivery attempts made so far by pending items
+	Bytes         int64     `json:"bytes"`   // Total message size of pending items
+	OldestPending time.Time `json:"oldest_pending"`
+	OldestFailed  time.Time `json:"oldest_failed"`
+}
+
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := Stats{
+		Pending: len(q.items),
+		Failed:  len(q.failedItems),
+		Bytes:   q.bytes,
+	}
+	for _, item := range q.items {
+		if item.InFlight {
+			stats.InFlight++
+		}
+		stats.Retries += item.Attempts
+		if stats.OldestPending.IsZero() || item.CreatedAt.Before(stats.OldestPending) {
+			stats.OldestPending = item.CreatedAt
+		}
+	}
+	for _, failedItem := range q.failedItems {
+		if stats.OldestFailed.IsZero() || failedItem.Timestamp.Before(stats.OldestFailed) {
+			stats.OldestFailed = failedItem.Timestamp
+		}
+	}
+	return stats
+}
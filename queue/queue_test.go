@@ -0,0 +1,656 @@
+package queue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-relay-server/logger"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, dir string) *Queue {
+	t.Helper()
+	q, err := NewQueue(&Config{
+		StoragePath:     dir,
+		MaxRetries:      2,
+		RetryInterval:   -time.Second, // Retried items are ready at once
+		MaxQueueSize:    100,
+		PersistInterval: time.Hour,
+		DedupWindow:     time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// reopen loads a second queue from q's files without closing q, as a restart
+// after a crash would
+func reopen(t *testing.T, dir string) *Queue {
+	t.Helper()
+	return newTestQueue(t, dir)
+}
+
+func envelope(to string) Envelope {
+	return Envelope{From: "a@example.com", To: to}
+}
+
+func TestEnqueueIsDurable(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir)
+	if err := q.Enqueue(envelope("b@example.org"), []byte("Subject: one\r\n\r\nBody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	items := reopen(t, dir).Items()
+	if len(items) != 1 || items[0].To != "b@example.org" {
+		t.Fatalf("reloaded items %+v, want the enqueued message", items)
+	}
+}
+
+func TestDequeueAndCompleteAreDurable(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir)
+	for _, to := range []string{"b@example.org", "c@example.org"} {
+		if err := q.Enqueue(envelope(to), []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Complete(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The completed item is gone and the one in flight is redelivered
+	items := reopen(t, dir).Items()
+	if len(items) != 1 || items[0].ID != second.ID {
+		t.Fatalf("reloaded %d items, want only %s", len(items), second.ID)
+	}
+}
+
+func TestRetryExhaustionIsDurable(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir)
+	if err := q.Enqueue(envelope("b@example.org"), []byte("Subject: fail\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Retry(item, ""); errors.Is(err, ErrMaxRetriesExceeded) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := reopen(t, dir)
+	if n := len(reloaded.Items()); n != 0 {
+		t.Fatalf("reloaded %d pending items, want 0", n)
+	}
+	if n := len(reloaded.GetFailedItems()); n != 1 {
+		t.Fatalf("reloaded %d failed items, want 1", n)
+	}
+}
+
+func TestConcurrentEnqueues(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir)
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			to := fmt.Sprintf("rcpt%d@example.org", i)
+			errs <- q.Enqueue(envelope(to), []byte("Subject: "+to+"\r\n\r\n"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every caller returned only once its item was on disk
+	if got := len(reopen(t, dir).Items()); got != n {
+		t.Fatalf("reloaded %d items, want %d", got, n)
+	}
+}
+
+func TestEnqueueWriteFailure(t *testing.T) {
+	dir := t.TempDir() + "/queue"
+	q := newTestQueue(t, dir)
+
+	// A file in place of the storage directory makes every write fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("Subject: lost\r\n\r\n")
+	if err := q.Enqueue(envelope("b@example.org"), data); err == nil {
+		t.Fatal("Enqueue succeeded with unwritable storage")
+	}
+	if n := len(q.Items()); n != 0 {
+		t.Fatalf("queue holds %d items after a failed enqueue, want 0", n)
+	}
+
+	// The failed attempt must not count as a duplicate of the next one
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(envelope("b@example.org"), data); err != nil {
+		t.Fatalf("Enqueue after the storage recovered: %v", err)
+	}
+}
+
+// readLogs returns what has been written to the log files in dir
+func readLogs(t *testing.T, dir string) string {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	var b strings.Builder
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(data)
+	}
+	return b.String()
+}
+
+func TestPersistWorkerLogsFailures(t *testing.T) {
+	logDir := t.TempDir()
+	log, err := logger.NewLogger(logger.Config{LogDir: logDir, LogFile: "queue", LogLevel: logger.LogLevelInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir() + "/queue"
+	q, err := NewQueue(&Config{
+		StoragePath:     dir,
+		MaxRetries:      2,
+		MaxQueueSize:    100,
+		PersistInterval: 20 * time.Millisecond,
+		Logger:          log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	waitForLog := func(what string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(readLogs(t, logDir), what) {
+			if time.Now().After(deadline) {
+				t.Fatalf("log never showed %q:\n%s", what, readLogs(t, logDir))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A file in place of the storage directory makes every write fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForLog("[ERROR] Failed to persist queue: ")
+
+	// The recovery is reported once the storage works again
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitForLog("Queue persisted to " + dir + " again")
+	if n := strings.Count(readLogs(t, logDir), "again"); n != 1 {
+		t.Errorf("recovery logged %d times, want once", n)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(&Config{
+		StoragePath:     dir,
+		MaxRetries:      2,
+		MaxQueueSize:    1000,
+		PersistInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	fileSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dir, "items.dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	// Churn through bursts of mail, leaving a few items each time
+	data := []byte(strings.Repeat("x", 256))
+	var peak int64
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 200; i++ {
+			if err := q.Enqueue(envelope(fmt.Sprintf("r%d-%d@example.org", round, i)), data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		peak = max(peak, fileSize())
+		for i := 0; i < 198; i++ {
+			item, err := q.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Complete(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var failedIDs []string
+	for i := 0; i < 150; i++ {
+		item := &QueueItem{Envelope: envelope(fmt.Sprintf("f%d@example.org", i)), Data: data}
+		if err := q.Fail(item, ""); err != nil {
+			t.Fatal(err)
+		}
+		failedIDs = append(failedIDs, item.ID)
+	}
+	for _, id := range failedIDs[2:] {
+		if err := q.RequeueFailedItem(id); err != nil {
+			t.Fatal(err)
+		}
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Complete(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Vacated slots no longer hold the removed items
+	q.mu.Lock()
+	for i, item := range q.items[len(q.items):cap(q.items)] {
+		if item != nil {
+			t.Errorf("slot %d past the end still holds item %s", len(q.items)+i, item.ID)
+		}
+	}
+	q.mu.Unlock()
+
+	if err := q.persistToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	q.mu.Lock()
+	items, failed := len(q.items), len(q.failedItems)
+	itemsCap, failedCap := cap(q.items), cap(q.failedItems)
+	q.mu.Unlock()
+	if items != 4 || failed != 2 {
+		t.Fatalf("queue holds %d pending and %d failed items, want 4 and 2", items, failed)
+	}
+	if itemsCap > minCompactCapacity || failedCap > minCompactCapacity {
+		t.Errorf("backing capacity %d pending and %d failed after compaction, want at most %d", itemsCap, failedCap, minCompactCapacity)
+	}
+	if size := fileSize(); size > peak/20 {
+		t.Errorf("items.dat is %d bytes after churn, peak %d", size, peak)
+	}
+
+	// Compaction keeps every remaining item
+	if n := len(reopen(t, dir).Items()); n != 4 {
+		t.Fatalf("reloaded %d items, want 4", n)
+	}
+}
+
+func TestInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir)
+	for _, to := range []string{"b@example.org", "c@example.org"} {
+		if err := q.Enqueue(envelope(to), []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Fail(item, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of the next write leaves a truncated temp file
+	// next to each good one
+	for _, name := range []string{"items.dat", "failed_items.dat"} {
+		good, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".tmp-1"), good[:len(good)/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := reopen(t, dir)
+	if n := len(reloaded.Items()); n != 1 {
+		t.Fatalf("reloaded %d items, want 1", n)
+	}
+	if n := len(reloaded.GetFailedItems()); n != 1 {
+		t.Fatalf("reloaded %d failed items, want 1", n)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "items.dat")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("file holds %q, %v, want \"new\"", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the directory, want only the target", len(entries))
+	}
+
+	// A write that cannot complete leaves no temp file behind
+	if err := os.Mkdir(filepath.Join(dir, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blocked", "x"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "blocked"), []byte("new"), 0644); err == nil {
+		t.Fatal("replacing a non-empty directory succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%d files in the directory after a failed write, want 2", len(entries))
+	}
+}
+
+func TestUniqueIDs(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			to := fmt.Sprintf("id%d@example.org", i)
+			if err := q.Enqueue(envelope(to), []byte("Subject: same\r\n\r\n")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ids := make(map[string]bool)
+	for _, item := range q.Items() {
+		if ids[item.ID] {
+			t.Fatalf("ID %s handed out twice", item.ID)
+		}
+		ids[item.ID] = true
+	}
+	if len(ids) != n {
+		t.Fatalf("%d distinct IDs, want %d", len(ids), n)
+	}
+
+	// IDs made within the same clock tick still differ
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := generateID()
+		if seen[id] {
+			t.Fatalf("generateID repeated %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestStats(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	if stats := q.Stats(); stats != (Stats{}) {
+		t.Fatalf("empty queue stats %+v, want zero", stats)
+	}
+
+	start := time.Now()
+	var size int64
+	for _, to := range []string{"b@example.org", "c@example.org", "d@example.org"} {
+		data := []byte("Subject: stats " + to + "\r\n\r\nBody\r\n")
+		size += int64(len(data))
+		if err := q.Enqueue(envelope(to), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var items []*QueueItem
+	for i := 0; i < 3; i++ {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	retried, failed := items[0], items[1]
+	if err := q.Retry(retried, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Fail(failed, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := q.Stats()
+	if stats.Pending != 2 || stats.InFlight != 1 || stats.Failed != 1 {
+		t.Errorf("pending %d, in flight %d, failed %d, want 2, 1, 1", stats.Pending, stats.InFlight, stats.Failed)
+	}
+	want := size - int64(len(failed.Data))
+	if stats.Bytes != want {
+		t.Errorf("bytes %d, want %d", stats.Bytes, want)
+	}
+	if stats.Retries < 1 {
+		t.Errorf("retries %d, want at least 1", stats.Retries)
+	}
+	if stats.OldestPending.Before(start) || stats.OldestPending.After(time.Now()) {
+		t.Errorf("oldest pending %v not within the test", stats.OldestPending)
+	}
+	if stats.OldestFailed.IsZero() {
+		t.Error("oldest failed not set")
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	q, err := NewQueue(&Config{
+		StoragePath:     t.TempDir(),
+		MaxRetries:      2,
+		MaxQueueSize:    3,
+		MaxQueueBytes:   1000,
+		PersistInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	large := func(to string) []byte {
+		return []byte("Subject: " + to + "\r\n\r\n" + strings.Repeat("x", 400-len(to)-13))
+	}
+	for _, to := range []string{"b@example.org", "c@example.org"} {
+		if err := q.Enqueue(envelope(to), large(to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Enqueue(envelope("d@example.org"), large("d@example.org")); !errors.Is(err, ErrQueueBytesExceeded) {
+		t.Fatalf("enqueue past the byte limit returned %v, want ErrQueueBytesExceeded", err)
+	}
+
+	// Small messages still fit until the count limit
+	if err := q.Enqueue(envelope("e@example.org"), []byte("Subject: small\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(envelope("f@example.org"), []byte("Subject: small\r\n\r\n")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("enqueue past the count limit returned %v, want ErrQueueFull", err)
+	}
+
+	// Delivered items free their bytes
+	item, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Complete(item); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(envelope("d@example.org"), large("d@example.org")); err != nil {
+		t.Fatalf("enqueue after a delivery freed space: %v", err)
+	}
+	if got := q.Stats().Bytes; got > 1000 {
+		t.Fatalf("queue holds %d bytes, over the limit", got)
+	}
+}
+
+func TestDomainPartitions(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	for _, to := range []string{"a@stuck.test", "b@stuck.test", "c@Healthy.Test"} {
+		if err := q.Enqueue(envelope(to), []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := q.ReadyDomains(); !slices.Equal(got, []string{"stuck.test", "healthy.test"}) {
+		t.Fatalf("ready domains %v, want [stuck.test healthy.test]", got)
+	}
+	stuck, err := q.DequeueDomain("stuck.test")
+	if err != nil || stuck.To != "a@stuck.test" {
+		t.Fatalf("DequeueDomain(stuck.test) = %+v, %v", stuck, err)
+	}
+	healthy, err := q.DequeueDomain("healthy.test")
+	if err != nil || healthy.To != "c@Healthy.Test" {
+		t.Fatalf("DequeueDomain(healthy.test) = %+v, %v", healthy, err)
+	}
+	if _, err := q.DequeueDomain("healthy.test"); err == nil {
+		t.Fatal("DequeueDomain handed out an item of another domain")
+	}
+	// Items in flight do not make their domain ready, others of it do
+	if got := q.ReadyDomains(); !slices.Equal(got, []string{"stuck.test"}) {
+		t.Fatalf("ready domains %v, want [stuck.test]", got)
+	}
+}
+
+func TestListViews(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	secret := "Subject: views\r\n\r\nconfidential body\r\n"
+	if err := q.Enqueue(Envelope{From: "a@example.com", To: "b@example.org", Relay: "smarthost:587"}, []byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(envelope("c@example.org"), []byte(secret+"second\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	inFlight, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := q.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.LastError = "550 no such user"
+	if err := q.Fail(failed, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := q.ListPending()
+	if len(pending) != 1 {
+		t.Fatalf("%d pending views, want 1", len(pending))
+	}
+	view := pending[0]
+	if view.ID != inFlight.ID || view.From != inFlight.From || view.To != inFlight.To || view.Relay != inFlight.Relay ||
+		view.Size != len(inFlight.Data) || !view.InFlight || !view.NextRetry.Equal(inFlight.NextRetry) || view.AgeSeconds < 0 {
+		t.Errorf("pending view %+v does not match item %+v", view, inFlight)
+	}
+
+	failedViews := q.ListFailed()
+	if len(failedViews) != 1 {
+		t.Fatalf("%d failed views, want 1", len(failedViews))
+	}
+	if fv := failedViews[0]; fv.ID != failed.ID || fv.LastError != "550 no such user" ||
+		!strings.Contains(fv.Error, "550 no such user") || fv.FailedAt.IsZero() || fv.InFlight {
+		t.Errorf("failed view %+v does not match item %+v", fv, failed)
+	}
+
+	// The views carry no message data, in any encoding
+	for name, v := range map[string]any{"pending": pending, "failed": failedViews} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "confidential") || strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte(secret))[:16]) ||
+			strings.Contains(strings.ToLower(string(data)), `"data"`) {
+			t.Errorf("%s view leaks the message: %s", name, data)
+		}
+	}
+}
+
+func TestFailedItemsCopy(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	var ids []string
+	for _, to := range []string{"b@example.org", "c@example.org", "d@example.org"} {
+		item := &QueueItem{Envelope: envelope(to), Data: []byte("Subject: " + to + "\r\n\r\n")}
+		if err := q.Fail(item, "550 no such user"); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, item.ID)
+	}
+
+	// Requeueing does not shift or reset a listing taken before
+	failed := q.GetFailedItems()
+	if err := q.RequeueFailedItem(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if failed[i].Item.ID != id {
+			t.Errorf("failed item %d changed to %s, want %s", i, failed[i].Item.ID, id)
+		}
+	}
+	if !failed[0].Item.NextRetry.IsZero() {
+		t.Errorf("listed item was reset by the requeue: next retry %s", failed[0].Item.NextRetry)
+	}
+
+	if count, err := q.ClearFailedItems(); err != nil || count != 2 {
+		t.Errorf("ClearFailedItems() = %d, %v, want 2 removed", count, err)
+	}
+	if count, err := q.ClearFailedItems(); err != nil || count != 0 {
+		t.Errorf("second ClearFailedItems() = %d, %v, want 0 removed", count, err)
+	}
+}
@@ -0,0 +1,146 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often expired results are dropped from the cache
+const sweepInterval = time.Minute
+
+// maxNames bounds the PTR names checked for forward confirmation
+const maxNames = 10
+
+// Resolver is the subset of *net.Resolver used for reverse DNS checks
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Result is the reverse DNS of one IP address
+type Result struct {
+	Names []string // PTR names, without the trailing dot; empty if there are none
+	// Confirmed is the first PTR name whose forward lookup includes the
+	// address (forward-confirmed reverse DNS), or "" if none does
+	Confirmed string
+}
+
+// Name returns the name to report for the address: the confirmed name, else
+// the first PTR name
+func (r Result) Name() string {
+	if r.Confirmed != "" {
+		return r.Confirmed
+	}
+	if len(r.Names) > 0 {
+		return r.Names[0]
+	}
+	return ""
+}
+
+type entry struct {
+	result  Result
+	expires time.Time
+}
+
+// Checker looks up and forward-confirms the PTR records of client IPs and
+// caches the results
+type Checker struct {
+	resolver  Resolver
+	cache     map[string]entry
+	nextSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewChecker(resolver Resolver) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Checker{resolver: resolver, cache: make(map[string]entry)}
+}
+
+// Lookup returns the reverse DNS of ip, remembering it for cacheTTL. An
+// address without PTR records has an empty result. Failures of the PTR
+// lookup other than NXDOMAIN are returned and not cached; a PTR name that
+// fails to resolve is just not confirmed.
+func (c *Checker) Lookup(ctx context.Context, ip net.IP, cacheTTL time.Duration) (Result, error) {
+	key := ip.String()
+	if result, ok := c.cached(key); ok {
+		return result, nil
+	}
+
+	names, err := c.resolver.LookupAddr(ctx, key)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return Result{}, fmt.Errorf("PTR lookup for %s failed: %w", key, err)
+		}
+	}
+
+	var result Result
+	for _, name := range names {
+		if name = strings.TrimSuffix(name, "."); name != "" {
+			result.Names = append(result.Names, name)
+		}
+	}
+	for i, name := range result.Names {
+		if i == maxNames {
+			break
+		}
+		if c.resolvesTo(ctx, name, ip) {
+			result.Confirmed = name
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		// The forward lookups were cut short, so the result is incomplete
+		return result, fmt.Errorf("reverse DNS check for %s timed out: %w", key, ctx.Err())
+	}
+	c.store(key, result, cacheTTL)
+	return result, nil
+}
+
+// resolvesTo reports whether name has an address record for ip
+func (c *Checker) resolvesTo(ctx context.Context, name string, ip net.IP) bool {
+	addrs, err := c.resolver.LookupHost(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) cached(key string) (Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return Result{}, false
+	}
+	return e.result, true
+}
+
+func (c *Checker) store(key string, result Result, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.cache {
+			if now.After(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+		c.nextSweep = now.Add(sweepInterval)
+	}
+	c.cache[key] = entry{result: result, expires: now.Add(ttl)}
+}
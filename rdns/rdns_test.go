@@ -0,0 +1,161 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers PTR and address lookups from tables and counts the
+// PTR lookups. Names without an entry do not exist.
+type fakeResolver struct {
+	ptr     map[string][]string
+	hosts   map[string][]string
+	err     error
+	block   bool // Forward lookups wait for the context to end
+	mu      sync.Mutex
+	lookups int
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, notFound(host)
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func TestLookup(t *testing.T) {
+	resolver := &fakeResolver{
+		ptr: map[string][]string{
+			"192.0.2.1":   {"mail.example.com."},
+			"192.0.2.2":   {"forged.example.com."},
+			"192.0.2.3":   {"other.example.com.", "mx.example.com."},
+			"192.0.2.4":   {"gone.example.com."},
+			"2001:db8::1": {"v6.example.com."},
+		},
+		hosts: map[string][]string{
+			"mail.example.com":   {"192.0.2.1"},
+			"forged.example.com": {"198.51.100.1"},
+			"other.example.com":  {"198.51.100.2"},
+			"mx.example.com":     {"198.51.100.3", "192.0.2.3"},
+			"v6.example.com":     {"2001:db8:0:0::1"},
+		},
+	}
+	c := NewChecker(resolver)
+
+	for _, tt := range []struct {
+		ip        string
+		names     []string
+		confirmed string
+		name      string
+	}{
+		{"192.0.2.1", []string{"mail.example.com"}, "mail.example.com", "mail.example.com"},
+		// A PTR name that resolves elsewhere, or not at all, is not confirmed
+		{"192.0.2.2", []string{"forged.example.com"}, "", "forged.example.com"},
+		{"192.0.2.4", []string{"gone.example.com"}, "", "gone.example.com"},
+		// Any of several PTR names can confirm
+		{"192.0.2.3", []string{"other.example.com", "mx.example.com"}, "mx.example.com", "mx.example.com"},
+		{"2001:db8::1", []string{"v6.example.com"}, "v6.example.com", "v6.example.com"},
+		{"192.0.2.5", nil, "", ""},
+	} {
+		result, err := c.Lookup(context.Background(), net.ParseIP(tt.ip), time.Hour)
+		if err != nil {
+			t.Errorf("Lookup(%s) failed: %v", tt.ip, err)
+			continue
+		}
+		if !slices.Equal(result.Names, tt.names) || result.Confirmed != tt.confirmed || result.Name() != tt.name {
+			t.Errorf("Lookup(%s) = %+v named %q, want names %v confirmed %q", tt.ip, result, result.Name(), tt.names, tt.confirmed)
+		}
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	resolver := &fakeResolver{ptr: map[string][]string{"192.0.2.1": {"mail.example.com."}}}
+	c := NewChecker(resolver)
+
+	// Absent PTR records are cached like present ones
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.5", "192.0.2.5"} {
+		if _, err := c.Lookup(context.Background(), net.ParseIP(ip), 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := resolver.count(); n != 2 {
+		t.Fatalf("resolver was queried %d times, want once per address", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	c.Lookup(context.Background(), net.ParseIP("192.0.2.1"), time.Hour)
+	if n := resolver.count(); n != 3 {
+		t.Fatalf("resolver was queried %d times, want the expired result looked up again", n)
+	}
+}
+
+func TestLookupFailure(t *testing.T) {
+	resolver := &fakeResolver{err: errors.New("server misbehaving")}
+	c := NewChecker(resolver)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Lookup(context.Background(), net.ParseIP("192.0.2.1"), time.Hour); err == nil {
+			t.Fatal("failed PTR lookup returned no error")
+		}
+	}
+	if n := resolver.count(); n != 2 {
+		t.Fatalf("resolver was queried %d times, want each failure retried", n)
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	resolver := &fakeResolver{ptr: map[string][]string{"192.0.2.1": {"slow.example.com."}}, block: true}
+	c := NewChecker(resolver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := c.Lookup(ctx, net.ParseIP("192.0.2.1"), time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Lookup with stalled forward lookups returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Lookup took %s with a 50ms timeout", elapsed)
+	}
+	if result.Name() != "slow.example.com" {
+		t.Errorf("incomplete result %+v, want the PTR name", result)
+	}
+
+	// The incomplete result is not cached
+	resolver.block = false
+	c.Lookup(context.Background(), net.ParseIP("192.0.2.1"), time.Hour)
+	if n := resolver.count(); n != 2 {
+		t.Fatalf("resolver was queried %d times, want the timed out lookup repeated", n)
+	}
+}
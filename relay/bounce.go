@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/queue"
+	"os"
+	"strings"
+	"time"
+)
+
+// sendBounce notifies the envelope sender of a permanently failed item with
+// an RFC 3464 delivery status notification. Messages with a null sender never
+// bounce, and bounces are sent with a null sender themselves, so a bounce
+// that cannot be delivered does not produce another one.
+func sendBounce(ctx context.Context, item *queue.QueueItem, reason string, cfg config.Config) {
+	if item.From == "" {
+		fmt.Printf("Not bouncing failed email %s: null sender\n", item.ID)
+		return
+	}
+
+	msg := NewMessage(buildBounce(item, reason, reportingMTA(cfg), time.Now()))
+	if err := RelayEmail(ctx, msg, "", []string{item.From}, cfg)[0].Err; err != nil {
+		if IsPermanent(err) {
+			fmt.Printf("Bounce for %s to %s was rejected: %v\n", item.ID, item.From, err)
+			return
+		}
+		if err := QueueForRetry(msg, "", "", item.From); err != nil {
+			fmt.Printf("Failed to queue bounce for %s to %s: %v\n", item.ID, item.From, err)
+		}
+		return
+	}
+	fmt.Printf("Sent bounce for %s to %s\n", item.ID, item.From)
+}
+
+// buildBounce returns a multipart/report DSN for the failed item. The
+// original message is represented by its header only.
+func buildBounce(item *queue.QueueItem, reason, mta string, now time.Time) []byte {
+	boundary := randomToken()
+	header, _ := splitHeader(item.Data)
+	header = bytes.TrimRight(normalizeCRLF(header), "\r\n")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", mta)
+	fmt.Fprintf(&b, "To: <%s>\r\n", item.From)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", randomToken(), mta)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", boundary)
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Your message to %s could not be delivered after %d attempts.\r\n\r\n", item.To, item.Attempts)
+	fmt.Fprintf(&b, "%s\r\n\r\n", oneLine(reason))
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", mta)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n\r\n", item.CreatedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", item.To)
+	b.WriteString("Action: failed\r\n")
+	b.WriteString("Status: 5.0.0\r\n")
+	fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", oneLine(reason))
+	fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n\r\n", now.Format(time.RFC1123Z))
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	b.Write(header)
+	b.WriteString("\r\n\r\n")
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// reportingMTA returns the name the relay uses for itself in bounces
+func reportingMTA(cfg config.Config) string {
+	if cfg.Hostname != "" {
+		return cfg.Hostname
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
+}
+
+// oneLine folds a multi-line error into a single header-safe line
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func randomToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
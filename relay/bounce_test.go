@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-relay-server/queue"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func failedItem(from string) *queue.QueueItem {
+	return &queue.QueueItem{
+		ID:        "item-1",
+		Envelope:  queue.Envelope{From: from, To: "b@example.org"},
+		Data:      []byte("From: a@example.com\r\nSubject: Original\r\n\r\nSecret body\r\n"),
+		Attempts:  3,
+		CreatedAt: time.Now().Add(-time.Hour),
+	}
+}
+
+func TestBuildBounce(t *testing.T) {
+	data := buildBounce(failedItem("a@example.com"), "550 5.1.1 No such user\nhere", "relay.test", time.Now())
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("To"); got != "<a@example.com>" {
+		t.Errorf("To %q, want the original sender", got)
+	}
+	if got := msg.Header.Get("From"); !strings.Contains(got, "MAILER-DAEMON@relay.test") {
+		t.Errorf("From %q, want MAILER-DAEMON of the reporting MTA", got)
+	}
+	if got := msg.Header.Get("Auto-Submitted"); got != "auto-replied" {
+		t.Errorf("Auto-Submitted %q, want auto-replied", got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Content-Type %q, want multipart/report for delivery-status", msg.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var types, bodies []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	if len(types) != 3 || !strings.HasPrefix(types[0], "text/plain") ||
+		types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("parts %q, want text/plain, message/delivery-status and text/rfc822-headers", types)
+	}
+
+	for _, field := range []string{
+		"Reporting-MTA: dns; relay.test",
+		"Final-Recipient: rfc822; b@example.org",
+		"Action: failed",
+		"Status: 5.0.0",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user here\r\n",
+	} {
+		if !strings.Contains(bodies[1], field) {
+			t.Errorf("delivery status lacks %q:\n%s", field, bodies[1])
+		}
+	}
+	if !strings.Contains(bodies[2], "Subject: Original") || strings.Contains(string(data), "Secret body") {
+		t.Errorf("bounce should carry the original header only:\n%s", data)
+	}
+}
+
+func TestSendBounce(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+
+	sendBounce(context.Background(), failedItem("a@example.com"), "550 No such user", cfg)
+	messages := upstream.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("upstream received %d messages, want the bounce", len(messages))
+	}
+	if bounce := messages[0]; bounce.From != "" || len(bounce.To) != 1 || bounce.To[0] != "a@example.com" {
+		t.Fatalf("bounce envelope %q -> %v, want <> -> [a@example.com]", bounce.From, bounce.To)
+	}
+
+	// A failed bounce must not bounce again
+	sendBounce(context.Background(), failedItem(""), "550 No such user", cfg)
+	if n := len(upstream.Messages()); n != 1 {
+		t.Fatalf("null sender bounced: upstream received %d messages", n)
+	}
+}
+
+func TestFailPermanentlyBounces(t *testing.T) {
+	q := useQueue(t)
+	upstream := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+	msg := NewMessage(failedItem("").Data)
+
+	if err := FailPermanently(context.Background(), msg, "", "a@example.com", "b@example.org", errors.New("550 No such user"), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := FailPermanently(context.Background(), msg, "", "", "c@example.org", errors.New("550 No such user"), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(q.GetFailedItems()); n != 2 {
+		t.Fatalf("%d failed items, want both messages", n)
+	}
+	messages := upstream.Messages()
+	if len(messages) != 1 || messages[0].To[0] != "a@example.com" {
+		t.Fatalf("upstream received %d messages, want one bounce to a@example.com", len(messages))
+	}
+}
@@ -0,0 +1,223 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dkimHeaders are the headers signed when present, in signing order
+var dkimHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+var (
+	dkimKeys   = make(map[string]*rsa.PrivateKey)
+	dkimKeysMu sync.Mutex
+)
+
+// dkimEnabled reports whether DKIM signing is fully configured
+func dkimEnabled(cfg config.DKIMConfig) bool {
+	return cfg.KeyFile != "" && cfg.Selector != "" && cfg.Domain != ""
+}
+
+// signDKIM prepends a DKIM-Signature header using rsa-sha256 with
+// relaxed/relaxed canonicalization. The returned header uses CRLF line
+// endings; the body is hashed as it streams and left as it is.
+func signDKIM(msg Message, cfg config.DKIMConfig) (Message, error) {
+	key, err := loadDKIMKey(cfg.KeyFile)
+	if err != nil {
+		return msg, err
+	}
+
+	header := normalizeCRLF(msg.Header)
+	bodyHash, err := hashRelaxedBody(msg.Body)
+	if err != nil {
+		return msg, err
+	}
+
+	fields := parseHeaderFields(bytes.TrimSuffix(header, []byte("\r\n\r\n")))
+	var signed []string
+	var hashed bytes.Buffer
+	for _, name := range dkimHeaders {
+		if field, ok := lastField(fields, name); ok {
+			signed = append(signed, strings.ToLower(name))
+			hashed.WriteString(relaxedHeader(field))
+			hashed.WriteString("\r\n")
+		}
+	}
+	if len(signed) == 0 || signed[0] != "from" {
+		return msg, errors.New("message has no From header to sign")
+	}
+
+	signature := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		cfg.Domain, cfg.Selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash))
+	hashed.WriteString(relaxedHeader("DKIM-Signature: " + signature))
+
+	digest := sha256.Sum256(hashed.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return msg, fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature: " + signature + base64.StdEncoding.EncodeToString(sig) + "\r\n")
+	out.Write(header)
+	return Message{Header: out.Bytes(), Body: msg.Body}, nil
+}
+
+func loadDKIMKey(path string) (*rsa.PrivateKey, error) {
+	dkimKeysMu.Lock()
+	defer dkimKeysMu.Unlock()
+
+	if key, ok := dkimKeys[path]; ok {
+		return key, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode DKIM key %s: no PEM block", path)
+	}
+
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = errors.New("only RSA keys are supported")
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM key %s: %w", path, err)
+	}
+
+	dkimKeys[path] = key
+	return key, nil
+}
+
+// normalizeCRLF converts all line endings to CRLF
+func normalizeCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// parseHeaderFields returns the raw header fields, folded lines included
+func parseHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+// lastField returns the bottom-most field with the given name
+func lastField(fields []string, name string) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if colon := strings.Index(fields[i], ":"); colon > 0 &&
+			strings.EqualFold(strings.TrimSpace(fields[i][:colon]), name) {
+			return fields[i], true
+		}
+	}
+	return "", false
+}
+
+// relaxedHeader applies the DKIM relaxed header canonicalization
+func relaxedHeader(field string) string {
+	colon := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimSpace(field[:colon]))
+	value := strings.NewReplacer("\r\n", "").Replace(field[colon+1:])
+	return name + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+// hashRelaxedBody returns the SHA-256 of the body under the DKIM relaxed
+// body canonicalization. Either line ending is accepted. Empty lines are
+// held back until a non-empty line follows, which drops trailing ones.
+func hashRelaxedBody(body Body) ([]byte, error) {
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	br := bufio.NewReader(r)
+	pendingEmpty := 0
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			line = strings.TrimRight(collapseWSP(line), " ")
+			if line == "" {
+				pendingEmpty++
+			} else {
+				io.WriteString(h, strings.Repeat("\r\n", pendingEmpty))
+				io.WriteString(h, line+"\r\n")
+				pendingEmpty = 0
+			}
+		}
+		if err == io.EOF {
+			return h.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message body: %w", err)
+		}
+	}
+}
+
+func collapseWSP(line string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
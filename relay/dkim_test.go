@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"go-relay-server/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDKIMKey writes a new RSA key to a PEM file and returns its path
+func testDKIMKey(t *testing.T) (string, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, &key.PublicKey
+}
+
+// verifyDKIM checks the DKIM-Signature at the top of data the way a
+// receiver would, given the signer's public key
+func verifyDKIM(data []byte, pub *rsa.PublicKey) error {
+	data = normalizeCRLF(data)
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return fmt.Errorf("no header block")
+	}
+	fields := parseHeaderFields(data[:end])
+	body := data[end+4:]
+	if !strings.HasPrefix(fields[0], "DKIM-Signature: ") {
+		return fmt.Errorf("first field is %q, want DKIM-Signature", fields[0])
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.TrimPrefix(fields[0], "DKIM-Signature: "), ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[name] = value
+	}
+
+	bodyHash, err := hashRelaxedBody(bytesBody(body))
+	if err != nil {
+		return err
+	}
+	if got := base64.StdEncoding.EncodeToString(bodyHash); got != tags["bh"] {
+		return fmt.Errorf("body hash %s, signed %s", got, tags["bh"])
+	}
+
+	var hashed strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		field, ok := lastField(fields[1:], name)
+		if !ok {
+			return fmt.Errorf("signed header %s is missing", name)
+		}
+		hashed.WriteString(relaxedHeader(field) + "\r\n")
+	}
+	unsigned := strings.TrimSuffix(fields[0], tags["b"])
+	hashed.WriteString(relaxedHeader(unsigned))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(hashed.String()))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+}
+
+func TestSignDKIM(t *testing.T) {
+	keyFile, pub := testDKIMKey(t)
+	cfg := config.DKIMConfig{KeyFile: keyFile, Selector: "mail", Domain: "example.com"}
+
+	data := []byte("From: Alice <a@example.com>\r\n" +
+		"To: b@example.org\r\n" +
+		"Subject:  A \r\n folded   subject\r\n" +
+		"X-Unsigned: yes\r\n" +
+		"\r\n" +
+		"Hello  there \r\n" +
+		"\r\n\r\n")
+	signed, err := signDKIM(NewMessage(data), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := signed.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDKIM(out, pub); err != nil {
+		t.Fatalf("signature does not verify: %v\n%s", err, out)
+	}
+	header := string(signed.Header)
+	for _, tag := range []string{"d=example.com;", "s=mail;", "h=from:to:subject;"} {
+		if !strings.Contains(header, tag) {
+			t.Errorf("signature lacks %q:\n%s", tag, header)
+		}
+	}
+	if !bytes.HasSuffix(out, data[bytes.Index(data, []byte("\r\n\r\n")):]) {
+		t.Error("body changed by signing")
+	}
+
+	// Relaxed canonicalization tolerates whitespace changes but not content
+	for _, tt := range []struct {
+		name   string
+		tamper func(string) string
+		valid  bool
+	}{
+		{"trailing empty lines", func(s string) string { return s + "\r\n" }, true},
+		{"body whitespace", func(s string) string { return strings.Replace(s, "Hello  there", "Hello there", 1) }, true},
+		{"header case", func(s string) string { return strings.Replace(s, "Subject:", "SUBJECT:", 1) }, true},
+		{"body", func(s string) string { return strings.Replace(s, "Hello", "Goodbye", 1) }, false},
+		{"subject", func(s string) string { return strings.Replace(s, "folded", "changed", 1) }, false},
+		{"unsigned header", func(s string) string { return strings.Replace(s, "X-Unsigned: yes", "X-Unsigned: no", 1) }, true},
+	} {
+		err := verifyDKIM([]byte(tt.tamper(string(out))), pub)
+		if tt.valid && err != nil {
+			t.Errorf("%s: signature no longer verifies: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: tampered message still verifies", tt.name)
+		}
+	}
+}
+
+func TestSignDKIMWithoutFrom(t *testing.T) {
+	keyFile, _ := testDKIMKey(t)
+	cfg := config.DKIMConfig{KeyFile: keyFile, Selector: "mail", Domain: "example.com"}
+	if _, err := signDKIM(NewMessage([]byte("Subject: x\r\n\r\nBody\r\n")), cfg); err == nil {
+		t.Fatal("signed a message without a From header")
+	}
+}
+
+func TestRelayDKIM(t *testing.T) {
+	keyFile, pub := testDKIMKey(t)
+	data := []byte("From: a@example.com\r\nSubject: relayed\r\n\r\nSigned body\r\n")
+
+	upstream := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+	cfg.DKIM = config.DKIMConfig{KeyFile: keyFile, Selector: "mail", Domain: "example.com"}
+	if err := RelayEmail(context.Background(), NewMessage(data), "a@example.com", []string{"b@example.org"}, cfg)[0].Err; err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDKIM(upstream.Messages()[0].Data, pub); err != nil {
+		t.Fatalf("relayed signature does not verify: %v", err)
+	}
+
+	// Without a key the message goes out unsigned
+	cfg.DKIM = config.DKIMConfig{}
+	if err := RelayEmail(context.Background(), NewMessage(data), "a@example.com", []string{"c@example.org"}, cfg)[0].Err; err != nil {
+		t.Fatal(err)
+	}
+	if got := upstream.Messages()[1].Data; bytes.Contains(got, []byte("DKIM-Signature")) {
+		t.Fatalf("unconfigured relay signed the message:\n%s", got)
+	}
+}
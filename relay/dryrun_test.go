@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"context"
+	"go-relay-server/config"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what f prints to standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestDryRun(t *testing.T) {
+	upstream := startUpstream(t)
+	routed := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+	cfg.DomainRouting = map[string]config.RelayList{"example.net": {routed.Addr, "mx"}}
+	cfg.DryRun = true
+
+	msg := NewMessage([]byte("Subject: dry run\r\n\r\nBody\r\n"))
+	var results []RecipientResult
+	output := captureStdout(t, func() {
+		results = RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org", "c@example.net"}, cfg)
+	})
+
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("%s: %v", result.To, result.Err)
+		}
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, want one per recipient", len(results))
+	}
+	if upstream.Connections() != 0 || routed.Connections() != 0 {
+		t.Fatal("dry run connected to a relay")
+	}
+	for _, line := range []string{
+		"Dry run, not relaying email: From=a@example.com, To=b@example.org, Relays=" + upstream.Addr + "\n",
+		"Dry run, not relaying email: From=a@example.com, To=c@example.net, Relays=" + routed.Addr + ",MX\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("routing decision %q not logged:\n%s", strings.TrimSpace(line), output)
+		}
+	}
+}
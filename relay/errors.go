@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"errors"
+	"net/textproto"
+)
+
+// PermanentError is a delivery failure that retrying will not fix, such as a
+// 5xx reply or a domain that does not accept mail
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// TransientError is a delivery failure that may clear up later, such as a
+// 4xx reply, a timeout or a refused connection
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string { return e.Err.Error() }
+func (e *TransientError) Unwrap() error { return e.Err }
+
+// IsPermanent reports whether err is, or wraps, a PermanentError
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// classify wraps a delivery error in a PermanentError when the server
+// answered with a 5xx code and in a TransientError otherwise. Errors that
+// are already classified are returned as they are.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var permanent *PermanentError
+	var transient *TransientError
+	if errors.As(err, &permanent) || errors.As(err, &transient) {
+		return err
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return &PermanentError{Err: err}
+	}
+	return &TransientError{Err: err}
+}
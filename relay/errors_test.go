@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/queue"
+	"go-relay-server/smtptest"
+	"net/textproto"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	permanent := &PermanentError{Err: errors.New("no such domain")}
+	transient := &TransientError{Err: &textproto.Error{Code: 550, Msg: "classified by the caller"}}
+	for _, tt := range []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"550 reply", &textproto.Error{Code: 550, Msg: "No such user"}, true},
+		{"554 reply", fmt.Errorf("DATA: %w", &textproto.Error{Code: 554, Msg: "Rejected"}), true},
+		{"451 reply", &textproto.Error{Code: 451, Msg: "Try again later"}, false},
+		{"refused connection", syscall.ECONNREFUSED, false},
+		{"other error", errors.New("connection reset"), false},
+		{"permanent error", permanent, true},
+		{"transient error", transient, false},
+	} {
+		err := classify(tt.err)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: classified error %v does not wrap the original", tt.name, err)
+		}
+		var asTransient *TransientError
+		if IsPermanent(err) != tt.permanent || errors.As(err, &asTransient) == tt.permanent {
+			t.Errorf("%s: classified as %T, want permanent %v", tt.name, err, tt.permanent)
+		}
+	}
+	if err := classify(permanent); err != permanent {
+		t.Errorf("a classified error was wrapped again: %v", err)
+	}
+	if classify(nil) != nil {
+		t.Error("classify(nil) is not nil")
+	}
+}
+
+func TestRelayErrors(t *testing.T) {
+	rejecting := smtptest.NewUnstartedServer()
+	rejecting.Reply = func(verb, line string) string {
+		if verb == "RCPT" {
+			return "550 No such user here"
+		}
+		return ""
+	}
+	rejecting.Start()
+	t.Cleanup(rejecting.Close)
+
+	msg := NewMessage([]byte("Subject: errors\r\n\r\n"))
+	err := RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, relayTo(rejecting.Addr))[0].Err
+	if !IsPermanent(err) {
+		t.Errorf("550 reply gave %T %v, want a permanent error", err, err)
+	}
+
+	err = RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, relayTo(closedAddr(t)))[0].Err
+	var transient *TransientError
+	if !errors.As(err, &transient) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("refused connection gave %T %v, want a transient error", err, err)
+	}
+}
+
+func TestQueuedErrors(t *testing.T) {
+	q := useQueue(t)
+	rejecting := smtptest.NewUnstartedServer()
+	rejecting.Reply = func(verb, line string) string {
+		if verb == "RCPT" {
+			return "550 No such user here"
+		}
+		return ""
+	}
+	rejecting.Start()
+	t.Cleanup(rejecting.Close)
+	cfg := relayTo(closedAddr(t))
+	cfg.DomainRouting = map[string]config.RelayList{"rejects.test": {rejecting.Addr}}
+
+	// A null sender, so the permanent failure is not bounced
+	for _, to := range []string{"a@rejects.test", "b@down.test"} {
+		if err := q.Enqueue(queue.Envelope{To: to}, []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverQueued(context.Background(), item, cfg)
+	}
+
+	// The rejected item fails at once and the other waits for its retry
+	failed := q.GetFailedItems()
+	if len(failed) != 1 || failed[0].Item.To != "a@rejects.test" || !strings.Contains(failed[0].Error, "550") {
+		t.Fatalf("failed items %+v, want the rejected recipient", failed)
+	}
+	items := q.Items()
+	if len(items) != 1 || items[0].To != "b@down.test" || items[0].Attempts != 1 {
+		t.Fatalf("queued items %+v, want the unreachable recipient retried once", items)
+	}
+}
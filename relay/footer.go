@@ -0,0 +1,282 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"go-relay-server/config"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxPartHeaderBytes bounds the MIME part headers read while looking for
+// the text part of a multipart message
+const maxPartHeaderBytes = 64 << 10
+
+// appendContent adds the configured header line to the message header and
+// the footer to its text body. A text/plain message gets the footer at the
+// end of its body, and a multipart message in its first text/plain part
+// that is not an attachment. Quoted-printable bodies get the footer
+// encoded; base64 bodies and other content types are left alone.
+func appendContent(msg Message, cfg config.AppendConfig) Message {
+	if cfg.Header != "" {
+		msg.Header = insertHeader(msg.Header, cfg.Header)
+	}
+	if cfg.Footer == "" {
+		return msg
+	}
+
+	fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg.Header))).ReadMIMEHeader()
+	if err != nil && len(fields) == 0 {
+		return msg
+	}
+	mediaType, params := contentType(fields)
+	switch {
+	case mediaType == "text/plain":
+		if footer, ok := encodeFooter(cfg.Footer, fields.Get("Content-Transfer-Encoding")); ok {
+			msg.Body = footerBody{body: msg.Body, footer: footer}
+		}
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		msg.Body = multipartFooterBody{body: msg.Body, boundary: params["boundary"], footer: cfg.Footer}
+	}
+	return msg
+}
+
+// insertHeader adds a header line at the end of a header block, before the
+// blank line that ends it, using the line ending of the block's last line
+func insertHeader(header []byte, line string) []byte {
+	eol := "\n"
+	if bytes.HasSuffix(header, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	end := len(header)
+	switch {
+	case bytes.HasSuffix(header, []byte("\r\n\r\n")) || bytes.HasSuffix(header, []byte("\n\n")):
+		end -= len(eol)
+	case len(header) > 0 && !bytes.HasSuffix(header, []byte("\n")):
+		line = eol + line
+	}
+
+	out := make([]byte, 0, len(header)+len(line)+len(eol))
+	out = append(out, header[:end]...)
+	out = append(out, line...)
+	out = append(out, eol...)
+	return append(out, header[end:]...)
+}
+
+// contentType returns the media type of a header, text/plain by default
+func contentType(fields textproto.MIMEHeader) (string, map[string]string) {
+	value := fields.Get("Content-Type")
+	if value == "" {
+		return "text/plain", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// encodeFooter returns the footer to append to a body with the given
+// transfer encoding, preceded by a blank line, or false if it cannot be
+// appended without decoding the body
+func encodeFooter(footer, encoding string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return "\n" + footer + "\n", true
+	case "quoted-printable":
+		var b strings.Builder
+		w := quotedprintable.NewWriter(&b)
+		io.WriteString(w, footer)
+		w.Close()
+		return "\n" + b.String() + "\n", true
+	}
+	return "", false
+}
+
+// footerBody appends a footer to a body, starting it on a new line
+type footerBody struct {
+	body   Body
+	footer string
+}
+
+func (b footerBody) Open() (io.ReadCloser, error) {
+	r, err := b.body.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &footerReader{r: r, footer: b.footer}, nil
+}
+
+type footerReader struct {
+	r      io.ReadCloser
+	footer string
+	last   byte
+	tail   *strings.Reader // Set once r is exhausted
+}
+
+func (f *footerReader) Read(p []byte) (int, error) {
+	if f.tail != nil {
+		return f.tail.Read(p)
+	}
+	n, err := f.r.Read(p)
+	if n > 0 {
+		f.last = p[n-1]
+	}
+	if err == io.EOF {
+		footer := f.footer
+		if f.last != '\n' && f.last != 0 {
+			footer = "\n" + footer
+		}
+		f.tail = strings.NewReader(footer)
+		if n == 0 {
+			return f.tail.Read(p)
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (f *footerReader) Close() error {
+	return f.r.Close()
+}
+
+// multipartFooterBody adds a footer to the first text/plain part of a
+// multipart body, rewriting the body as it streams
+type multipartFooterBody struct {
+	body     Body
+	boundary string
+	footer   string
+}
+
+func (b multipartFooterBody) Open() (io.ReadCloser, error) {
+	r, err := b.body.Open()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		pw.CloseWithError(addPartFooter(pw, bufio.NewReader(r), b.boundary, b.footer))
+	}()
+	return pr, nil
+}
+
+// addPartFooter copies a multipart body from r to w, inserting footer before
+// the delimiter that ends the first suitable text/plain part. Nested
+// multiparts are followed through a stack of boundaries.
+func addPartFooter(w io.Writer, r *bufio.Reader, boundary, footer string) error {
+	boundaries := []string{boundary}
+	pending := "" // Encoded footer waiting for the end of its part
+	done := false
+	lineStart := true
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return err
+		}
+		atLineStart := lineStart
+		lineStart = err == nil
+
+		depth := -1
+		closing := false
+		if atLineStart {
+			depth, closing = matchDelimiter(line, boundaries)
+		}
+		if depth < 0 {
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+			if err == io.EOF {
+				return nil
+			}
+			continue
+		}
+
+		// A delimiter ends the part holding the footer, whatever its level
+		if pending != "" {
+			if _, werr := io.WriteString(w, pending); werr != nil {
+				return werr
+			}
+			pending, done = "", true
+		}
+		if _, werr := w.Write(line); werr != nil {
+			return werr
+		}
+		boundaries = boundaries[:depth+1]
+		if closing {
+			boundaries = boundaries[:depth]
+			if err == io.EOF {
+				return nil
+			}
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+
+		// Copy the part headers and decide what the part is
+		header, herr := copyPartHeader(w, r)
+		if herr != nil {
+			return herr
+		}
+		fields, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+		mediaType, params := contentType(fields)
+		disposition, _, _ := mime.ParseMediaType(fields.Get("Content-Disposition"))
+		switch {
+		case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+			boundaries = append(boundaries, params["boundary"])
+		case mediaType == "text/plain" && !done && disposition != "attachment":
+			if encoded, ok := encodeFooter(footer, fields.Get("Content-Transfer-Encoding")); ok {
+				pending = encoded
+			}
+		}
+	}
+}
+
+// matchDelimiter reports which boundary of the stack, counted from the
+// outermost, a line is a delimiter for, and whether it is the closing one.
+// It returns -1 if the line is not a delimiter.
+func matchDelimiter(line []byte, boundaries []string) (int, bool) {
+	line = bytes.TrimRight(line, " \t\r\n")
+	if !bytes.HasPrefix(line, []byte("--")) {
+		return -1, false
+	}
+	for i := len(boundaries) - 1; i >= 0; i-- {
+		rest, ok := bytes.CutPrefix(line[2:], []byte(boundaries[i]))
+		if !ok {
+			continue
+		}
+		switch string(rest) {
+		case "":
+			return i, false
+		case "--":
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// copyPartHeader copies the header block of a MIME part, up to and including
+// the blank line, and returns it. An overlong block is copied but only its
+// start is returned.
+func copyPartHeader(w io.Writer, r *bufio.Reader) ([]byte, error) {
+	var header []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return nil, err
+		}
+		if _, werr := w.Write(line); werr != nil {
+			return nil, werr
+		}
+		if len(header) < maxPartHeaderBytes {
+			header = append(header, line...)
+		}
+		if err == io.EOF || (err == nil && len(bytes.TrimRight(line, "\r\n")) == 0) {
+			return header, nil
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"context"
+	"go-relay-server/config"
+	"strings"
+	"testing"
+)
+
+const footer = "-- \nThis message is confidential."
+
+// appended returns message with the header line and footer added, with
+// its line endings normalized to LF
+func appended(t *testing.T, message string, cfg config.AppendConfig) string {
+	t.Helper()
+	data, err := appendContent(NewMessage([]byte(message)), cfg).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ReplaceAll(string(data), "\r\n", "\n")
+}
+
+func TestAppendPlain(t *testing.T) {
+	cfg := config.AppendConfig{Footer: footer}
+	for _, tt := range []struct {
+		name, message, want string
+	}{
+		{"plain", "Subject: a\r\n\r\nHello\r\n", "Subject: a\n\nHello\n\n" + footer + "\n"},
+		{"no final newline", "Subject: a\r\n\r\nHello", "Subject: a\n\nHello\n\n" + footer + "\n"},
+		{"empty body", "Subject: a\r\n\r\n", "Subject: a\n\n\n" + footer + "\n"},
+		{"explicit type", "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nHällo\r\n", "Content-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 8bit\n\nHällo\n\n" + footer + "\n"},
+		{"quoted-printable", "Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nH=C3=A4llo\r\n", "Content-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\nH=C3=A4llo\n\n--=20\nThis message is confidential.\n"},
+		// Bodies that cannot take the footer without decoding them
+		{"base64", "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nSGVsbG8=\r\n", "Content-Type: text/plain\nContent-Transfer-Encoding: base64\n\nSGVsbG8=\n"},
+		{"html", "Content-Type: text/html\r\n\r\n<p>Hello</p>\r\n", "Content-Type: text/html\n\n<p>Hello</p>\n"},
+	} {
+		if got := appended(t, tt.message, cfg); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Non-ASCII footers are encoded for quoted-printable bodies
+	got := appended(t, "Content-Transfer-Encoding: quoted-printable\r\n\r\nHello\r\n", config.AppendConfig{Footer: "Vertraulich – bitte löschen"})
+	if !strings.HasSuffix(got, "\n\nVertraulich =E2=80=93 bitte l=C3=B6schen\n") {
+		t.Errorf("quoted-printable footer not encoded: %q", got)
+	}
+}
+
+func TestAppendHeader(t *testing.T) {
+	cfg := config.AppendConfig{Header: "X-Relayed-By: relay1"}
+	for _, tt := range []struct {
+		name, message, want string
+	}{
+		{"end of header", "From: a@example.com\r\nSubject: a\r\n\r\nHello\r\n", "From: a@example.com\r\nSubject: a\r\nX-Relayed-By: relay1\r\n\r\nHello\r\n"},
+		{"LF header", "Subject: a\n\nHello\n", "Subject: a\nX-Relayed-By: relay1\n\nHello\n"},
+		{"no body", "Subject: a\r\n", "Subject: a\r\nX-Relayed-By: relay1\r\n"},
+	} {
+		data, err := appendContent(NewMessage([]byte(tt.message)), cfg).Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestAppendMultipart(t *testing.T) {
+	cfg := config.AppendConfig{Footer: footer}
+	for _, tt := range []struct {
+		name, message, want string
+	}{
+		{
+			"alternative",
+			"Content-Type: multipart/alternative; boundary=\"b1\"\r\n\r\n" +
+				"preamble\r\n" +
+				"--b1\r\nContent-Type: text/plain\r\n\r\nPlain\r\n" +
+				"--b1\r\nContent-Type: text/html\r\n\r\n<p>Html</p>\r\n" +
+				"--b1--\r\n",
+			"Content-Type: multipart/alternative; boundary=\"b1\"\n\n" +
+				"preamble\n" +
+				"--b1\nContent-Type: text/plain\n\nPlain\n\n" + footer + "\n" +
+				"--b1\nContent-Type: text/html\n\n<p>Html</p>\n" +
+				"--b1--\n",
+		},
+		{
+			"nested with attachment",
+			"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+				"--outer\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=notes.txt\r\n\r\nNotes\r\n" +
+				"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+				"--inner\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nPlain=20text\r\n" +
+				"--inner\r\nContent-Type: text/plain\r\n\r\nSecond\r\n" +
+				"--inner--\r\n" +
+				"--outer--\r\n",
+			"Content-Type: multipart/mixed; boundary=outer\n\n" +
+				"--outer\nContent-Type: text/plain\nContent-Disposition: attachment; filename=notes.txt\n\nNotes\n" +
+				"--outer\nContent-Type: multipart/alternative; boundary=inner\n\n" +
+				"--inner\nContent-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\nPlain=20text\n\n--=20\nThis message is confidential.\n" +
+				"--inner\nContent-Type: text/plain\n\nSecond\n" +
+				"--inner--\n" +
+				"--outer--\n",
+		},
+		{
+			"no text part",
+			"Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: text/html\r\n\r\n<p>Html</p>\r\n" +
+				"--b1\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nUGxhaW4=\r\n" +
+				"--b1--\r\n",
+			"Content-Type: multipart/mixed; boundary=b1\n\n" +
+				"--b1\nContent-Type: text/html\n\n<p>Html</p>\n" +
+				"--b1\nContent-Type: text/plain\nContent-Transfer-Encoding: base64\n\nUGxhaW4=\n" +
+				"--b1--\n",
+		},
+		{
+			// A line that merely starts like the delimiter is part content
+			"boundary prefix",
+			"Content-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: text/plain\r\n\r\n--b1x is not a delimiter\r\n" +
+				"--b1--\r\n",
+			"Content-Type: multipart/alternative; boundary=b1\n\n" +
+				"--b1\nContent-Type: text/plain\n\n--b1x is not a delimiter\n\n" + footer + "\n" +
+				"--b1--\n",
+		},
+	} {
+		if got := appended(t, tt.message, cfg); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRelayAppend(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+	cfg.Append = config.AppendConfig{Header: "X-Relayed-By: relay1", Footer: footer}
+
+	msg := NewMessage([]byte("Subject: append\r\n\r\nHello\r\n"))
+	if err := RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, cfg)[0].Err; err != nil {
+		t.Fatal(err)
+	}
+	// The footer goes out with CRLF line endings like the rest
+	want := "Subject: append\r\nX-Relayed-By: relay1\r\n\r\nHello\r\n\r\n-- \r\nThis message is confidential.\r\n"
+	if got := upstream.Messages(); len(got) != 1 || string(got[0].Data) != want {
+		t.Fatalf("upstream received %+v, want %q", got, want)
+	}
+}
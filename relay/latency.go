@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency histograms
+var LatencyBuckets = [...]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts observations per latency bucket without locking
+type histogram struct {
+	buckets [len(LatencyBuckets) + 1]atomic.Uint64 // One per LatencyBuckets entry plus +Inf
+	count   atomic.Uint64
+	sumNano atomic.Uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(LatencyBuckets[:], seconds)
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sumNano.Add(uint64(d))
+}
+
+// Histogram is a snapshot of a latency histogram. Buckets holds the
+// non-cumulative count per LatencyBuckets entry, followed by the count above
+// the last bound.
+type Histogram struct {
+	Buckets []uint64 `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"` // Seconds
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Buckets: make([]uint64, len(h.buckets)),
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sumNano.Load()).Seconds(),
+	}
+	for i := range h.buckets {
+		s.Buckets[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// relayAttempts holds the per-relay outcome counters and attempt latency
+type relayAttempts struct {
+	succeeded atomic.Uint64
+	failed    atomic.Uint64
+	latency   histogram
+}
+
+var (
+	attemptsMu sync.Mutex
+	attempts   = make(map[string]*relayAttempts)
+
+	// deliveryLatency observes how long relayEmail took for delivered
+	// messages, including failover to later relays
+	deliveryLatency histogram
+)
+
+// recordAttempt records one delivery attempt to relay ("MX" for direct
+// delivery)
+func recordAttempt(relay string, d time.Duration, err error) {
+	attemptsMu.Lock()
+	a, ok := attempts[relay]
+	if !ok {
+		a = &relayAttempts{}
+		attempts[relay] = a
+	}
+	attemptsMu.Unlock()
+
+	if err == nil {
+		a.succeeded.Add(1)
+	} else {
+		a.failed.Add(1)
+	}
+	a.latency.observe(d)
+}
+
+// RelayStats is the attempt breakdown for one upstream relay
+type RelayStats struct {
+	Relay     string    `json:"relay"`
+	Succeeded uint64    `json:"succeeded"`
+	Failed    uint64    `json:"failed"`
+	Latency   Histogram `json:"latency"`
+}
+
+// GetRelayStats returns the attempt breakdown per relay, sorted by relay
+func GetRelayStats() []RelayStats {
+	attemptsMu.Lock()
+	defer attemptsMu.Unlock()
+
+	stats := make([]RelayStats, 0, len(attempts))
+	for relay, a := range attempts {
+		stats = append(stats, RelayStats{
+			Relay:     relay,
+			Succeeded: a.succeeded.Load(),
+			Failed:    a.failed.Load(),
+			Latency:   a.latency.snapshot(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Relay < stats[j].Relay })
+	return stats
+}
+
+// GetDeliveryLatency returns the histogram of delivery latency for messages
+// that were relayed
+func GetDeliveryLatency() Histogram {
+	return deliveryLatency.snapshot()
+}
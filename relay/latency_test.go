@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, d := range []time.Duration{
+		10 * time.Millisecond,  // 0.05
+		50 * time.Millisecond,  // 0.05, bounds are inclusive
+		300 * time.Millisecond, // 0.5
+		2 * time.Second,        // 2.5
+		2 * time.Minute,        // +Inf
+	} {
+		h.observe(d)
+	}
+
+	s := h.snapshot()
+	want := make([]uint64, len(LatencyBuckets)+1)
+	want[0], want[3], want[5], want[len(LatencyBuckets)] = 2, 1, 1, 1
+	for i := range want {
+		if s.Buckets[i] != want[i] {
+			t.Errorf("bucket %d = %d, want %d (all: %v)", i, s.Buckets[i], want[i], s.Buckets)
+		}
+	}
+	if s.Count != 5 {
+		t.Errorf("count = %d, want 5", s.Count)
+	}
+	if wantSum := 122.36; s.Sum < wantSum-1e-9 || s.Sum > wantSum+1e-9 {
+		t.Errorf("sum = %g, want %g", s.Sum, wantSum)
+	}
+}
+
+// relayStats returns the attempt breakdown recorded for addr
+func relayStats(addr string) RelayStats {
+	for _, rs := range GetRelayStats() {
+		if rs.Relay == addr {
+			return rs
+		}
+	}
+	return RelayStats{}
+}
+
+func TestRelayAttemptLatency(t *testing.T) {
+	down := closedAddr(t)
+	up := startUpstream(t)
+	delivered := GetDeliveryLatency().Count
+
+	// Each message is tried on the relay that is down before it fails over
+	msg := NewMessage([]byte("Subject: latency\r\n\r\n"))
+	for i := 0; i < 2; i++ {
+		if err := RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, relayTo(down, up.Addr))[0].Err; err != nil {
+			t.Fatalf("relay %d failed: %v", i, err)
+		}
+	}
+
+	if rs := relayStats(down); rs.Succeeded != 0 || rs.Failed != 2 || rs.Latency.Count != 2 {
+		t.Errorf("stats for the relay that is down = %+v, want 2 failed attempts", rs)
+	}
+	if rs := relayStats(up.Addr); rs.Succeeded != 2 || rs.Failed != 0 || rs.Latency.Count != 2 {
+		t.Errorf("stats for the relay that is up = %+v, want 2 successful attempts", rs)
+	}
+	// One delivery observation per message, however many relays it took
+	if got := GetDeliveryLatency().Count - delivered; got != 2 {
+		t.Errorf("delivery latency recorded %d observations, want 2", got)
+	}
+}
@@ -0,0 +1,225 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Body is a message body that can be read again for every delivery attempt
+type Body interface {
+	Open() (io.ReadCloser, error)
+}
+
+// Message is an email to relay. The header block, including the blank line
+// that ends it, is held in memory while the body may be backed by a spool
+// file, so large messages are streamed rather than loaded.
+type Message struct {
+	Header []byte
+	Body   Body
+}
+
+type bytesBody []byte
+
+func (b bytesBody) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// NewMessage returns a message for data held entirely in memory
+func NewMessage(data []byte) Message {
+	header, body := splitHeader(data)
+	return Message{Header: header, Body: bytesBody(body)}
+}
+
+// Bytes reads the whole message into memory, for storing it in the queue
+func (m Message) Bytes() ([]byte, error) {
+	var data bytes.Buffer
+	data.Write(m.Header)
+	body, err := m.Body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if _, err := io.Copy(&data, body); err != nil {
+		return nil, fmt.Errorf("failed to read message body: %w", err)
+	}
+	return data.Bytes(), nil
+}
+
+// splitHeader splits data after the blank line ending the header block,
+// accepting either CRLF or LF line endings. Data without a blank line is
+// all header.
+func splitHeader(data []byte) ([]byte, []byte) {
+	for i := 0; i < len(data); {
+		end := bytes.IndexByte(data[i:], '\n')
+		if end < 0 {
+			break
+		}
+		line := data[i : i+end+1]
+		i += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return data[:i], data[i:]
+		}
+	}
+	return data, nil
+}
+
+// sendMail works like smtp.SendMail but streams the message body instead of
+// taking it as a byte slice, and returns the result for each recipient,
+// parallel to to: a recipient rejected at RCPT does not fail the others.
+// With pooling enabled the connection is kept open afterwards for the next
+// message to the same address. Cancelling ctx closes the connection.
+func sendMail(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg Message, config config.Config) []error {
+	if strings.ContainsAny(from+strings.Join(to, ""), "\r\n") {
+		return failAll(to, &PermanentError{Err: errors.New("smtp: A line must not contain CR or LF")})
+	}
+
+	pooling := config.RelayPool.Size > 0
+	var c *smtp.Client
+	if pooling {
+		c = clients.get(addr, relayPoolIdleTimeout(config.RelayPool))
+	}
+	if c == nil {
+		var err error
+		if c, err = dialClient(ctx, addr, auth, config); err != nil {
+			return failAll(to, err)
+		}
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	errs, err := sendTransaction(c, from, to, msg)
+	if !stop() {
+		// ctx was cancelled and the connection closed under the transaction
+		return errs
+	}
+	if err != nil {
+		c.Close()
+		return errs
+	}
+	if pooling {
+		clients.put(addr, c, config.RelayPool.Size)
+		return errs
+	}
+	c.Quit()
+	return errs
+}
+
+// failAll returns err as the result for every recipient
+func failAll(to []string, err error) []error {
+	errs := make([]error, len(to))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// dialClient connects to addr and prepares the session for mail: STARTTLS
+// is used whenever the server offers it and, with RequireTLS set, the
+// connection fails if it does not. A server that stalls for longer than the
+// command timeout fails the session, as does cancelling ctx.
+func dialClient(ctx context.Context, addr string, auth smtp.Auth, config config.Config) (*smtp.Client, error) {
+	dialTimeout, commandTimeout := relayTimeouts(config.RelayTimeout)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	raw, err := dialRetry(ctx, dialer, addr, config.RelayRetry)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+	conn := &timeoutConn{Conn: raw, timeout: commandTimeout}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := startSession(c, addr, auth, config.UpstreamTLS); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func startSession(c *smtp.Client, addr string, auth smtp.Auth, tlsOpts config.UpstreamTLSConfig) error {
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig, err := upstreamTLSConfig(addr, tlsOpts)
+		if err != nil {
+			return err
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS with %s failed: %w", addr, err)
+		}
+	} else if tlsOpts.RequireTLS {
+		return fmt.Errorf("%s does not offer STARTTLS and upstream TLS is required", addr)
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTransaction sends one message to the recipients the server accepts
+// and returns the result for each of them. The error is set when the session
+// can no longer be used.
+func sendTransaction(c *smtp.Client, from string, to []string, msg Message) ([]error, error) {
+	if err := c.Mail(from); err != nil {
+		return failAll(to, err), err
+	}
+	errs := make([]error, len(to))
+	accepted := 0
+	for i, rcpt := range to {
+		if errs[i] = c.Rcpt(rcpt); errs[i] == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		// Nothing to send, so end the transaction without DATA
+		return errs, c.Reset()
+	}
+
+	if err := sendData(c, msg); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs, err
+	}
+	return errs, nil
+}
+
+// sendData sends the message after the recipients have been accepted
+func sendData(c *smtp.Client, msg Message) error {
+	body, err := msg.Body.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("failed to send message body: %w", err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"net"
+	"sort"
+	"strings"
+)
+
+// mxPort is the port used for direct delivery to MX hosts
+const mxPort = "25"
+
+// dnsResolver is the subset of *net.Resolver used for MX delivery
+type dnsResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolver performs the DNS lookups for MX delivery; tests may replace it
+var resolver dnsResolver = net.DefaultResolver
+
+// isMXTarget reports whether a routing target selects direct MX delivery
+func isMXTarget(target string) bool {
+	return target == "" || strings.EqualFold(target, "mx")
+}
+
+// mxHosts returns the delivery addresses for a domain in MX preference order.
+// A domain without MX records falls back to its own address records.
+func mxHosts(ctx context.Context, domain string) ([]string, error) {
+	records, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("MX lookup for %s failed: %w", domain, err)
+		}
+	}
+
+	if len(records) == 0 {
+		if _, err := resolver.LookupHost(ctx, domain); err != nil {
+			return nil, fmt.Errorf("no MX or address records for %s: %w", domain, err)
+		}
+		return []string{net.JoinHostPort(domain, mxPort)}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Host, ".")
+		// A null MX (RFC 7505) means the domain does not accept mail
+		if host == "" {
+			continue
+		}
+		hosts = append(hosts, net.JoinHostPort(host, mxPort))
+	}
+	if len(hosts) == 0 {
+		return nil, &PermanentError{Err: fmt.Errorf("domain %s does not accept mail", domain)}
+	}
+	return hosts, nil
+}
+
+// deliverMX sends the message directly to each recipient domain's MX hosts,
+// trying each in preference order until one accepts the recipient. It
+// returns the result for each recipient, parallel to to.
+func deliverMX(ctx context.Context, msg Message, from string, to []string, config config.Config) []error {
+	errs := make([]error, len(to))
+	byDomain := make(map[string][]int)
+	var domains []string
+	for i, rcpt := range to {
+		domain := addressDomain(rcpt)
+		if domain == "" {
+			errs[i] = &PermanentError{Err: fmt.Errorf("invalid recipient address %q", rcpt)}
+			continue
+		}
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], i)
+	}
+
+	for _, domain := range domains {
+		pending := byDomain[domain]
+		hosts, err := mxHosts(ctx, domain)
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+			continue
+		}
+
+		var lastErrs []error
+		for _, host := range hosts {
+			if err := ctx.Err(); err != nil {
+				lastErrs = make([]error, len(pending))
+				for j := range lastErrs {
+					lastErrs[j] = err
+				}
+				break
+			}
+			rcpts := make([]string, len(pending))
+			for j, i := range pending {
+				rcpts[j] = to[i]
+			}
+			fmt.Printf("Delivering email to MX %s: From=%s, To=%s\n", host, from, strings.Join(rcpts, ","))
+			lastErrs = sendMail(ctx, host, nil, from, rcpts, msg, config)
+
+			var retry []int
+			var retryErrs []error
+			for j, i := range pending {
+				if lastErrs[j] != nil {
+					retry = append(retry, i)
+					retryErrs = append(retryErrs, lastErrs[j])
+					fmt.Printf("MX %s rejected delivery to %s: %v\n", host, to[i], lastErrs[j])
+				}
+			}
+			pending, lastErrs = retry, retryErrs
+			if len(pending) == 0 {
+				break
+			}
+		}
+		for j, i := range pending {
+			errs[i] = fmt.Errorf("all MX hosts for %s failed: %w", domain, lastErrs[j])
+		}
+	}
+	return errs
+}
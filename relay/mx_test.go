@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+// fakeResolver answers MX and address lookups from maps; names missing from
+// both are not found
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error // Returned by every lookup when set
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// useResolver replaces the resolver for the rest of the test
+func useResolver(t *testing.T, r dnsResolver) {
+	t.Helper()
+	saved := resolver
+	resolver = r
+	t.Cleanup(func() { resolver = saved })
+}
+
+func TestMXHosts(t *testing.T) {
+	useResolver(t, &fakeResolver{
+		mx: map[string][]*net.MX{
+			"multi.test": {
+				{Host: "backup.multi.test.", Pref: 20},
+				{Host: "primary.multi.test.", Pref: 10},
+				{Host: "second.multi.test.", Pref: 10},
+				{Host: "last.multi.test.", Pref: 30},
+			},
+			"nullmx.test": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"a-only.test": {"192.0.2.1"}},
+	})
+
+	for _, test := range []struct {
+		domain    string
+		want      []string
+		permanent bool // Whether the error is a *PermanentError, when want is nil
+	}{
+		// Ordered by preference, keeping the DNS order on a tie
+		{"multi.test", []string{"primary.multi.test:25", "second.multi.test:25", "backup.multi.test:25", "last.multi.test:25"}, false},
+		// Without MX records the domain's own address is used (RFC 5321 5.1)
+		{"a-only.test", []string{"a-only.test:25"}, false},
+		{"nullmx.test", nil, true},
+		{"missing.test", nil, false},
+	} {
+		t.Run(test.domain, func(t *testing.T) {
+			hosts, err := mxHosts(context.Background(), test.domain)
+			if test.want != nil {
+				if err != nil || !slices.Equal(hosts, test.want) {
+					t.Fatalf("mxHosts = %v, %v; want %v", hosts, err, test.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("mxHosts = %v, want an error", hosts)
+			}
+			var permanent *PermanentError
+			if errors.As(err, &permanent) != test.permanent {
+				t.Fatalf("error %v: permanent is %v, want %v", err, !test.permanent, test.permanent)
+			}
+		})
+	}
+}
+
+func TestMXHostsLookupFailure(t *testing.T) {
+	useResolver(t, &fakeResolver{err: &net.DNSError{Err: "server misbehaving", Name: "example.org", IsTemporary: true}})
+	hosts, err := mxHosts(context.Background(), "example.org")
+	if err == nil {
+		t.Fatalf("mxHosts = %v, want an error", hosts)
+	}
+	if IsPermanent(err) {
+		t.Fatalf("a failed lookup is permanent: %v", err)
+	}
+}
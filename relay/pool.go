@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"go-relay-server/config"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// defaultPoolIdleTimeout is how long an unused pooled connection is kept
+const defaultPoolIdleTimeout = 30 * time.Second
+
+// clients holds the idle upstream connections shared by all deliveries
+var clients = &clientPool{idle: make(map[string][]*pooledClient)}
+
+type pooledClient struct {
+	client    *smtp.Client
+	idleSince time.Time
+}
+
+// clientPool keeps idle SMTP sessions per upstream address for reuse
+type clientPool struct {
+	mu   sync.Mutex
+	idle map[string][]*pooledClient
+}
+
+// get returns an idle session for addr that has been reset and is ready for
+// a new transaction, or nil if there is none. Sessions idle for longer than
+// idleTimeout, or that fail the reset, are closed.
+func (p *clientPool) get(addr string, idleTimeout time.Duration) *smtp.Client {
+	for {
+		p.mu.Lock()
+		list := p.idle[addr]
+		if len(list) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		pc := list[len(list)-1]
+		p.idle[addr] = list[:len(list)-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.idleSince) > idleTimeout {
+			pc.client.Close()
+			continue
+		}
+		if err := pc.client.Reset(); err != nil {
+			pc.client.Close()
+			continue
+		}
+		return pc.client
+	}
+}
+
+// put returns a session to the pool, closing it instead when addr already
+// has size idle sessions
+func (p *clientPool) put(addr string, c *smtp.Client, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[addr]) >= size {
+		c.Quit()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], &pooledClient{client: c, idleSince: time.Now()})
+}
+
+// relayPoolIdleTimeout returns the configured idle timeout or the default
+func relayPoolIdleTimeout(cfg config.RelayPoolConfig) time.Duration {
+	if timeout, err := time.ParseDuration(cfg.IdleTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultPoolIdleTimeout
+}
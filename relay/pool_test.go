@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// relayN relays n distinct messages through cfg one after another
+func relayN(t *testing.T, n int, cfg config.Config) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg := NewMessage([]byte(fmt.Sprintf("Subject: pooled %d\r\n\r\nBody\r\n", i)))
+		if err := RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, cfg)[0].Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countCommands(upstream *smtptest.Server, verb string) int {
+	n := 0
+	for _, command := range upstream.Commands() {
+		if strings.HasPrefix(strings.ToUpper(command), verb) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+	cfg.RelayPool = config.RelayPoolConfig{Size: 2}
+	relayN(t, 3, cfg)
+
+	if n := upstream.Connections(); n != 1 {
+		t.Fatalf("upstream saw %d connections for 3 messages, want 1", n)
+	}
+	if n := countCommands(upstream, "RSET"); n != 2 {
+		t.Errorf("%d RSET commands, want one per reuse", n)
+	}
+	if n := len(upstream.Messages()); n != 3 {
+		t.Errorf("upstream received %d messages, want 3", n)
+	}
+}
+
+func TestPoolDisabled(t *testing.T) {
+	upstream := startUpstream(t)
+	relayN(t, 3, relayTo(upstream.Addr))
+
+	if n := upstream.Connections(); n != 3 {
+		t.Fatalf("upstream saw %d connections for 3 messages without pooling, want 3", n)
+	}
+	if n := countCommands(upstream, "QUIT"); n != 3 {
+		t.Errorf("%d QUIT commands, want one per message", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := relayTo(upstream.Addr)
+	cfg.RelayPool = config.RelayPoolConfig{Size: 1, IdleTimeout: "50ms"}
+	relayN(t, 1, cfg)
+	time.Sleep(100 * time.Millisecond)
+	relayN(t, 1, cfg)
+
+	if n := upstream.Connections(); n != 2 {
+		t.Fatalf("upstream saw %d connections, want a new one after the idle timeout", n)
+	}
+}
+
+func TestPoolRecyclesBrokenConnections(t *testing.T) {
+	var refuse atomic.Bool
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "RSET" && refuse.Load() {
+			return "421 Closing connection"
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	cfg := relayTo(upstream.Addr)
+	cfg.RelayPool = config.RelayPoolConfig{Size: 1}
+	relayN(t, 1, cfg)
+	// The pooled session fails its reset, so the next message dials again
+	refuse.Store(true)
+	relayN(t, 1, cfg)
+
+	if n := upstream.Connections(); n != 2 {
+		t.Fatalf("upstream saw %d connections, want a new one after the reset failed", n)
+	}
+	if n := len(upstream.Messages()); n != 2 {
+		t.Fatalf("upstream received %d messages, want 2", n)
+	}
+}
@@ -1,20 +1,48 @@
 package relay
 
 import (
+	"context"
 	"fmt"
 	"go-relay-server/config"
+	"go-relay-server/logger"
 	"go-relay-server/queue"
+	"net"
 	"net/smtp"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	q           *queue.Queue
 	initialized bool
+
+	delivered atomic.Uint64
+	failed    atomic.Uint64
 )
 
-func InitializeQueue(cfg config.Config) error {
+// Stats holds the relay outcome counters since startup
+type Stats struct {
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`
+}
+
+// GetStats returns the current relay outcome counters
+func GetStats() Stats {
+	return Stats{
+		Delivered: delivered.Load(),
+		Failed:    failed.Load(),
+	}
+}
+
+// GetQueue returns the relay queue, or nil if InitializeQueue has not been called
+func GetQueue() *queue.Queue {
+	return q
+}
+
+// InitializeQueue loads the queue from disk. Persist failures and queue
+// worker events are written to log, which may be nil.
+func InitializeQueue(cfg config.Config, log *logger.Logger) error {
 	if initialized {
 		return nil
 	}
@@ -29,12 +57,23 @@ func InitializeQueue(cfg config.Config) error {
 		return fmt.Errorf("invalid persist interval: %w", err)
 	}
 
+	var dedupWindow time.Duration
+	if cfg.Queue.DedupWindow != "" {
+		dedupWindow, err = time.ParseDuration(cfg.Queue.DedupWindow)
+		if err != nil {
+			return fmt.Errorf("invalid dedup window: %w", err)
+		}
+	}
+
 	queueConfig := &queue.Config{
 		StoragePath:     cfg.Queue.StoragePath,
 		MaxRetries:      cfg.Queue.MaxRetries,
 		RetryInterval:   retryInterval,
 		MaxQueueSize:    cfg.Queue.MaxQueueSize,
+		MaxQueueBytes:   cfg.Queue.MaxQueueBytes,
 		PersistInterval: persistInterval,
+		DedupWindow:     dedupWindow,
+		Logger:          log,
 	}
 
 	q, err = queue.NewQueue(queueConfig)
@@ -46,20 +85,240 @@ func InitializeQueue(cfg config.Config) error {
 	return nil
 }
 
-func RelayEmail(data []byte, from, to string, config config.Config) {
-	relayServer := config.DefaultRelay
-	for domain, server := range config.DomainRouting {
-		if strings.Contains(to, domain) { // Fix: Use the imported `strings` package
-			relayServer = server
+// RecipientResult is the outcome of relaying a message to one recipient
+type RecipientResult struct {
+	To  string
+	Err error // nil once a relay accepted the recipient, else a *PermanentError or *TransientError
+}
+
+// RelayEmail delivers the message through the relays routed for the sender
+// and each recipient. Recipients sharing a route are sent in one transaction
+// and the result for every recipient is returned, so a partial failure can
+// be retried for the failed recipients only. Cancelling ctx aborts the
+// delivery, failing the recipients not yet accepted.
+func RelayEmail(ctx context.Context, msg Message, from string, to []string, config config.Config) []RecipientResult {
+	var routes [][]string
+	groups := make(map[string][]string)
+	for _, rcpt := range to {
+		relays := Route(from, rcpt, config)
+		key := strings.Join(relays, ",")
+		if _, ok := groups[key]; !ok {
+			routes = append(routes, relays)
+		}
+		groups[key] = append(groups[key], rcpt)
+	}
+
+	var results []RecipientResult
+	for _, relays := range routes {
+		results = append(results, relayEmail(ctx, relays, msg, from, groups[strings.Join(relays, ",")], config)...)
+	}
+	return results
+}
+
+// Route returns the relays a message is routed to, tried in order; an empty
+// list means direct MX delivery. Sender routing takes precedence over
+// recipient domain routing, which takes precedence over the default relays.
+func Route(from, to string, config config.Config) []string {
+	if relays, ok := routeSender(from, config); ok {
+		return relays
+	}
+	return routeRecipient(to, config)
+}
+
+// routeSender picks the relays for an envelope sender from the sender
+// routing rules. A rule is a full address ("billing@example.com"), a local
+// part ("billing@") or a domain ("example.com", which also matches its
+// subdomains); the full address is preferred over the local part, and the
+// local part over the most specific domain.
+func routeSender(from string, config config.Config) (config.RelayList, bool) {
+	if from == "" || len(config.SenderRouting) == 0 {
+		return nil, false
+	}
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return nil, false
+	}
+	local := strings.ToLower(from[:at+1])
+	domain := addressDomain(from)
+
+	var relays []string
+	matched, rank := "", 0
+	for rule, servers := range config.SenderRouting {
+		r := strings.ToLower(rule)
+		switch {
+		case strings.HasSuffix(r, "@"):
+			if r == local && rank < 2 {
+				relays, rank = servers, 2
+			}
+		case strings.Contains(r, "@"):
+			if r == local+domain {
+				return servers, true
+			}
+		default:
+			if rank == 0 && matchDomain(domain, r) && len(r) > len(matched) {
+				relays, matched = servers, r
+			}
+		}
+	}
+	return relays, rank > 0 || matched != ""
+}
+
+// routeRecipient picks the relays for a recipient from the domain routing
+// rules, preferring the most specific matching rule, or the default relays.
+func routeRecipient(to string, config config.Config) config.RelayList {
+	relays := config.DefaultRelay
+	domain := addressDomain(to)
+	matched := ""
+	for rule, servers := range config.DomainRouting {
+		if matchDomain(domain, rule) && len(rule) > len(matched) {
+			relays = servers
+			matched = rule
+		}
+	}
+	return relays
+}
+
+// addressDomain returns the lowercased domain part of an email address
+func addressDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(address[at+1:], "."))
+}
+
+// matchDomain reports whether domain equals rule or is a subdomain of it
+func matchDomain(domain, rule string) bool {
+	rule = strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(rule, "."), "."))
+	if domain == "" || rule == "" {
+		return false
+	}
+	return domain == rule || strings.HasSuffix(domain, "."+rule)
+}
+
+// RelayEmailVia relays the message through relayServer, bypassing routing,
+// and returns the result for every recipient
+func RelayEmailVia(ctx context.Context, relayServer string, msg Message, from string, to []string, config config.Config) []RecipientResult {
+	return relayEmail(ctx, []string{relayServer}, msg, from, to, config)
+}
+
+// relayEmail tries each relay in order until every recipient has been
+// accepted, passing only the recipients still failing on to the next relay.
+// Recipients no relay accepts get the last error. An empty list means direct
+// MX delivery. The envelope sender is rewritten here, after routing has used
+// the original.
+func relayEmail(ctx context.Context, relays []string, msg Message, from string, to []string, config config.Config) []RecipientResult {
+	if rewritten := rewriteSender(from, config.SenderRewrite); rewritten != from {
+		fmt.Printf("Rewrote envelope sender %s to %s\n", from, rewritten)
+		from = rewritten
+	}
+
+	if config.DryRun {
+		targets := make([]string, len(relays))
+		for i, relayServer := range relays {
+			if isMXTarget(relayServer) {
+				relayServer = "MX"
+			}
+			targets[i] = relayServer
+		}
+		if len(targets) == 0 {
+			targets = []string{"MX"}
+		}
+		fmt.Printf("Dry run, not relaying email: From=%s, To=%s, Relays=%s\n", from, strings.Join(to, ","), strings.Join(targets, ","))
+		results := make([]RecipientResult, len(to))
+		for i, rcpt := range to {
+			results[i] = RecipientResult{To: rcpt}
+		}
+		return results
+	}
+
+	// The footer must be in place before the body hash is computed
+	msg = appendContent(msg, config.Append)
+
+	if dkimEnabled(config.DKIM) {
+		signed, err := signDKIM(msg, config.DKIM)
+		if err != nil {
+			fmt.Printf("Failed to DKIM sign email, relaying unsigned: %v\n", err)
+		} else {
+			msg = signed
+		}
+	}
+
+	if len(relays) == 0 {
+		relays = []string{""}
+	}
+	var results []RecipientResult
+	pending := to
+	var errs []error
+	start := time.Now()
+	for i, relayServer := range relays {
+		if err := ctx.Err(); err != nil {
+			errs = failAll(pending, err)
 			break
 		}
+		attemptStart := time.Now()
+		if isMXTarget(relayServer) {
+			relayServer = "MX"
+			errs = deliverMX(ctx, msg, from, pending, config)
+		} else {
+			fmt.Printf("Relaying email to %s: From=%s, To=%s\n", relayServer, from, strings.Join(pending, ","))
+			errs = sendMail(ctx, relayServer, relayAuth(relayServer, config), from, pending, msg, config)
+		}
+
+		var retry, accepted []string
+		var retryErrs []error
+		for j, rcpt := range pending {
+			if errs[j] == nil {
+				accepted = append(accepted, rcpt)
+				results = append(results, RecipientResult{To: rcpt})
+				continue
+			}
+			retry = append(retry, rcpt)
+			retryErrs = append(retryErrs, errs[j])
+			if i < len(relays)-1 {
+				fmt.Printf("Failed to relay email to %s for %s, trying next relay: %v\n", relayServer, rcpt, errs[j])
+			} else {
+				fmt.Printf("Failed to relay email to %s for %s: %v\n", relayServer, rcpt, errs[j])
+			}
+		}
+
+		// An attempt counts as a success if the relay took any recipient
+		var attemptErr error
+		if len(accepted) == 0 {
+			attemptErr = retryErrs[0]
+		}
+		recordAttempt(relayServer, time.Since(attemptStart), attemptErr)
+		if len(accepted) > 0 {
+			deliveryLatency.observe(time.Since(start))
+			delivered.Add(uint64(len(accepted)))
+			fmt.Printf("Email successfully relayed to %s: To=%s\n", relayServer, strings.Join(accepted, ","))
+		}
+
+		pending, errs = retry, retryErrs
+		if len(pending) == 0 {
+			break
+		}
+	}
+
+	failed.Add(uint64(len(pending)))
+	for j, rcpt := range pending {
+		results = append(results, RecipientResult{To: rcpt, Err: classify(fmt.Errorf("failed to relay email to %s: %w", rcpt, errs[j]))})
+	}
+	return results
+}
+
+// relayAuth returns PLAIN credentials for relays that have them configured,
+// or nil for open relays. smtp.PlainAuth refuses to send the credentials
+// unless the connection is TLS-protected (or to localhost).
+func relayAuth(relayServer string, config config.Config) smtp.Auth {
+	credential, ok := config.RelayCredentials[relayServer]
+	if !ok {
+		return nil
 	}
 
-	fmt.Printf("Relaying email to %s: From=%s, To=%s\n", relayServer, from, to)
-	err := smtp.SendMail(relayServer, nil, from, []string{to}, data)
+	host, _, err := net.SplitHostPort(relayServer)
 	if err != nil {
-		fmt.Printf("Failed to relay email to %s: %v\n", relayServer, err)
-	} else {
-		fmt.Printf("Email successfully relayed to %s\n", relayServer)
+		host = relayServer
 	}
+	return smtp.PlainAuth("", credential.Username, credential.Password, host)
 }
@@ -0,0 +1,270 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"strings"
+	"testing"
+)
+
+// startUpstream starts a mock relay that is closed when the test ends
+func startUpstream(t *testing.T) *smtptest.Server {
+	t.Helper()
+	upstream := smtptest.NewServer()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// relayTo returns a config that relays everything through addrs in order
+func relayTo(addrs ...string) config.Config {
+	return config.Config{DefaultRelay: config.RelayList(addrs)}
+}
+
+func TestDotLinesRoundTrip(t *testing.T) {
+	upstream := startUpstream(t)
+
+	data := []byte("Subject: dots\r\n\r\n" +
+		".leading dot\r\n" +
+		"..two dots\r\n" +
+		".\r\n" +
+		"middle . dot\r\n" +
+		".\r\n")
+	results := RelayEmail(context.Background(), NewMessage(data), "a@example.com", []string{"b@example.org"}, relayTo(upstream.Addr))
+	if err := results[0].Err; err != nil {
+		t.Fatalf("relay failed: %v", err)
+	}
+
+	messages := upstream.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("upstream received %d messages, want 1", len(messages))
+	}
+	if !bytes.Equal(messages[0].Data, data) {
+		t.Fatalf("message changed in transit:\n got %q\nwant %q", messages[0].Data, data)
+	}
+}
+
+// startAuthUpstream starts a mock relay that advertises AUTH
+func startAuthUpstream(t *testing.T) *smtptest.Server {
+	t.Helper()
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Auth = true
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// authCommands returns the AUTH commands upstream received
+func authCommands(upstream *smtptest.Server) []string {
+	var auth []string
+	for _, command := range upstream.Commands() {
+		if strings.HasPrefix(strings.ToUpper(command), "AUTH") {
+			auth = append(auth, command)
+		}
+	}
+	return auth
+}
+
+func TestRelayCredentials(t *testing.T) {
+	withCredentials := startAuthUpstream(t)
+	without := startAuthUpstream(t)
+	cfg := relayTo()
+	cfg.RelayCredentials = map[string]config.RelayCredential{
+		withCredentials.Addr: {Username: "user", Password: "secret"},
+	}
+
+	msg := NewMessage([]byte("Subject: auth\r\n\r\n"))
+	for _, upstream := range []*smtptest.Server{withCredentials, without} {
+		results := RelayEmailVia(context.Background(), upstream.Addr, msg, "a@example.com", []string{"b@example.org"}, cfg)
+		if err := results[0].Err; err != nil {
+			t.Fatalf("relay via %s failed: %v", upstream.Addr, err)
+		}
+	}
+
+	want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+	if auth := authCommands(withCredentials); len(auth) != 1 || auth[0] != want {
+		t.Fatalf("relay with credentials got AUTH commands %q, want [%q]", auth, want)
+	}
+	if auth := authCommands(without); len(auth) != 0 {
+		t.Fatalf("relay without credentials got AUTH commands %q", auth)
+	}
+}
+
+func TestRelayCredentialsWithoutAuthSupport(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := relayTo()
+	cfg.RelayCredentials = map[string]config.RelayCredential{upstream.Addr: {Username: "user", Password: "secret"}}
+
+	results := RelayEmailVia(context.Background(), upstream.Addr, NewMessage([]byte("Subject: auth\r\n\r\n")), "a@example.com", []string{"b@example.org"}, cfg)
+	if results[0].Err == nil {
+		t.Fatal("relay without AUTH accepted a message that needs credentials")
+	}
+	if n := len(upstream.Messages()); n != 0 {
+		t.Fatalf("relay received %d messages without authentication", n)
+	}
+}
+
+func TestRouteByRecipientDomain(t *testing.T) {
+	cfg := relayTo("default:25")
+	cfg.DomainRouting = map[string]config.RelayList{
+		"example.com":      {"example:25"},
+		"mail.example.com": {"mail-example:25"},
+		".Example.ORG.":    {"org:25"},
+		"co":               {"co:25"},
+	}
+
+	for _, test := range []struct {
+		to   string
+		want string
+	}{
+		// Exact matches, ignoring case and a trailing dot
+		{"user@example.com", "example:25"},
+		{"user@EXAMPLE.com.", "example:25"},
+		{"user@example.org", "org:25"},
+		// Subdomains, preferring the most specific rule
+		{"user@eu.example.com", "example:25"},
+		{"user@mail.example.com", "mail-example:25"},
+		{"user@a.mail.example.com", "mail-example:25"},
+		{"user@eu.example.org", "org:25"},
+		// Substrings of a rule that are not subdomains of it
+		{"user@notexample.com", "default:25"},
+		{"user@example.com.evil.test", "default:25"},
+		{"user@example.community", "default:25"},
+		{"user@xmail.example.com", "example:25"},
+		{"user@eco", "default:25"},
+		{"user@example.co", "co:25"},
+		{"no-domain", "default:25"},
+	} {
+		if got := Route("", test.to, cfg); len(got) != 1 || got[0] != test.want {
+			t.Errorf("Route(%q) = %v, want [%s]", test.to, got, test.want)
+		}
+	}
+}
+
+func TestRouteBySender(t *testing.T) {
+	cfg := relayTo("default:25")
+	cfg.DomainRouting = map[string]config.RelayList{"example.org": {"org:25"}}
+	cfg.SenderRouting = map[string]config.RelayList{
+		"billing@example.com": {"billing:25"},
+		"billing@":            {"any-billing:25"},
+		"example.com":         {"example:25"},
+		"eu.example.com":      {"eu:25"},
+	}
+
+	for _, tt := range []struct {
+		from, to string
+		want     string
+	}{
+		// The full address beats the local part, which beats the domain
+		{"billing@example.com", "user@example.net", "billing:25"},
+		{"BILLING@Example.COM", "user@example.net", "billing:25"},
+		{"billing@eu.example.com", "user@example.net", "any-billing:25"},
+		{"billing@other.test", "user@example.net", "any-billing:25"},
+		{"news@example.com", "user@example.net", "example:25"},
+		{"news@eu.example.com", "user@example.net", "eu:25"},
+		{"news@mail.example.com", "user@example.net", "example:25"},
+		// Sender routing takes precedence over recipient routing
+		{"billing@example.com", "user@example.org", "billing:25"},
+		{"news@example.com", "user@example.org", "example:25"},
+		// Without a sender rule the recipient decides
+		{"news@example.community", "user@example.org", "org:25"},
+		{"news@other.test", "user@example.net", "default:25"},
+		{"", "user@example.org", "org:25"},
+	} {
+		if got := Route(tt.from, tt.to, cfg); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("Route(%q, %q) = %v, want [%s]", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestRelayBySender(t *testing.T) {
+	billing := startUpstream(t)
+	recipient := startUpstream(t)
+	cfg := relayTo(closedAddr(t))
+	cfg.DomainRouting = map[string]config.RelayList{"example.org": {recipient.Addr}}
+	cfg.SenderRouting = map[string]config.RelayList{"billing@": {billing.Addr}}
+
+	msg := NewMessage([]byte("Subject: sender routing\r\n\r\n"))
+	for _, from := range []string{"billing@example.com", "news@example.com"} {
+		if err := RelayEmail(context.Background(), msg, from, []string{"b@example.org"}, cfg)[0].Err; err != nil {
+			t.Fatalf("relay from %s failed: %v", from, err)
+		}
+	}
+	if got := billing.Messages(); len(got) != 1 || got[0].From != "billing@example.com" {
+		t.Errorf("billing relay received %+v, want the billing message", got)
+	}
+	if got := recipient.Messages(); len(got) != 1 || got[0].From != "news@example.com" {
+		t.Errorf("recipient domain relay received %+v, want the other message", got)
+	}
+}
+
+// closedAddr returns a loopback address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	upstream := smtptest.NewServer()
+	upstream.Close()
+	return upstream.Addr
+}
+
+func TestFailover(t *testing.T) {
+	data := []byte("Subject: failover\r\n\r\nBody\r\n")
+
+	t.Run("unreachable relay", func(t *testing.T) {
+		second := startUpstream(t)
+		results := RelayEmail(context.Background(), NewMessage(data), "a@example.com", []string{"b@example.org"}, relayTo(closedAddr(t), second.Addr))
+		if err := results[0].Err; err != nil {
+			t.Fatalf("relay failed although the second relay is up: %v", err)
+		}
+		if n := len(second.Messages()); n != 1 {
+			t.Fatalf("second relay received %d messages, want 1", n)
+		}
+	})
+
+	t.Run("rejected recipient", func(t *testing.T) {
+		first := smtptest.NewUnstartedServer()
+		first.Reply = func(verb, line string) string {
+			if verb == "RCPT" && strings.Contains(line, "c@example.org") {
+				return "451 Try again later"
+			}
+			return ""
+		}
+		first.Start()
+		t.Cleanup(first.Close)
+		second := startUpstream(t)
+
+		to := []string{"b@example.org", "c@example.org"}
+		for _, result := range RelayEmail(context.Background(), NewMessage(data), "a@example.com", to, relayTo(first.Addr, second.Addr)) {
+			if result.Err != nil {
+				t.Errorf("%s failed: %v", result.To, result.Err)
+			}
+		}
+		// Only the recipient the first relay refused goes to the second
+		if got := second.Messages(); len(got) != 1 || len(got[0].To) != 1 || got[0].To[0] != "c@example.org" {
+			t.Fatalf("second relay received %+v, want only c@example.org", got)
+		}
+		if got := first.Messages(); len(got) != 1 || len(got[0].To) != 1 || got[0].To[0] != "b@example.org" {
+			t.Fatalf("first relay received %+v, want only b@example.org", got)
+		}
+	})
+
+	t.Run("domain route", func(t *testing.T) {
+		fallback := startUpstream(t)
+		cfg := relayTo(closedAddr(t))
+		cfg.DomainRouting = map[string]config.RelayList{"example.net": {closedAddr(t), fallback.Addr}}
+		if err := RelayEmail(context.Background(), NewMessage(data), "a@example.com", []string{"b@example.net"}, cfg)[0].Err; err != nil {
+			t.Fatalf("relay failed although the domain's second relay is up: %v", err)
+		}
+		if n := len(fallback.Messages()); n != 1 {
+			t.Fatalf("domain's second relay received %d messages, want 1", n)
+		}
+	})
+
+	t.Run("every relay down", func(t *testing.T) {
+		results := RelayEmail(context.Background(), NewMessage(data), "a@example.com", []string{"b@example.org"}, relayTo(closedAddr(t), closedAddr(t)))
+		if results[0].Err == nil {
+			t.Fatal("relay succeeded with no relay up")
+		}
+	})
+}
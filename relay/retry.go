@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"net"
+	"syscall"
+	"time"
+)
+
+// defaultConnectBackoff is the wait before the first connection retry
+const defaultConnectBackoff = time.Second
+
+// dialRetry connects to addr, retrying a refused or reset connection up to
+// connect_retries times with a doubling backoff. These retries happen within
+// one delivery attempt; once they are used up the error is returned and the
+// message is left to the queue's slower retries.
+func dialRetry(ctx context.Context, dialer *net.Dialer, addr string, cfg config.RelayRetryConfig) (net.Conn, error) {
+	backoff := defaultConnectBackoff
+	if value, err := time.ParseDuration(cfg.Backoff); err == nil && value > 0 {
+		backoff = value
+	}
+
+	for retry := 0; ; retry++ {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil || retry >= cfg.ConnectRetries || !transientDialError(err) {
+			return conn, err
+		}
+		fmt.Printf("Connection to %s failed, retrying in %s: %v\n", addr, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// transientDialError reports whether a failed connection is worth retrying
+// straight away: the host is reachable but not accepting connections, as
+// while a relay restarts
+func transientDialError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
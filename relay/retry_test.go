@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"context"
+	"go-relay-server/config"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenLater starts accepting connections on addr after delay, passing them
+// through to upstream. Until then connections to addr are refused.
+func listenLater(t *testing.T, addr, upstream string, delay time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	go func() {
+		defer close(done)
+		time.Sleep(delay)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("listening on %s: %v", addr, err)
+			return
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				backend, err := net.Dial("tcp", upstream)
+				if err != nil {
+					conn.Close()
+					continue
+				}
+				go func() { io.Copy(backend, conn); backend.Close() }()
+				go func() { io.Copy(conn, backend); conn.Close() }()
+			}
+		}()
+	}()
+}
+
+func TestConnectRetry(t *testing.T) {
+	msg := NewMessage([]byte("Subject: connect retry\r\n\r\n"))
+
+	t.Run("relay comes up", func(t *testing.T) {
+		upstream := startUpstream(t)
+		addr := closedAddr(t)
+		listenLater(t, addr, upstream.Addr, 300*time.Millisecond)
+		cfg := relayTo(addr)
+		cfg.RelayRetry = config.RelayRetryConfig{ConnectRetries: 5, Backoff: "200ms"}
+
+		var results []RecipientResult
+		start := time.Now()
+		output := captureStdout(t, func() {
+			results = RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, cfg)
+		})
+		if err := results[0].Err; err != nil {
+			t.Fatalf("relay failed although it came up within the retries: %v\n%s", err, output)
+		}
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Errorf("delivered after %v, before the relay was up", elapsed)
+		}
+		// Refused at 0 and 200ms, accepted at 600ms
+		if n := strings.Count(output, "retrying in"); n != 2 {
+			t.Errorf("%d connection retries logged, want 2:\n%s", n, output)
+		}
+		if n := len(upstream.Messages()); n != 1 {
+			t.Fatalf("upstream received %d messages, want 1", n)
+		}
+	})
+
+	t.Run("retries used up", func(t *testing.T) {
+		cfg := relayTo(closedAddr(t))
+		cfg.RelayRetry = config.RelayRetryConfig{ConnectRetries: 2, Backoff: "50ms"}
+
+		var results []RecipientResult
+		start := time.Now()
+		output := captureStdout(t, func() {
+			results = RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, cfg)
+		})
+		elapsed := time.Since(start)
+		if results[0].Err == nil {
+			t.Fatal("relay succeeded with nothing listening")
+		}
+		// The queue retries later, so the failure stays transient
+		if IsPermanent(results[0].Err) {
+			t.Errorf("refused connection reported as permanent: %v", results[0].Err)
+		}
+		// Waits of 50ms and then 100ms
+		if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("gave up after %v, want about 150ms", elapsed)
+		}
+		if n := strings.Count(output, "retrying in"); n != 2 {
+			t.Errorf("%d connection retries logged, want 2:\n%s", n, output)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := relayTo(closedAddr(t))
+		output := captureStdout(t, func() {
+			if RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, cfg)[0].Err == nil {
+				t.Error("relay succeeded with nothing listening")
+			}
+		})
+		if strings.Contains(output, "retrying in") {
+			t.Errorf("connection retried with connect_retries unset:\n%s", output)
+		}
+	})
+}
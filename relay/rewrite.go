@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"go-relay-server/config"
+	"strings"
+)
+
+// rewriteSender returns the envelope sender to relay with under the
+// sender_rewrite rule. {local} and {domain} in the rule address are replaced
+// with the parts of the original sender. The null sender and senders in a
+// skipped domain are left unchanged.
+func rewriteSender(from string, rule config.SenderRewriteConfig) string {
+	if rule.Address == "" || from == "" {
+		return from
+	}
+	domain := addressDomain(from)
+	for _, skip := range rule.SkipDomains {
+		if matchDomain(domain, skip) {
+			return from
+		}
+	}
+
+	local := from
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		local = from[:at]
+	}
+	return strings.NewReplacer("{local}", local, "{domain}", domain).Replace(rule.Address)
+}
@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"go-relay-server/config"
+	"slices"
+	"testing"
+)
+
+func TestRewriteSender(t *testing.T) {
+	rule := config.SenderRewriteConfig{
+		Address:     "bounces+{local}={domain}@relay.example.net",
+		SkipDomains: []string{"relay.example.net", "internal.test"},
+	}
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{"user@example.com", "bounces+user=example.com@relay.example.net"},
+		{"first.last@Mail.Example.COM", "bounces+first.last=mail.example.com@relay.example.net"},
+		// Our own domain and skipped domains keep the sender
+		{"someone@relay.example.net", "someone@relay.example.net"},
+		{"app@internal.test", "app@internal.test"},
+		{"app@eu.internal.test", "app@eu.internal.test"},
+		{"app@notinternal.test", "bounces+app=notinternal.test@relay.example.net"},
+		// The null sender of bounces is never rewritten
+		{"", ""},
+	} {
+		if got := rewriteSender(tt.from, rule); got != tt.want {
+			t.Errorf("rewriteSender(%q) = %q, want %q", tt.from, got, tt.want)
+		}
+	}
+
+	fixed := config.SenderRewriteConfig{Address: "bounces@relay.example.net"}
+	if got := rewriteSender("user@example.com", fixed); got != "bounces@relay.example.net" {
+		t.Errorf("fixed rewrite gave %q", got)
+	}
+	if got := rewriteSender("user@example.com", config.SenderRewriteConfig{}); got != "user@example.com" {
+		t.Errorf("rewrite without an address gave %q", got)
+	}
+}
+
+func TestRelaySenderRewrite(t *testing.T) {
+	routed := startUpstream(t)
+	cfg := relayTo(closedAddr(t))
+	cfg.SenderRewrite = config.SenderRewriteConfig{Address: "bounces+{local}={domain}@relay.example.net"}
+	// Routing still sees the original sender
+	cfg.SenderRouting = map[string]config.RelayList{"example.com": {routed.Addr}}
+
+	data := []byte("From: user@example.com\r\nSubject: rewrite\r\n\r\nBody\r\n")
+	to := []string{"b@example.org", "c@example.org"}
+	for _, result := range RelayEmail(context.Background(), NewMessage(data), "user@example.com", to, cfg) {
+		if result.Err != nil {
+			t.Fatalf("relay to %s failed: %v", result.To, result.Err)
+		}
+	}
+
+	messages := routed.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("upstream received %d messages, want 1", len(messages))
+	}
+	if got := messages[0].From; got != "bounces+user=example.com@relay.example.net" {
+		t.Errorf("envelope sender %q, want the rewritten address", got)
+	}
+	if !slices.Equal(messages[0].To, to) {
+		t.Errorf("recipients %v, want %v", messages[0].To, to)
+	}
+	// Only the envelope changes, not the message
+	if !bytes.Equal(messages[0].Data, data) {
+		t.Errorf("message changed:\n got %q\nwant %q", messages[0].Data, data)
+	}
+}
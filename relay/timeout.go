@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"go-relay-server/config"
+	"net"
+	"time"
+)
+
+const (
+	// defaultDialTimeout bounds connecting to a relay or MX host
+	defaultDialTimeout = 30 * time.Second
+	// defaultCommandTimeout bounds each read or write on a relay session
+	defaultCommandTimeout = 5 * time.Minute
+)
+
+// relayTimeouts returns the configured dial and command timeouts, or the
+// defaults
+func relayTimeouts(cfg config.RelayTimeoutConfig) (dial, command time.Duration) {
+	dial, command = defaultDialTimeout, defaultCommandTimeout
+	if timeout, err := time.ParseDuration(cfg.Dial); err == nil && timeout > 0 {
+		dial = timeout
+	}
+	if timeout, err := time.ParseDuration(cfg.Command); err == nil && timeout > 0 {
+		command = timeout
+	}
+	return dial, command
+}
+
+// timeoutConn renews its deadline before every read and write, so each phase
+// of the SMTP session must make progress within the timeout. smtp.Client has
+// no deadlines of its own.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"context"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"net"
+	"testing"
+	"time"
+)
+
+// silentUpstream accepts connections but never says anything
+func silentUpstream(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRelayTimeout(t *testing.T) {
+	// An upstream that answers the greeting but stalls on DATA
+	release := make(chan struct{})
+	stalled := smtptest.NewUnstartedServer()
+	stalled.Reply = func(verb, line string) string {
+		if verb == "DATA" {
+			<-release
+		}
+		return ""
+	}
+	stalled.Start()
+	t.Cleanup(stalled.Close)
+	t.Cleanup(func() { close(release) })
+
+	for name, addr := range map[string]string{
+		"no greeting":  silentUpstream(t),
+		"stalled DATA": stalled.Addr,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := relayTo(addr)
+			cfg.RelayTimeout = config.RelayTimeoutConfig{Dial: "1s", Command: "200ms"}
+
+			start := time.Now()
+			results := RelayEmail(context.Background(), NewMessage([]byte("Subject: timeout\r\n\r\n")), "a@example.com", []string{"b@example.org"}, cfg)
+			elapsed := time.Since(start)
+			if results[0].Err == nil {
+				t.Fatal("relay to a stalled upstream succeeded")
+			}
+			if IsPermanent(results[0].Err) {
+				t.Errorf("timeout reported as permanent: %v", results[0].Err)
+			}
+			if elapsed < 200*time.Millisecond || elapsed > 3*time.Second {
+				t.Errorf("relay gave up after %v, want about the 200ms command timeout", elapsed)
+			}
+		})
+	}
+}
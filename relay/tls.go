@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go-relay-server/config"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	caPools   = make(map[string]*x509.CertPool)
+	caPoolsMu sync.Mutex
+)
+
+// upstreamTLSConfig returns the TLS settings used for STARTTLS to addr
+func upstreamTLSConfig(addr string, cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCAPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	caPoolsMu.Lock()
+	defer caPoolsMu.Unlock()
+
+	if pool, ok := caPools[path]; ok {
+		return pool, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+
+	caPools[path] = pool
+	return pool, nil
+}
@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"slices"
+	"testing"
+)
+
+// startTLSUpstream starts a mock relay offering STARTTLS with cert
+func startTLSUpstream(t *testing.T, cert *smtptest.Cert) *smtptest.Server {
+	t.Helper()
+	upstream := smtptest.NewUnstartedServer()
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS}}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	cert := smtptest.SelfSigned("127.0.0.1")
+	caFile, _ := cert.WriteFiles(t.TempDir(), "ca")
+	msg := NewMessage([]byte("Subject: tls\r\n\r\nBody\r\n"))
+
+	for _, tt := range []struct {
+		name     string
+		tls      bool // Whether the upstream offers STARTTLS
+		opts     config.UpstreamTLSConfig
+		delivers bool
+	}{
+		{"trusted certificate", true, config.UpstreamTLSConfig{CAFile: caFile}, true},
+		{"trusted certificate, TLS required", true, config.UpstreamTLSConfig{CAFile: caFile, RequireTLS: true}, true},
+		{"untrusted certificate", true, config.UpstreamTLSConfig{}, false},
+		{"untrusted certificate, verification off", true, config.UpstreamTLSConfig{InsecureSkipVerify: true}, true},
+		{"no STARTTLS", false, config.UpstreamTLSConfig{}, true},
+		{"no STARTTLS, TLS required", false, config.UpstreamTLSConfig{RequireTLS: true}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream *smtptest.Server
+			if tt.tls {
+				upstream = startTLSUpstream(t, cert)
+			} else {
+				upstream = startUpstream(t)
+			}
+			cfg := relayTo(upstream.Addr)
+			cfg.UpstreamTLS = tt.opts
+
+			err := RelayEmail(context.Background(), msg, "a@example.com", []string{"b@example.org"}, cfg)[0].Err
+			if tt.delivers && err != nil {
+				t.Fatalf("delivery failed: %v", err)
+			}
+			if !tt.delivers && err == nil {
+				t.Fatal("delivery succeeded")
+			}
+			if n := len(upstream.Messages()); !tt.delivers && n != 0 {
+				t.Fatalf("upstream received %d messages", n)
+			}
+			if started := slices.Contains(upstream.Commands(), "STARTTLS"); started != tt.tls {
+				t.Errorf("STARTTLS sent: %v, want %v", started, tt.tls)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/queue"
+	"sync"
+	"time"
+)
+
+// queueScanInterval is how often the worker looks for items due for retry
+const queueScanInterval = time.Second
+
+var (
+	workerMu     sync.Mutex
+	workerStop   context.CancelFunc // Stops dispatching new domains
+	workerCancel context.CancelFunc // Aborts deliveries in progress
+	workerWG     sync.WaitGroup
+)
+
+// QueueForRetry stores a message whose delivery failed in the queue.
+// relayServer is the relay the message was routed to explicitly, or "" for
+// normal routing.
+func QueueForRetry(msg Message, relayServer, from, to string) error {
+	if q == nil {
+		return errors.New("queue is not initialized")
+	}
+
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(queue.Envelope{From: from, To: to, Relay: relayServer}, data)
+}
+
+// FailPermanently records a message whose delivery to one recipient failed
+// permanently in the failed items, without queueing it for retry, and
+// bounces it to the sender
+func FailPermanently(ctx context.Context, msg Message, relayServer, from, to string, reason error, config config.Config) error {
+	if q == nil {
+		return errors.New("queue is not initialized")
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	item := &queue.QueueItem{
+		Envelope: queue.Envelope{From: from, To: to, Relay: relayServer},
+		Data:     data,
+	}
+	if err := q.Fail(item, reason.Error()); err != nil {
+		return err
+	}
+	sendBounce(ctx, item, reason.Error(), config)
+	return nil
+}
+
+// StartQueueWorker retries queued items in the background until
+// StopQueueWorker is called. Each recipient domain is worked on by its own
+// goroutine, so a domain whose relay is down does not hold up the others.
+// currentConfig is called for every delivery so reloaded settings apply.
+func StartQueueWorker(currentConfig func() config.Config) {
+	workerMu.Lock()
+	defer workerMu.Unlock()
+
+	if q == nil || workerCancel != nil {
+		return
+	}
+	var deliverCtx, scanCtx context.Context
+	deliverCtx, workerCancel = context.WithCancel(context.Background())
+	scanCtx, workerStop = context.WithCancel(deliverCtx)
+
+	workerWG.Add(1)
+	go dispatch(scanCtx, deliverCtx, currentConfig)
+}
+
+// StopQueueWorker stops the queue worker and waits for it to exit. Domains
+// already being worked on may go on delivering their due items for up to
+// drainTimeout; deliveries still in progress then are aborted, and those
+// items stay queued without using up a retry.
+func StopQueueWorker(drainTimeout time.Duration) {
+	workerMu.Lock()
+	stop, cancel := workerStop, workerCancel
+	workerStop, workerCancel = nil, nil
+	workerMu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	stop()
+
+	done := make(chan struct{})
+	go func() {
+		workerWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		fmt.Printf("Queue drain timeout of %s reached, aborting deliveries in progress\n", drainTimeout)
+		cancel()
+		<-done
+	}
+	cancel()
+}
+
+// CloseQueue writes the queue to disk a final time once the queue worker has
+// stopped. Sessions still finishing can queue messages afterwards; those are
+// written as they are queued.
+func CloseQueue() error {
+	if q == nil {
+		return nil
+	}
+	if err := q.Close(); err != nil {
+		return fmt.Errorf("failed to persist queue: %w", err)
+	}
+	return nil
+}
+
+// dispatch starts a worker for every domain with items due and no worker
+// until scanCtx is cancelled. Each domain worker delivers one item at a time,
+// so with queue.max_concurrency set no more workers than that are started.
+// The domain workers run under deliverCtx, so they can finish after
+// dispatching has stopped.
+func dispatch(scanCtx, ctx context.Context, currentConfig func() config.Config) {
+	defer workerWG.Done()
+
+	var mu sync.Mutex
+	active := make(map[string]bool)
+
+	ticker := time.NewTicker(queueScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-scanCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		limit := currentConfig().Queue.MaxConcurrency
+		for _, domain := range q.ReadyDomains() {
+			mu.Lock()
+			busy := active[domain]
+			full := limit > 0 && len(active) >= limit
+			if !busy && !full {
+				active[domain] = true
+			}
+			mu.Unlock()
+			if full {
+				break
+			}
+			if busy {
+				continue
+			}
+
+			workerWG.Add(1)
+			go func(domain string) {
+				defer workerWG.Done()
+				drainDomain(ctx, domain, currentConfig)
+				mu.Lock()
+				delete(active, domain)
+				mu.Unlock()
+			}(domain)
+		}
+	}
+}
+
+// drainDomain delivers the due items for one domain until none are left
+func drainDomain(ctx context.Context, domain string, currentConfig func() config.Config) {
+	for ctx.Err() == nil {
+		item, err := q.DequeueDomain(domain)
+		if err != nil {
+			return
+		}
+		deliverQueued(ctx, item, currentConfig())
+	}
+}
+
+func deliverQueued(ctx context.Context, item *queue.QueueItem, config config.Config) {
+	msg := NewMessage(item.Data)
+
+	// Each item holds a single recipient
+	var results []RecipientResult
+	if item.Relay != "" {
+		results = RelayEmailVia(ctx, item.Relay, msg, item.From, []string{item.To}, config)
+	} else {
+		results = RelayEmail(ctx, msg, item.From, []string{item.To}, config)
+	}
+	err := results[0].Err
+
+	// A delivery cut short by shutdown says nothing about the item
+	if err != nil && ctx.Err() != nil {
+		if err := q.Release(item); err != nil {
+			fmt.Printf("Failed to release queued item %s: %v\n", item.ID, err)
+		}
+		return
+	}
+
+	if err == nil {
+		if err := q.Complete(item); err != nil {
+			fmt.Printf("Failed to remove delivered item %s from queue: %v\n", item.ID, err)
+		}
+		return
+	}
+
+	// The item is still shared with the queue, so the queue records the error
+	lastError := err.Error()
+	if IsPermanent(err) {
+		if err := q.Fail(item, lastError); err != nil {
+			fmt.Printf("Failed to move queued item %s to the failed items: %v\n", item.ID, err)
+		}
+		fmt.Printf("Queued email %s to %s failed permanently: %s\n", item.ID, item.To, lastError)
+		sendBounce(ctx, item, lastError, config)
+		return
+	}
+	if err := q.Retry(item, lastError); err != nil {
+		fmt.Printf("Queued email %s to %s failed permanently: %v\n", item.ID, item.To, err)
+		if errors.Is(err, queue.ErrMaxRetriesExceeded) {
+			sendBounce(ctx, item, lastError, config)
+		}
+	}
+}
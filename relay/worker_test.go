@@ -0,0 +1,317 @@
+package relay
+
+import (
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/queue"
+	"go-relay-server/smtptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useQueue replaces the package queue with an empty one for the rest of
+// the test
+func useQueue(t *testing.T) *queue.Queue {
+	t.Helper()
+	return useQueueIn(t, t.TempDir())
+}
+
+// useQueueIn is useQueue with the queue stored in dir
+func useQueueIn(t *testing.T, dir string) *queue.Queue {
+	t.Helper()
+	testQueue, err := queue.NewQueue(&queue.Config{
+		StoragePath:     dir,
+		MaxRetries:      3,
+		RetryInterval:   -time.Second, // Queued items are due at once
+		MaxQueueSize:    100,
+		PersistInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := q
+	q = testQueue
+	t.Cleanup(func() {
+		testQueue.Close()
+		q = previous
+	})
+	return testQueue
+}
+
+// waitFor polls cond until it holds or a few seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStuckDomainDoesNotBlockOthers(t *testing.T) {
+	q := useQueue(t)
+
+	// The stuck domain's relay accepts the connection but never answers DATA
+	release := make(chan struct{})
+	stuck := smtptest.NewUnstartedServer()
+	stuck.Reply = func(verb, line string) string {
+		if verb == "DATA" {
+			<-release
+		}
+		return ""
+	}
+	stuck.Start()
+	t.Cleanup(stuck.Close)
+	t.Cleanup(func() { close(release) })
+	healthy := startUpstream(t)
+
+	cfg := relayTo(healthy.Addr)
+	cfg.DomainRouting = map[string]config.RelayList{"stuck.test": {stuck.Addr}}
+	// Queued first, so a single worker would reach it first
+	for _, to := range []string{"a@stuck.test", "b@stuck.test", "c@healthy.test", "d@healthy.test"} {
+		if err := q.Enqueue(queue.Envelope{From: "a@example.com", To: to}, []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	StartQueueWorker(func() config.Config { return cfg })
+	t.Cleanup(func() { StopQueueWorker(0) })
+
+	waitFor(t, "delivery to the healthy domain", func() bool { return len(healthy.Messages()) == 2 })
+	if stats := q.Stats(); stats.Pending != 2 || stats.InFlight != 1 {
+		t.Fatalf("queue %+v, want the stuck domain's two items with one in flight", stats)
+	}
+}
+
+// slowUpstream starts a mock relay that answers DATA once release is closed
+func slowUpstream(t *testing.T, release <-chan struct{}) *smtptest.Server {
+	t.Helper()
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "DATA" {
+			<-release
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// reloadItems returns the items a queue loaded from dir would start with
+func reloadItems(t *testing.T, dir string) []queue.QueueItem {
+	t.Helper()
+	reloaded, err := queue.NewQueue(&queue.Config{StoragePath: dir, MaxQueueSize: 100, PersistInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	return reloaded.Items()
+}
+
+func TestStopQueueWorkerDrains(t *testing.T) {
+	dir := t.TempDir()
+	q := useQueueIn(t, dir)
+	release := make(chan struct{})
+	upstream := slowUpstream(t, release)
+	cfg := relayTo(upstream.Addr)
+	if err := q.Enqueue(queue.Envelope{From: "a@example.com", To: "b@example.org"}, []byte("Subject: drain\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	StartQueueWorker(func() config.Config { return cfg })
+	waitFor(t, "the delivery to start", func() bool { return q.Stats().InFlight == 1 })
+
+	// The delivery in progress finishes within the drain timeout
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+	StopQueueWorker(5 * time.Second)
+	if n := len(upstream.Messages()); n != 1 {
+		t.Fatalf("relay received %d messages during the drain, want 1", n)
+	}
+	if err := CloseQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if items := reloadItems(t, dir); len(items) != 0 {
+		t.Fatalf("queue on disk holds %+v after the drain, want nothing", items)
+	}
+}
+
+func TestStopQueueWorkerAborts(t *testing.T) {
+	dir := t.TempDir()
+	q := useQueueIn(t, dir)
+	release := make(chan struct{})
+	cfg := relayTo(slowUpstream(t, release).Addr)
+	t.Cleanup(func() { close(release) })
+	if err := q.Enqueue(queue.Envelope{From: "a@example.com", To: "b@example.org"}, []byte("Subject: abort\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	StartQueueWorker(func() config.Config { return cfg })
+	waitFor(t, "the delivery to start", func() bool { return q.Stats().InFlight == 1 })
+
+	start := time.Now()
+	StopQueueWorker(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("StopQueueWorker took %s with a 100ms drain timeout", elapsed)
+	}
+	if err := CloseQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The aborted delivery stays queued without using up a retry
+	items := reloadItems(t, dir)
+	if len(items) != 1 || items[0].InFlight || items[0].Attempts != 0 {
+		t.Fatalf("queue on disk holds %+v, want the item back in the queue", items)
+	}
+}
+
+func TestCloseQueuePersists(t *testing.T) {
+	dir := t.TempDir()
+	q := useQueueIn(t, dir)
+	if err := q.Enqueue(queue.Envelope{From: "a@example.com", To: "b@example.org"}, []byte("Subject: close\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Only the final write can bring the file back
+	if err := os.Remove(filepath.Join(dir, "items.dat")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CloseQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if items := reloadItems(t, dir); len(items) != 1 || items[0].To != "b@example.org" {
+		t.Fatalf("queue on disk holds %+v after CloseQueue, want the queued item", items)
+	}
+}
+
+// concurrencyUpstream starts a mock relay that holds each DATA for a moment
+// and returns a function reporting the most DATA commands it held at once
+func concurrencyUpstream(t *testing.T) (*smtptest.Server, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	current, peak := 0, 0
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "DATA" {
+			mu.Lock()
+			current++
+			peak = max(peak, current)
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			current--
+			mu.Unlock()
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return peak
+	}
+}
+
+func TestQueueConcurrencyLimit(t *testing.T) {
+	for _, limit := range []int{0, 2} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			q := useQueue(t)
+			upstream, peak := concurrencyUpstream(t)
+			cfg := relayTo(upstream.Addr)
+			cfg.Queue.MaxConcurrency = limit
+
+			const domains, perDomain = 4, 3
+			for i := 0; i < domains; i++ {
+				for j := 0; j < perDomain; j++ {
+					to := fmt.Sprintf("user%d@domain%d.test", j, i)
+					if err := q.Enqueue(queue.Envelope{From: "a@example.com", To: to}, []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			StartQueueWorker(func() config.Config { return cfg })
+			t.Cleanup(func() { StopQueueWorker(0) })
+			waitFor(t, "every delivery", func() bool { return len(upstream.Messages()) == domains*perDomain })
+
+			got := peak()
+			switch {
+			case limit > 0 && got > limit:
+				t.Fatalf("%d deliveries ran at once, above the limit of %d", got, limit)
+			case limit > 0 && got < limit:
+				t.Fatalf("only %d deliveries ran at once with a limit of %d", got, limit)
+			case limit == 0 && got <= 2:
+				t.Fatalf("only %d deliveries ran at once without a limit", got)
+			}
+		})
+	}
+}
+
+func TestQueuedErrorsRecordedUnderLock(t *testing.T) {
+	q := useQueue(t)
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "RCPT" {
+			return "451 Try again later"
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	cfg := relayTo(upstream.Addr)
+
+	// Two domains are retried by their own workers while the queue is
+	// read and written from outside, as the handlers and admin API do
+	for _, to := range []string{"b@one.test", "c@two.test"} {
+		if err := q.Enqueue(queue.Envelope{From: "a@example.com", To: to}, []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	StartQueueWorker(func() config.Config { return cfg })
+	t.Cleanup(func() { StopQueueWorker(0) })
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			q.Items()
+			q.ListPending()
+			q.Stats()
+			if i < 50 {
+				q.Enqueue(queue.Envelope{From: "a@example.com", To: fmt.Sprintf("d%d@three.test", i)}, []byte(fmt.Sprintf("Subject: %d\r\n\r\n", i)))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	waitFor(t, "both domains to fail", func() bool {
+		failed := 0
+		for _, item := range q.ListFailed() {
+			if item.To == "b@one.test" || item.To == "c@two.test" {
+				failed++
+			}
+		}
+		return failed == 2
+	})
+	close(done)
+	readers.Wait()
+
+	for _, item := range q.ListFailed() {
+		if !strings.Contains(item.LastError, `451 "Try again later"`) {
+			t.Errorf("failed item to %s records %q, want the last delivery error", item.To, item.LastError)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-relay-server/queue"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Message is a stored message with the envelope to submit it with
+type Message struct {
+	Name string // Where the message came from, for reporting
+	From string
+	To   []string
+	Data []byte
+}
+
+// Envelope is the sidecar file "<message>.json" that overrides the envelope
+// read from the message headers
+type Envelope struct {
+	From *string  `json:"from"` // null keeps the header sender, "" is the null sender
+	To   []string `json:"to"`
+}
+
+// Load reads the messages stored in path. A queue file (items.dat or
+// failed_items.dat) yields every item with its queued envelope. Any other
+// file is a raw RFC 5322 message whose envelope is taken from the sidecar
+// file if there is one, and otherwise from its Return-Path or From header and
+// its To, Cc and Bcc headers.
+func Load(path string) ([]Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".dat") {
+		return loadQueueFile(path, data)
+	}
+
+	msg := Message{Name: path, Data: data}
+	from, to, err := headerEnvelope(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	msg.From, msg.To = from, to
+
+	sidecar, err := os.ReadFile(path + ".json")
+	if err == nil {
+		var env Envelope
+		if err := json.Unmarshal(sidecar, &env); err != nil {
+			return nil, fmt.Errorf("failed to decode %s.json: %w", path, err)
+		}
+		if env.From != nil {
+			msg.From = *env.From
+		}
+		if len(env.To) > 0 {
+			msg.To = env.To
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if len(msg.To) == 0 {
+		return nil, fmt.Errorf("%s: no recipients in the headers or a sidecar file", path)
+	}
+	return []Message{msg}, nil
+}
+
+// queueFileItem decodes both queue items and failed items, which wrap the
+// queue item in Item
+type queueFileItem struct {
+	queue.QueueItem
+	Item *queue.QueueItem
+}
+
+func loadQueueFile(path string, data []byte) ([]Message, error) {
+	var items []queueFileItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to decode queue file %s: %w", path, err)
+	}
+	msgs := make([]Message, 0, len(items))
+	for _, entry := range items {
+		item := &entry.QueueItem
+		if entry.Item != nil {
+			item = entry.Item
+		}
+		msgs = append(msgs, Message{
+			Name: path + ":" + item.ID,
+			From: item.From,
+			To:   []string{item.To},
+			Data: item.Data,
+		})
+	}
+	return msgs, nil
+}
+
+// headerEnvelope takes the envelope from the message headers. Return-Path
+// is preferred as the sender because it records the original envelope
+// sender, including the null sender of bounces.
+func headerEnvelope(data []byte) (string, []string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	var from string
+	if returnPath := strings.TrimSpace(m.Header.Get("Return-Path")); returnPath != "" {
+		from = strings.TrimSuffix(strings.TrimPrefix(returnPath, "<"), ">")
+	} else if header := m.Header.Get("From"); header != "" {
+		addr, err := mail.ParseAddress(header)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid From header: %w", err)
+		}
+		from = addr.Address
+	}
+
+	var to []string
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		if m.Header.Get(name) == "" {
+			continue
+		}
+		addrs, err := m.Header.AddressList(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s header: %w", name, err)
+		}
+		for _, addr := range addrs {
+			to = append(to, addr.Address)
+		}
+	}
+	return from, to, nil
+}
+
+// Submit sends msg to the relay's own SMTP listener at addr, so it goes
+// through the same checks, routing and queueing as any received message. It
+// returns the recipients that were accepted; those the relay rejects are
+// skipped and their errors returned in rejected. STARTTLS is used when
+// offered; the certificate is not verified, since addr is the relay itself.
+// auth may be nil.
+func Submit(addr, helo string, auth smtp.Auth, msg Message) (accepted []string, rejected []error, err error) {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+
+	if err := c.Hello(helo); err != nil {
+		return nil, nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		host, _, _ := net.SplitHostPort(addr)
+		if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+			return nil, nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := c.Mail(msg.From); err != nil {
+		return nil, nil, err
+	}
+	for _, rcpt := range msg.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			rejected = append(rejected, fmt.Errorf("recipient %s rejected: %w", rcpt, err))
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		return nil, rejected, errors.New("no recipient was accepted")
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return nil, rejected, err
+	}
+	if _, err := w.Write(msg.Data); err != nil {
+		return nil, rejected, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, rejected, err
+	}
+	c.Quit()
+	return accepted, rejected, nil
+}
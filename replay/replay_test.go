@@ -0,0 +1,214 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"go-relay-server/queue"
+	"go-relay-server/smtptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sample = "Return-Path: <bounces@example.com>\r\n" +
+	"From: Alice <alice@example.com>\r\n" +
+	"To: Bob <bob@example.org>, carol@example.org\r\n" +
+	"Cc: dave@example.net\r\n" +
+	"Bcc: <eve@example.net>\r\n" +
+	"Subject: replayed\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+// writeFile writes content to name in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadOne loads path, which must hold a single message
+func loadOne(t *testing.T, path string) Message {
+	t.Helper()
+	msgs, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("%s holds %d messages, want 1", path, len(msgs))
+	}
+	return msgs[0]
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	allTo := []string{"bob@example.org", "carol@example.org", "dave@example.net", "eve@example.net"}
+
+	msg := loadOne(t, writeFile(t, dir, "sample.eml", sample))
+	if msg.From != "bounces@example.com" || !slices.Equal(msg.To, allTo) {
+		t.Errorf("envelope %s %v, want the Return-Path and every recipient header", msg.From, msg.To)
+	}
+	if string(msg.Data) != sample {
+		t.Errorf("data %q, want the file unchanged", msg.Data)
+	}
+
+	for _, tt := range []struct {
+		name, content string
+		from          string
+		to            []string
+	}{
+		{"from header", strings.Replace(sample, "Return-Path: <bounces@example.com>\r\n", "", 1), "alice@example.com", allTo},
+		{"null return path", strings.Replace(sample, "<bounces@example.com>", "<>", 1), "", allTo},
+		{"to only", "From: alice@example.com\r\nTo: bob@example.org\r\n\r\nHello\r\n", "alice@example.com", []string{"bob@example.org"}},
+	} {
+		msg := loadOne(t, writeFile(t, dir, tt.name+".eml", tt.content))
+		if msg.From != tt.from || !slices.Equal(msg.To, tt.to) {
+			t.Errorf("%s: envelope %q %v, want %q %v", tt.name, msg.From, msg.To, tt.from, tt.to)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, content string
+		err           string
+	}{
+		{"no recipients", "From: alice@example.com\r\n\r\nHello\r\n", "no recipients"},
+		{"bad from", "From: not an address\r\nTo: bob@example.org\r\n\r\n", "invalid From header"},
+		{"bad cc", "From: alice@example.com\r\nTo: bob@example.org\r\nCc: <unterminated\r\n\r\n", "invalid Cc header"},
+	} {
+		if _, err := Load(writeFile(t, dir, tt.name+".eml", tt.content)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing.eml")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestLoadSidecar(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		sidecar string
+		from    string
+		to      []string
+	}{
+		{`{"from": "ops@example.com", "to": ["frank@example.org"]}`, "ops@example.com", []string{"frank@example.org"}},
+		{`{"from": ""}`, "", []string{"bob@example.org", "carol@example.org", "dave@example.net", "eve@example.net"}},
+		{`{"from": null, "to": ["frank@example.org"]}`, "bounces@example.com", []string{"frank@example.org"}},
+	} {
+		path := writeFile(t, dir, "sample.eml", sample)
+		writeFile(t, dir, "sample.eml.json", tt.sidecar)
+		msg := loadOne(t, path)
+		if msg.From != tt.from || !slices.Equal(msg.To, tt.to) {
+			t.Errorf("sidecar %s: envelope %q %v, want %q %v", tt.sidecar, msg.From, msg.To, tt.from, tt.to)
+		}
+	}
+
+	// A sidecar supplies recipients a message without headers lacks
+	path := writeFile(t, dir, "bare.eml", "Subject: bare\r\n\r\nHello\r\n")
+	writeFile(t, dir, "bare.eml.json", `{"from": "ops@example.com", "to": ["frank@example.org"]}`)
+	if msg := loadOne(t, path); msg.From != "ops@example.com" || !slices.Equal(msg.To, []string{"frank@example.org"}) {
+		t.Errorf("bare message envelope %q %v", msg.From, msg.To)
+	}
+
+	writeFile(t, dir, "bare.eml.json", `{"to": "frank@example.org"}`)
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "bare.eml.json") {
+		t.Errorf("malformed sidecar: got error %v", err)
+	}
+}
+
+func TestLoadQueueFiles(t *testing.T) {
+	dir := t.TempDir()
+	q, err := queue.NewQueue(&queue.Config{StoragePath: dir, MaxRetries: 3, RetryInterval: time.Hour, MaxQueueSize: 10, PersistInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"bob@example.org", "carol@example.org"} {
+		if err := q.Enqueue(queue.Envelope{From: "alice@example.com", To: to}, []byte("Subject: "+to+"\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed := &queue.QueueItem{Envelope: queue.Envelope{To: "dave@example.net"}, Data: []byte("Subject: bounce\r\n\r\n")}
+	if err := q.Fail(failed, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := Load(filepath.Join(dir, "items.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("items.dat holds %d messages, want 2", len(msgs))
+	}
+	for i, to := range []string{"bob@example.org", "carol@example.org"} {
+		if msgs[i].From != "alice@example.com" || !slices.Equal(msgs[i].To, []string{to}) || string(msgs[i].Data) != "Subject: "+to+"\r\n\r\n" {
+			t.Errorf("item %d is %+v, want the message queued for %s", i, msgs[i], to)
+		}
+		if !strings.HasPrefix(msgs[i].Name, filepath.Join(dir, "items.dat")+":") {
+			t.Errorf("item %d is named %q, want the file and item ID", i, msgs[i].Name)
+		}
+	}
+
+	msg := loadOne(t, filepath.Join(dir, "failed_items.dat"))
+	if msg.From != "" || !slices.Equal(msg.To, []string{"dave@example.net"}) || msg.Name != filepath.Join(dir, "failed_items.dat")+":"+failed.ID {
+		t.Errorf("failed item is %+v, want the bounce to dave@example.net", msg)
+	}
+
+	if _, err := Load(writeFile(t, dir, "broken.dat", "not json")); err == nil || !strings.Contains(err.Error(), "failed to decode queue file") {
+		t.Errorf("broken queue file: got error %v", err)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	cert := smtptest.SelfSigned("relay.test", "127.0.0.1")
+	relay := smtptest.NewUnstartedServer()
+	relay.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS}}
+	relay.Reply = func(verb, line string) string {
+		if verb == "RCPT" && strings.Contains(line, "<carol@") {
+			return "550 No such user"
+		}
+		return ""
+	}
+	relay.Start()
+	t.Cleanup(relay.Close)
+
+	msg := Message{Name: "sample", From: "bounces@example.com", To: []string{"bob@example.org", "carol@example.org"}, Data: []byte(sample)}
+	accepted, rejected, err := Submit(relay.Addr, "replay.test", nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(accepted, []string{"bob@example.org"}) {
+		t.Errorf("accepted %v, want bob@example.org", accepted)
+	}
+	if len(rejected) != 1 || !strings.Contains(rejected[0].Error(), "carol@example.org rejected: 550") {
+		t.Errorf("rejected %v, want carol@example.org", rejected)
+	}
+
+	messages := relay.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("relay received %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if got.From != "bounces@example.com" || !slices.Equal(got.To, []string{"bob@example.org"}) || !bytes.Equal(got.Data, []byte(sample)) {
+		t.Errorf("relay received %+v, want the sample with its envelope", got)
+	}
+	if !slices.Contains(relay.Commands(), "STARTTLS") {
+		t.Error("STARTTLS was offered but not used")
+	}
+
+	// Nothing is sent when every recipient is rejected
+	msg.To = []string{"carol@example.org"}
+	if _, rejected, err := Submit(relay.Addr, "replay.test", nil, msg); err == nil || len(rejected) != 1 {
+		t.Errorf("submit with every recipient rejected = %v, %v", rejected, err)
+	}
+	if n := len(relay.Messages()); n != 1 {
+		t.Errorf("relay received %d messages, want no new one", n)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+var (
+	activationOnce sync.Once
+	activated      []net.Listener
+)
+
+// activatedListeners returns the listeners passed by systemd through
+// LISTEN_PID and LISTEN_FDS, or nil when the process was not socket
+// activated. The variables are cleared so child processes do not inherit them.
+func activatedListeners() []net.Listener {
+	activationOnce.Do(func() {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+			f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+			listener, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				continue
+			}
+			activated = append(activated, listener)
+		}
+	})
+	return activated
+}
+
+// takeActivatedListener returns the inherited listener bound to the port
+// (and host, if set) of cfg and removes it from the inherited set, or nil if
+// there is none
+func takeActivatedListener(host, port string) net.Listener {
+	listeners := activatedListeners()
+	for i, listener := range listeners {
+		if listener == nil {
+			continue
+		}
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok || strconv.Itoa(addr.Port) != port {
+			continue
+		}
+		if ip := parseIP(host); ip != nil && !ip.IsUnspecified() && !ip.Equal(addr.IP) {
+			continue
+		}
+		listeners[i] = nil
+		return listener
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSocketActivation runs TestActivatedServer in a child process that
+// inherits a listening socket the way systemd passes one
+func TestSocketActivation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	f, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivatedServer$", "-test.v")
+	cmd.Env = append(os.Environ(), "ACTIVATION_TEST_PORT="+port, "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	output, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "--- PASS: TestActivatedServer") {
+		t.Fatalf("activated server failed: %v\n%s", err, output)
+	}
+}
+
+// TestActivatedServer only runs as the child of TestSocketActivation. Its
+// copy of the parent's socket is fd 3, and the parent keeps the port bound,
+// so the server can only serve on it by adopting the inherited socket.
+func TestActivatedServer(t *testing.T) {
+	port := os.Getenv("ACTIVATION_TEST_PORT")
+	if port == "" {
+		t.Skip("run by TestSocketActivation")
+	}
+	// systemd sets LISTEN_PID to the service's PID, which is only known here
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].Port = port
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "none"})
+	startServer(t, cfg)
+
+	for i := range cfg.Listeners {
+		c := dial(t, listenerAddr(cfg, i))
+		c.cmd(221, "QUIT")
+	}
+	log := readLog(t, cfg)
+	if !strings.Contains(log, "Using socket-activated listener for port "+port) {
+		t.Errorf("inherited socket for port %s was not adopted:\n%s", port, log)
+	}
+	// The other port is not inherited and is listened on as usual
+	if strings.Contains(log, "Using socket-activated listener for port "+cfg.Listeners[1].Port) {
+		t.Errorf("port %s reported as socket activated", cfg.Listeners[1].Port)
+	}
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		t.Error("activation variables left for child processes")
+	}
+}
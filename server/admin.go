@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-relay-server/logger"
+	"go-relay-server/queue"
+	"go-relay-server/relay"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Snapshot is a single JSON document describing the server, its listeners,
+// the relay queue and recent relay outcomes.
+type Snapshot struct {
+	Status        string             `json:"status"`
+	StartedAt     time.Time          `json:"started_at"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Listeners     []ListenerSnapshot `json:"listeners"`
+	Queue         *queue.Stats       `json:"queue"`
+	Relay         relay.Stats        `json:"relay"`
+}
+
+type ListenerSnapshot struct {
+	Port              string `json:"port"`
+	Encryption        string `json:"encryption"`
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+}
+
+// Snapshot aggregates the current server state
+func (s *Server) Snapshot() Snapshot {
+	s.mu.RLock()
+	startedAt := s.startedAt
+	allStats := s.listenerStats
+	s.mu.RUnlock()
+
+	snapshot := Snapshot{
+		Status:    s.Status(),
+		StartedAt: startedAt,
+		Listeners: []ListenerSnapshot{},
+		Relay:     relay.GetStats(),
+	}
+	if !startedAt.IsZero() {
+		snapshot.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+	}
+
+	for _, listenerCfg := range s.currentConfig().Listeners {
+		listener := ListenerSnapshot{
+			Port:       listenerCfg.Port,
+			Encryption: listenerCfg.Encryption,
+		}
+		if stats, ok := allStats[listenerCfg.Port]; ok {
+			listener.ActiveConnections = stats.active.Load()
+			listener.TotalConnections = stats.total.Load()
+		}
+		snapshot.Listeners = append(snapshot.Listeners, listener)
+	}
+
+	if q := relay.GetQueue(); q != nil {
+		stats := q.Stats()
+		snapshot.Queue = &stats
+	}
+
+	return snapshot
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Snapshot()); err != nil {
+		s.Logger.Log(logger.LogLevelError, "Error encoding snapshot: %v", err)
+	}
+}
+
+// handleQueuePending lists the pending queue items without their data
+func (s *Server) handleQueuePending(w http.ResponseWriter, r *http.Request) {
+	q := relay.GetQueue()
+	if q == nil {
+		http.Error(w, "queue not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	s.writeJSON(w, q.ListPending())
+}
+
+// handleQueueFailed lists the permanently failed queue items without their data
+func (s *Server) handleQueueFailed(w http.ResponseWriter, r *http.Request) {
+	q := relay.GetQueue()
+	if q == nil {
+		http.Error(w, "queue not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	s.writeJSON(w, q.ListFailed())
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Logger.Log(logger.LogLevelError, "Error encoding response: %v", err)
+	}
+}
+
+// handleHealthz reports that the process is up
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the listeners are bound and the queue is initialized
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() || relay.GetQueue() == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready\n"))
+}
+
+// startAdmin starts the admin HTTP server when an admin address is configured
+func (s *Server) startAdmin() error {
+	addr := s.currentConfig().AdminAddr
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", s.handleSnapshot)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/queue/pending", s.handleQueuePending)
+	mux.HandleFunc("/queue/failed", s.handleQueueFailed)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start admin endpoint on %s: %v", addr, err)
+	}
+
+	s.adminServer = &http.Server{Handler: mux}
+	go func() {
+		if err := s.adminServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Log(logger.LogLevelError, "Admin endpoint error: %v", err)
+		}
+	}()
+
+	s.Logger.Log(logger.LogLevelInfo, "Admin endpoint started on %s", addr)
+	return nil
+}
+
+func (s *Server) stopAdmin() {
+	if s.adminServer == nil {
+		return
+	}
+	s.adminServer.Close()
+	s.adminServer = nil
+}
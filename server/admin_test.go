@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"go-relay-server/config"
+	"go-relay-server/queue"
+	"go-relay-server/relay"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAdmin enables the admin endpoint of cfg on a free port and returns its
+// base URL
+func withAdmin(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	cfg.AdminAddr = net.JoinHostPort("127.0.0.1", freePort(t))
+	return "http://" + cfg.AdminAddr
+}
+
+// httpGet fetches url and returns the status code and body
+func httpGet(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestSnapshot(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	admin := withAdmin(t, &cfg)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("snapshot", "Hello\r\n"))
+
+	code, body := httpGet(t, admin+"/snapshot")
+	if code != http.StatusOK {
+		t.Fatalf("GET /snapshot: %d %s", code, body)
+	}
+	var snapshot struct {
+		Status        string    `json:"status"`
+		StartedAt     time.Time `json:"started_at"`
+		UptimeSeconds *int64    `json:"uptime_seconds"`
+		Listeners     []struct {
+			Port              string `json:"port"`
+			Encryption        string `json:"encryption"`
+			ActiveConnections int64  `json:"active_connections"`
+			TotalConnections  uint64 `json:"total_connections"`
+		} `json:"listeners"`
+		Queue *struct {
+			Pending *int `json:"pending"`
+			Failed  *int `json:"failed"`
+		} `json:"queue"`
+		Relay *struct {
+			Delivered uint64  `json:"delivered"`
+			Failed    *uint64 `json:"failed"`
+		} `json:"relay"`
+	}
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		t.Fatalf("snapshot is not valid JSON: %v\n%s", err, body)
+	}
+
+	if snapshot.Status != "running" || snapshot.StartedAt.IsZero() || snapshot.UptimeSeconds == nil {
+		t.Errorf("server fields missing: %s", body)
+	}
+	if len(snapshot.Listeners) != 1 {
+		t.Fatalf("snapshot has %d listeners, want 1: %s", len(snapshot.Listeners), body)
+	}
+	listener := snapshot.Listeners[0]
+	if listener.Port != cfg.Listeners[0].Port || listener.Encryption != "none" ||
+		listener.ActiveConnections != 1 || listener.TotalConnections < 1 {
+		t.Errorf("listener %+v does not describe the open connection", listener)
+	}
+	if snapshot.Queue == nil || snapshot.Queue.Pending == nil || snapshot.Queue.Failed == nil {
+		t.Errorf("queue stats missing: %s", body)
+	}
+	if snapshot.Relay == nil || snapshot.Relay.Delivered < 1 || snapshot.Relay.Failed == nil {
+		t.Errorf("relay stats missing or not counting the delivery: %s", body)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.ShutdownTimeout = "5s"
+	admin := withAdmin(t, &cfg)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	probe := func(when string, want int) {
+		t.Helper()
+		if code, body := httpGet(t, admin+"/readyz"); code != want {
+			t.Fatalf("GET /readyz %s: %d %s, want %d", when, code, body, want)
+		}
+	}
+
+	// The endpoint answers from Prepare on, before the listeners are bound
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := httpGet(t, admin+"/healthz"); code != http.StatusOK {
+		t.Fatalf("GET /healthz when prepared: %d %s", code, body)
+	}
+	probe("when prepared", http.StatusServiceUnavailable)
+	if err := s.ListenOnly(); err != nil {
+		t.Fatal(err)
+	}
+	probe("with listeners bound but not accepting", http.StatusServiceUnavailable)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	probe("when running", http.StatusOK)
+
+	// A session halfway through DATA holds Stop in the drain
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(354, "DATA")
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	waitFor(t, "the listener to close", func() bool { return refused(listenerAddr(cfg, 0)) })
+	probe("while draining", http.StatusServiceUnavailable)
+	if code, _ := httpGet(t, admin+"/healthz"); code != http.StatusOK {
+		t.Fatalf("GET /healthz while draining: %d", code)
+	}
+
+	c.tp.PrintfLine("Subject: readyz drain\r\n\r\n.\r\nQUIT")
+	<-stopped
+	if _, err := (&http.Client{Timeout: time.Second}).Get(admin + "/readyz"); err == nil {
+		t.Fatal("admin endpoint still answers after Stop")
+	}
+}
+
+func TestQueueEndpoints(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	admin := withAdmin(t, &cfg)
+	startServer(t, cfg)
+
+	q := relay.GetQueue()
+	if err := q.Enqueue(queue.Envelope{From: "views@example.com", To: "pending@example.org"}, []byte("Subject: endpoint\r\n\r\nconfidential pending\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	failed := &queue.QueueItem{
+		Envelope:  queue.Envelope{From: "views@example.com", To: "failed@example.org"},
+		Data:      []byte("Subject: endpoint\r\n\r\nconfidential failed\r\n"),
+		LastError: "550 no such user",
+	}
+	if err := q.Fail(failed, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		to   string
+		keys []string
+	}{
+		{"/queue/pending", "pending@example.org", []string{"id", "from", "to", "size", "attempts", "next_retry", "age_seconds", "in_flight"}},
+		{"/queue/failed", "failed@example.org", []string{"id", "from", "to", "size", "attempts", "next_retry", "age_seconds", "in_flight", "last_error", "error", "failed_at"}},
+	} {
+		code, body := httpGet(t, admin+tt.path)
+		if code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", tt.path, code, body)
+		}
+		if strings.Contains(string(body), "confidential") {
+			t.Errorf("GET %s leaks message bodies: %s", tt.path, body)
+		}
+		var items []map[string]any
+		if err := json.Unmarshal(body, &items); err != nil {
+			t.Fatalf("GET %s is not a JSON list: %v\n%s", tt.path, err, body)
+		}
+		var item map[string]any
+		for _, candidate := range items {
+			if candidate["to"] == tt.to {
+				item = candidate
+			}
+		}
+		if item == nil {
+			t.Fatalf("GET %s does not list %s: %s", tt.path, tt.to, body)
+		}
+		var keys []string
+		for key := range item {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		want := slices.Clone(tt.keys)
+		slices.Sort(want)
+		if !slices.Equal(keys, want) {
+			t.Errorf("GET %s item has fields %v, want %v", tt.path, keys, want)
+		}
+	}
+}
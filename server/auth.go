@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+)
+
+// authEnabled reports whether clients may authenticate with AUTH
+func (s *Server) authEnabled() bool {
+	return s.currentConfig().AuthUsername != ""
+}
+
+// handleAuth runs an AUTH PLAIN or AUTH LOGIN exchange, writing every reply
+// itself, and returns the authenticated username or "" on failure. args are
+// the words following AUTH.
+func (s *Server) handleAuth(tp *textproto.Conn, args []string) string {
+	if len(args) == 0 {
+		tp.PrintfLine("501 Syntax: AUTH mechanism")
+		return ""
+	}
+
+	var username, password string
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		response := ""
+		if len(args) > 1 {
+			response = args[1]
+		} else {
+			tp.PrintfLine("334 ")
+			line, ok := readAuthLine(tp)
+			if !ok {
+				return ""
+			}
+			response = line
+		}
+		decoded, err := base64.StdEncoding.DecodeString(response)
+		if err != nil {
+			tp.PrintfLine("501 Invalid base64 data")
+			return ""
+		}
+		// authzid NUL authcid NUL passwd
+		parts := bytes.Split(decoded, []byte{0})
+		if len(parts) != 3 {
+			tp.PrintfLine("501 Invalid PLAIN credentials")
+			return ""
+		}
+		username, password = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		var fields [2]string
+		for i, prompt := range []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} {
+			if i == 0 && len(args) > 1 {
+				fields[0] = args[1]
+				continue
+			}
+			tp.PrintfLine("334 %s", prompt)
+			line, ok := readAuthLine(tp)
+			if !ok {
+				return ""
+			}
+			fields[i] = line
+		}
+		user, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			tp.PrintfLine("501 Invalid base64 data")
+			return ""
+		}
+		pass, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			tp.PrintfLine("501 Invalid base64 data")
+			return ""
+		}
+		username, password = string(user), string(pass)
+	default:
+		tp.PrintfLine("504 Unrecognized authentication mechanism")
+		return ""
+	}
+
+	if !s.checkCredentials(username, password) {
+		tp.PrintfLine("%s", s.response("auth_failed"))
+		return ""
+	}
+	tp.PrintfLine("235 Authentication successful")
+	return username
+}
+
+// readAuthLine reads one client response during AUTH, treating "*" as the
+// client cancelling the exchange
+func readAuthLine(tp *textproto.Conn) (string, bool) {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", false
+	}
+	if line == "*" {
+		tp.PrintfLine("501 Authentication cancelled")
+		return "", false
+	}
+	return line, true
+}
+
+// checkCredentials compares against the configured username and password in
+// constant time
+func (s *Server) checkCredentials(username, password string) bool {
+	conf := s.currentConfig()
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(conf.AuthUsername)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(conf.AuthPassword)) == 1
+	return userOK && passOK
+}
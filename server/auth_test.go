@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"go-relay-server/config"
+	"strings"
+	"testing"
+)
+
+// startTLS upgrades c with STARTTLS and returns the client for the TLS
+// connection, which expects no new greeting
+func (c *client) startTLS(cfg *tls.Config) *client {
+	c.t.Helper()
+	c.cmd(220, "STARTTLS")
+	conn := tls.Client(c.conn, cfg)
+	if err := conn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake failed: %v", err)
+	}
+	return newClient(c.t, conn)
+}
+
+// withAuth enables AUTH for user and password on cfg
+func withAuth(cfg *config.Config, user, password string) string {
+	cfg.AuthUsername, cfg.AuthPassword = user, password
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	plain := withAuth(&cfg, "relay", "secret")
+	cert := withTLS(t, &cfg)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "starttls"})
+	startServer(t, cfg)
+
+	t.Run("plaintext listener", func(t *testing.T) {
+		c := dial(t, listenerAddr(cfg, 0))
+		if ehlo := c.cmd(250, "EHLO client.test"); strings.Contains(ehlo, "AUTH") {
+			t.Errorf("AUTH advertised without TLS: %q", ehlo)
+		}
+		c.cmd(538, "AUTH PLAIN %s", plain)
+		c.cmd(538, "AUTH LOGIN")
+	})
+
+	t.Run("before STARTTLS", func(t *testing.T) {
+		c := dial(t, listenerAddr(cfg, 1))
+		c.cmd(250, "EHLO client.test")
+		c.cmd(538, "AUTH PLAIN %s", plain)
+	})
+
+	t.Run("after STARTTLS", func(t *testing.T) {
+		c := dial(t, listenerAddr(cfg, 1))
+		c.cmd(250, "EHLO client.test")
+		c = c.startTLS(&tls.Config{RootCAs: cert.Pool(), ServerName: "relay.test"})
+		if ehlo := c.cmd(250, "EHLO client.test"); !strings.Contains(ehlo, "AUTH PLAIN LOGIN") {
+			t.Errorf("AUTH not advertised after STARTTLS: %q", ehlo)
+		}
+		c.cmd(235, "AUTH PLAIN %s", plain)
+	})
+
+	if log := readLog(t, cfg); strings.Count(log, "Refused AUTH over unencrypted connection") != 3 {
+		t.Errorf("want a warning for each AUTH refused, log:\n%s", log)
+	}
+}
+
+func TestSTARTTLSDiscardsPipelinedCommands(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cert := withTLS(t, &cfg)
+	cfg.Listeners[0].Encryption = "starttls"
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	// An attacker on the path appends commands to the client's STARTTLS
+	if _, err := c.conn.Write([]byte("STARTTLS\r\nMAIL FROM:<injected@example.com>\r\nRCPT TO:<victim@example.org>\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(220)
+	conn := tls.Client(c.conn, &tls.Config{RootCAs: cert.Pool(), ServerName: "relay.test"})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	c = newClient(t, conn)
+
+	// Neither the injected commands nor the EHLO before the upgrade count
+	c.cmd(503, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "EHLO client.test")
+	c.cmd(503, "RCPT TO:<b@example.org>")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.data(250, testMessage("after starttls", "Hello\r\n"))
+
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) == 1 })
+	if msg := upstream.Messages()[0]; msg.From != "a@example.com" || len(msg.To) != 1 || msg.To[0] != "b@example.org" {
+		t.Fatalf("relayed envelope %s -> %v, want only the commands sent over TLS", msg.From, msg.To)
+	}
+	if !strings.Contains(readLog(t, cfg), "pipelined after STARTTLS") {
+		t.Error("discarded input not logged")
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// sentEarly waits the configured banner_delay before the greeting and reports
+// whether the client sent anything in the meantime. RFC 5321 clients wait for
+// the 220 greeting, so data arriving before it marks a likely spambot. A
+// connection that fails or closes while waiting also counts as early.
+// Cancelling ctx ends the wait.
+func (s *Server) sentEarly(ctx context.Context, conn net.Conn) bool {
+	delay := s.bannerDelay()
+	if delay <= 0 {
+		return false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(delay))
+	defer conn.SetReadDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 {
+		return true
+	}
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (s *Server) bannerDelay() time.Duration {
+	value := s.currentConfig().BannerDelay
+	if value == "" {
+		return 0
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return delay
+}
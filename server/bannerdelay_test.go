@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBannerDelay(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.BannerDelay = "300ms"
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	t.Run("patient client", func(t *testing.T) {
+		c := connect(t, addr)
+		start := time.Now()
+		c.expect(220)
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Errorf("greeting sent after %v, want the 300ms banner delay", elapsed)
+		}
+		c.cmd(250, "EHLO client.test")
+	})
+
+	t.Run("early talker", func(t *testing.T) {
+		c := connect(t, addr)
+		if err := c.tp.PrintfLine("EHLO bot.test"); err != nil {
+			t.Fatal(err)
+		}
+		if code, msg := c.reply(); code != 554 {
+			t.Fatalf("early talker got %d %s, want 554", code, msg)
+		}
+		if !c.closed() {
+			t.Error("connection left open after rejecting an early talker")
+		}
+		waitFor(t, "early talker log line", func() bool {
+			return strings.Contains(readLog(t, cfg), "sent data before the greeting")
+		})
+	})
+}
+
+func TestBannerDelayDisabled(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	// Without a delay, a client that does not wait is served as usual
+	c := connect(t, listenerAddr(cfg, 0))
+	if err := c.tp.PrintfLine("EHLO eager.test"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(220)
+	c.expect(250)
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// parseBDAT parses the arguments of "BDAT <size> [LAST]" (RFC 3030)
+func parseBDAT(args []string) (int64, bool, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return 0, false, errors.New("expected BDAT <size> [LAST]")
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, errors.New("invalid chunk size")
+	}
+	last := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "LAST") {
+			return 0, false, errors.New("expected BDAT <size> [LAST]")
+		}
+		last = true
+	}
+	return size, last, nil
+}
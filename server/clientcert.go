@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/logger"
+	"net"
+	"os"
+)
+
+// loadClientCAs reads a PEM bundle of CA certificates for verifying clients
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return pool, nil
+}
+
+// listenerTLSConfig returns the TLS config for a listener, which presents
+// only its own and the global certificate. Listeners with
+// tls_client_ca_file require a client certificate, verified against the CAs
+// loaded with the current certificates so a reload also picks up CA changes.
+func (s *Server) listenerTLSConfig(cfg config.ListenerConfig) *tls.Config {
+	conf := s.tlsConfig.Clone()
+	conf.GetCertificate = s.listenerCertificate(cfg.Port)
+	if cfg.TLSClientCAFile == "" {
+		return conf
+	}
+	base := conf.Clone()
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		client := base.Clone()
+		client.ClientAuth = tls.RequireAndVerifyClientCert
+		client.ClientCAs = s.certs.Load().clientCAs[cfg.TLSClientCAFile]
+		return client, nil
+	}
+	return conf
+}
+
+// verifyClientCertificate completes the TLS handshake of a listener that
+// requires client certificates and returns the client's identity. A client
+// without a valid certificate fails the handshake and is logged.
+func (s *Server) verifyClientCertificate(ctx context.Context, conn net.Conn, remoteAddr string) (string, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		s.Logger.Log(logger.LogLevelError, "Connection from %s is not using TLS", remoteAddr)
+		return "", false
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		s.Logger.Log(logger.LogLevelWarn, "Rejected client certificate from %s: %v", remoteAddr, err)
+		return "", false
+	}
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+	identity := clientIdentity(cert)
+	s.Logger.Log(logger.LogLevelInfo, "Verified client certificate from %s: %s (issuer %q, serial %s)",
+		remoteAddr, identity, cert.Issuer.String(), cert.SerialNumber.Text(16))
+	return identity, true
+}
+
+// clientIdentity names a client certificate by its common name, or by its
+// first DNS, email or URI name when the common name is empty
+func clientIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return fmt.Sprintf("serial %s", cert.SerialNumber.Text(16))
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startMTLSServer starts a server whose implicit TLS and STARTTLS listeners
+// require client certificates issued by ca, and AUTH for MAIL
+func startMTLSServer(t *testing.T, ca *smtptest.Cert) (config.Config, *smtptest.Cert) {
+	t.Helper()
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cert := withTLS(t, &cfg)
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	if err := os.WriteFile(caFile, ca.CertPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners[0].Encryption = "tls"
+	cfg.Listeners[0].TLSClientCAFile = caFile
+	cfg.Listeners[0].RequireAuth = true
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{
+		Host: "127.0.0.1", Port: freePort(t), Encryption: "starttls", TLSClientCAFile: caFile, RequireAuth: true,
+	})
+	startServer(t, cfg)
+	return cfg, cert
+}
+
+// clientTLS returns a client TLS config trusting the server's certificate
+// and presenting certs
+func clientTLS(server *smtptest.Cert, certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs: server.Pool(), ServerName: "relay.test", Certificates: certs}
+}
+
+// greetedOverTLS connects to the implicit TLS listener at addr and returns
+// the client if the server greeted it. Under TLS 1.3 the client finishes
+// its handshake before the server has checked its certificate, so a
+// rejection may only show once the greeting is read.
+func greetedOverTLS(t *testing.T, addr string, conf *tls.Config) (*client, bool) {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, conf)
+	if err != nil {
+		return nil, false
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := newClient(t, conn)
+	if code, _, err := c.tp.ReadResponse(220); err != nil || code != 220 {
+		return nil, false
+	}
+	return c, true
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca := smtptest.NewCA("Relay Mesh CA")
+	valid := ca.Issue("mta1.mesh.test", x509.ExtKeyUsageClientAuth)
+	foreign := smtptest.NewCA("Other CA").Issue("mta2.mesh.test", x509.ExtKeyUsageClientAuth)
+	serverOnly := ca.Issue("mta3.mesh.test", x509.ExtKeyUsageServerAuth)
+	cfg, cert := startMTLSServer(t, ca)
+	addr := listenerAddr(cfg, 0)
+
+	t.Run("valid", func(t *testing.T) {
+		c, ok := greetedOverTLS(t, addr, clientTLS(cert, valid.TLS))
+		if !ok {
+			t.Fatal("client with a valid certificate was not greeted")
+		}
+		// The certificate counts as authentication for require_auth
+		c.cmd(250, "EHLO mta1.mesh.test")
+		c.cmd(250, "MAIL FROM:<a@example.com>")
+		c.cmd(221, "QUIT")
+	})
+
+	for _, tt := range []struct {
+		name  string
+		certs []tls.Certificate
+	}{
+		{"absent", nil},
+		{"foreign CA", []tls.Certificate{foreign.TLS}},
+		{"wrong usage", []tls.Certificate{serverOnly.TLS}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := greetedOverTLS(t, addr, clientTLS(cert, tt.certs...)); ok {
+				t.Fatal("client without a valid certificate was greeted")
+			}
+		})
+	}
+
+	waitFor(t, "the certificate checks in the log", func() bool {
+		log := readLog(t, cfg)
+		return strings.Contains(log, "Verified client certificate from 127.0.0.1:") &&
+			strings.Count(log, "Rejected client certificate from 127.0.0.1:") == 3
+	})
+	log := readLog(t, cfg)
+	if !strings.Contains(log, ": mta1.mesh.test (issuer \"CN=Relay Mesh CA\", serial "+valid.X509.SerialNumber.Text(16)+")") {
+		t.Errorf("verified identity not logged:\n%s", log)
+	}
+}
+
+func TestClientCertificatesSTARTTLS(t *testing.T) {
+	ca := smtptest.NewCA("Relay Mesh CA")
+	valid := ca.Issue("mta1.mesh.test", x509.ExtKeyUsageClientAuth)
+	cfg, cert := startMTLSServer(t, ca)
+	addr := listenerAddr(cfg, 1)
+
+	// The certificate is checked once the connection is upgraded
+	c := dial(t, addr)
+	c.cmd(250, "EHLO mta1.mesh.test")
+	c.cmd(500, "MAIL FROM:<a@example.com>")
+	c = c.startTLS(clientTLS(cert, valid.TLS))
+	c.cmd(250, "EHLO mta1.mesh.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(221, "QUIT")
+
+	// A client without a certificate loses the connection after the upgrade
+	c = dial(t, addr)
+	c.cmd(250, "EHLO mta2.mesh.test")
+	c.cmd(220, "STARTTLS")
+	conn := tls.Client(c.conn, clientTLS(cert))
+	if err := conn.Handshake(); err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		tc := newClient(t, conn)
+		if err := tc.tp.PrintfLine("EHLO mta2.mesh.test"); err == nil {
+			if _, _, err := tc.tp.ReadResponse(250); err == nil {
+				t.Fatal("client without a certificate got a reply after STARTTLS")
+			}
+		}
+	}
+	waitFor(t, "the rejection in the log", func() bool {
+		return strings.Contains(readLog(t, cfg), "Rejected client certificate from 127.0.0.1:")
+	})
+}
+
+func TestClientCAValidation(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	withTLS(t, &cfg)
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "clients.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners[0].Encryption = "tls"
+
+	for path, want := range map[string]string{
+		filepath.Join(dir, "missing.pem"): "failed to load client CAs for port " + cfg.Listeners[0].Port,
+		notPEM:                            "no PEM certificates found",
+	} {
+		cfg.Listeners[0].TLSClientCAFile = path
+		s, err := NewServer(cfg)
+		if err == nil {
+			err = s.Prepare()
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want one containing %q", path, err, want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package server
+
+import (
+	"slices"
+	"strings"
+)
+
+// commandDisabled reports whether disabled_commands lists the verb cmd
+func (s *Server) commandDisabled(cmd string) bool {
+	return slices.ContainsFunc(s.currentConfig().DisabledCommands, func(disabled string) bool {
+		return strings.EqualFold(disabled, cmd)
+	})
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisabledCommands(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.DisabledCommands = []string{"helo", "BDAT", "NOOP", "RSET"}
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(502, "HELO client.test")
+	if ehlo := c.cmd(250, "EHLO client.test"); strings.Contains(ehlo, "CHUNKING") {
+		t.Fatalf("EHLO advertises CHUNKING with BDAT disabled:\n%s", ehlo)
+	}
+	c.cmd(502, "NOOP")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(502, "RSET")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(502, "BDAT 4 LAST")
+	// Verbs that are not implemented are unrecognized rather than disabled
+	c.cmd(500, "VRFY b@example.org")
+	c.cmd(221, "QUIT")
+}
@@ -0,0 +1,57 @@
+package server
+
+import "sync"
+
+// connLimiter counts open connections in total and per client IP
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{perIP: make(map[string]int)}
+}
+
+// acquire reserves one of maxTotal connection slots, returning false if
+// they are all taken. A limit of 0 means unlimited.
+func (l *connLimiter) acquire(maxTotal int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if maxTotal > 0 && l.total >= maxTotal {
+		return false
+	}
+	l.total++
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+}
+
+// acquireIP reserves a slot for a client IP, returning false if ip already
+// has maxPerIP connections. A limit of 0 means unlimited.
+func (l *connLimiter) acquireIP(ip string, maxPerIP int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if maxPerIP > 0 && l.perIP[ip] >= maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+// releaseIP frees a slot reserved by acquireIP
+func (l *connLimiter) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
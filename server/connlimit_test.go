@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// proxyDial connects to a proxy_protocol listener as if from clientIP and
+// returns the greeting's reply code
+func proxyDial(t *testing.T, addr, clientIP string) (*client, int) {
+	t.Helper()
+	c := connect(t, addr)
+	fmt.Fprintf(c.conn, "PROXY TCP4 %s 192.0.2.254 40000 25\r\n", clientIP)
+	code, _ := c.reply()
+	return c, code
+}
+
+// greetingCode connects to addr and returns the reply code of the greeting
+func greetingCode(t *testing.T, addr string) (*client, int) {
+	t.Helper()
+	c := connect(t, addr)
+	code, _ := c.reply()
+	return c, code
+}
+
+func TestPerIPConnectionLimit(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.MaxConnectionsPerIP = 2
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	first, _ := greetingCode(t, addr)
+	if _, code := greetingCode(t, addr); code != 220 {
+		t.Fatalf("second connection got %d, want 220", code)
+	}
+	if _, code := greetingCode(t, addr); code != 421 {
+		t.Fatalf("connection over the limit got %d, want 421", code)
+	}
+
+	// The slot is freed once a connection closes
+	first.cmd(221, "QUIT")
+	waitFor(t, "a free slot", func() bool {
+		c, code := greetingCode(t, addr)
+		c.conn.Close()
+		return code == 220
+	})
+}
+
+func TestTotalConnectionLimit(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.MaxConnections = 2
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	first, _ := proxyDial(t, addr, "192.0.2.1")
+	if _, code := proxyDial(t, addr, "192.0.2.2"); code != 220 {
+		t.Fatalf("second connection got %d, want 220", code)
+	}
+	// Rejected at accept, before the PROXY header is read
+	if _, code := greetingCode(t, addr); code != 421 {
+		t.Fatalf("connection over the total limit got %d, want 421", code)
+	}
+
+	first.cmd(221, "QUIT")
+	waitFor(t, "a free slot", func() bool {
+		c, code := proxyDial(t, addr, "192.0.2.3")
+		c.conn.Close()
+		return code == 220
+	})
+}
+
+func TestPerIPLimitBehindProxy(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.MaxConnectionsPerIP = 1
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	// Every connection comes from the balancer's address, but each client
+	// has its own allowance
+	if _, code := proxyDial(t, addr, "192.0.2.1"); code != 220 {
+		t.Fatalf("first client got %d, want 220", code)
+	}
+	if _, code := proxyDial(t, addr, "192.0.2.2"); code != 220 {
+		t.Fatalf("second client got %d, want 220", code)
+	}
+	if _, code := proxyDial(t, addr, "192.0.2.1"); code != 421 {
+		t.Fatalf("second connection from the first client got %d, want 421", code)
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/logger"
+	"go-relay-server/queue"
+	"go-relay-server/relay"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultControlSocket is used when the config does not set control_socket
+const DefaultControlSocket = "smtp-relay.sock"
+
+// controlTimeout bounds a single control socket exchange
+const controlTimeout = 10 * time.Second
+
+// The control socket speaks a line protocol: the client sends one command
+// line, the server answers "OK" or "ERR <message>" on the first line,
+// followed by the command output, and closes the connection.
+
+// controlCommand runs a control command and returns its output
+type controlCommand func(s *Server, args []string) (string, error)
+
+var controlCommands = map[string]controlCommand{
+	"status":    controlStatus,
+	"queue":     controlQueue,
+	"failed":    controlFailed,
+	"blocklist": controlBlocklist,
+	"certs":     controlCerts,
+	"reload":    controlReload,
+}
+
+func controlStatus(s *Server, args []string) (string, error) {
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// controlFailed handles "failed list", "failed requeue <id>" and
+// "failed clear"
+func controlFailed(s *Server, args []string) (string, error) {
+	q := relay.GetQueue()
+	if q == nil {
+		return "", errors.New("queue is not initialized")
+	}
+	if len(args) == 0 {
+		return "", errors.New("usage: failed list|requeue <id>|clear")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "list":
+		failed := q.GetFailedItems()
+		if len(failed) == 0 {
+			return "no failed items", nil
+		}
+		var b strings.Builder
+		w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tFAILED AT\tRETRIES\tFROM\tTO\tERROR")
+		for _, item := range failed {
+			from := item.Item.From
+			if from == "" {
+				from = "<>"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", item.Item.ID, item.Timestamp.Format(time.RFC3339),
+				item.Retries, from, item.Item.To, item.Error)
+		}
+		w.Flush()
+		return b.String(), nil
+	case "requeue":
+		return requeueFailed(q, "failed", args)
+	case "clear":
+		return clearFailed(q)
+	default:
+		return "", fmt.Errorf("unknown failed command %q", args[0])
+	}
+}
+
+// controlQueue handles "queue list [domain]", "queue requeue <id>" and
+// "queue flush-failed"
+func controlQueue(s *Server, args []string) (string, error) {
+	q := relay.GetQueue()
+	if q == nil {
+		return "", errors.New("queue is not initialized")
+	}
+	if len(args) == 0 {
+		return "", errors.New("usage: queue list [domain]|requeue <id>|flush-failed")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "list":
+		// An optional domain argument limits the listing to one partition
+		domain := ""
+		if len(args) > 1 {
+			domain = strings.ToLower(args[1])
+		}
+		var b strings.Builder
+		for _, item := range q.Items() {
+			if domain != "" && item.Domain() != domain {
+				continue
+			}
+			state := "pending"
+			if item.InFlight {
+				state = "in-flight"
+			}
+			fmt.Fprintf(&b, "%s %s to=%s attempts=%d next_retry=%s size=%d\n",
+				item.ID, state, item.To, item.Attempts, item.NextRetry.Format(time.RFC3339), len(item.Data))
+		}
+		for _, failed := range q.GetFailedItems() {
+			if domain != "" && failed.Item.Domain() != domain {
+				continue
+			}
+			fmt.Fprintf(&b, "%s failed to=%s retries=%d at=%s error=%q\n",
+				failed.Item.ID, failed.Item.To, failed.Retries, failed.Timestamp.Format(time.RFC3339), failed.Error)
+		}
+		return b.String(), nil
+	case "requeue":
+		return requeueFailed(q, "queue", args)
+	case "flush-failed":
+		return clearFailed(q)
+	default:
+		return "", fmt.Errorf("unknown queue command %q", args[0])
+	}
+}
+
+// requeueFailed handles the "requeue <id>" subcommand of "failed" and
+// "queue", which puts a failed item back in the queue
+func requeueFailed(q *queue.Queue, command string, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("usage: %s requeue <id>", command)
+	}
+	if err := q.RequeueFailedItem(args[1]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("requeued %s", args[1]), nil
+}
+
+// clearFailed handles "failed clear" and "queue flush-failed", which remove
+// all failed items
+func clearFailed(q *queue.Queue) (string, error) {
+	count, err := q.ClearFailedItems()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("removed %d failed items", count), nil
+}
+
+// controlBlocklist handles "blocklist list" and "blocklist add <entry>".
+// Added entries last until the next reload or restart.
+func controlBlocklist(s *Server, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("usage: blocklist list|add <entry>")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "list":
+		return strings.Join(s.currentConfig().BlockList, "\n"), nil
+	case "add":
+		if len(args) != 2 {
+			return "", errors.New("usage: blocklist add <entry>")
+		}
+		s.cfgMu.Lock()
+		blockList := append([]string{}, s.Config.BlockList...)
+		s.Config.BlockList = append(blockList, args[1])
+		s.cfgMu.Unlock()
+		s.Logger.Log(logger.LogLevelInfo, "Added %s to block list", args[1])
+		return fmt.Sprintf("added %s", args[1]), nil
+	default:
+		return "", fmt.Errorf("unknown blocklist command %q", args[0])
+	}
+}
+
+// controlCerts handles "certs reload", rereading the TLS certificate files
+// without reloading the rest of the config
+func controlCerts(s *Server, args []string) (string, error) {
+	if len(args) != 1 || strings.ToLower(args[0]) != "reload" {
+		return "", errors.New("usage: certs reload")
+	}
+	if err := s.ReloadCertificates(); err != nil {
+		return "", fmt.Errorf("failed to reload certificates: %v", err)
+	}
+	return "certificates reloaded", nil
+}
+
+// controlReload rereads the config file or URL the server was started with
+func controlReload(s *Server, args []string) (string, error) {
+	if s.ConfigPath == "" {
+		return "", errors.New("config path is not known, send SIGHUP instead")
+	}
+	if s.ConfigPath == config.Stdin {
+		return "", errors.New("config was read from standard input and cannot be reloaded")
+	}
+	newConfig, err := config.LoadConfig(s.ConfigPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to reload config: %v", err)
+	}
+	s.Reload(newConfig)
+	return "configuration reloaded", nil
+}
+
+// controlSocketPath returns the configured control socket path or the default
+func (s *Server) controlSocketPath() string {
+	if path := s.currentConfig().ControlSocket; path != "" {
+		return path
+	}
+	return DefaultControlSocket
+}
+
+// startControl listens on the control socket, readable and writable by the
+// owner only
+func (s *Server) startControl() error {
+	path := s.controlSocketPath()
+
+	// A socket left behind by a crashed process would make Listen fail; the
+	// PID file has already ruled out a live one
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket %s: %v", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to start control socket on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket %s: %v", path, err)
+	}
+
+	s.controlListener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.Logger.Log(logger.LogLevelError, "Control socket error: %v", err)
+				}
+				return
+			}
+			go s.handleControl(conn)
+		}
+	}()
+
+	s.Logger.Log(logger.LogLevelInfo, "Control socket started on %s", path)
+	return nil
+}
+
+func (s *Server) stopControl() {
+	if s.controlListener == nil {
+		return
+	}
+	s.controlListener.Close()
+	s.controlListener = nil
+	os.Remove(s.controlSocketPath())
+}
+
+func (s *Server) handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprintf(conn, "ERR empty command\n")
+		return
+	}
+
+	command, ok := controlCommands[strings.ToLower(fields[0])]
+	if !ok {
+		fmt.Fprintf(conn, "ERR unknown command %q\n", fields[0])
+		return
+	}
+	s.Logger.Log(logger.LogLevelInfo, "Control command: %s", strings.Join(fields, " "))
+
+	output, err := command(s, fields[1:])
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "OK\n%s", output)
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		fmt.Fprintln(conn)
+	}
+}
+
+// QueryControl sends a command to the control socket at path and returns
+// the command output
+func QueryControl(path, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to control socket %s: %v", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return "", fmt.Errorf("failed to send control command: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read control response: %v", err)
+	}
+	status = strings.TrimSuffix(status, "\n")
+	if strings.HasPrefix(status, "ERR ") {
+		return "", errors.New(strings.TrimPrefix(status, "ERR "))
+	}
+	if status != "OK" {
+		return "", fmt.Errorf("unexpected control response %q", status)
+	}
+
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read control response: %v", err)
+	}
+	return string(output), nil
+}
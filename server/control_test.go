@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"go-relay-server/config"
+	"go-relay-server/queue"
+	"go-relay-server/relay"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlStatus(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "none"})
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 1))
+	c.cmd(250, "EHLO client.test")
+
+	output, err := QueryControl(cfg.ControlSocket, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal([]byte(output), &snapshot); err != nil {
+		t.Fatalf("status is not a snapshot: %v\n%s", err, output)
+	}
+
+	if snapshot.Status != "running" {
+		t.Errorf("status %q, want running", snapshot.Status)
+	}
+	if since := time.Since(snapshot.StartedAt); since < 0 || since > time.Minute || snapshot.UptimeSeconds < 0 {
+		t.Errorf("started at %v with uptime %ds, want the start of this test", snapshot.StartedAt, snapshot.UptimeSeconds)
+	}
+	if len(snapshot.Listeners) != 2 {
+		t.Fatalf("%d listeners reported, want 2", len(snapshot.Listeners))
+	}
+	for i, want := range []int64{0, 1} {
+		if got := snapshot.Listeners[i]; got.Port != cfg.Listeners[i].Port || got.ActiveConnections != want {
+			t.Errorf("listener %d reported as %+v, want port %s with %d active connections", i, got, cfg.Listeners[i].Port, want)
+		}
+	}
+	if snapshot.Queue == nil {
+		t.Error("queue stats missing")
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	info, err := os.Stat(cfg.ControlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("control socket mode %v, want 0600", perm)
+	}
+
+	for _, tt := range []struct {
+		command string
+		output  string // Substring of the output, or of the error when err is set
+		err     bool
+	}{
+		{"blocklist add 127.0.0.1", "added 127.0.0.1", false},
+		{"blocklist list", "127.0.0.1", false},
+		{"queue list", "", false},
+		{"queue requeue no-such-id", "not found", true},
+		{"queue", "usage", true},
+		{"failed bogus", "unknown failed command", true},
+		{"QUEUE flush-failed", "removed", false},
+		{"shutdown", `unknown command "shutdown"`, true},
+		{"", "empty command", true},
+	} {
+		output, err := QueryControl(cfg.ControlSocket, tt.command)
+		if tt.err {
+			if err == nil || !strings.Contains(err.Error(), tt.output) {
+				t.Errorf("%q returned %q, %v, want an error containing %q", tt.command, output, err, tt.output)
+			}
+			continue
+		}
+		if err != nil || !strings.Contains(output, tt.output) {
+			t.Errorf("%q returned %q, %v, want output containing %q", tt.command, output, err, tt.output)
+		}
+	}
+
+	// The added entry applies to new connections
+	if _, code := greetingCode(t, listenerAddr(cfg, 0)); code != 550 {
+		t.Fatalf("connection after blocklist add got %d, want 550", code)
+	}
+}
+
+// control runs a control command that must succeed and returns its output
+// without the trailing newline
+func control(t *testing.T, cfg config.Config, command string) string {
+	t.Helper()
+	output, err := QueryControl(cfg.ControlSocket, command)
+	if err != nil {
+		t.Fatalf("%q failed: %v", command, err)
+	}
+	return strings.TrimSuffix(output, "\n")
+}
+
+func TestControlFailed(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+	control(t, cfg, "failed clear")
+
+	if output := control(t, cfg, "failed list"); output != "no failed items" {
+		t.Fatalf("failed list on an empty queue = %q", output)
+	}
+	q := relay.GetQueue()
+	for _, to := range []string{"first@example.org", "second@example.org"} {
+		item := &queue.QueueItem{
+			Envelope:  queue.Envelope{From: "failed-cli@example.com", To: to},
+			Data:      []byte("Subject: failed " + to + "\r\n\r\n"),
+			LastError: "550 no such user " + to,
+		}
+		if err := q.Fail(item, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed := q.GetFailedItems()
+	first, second := failed[0].Item.ID, failed[1].Item.ID
+
+	lines := strings.Split(strings.TrimSpace(control(t, cfg, "failed list")), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID ") || !strings.Contains(lines[0], "FAILED AT") {
+		t.Fatalf("failed list = %q, want a header and two items", lines)
+	}
+	for i, id := range []string{first, second} {
+		fields := strings.Fields(lines[i+1])
+		if fields[0] != id {
+			t.Errorf("line %d lists %q, want %s", i+1, fields[0], id)
+		}
+		if _, err := time.Parse(time.RFC3339, fields[1]); err != nil {
+			t.Errorf("line %d has no timestamp: %q", i+1, lines[i+1])
+		}
+		if !strings.Contains(lines[i+1], "550 no such user") {
+			t.Errorf("line %d does not show the error: %q", i+1, lines[i+1])
+		}
+	}
+
+	if output := control(t, cfg, "failed requeue "+first); output != "requeued "+first {
+		t.Errorf("failed requeue = %q", output)
+	}
+	if failed := q.GetFailedItems(); len(failed) != 1 || failed[0].Item.ID != second {
+		t.Errorf("failed items after requeue = %+v, want only %s", failed, second)
+	}
+	if _, err := QueryControl(cfg.ControlSocket, "failed requeue "+first); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("requeueing %s twice returned %v, want not found", first, err)
+	}
+
+	if output := control(t, cfg, "failed clear"); output != "removed 1 failed items" {
+		t.Errorf("failed clear = %q", output)
+	}
+	if output := control(t, cfg, "failed list"); output != "no failed items" {
+		t.Errorf("failed list after clear = %q", output)
+	}
+}
+
+func TestControlReloadSource(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	updated := cfg
+	updated.Greeting = "fetched"
+	data, err := json.Marshal(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(data) }))
+	defer source.Close()
+
+	for _, tt := range []struct {
+		configPath string
+		want       string
+		err        string
+	}{
+		{config.Stdin, "", "config was read from standard input and cannot be reloaded"},
+		{source.URL + "/config.json", "configuration reloaded", ""},
+	} {
+		s, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ConfigPath = tt.configPath
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		output, err := QueryControl(cfg.ControlSocket, "reload")
+		s.Stop()
+		if output = strings.TrimSuffix(output, "\n"); output != tt.want || (tt.err == "") != (err == nil) || (err != nil && err.Error() != tt.err) {
+			t.Errorf("reload of %s = %q, %v, want %q, %q", tt.configPath, output, err, tt.want, tt.err)
+		}
+		if tt.err == "" && s.currentConfig().Greeting != "fetched" {
+			t.Errorf("reload of %s did not apply the fetched config", tt.configPath)
+		}
+	}
+}
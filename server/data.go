@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"go-relay-server/logger"
+	"io"
+	"net"
+	"net/textproto"
+	"syscall"
+)
+
+// spoolError is a failure to store message data, as opposed to a failure of
+// the client connection
+type spoolError struct {
+	err error
+}
+
+func (e *spoolError) Error() string { return "failed to spool message: " + e.err.Error() }
+func (e *spoolError) Unwrap() error { return e.err }
+
+// spoolWriter marks the errors of w as spool errors
+type spoolWriter struct {
+	w io.Writer
+}
+
+func (w spoolWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		err = &spoolError{err: err}
+	}
+	return n, err
+}
+
+// readData copies message data from r into dst, telling spool failures
+// apart from read failures. r yielding fewer than want bytes is an
+// io.ErrUnexpectedEOF; want below zero reads r to its end.
+func readData(dst io.Writer, r io.Reader, want int64) error {
+	n, err := io.Copy(spoolWriter{w: dst}, r)
+	if err == nil && want >= 0 && n < want {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// clientGone reports whether a read failed because the client closed or
+// reset the connection
+func clientGone(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// dataFailed handles an error receiving the message data of a DATA or BDAT
+// command after received bytes were stored, once the spool has been closed.
+// When only the spool failed, the rest of the data in r is read and
+// discarded and the transaction is answered with 451. It reports whether
+// the session can go on; otherwise the client has gone, or is sent 421 if a
+// reply is still possible, and the connection must be closed.
+func (s *Server) dataFailed(tp *textproto.Conn, r io.Reader, err error, cmd string, received int64, remoteAddr string) bool {
+	var spoolErr *spoolError
+	if errors.As(err, &spoolErr) {
+		s.Logger.Log(logger.LogLevelError, "Error storing %s from %s after %d bytes: %v", cmd, remoteAddr, received, err)
+		if _, err = io.Copy(io.Discard, r); err == nil {
+			reply(tp, "451 Requested action aborted: local error in processing")
+			return true
+		}
+	}
+
+	if clientGone(err) {
+		s.Logger.Log(logger.LogLevelWarn, "Connection from %s lost during %s after %d bytes: %v", remoteAddr, cmd, received, err)
+		return false
+	}
+	s.Logger.Log(logger.LogLevelError, "Error reading %s from %s after %d bytes: %v", cmd, remoteAddr, received, err)
+	tp.PrintfLine("421 %s Error reading message data, closing transmission channel", s.hostname())
+	return false
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-relay-server/config"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+)
+
+// spoolFiles returns the number of files in dir
+func spoolFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestDataDisconnect(t *testing.T) {
+	// More than DotReader buffers before its first write, so DATA spills too
+	partial := strings.Repeat("A line of a message that never ends\r\n", 1000)
+	for _, tt := range []struct {
+		cmd   string
+		start func(c *client)
+		want  string
+	}{
+		{"DATA", func(c *client) { c.cmd(354, "DATA") }, fmt.Sprintf("lost during DATA after %d bytes", len(partial)-1000)},
+		{"BDAT", func(c *client) { fmt.Fprintf(c.conn, "BDAT %d LAST\r\n", 2*len(partial)) }, fmt.Sprintf("lost during BDAT after %d bytes", len(partial))},
+	} {
+		t.Run(tt.cmd, func(t *testing.T) {
+			upstream := startUpstream(t)
+			cfg := testConfig(t, upstream.Addr)
+			spoolDir := t.TempDir()
+			cfg.Spool = config.SpoolConfig{Dir: spoolDir, MemoryThreshold: 1024}
+			startServer(t, cfg)
+
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.cmd(250, "MAIL FROM:<a@example.com>")
+			c.cmd(250, "RCPT TO:<b@example.org>")
+			tt.start(c)
+			// Past the memory threshold, so the message is spilled to a file
+			fmt.Fprint(c.conn, partial)
+			waitFor(t, "the message to spill", func() bool { return spoolFiles(t, spoolDir) == 1 })
+			c.conn.Close()
+
+			waitFor(t, "the disconnect in the log", func() bool { return strings.Contains(readLog(t, cfg), tt.want) })
+			if n := spoolFiles(t, spoolDir); n != 0 {
+				t.Errorf("%d spool files left after the disconnect", n)
+			}
+			if n := len(upstream.Messages()); n != 0 {
+				t.Errorf("upstream received %d messages from a dropped transfer", n)
+			}
+		})
+	}
+}
+
+func TestSpoolFailure(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	spoolDir := t.TempDir()
+	cfg.Spool = config.SpoolConfig{Dir: spoolDir, MemoryThreshold: 1024}
+	startServer(t, cfg)
+	if err := os.Remove(spoolDir); err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("A line that cannot be spooled\r\n", 100)
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.data(451, testMessage("spool failure data", large))
+
+	message := testMessage("spool failure bdat", large)
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	fmt.Fprintf(c.conn, "BDAT %d LAST\r\n%s", len(message), message)
+	c.expect(451)
+
+	// The session goes on with messages that fit in memory
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("spool failure small", "Hello\r\n"))
+	if n := len(upstream.Messages()); n != 1 {
+		t.Fatalf("upstream received %d messages, want only the small one", n)
+	}
+	if log := readLog(t, cfg); !strings.Contains(log, "Error storing DATA") || !strings.Contains(log, "Error storing BDAT") {
+		t.Errorf("log does not report the spool failures:\n%s", log)
+	}
+}
+
+// bufferConn is a connection that reads from r and records what is written
+type bufferConn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error) { return c.Reader.Read(p) }
+func (c *bufferConn) Close() error               { return nil }
+
+func TestDataFailed(t *testing.T) {
+	upstream := startUpstream(t)
+	s, err := NewServer(testConfig(t, upstream.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		r     io.Reader
+		err   error
+		goOn  bool
+		reply string
+	}{
+		{"client closed", nil, io.ErrUnexpectedEOF, false, ""},
+		{"client reset", nil, fmt.Errorf("read: %w", syscall.ECONNRESET), false, ""},
+		{"connection closed", nil, net.ErrClosed, false, ""},
+		{"read error", nil, errors.New("line too long"), false, "421 relay.test Error reading message data"},
+		{"spool error", strings.NewReader("rest of the message"), &spoolError{err: errors.New("disk full")}, true, "451 Requested action aborted"},
+		{"spool error and disconnect", iotest.ErrReader(io.ErrUnexpectedEOF), &spoolError{err: errors.New("disk full")}, false, ""},
+	} {
+		conn := &bufferConn{Reader: strings.NewReader("")}
+		tp := textproto.NewConn(conn)
+		if goOn := s.dataFailed(tp, tt.r, tt.err, "DATA", 10, "192.0.2.1:40000"); goOn != tt.goOn {
+			t.Errorf("%s: dataFailed = %v, want %v", tt.name, goOn, tt.goOn)
+		}
+		tp.W.Flush()
+		if got := conn.String(); !strings.HasPrefix(got, tt.reply) || (tt.reply == "" && got != "") {
+			t.Errorf("%s: replied %q, want %q", tt.name, got, tt.reply)
+		}
+	}
+}
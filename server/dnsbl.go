@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"go-relay-server/logger"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultDNSBLTimeout bounds the DNSBL lookups for one connection
+	defaultDNSBLTimeout = 5 * time.Second
+	// defaultDNSBLCacheTTL is how long a DNSBL answer is remembered
+	defaultDNSBLCacheTTL = time.Hour
+)
+
+// checkDNSBL looks the client up in the configured DNSBL zones and reports
+// whether the connection may proceed, along with the zone that listed it.
+// Loopback and private addresses are never looked up, and a failed lookup
+// lets the client through.
+func (s *Server) checkDNSBL(ctx context.Context, host string) (bool, string) {
+	conf := s.currentConfig().DNSBL
+	if conf.Mode == "" || conf.Mode == "off" || len(conf.Zones) == 0 {
+		return true, ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return true, ""
+	}
+
+	timeout, cacheTTL := defaultDNSBLTimeout, defaultDNSBLCacheTTL
+	if d, err := time.ParseDuration(conf.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	if d, err := time.ParseDuration(conf.CacheTTL); err == nil && d > 0 {
+		cacheTTL = d
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, zone := range conf.Zones {
+		listed, err := s.dnsblChecker.Listed(ctx, ip, zone, cacheTTL)
+		if err != nil {
+			s.Logger.Log(logger.LogLevelWarn, "DNSBL check of %s at %s failed: %v", host, zone, err)
+			continue
+		}
+		if !listed {
+			continue
+		}
+		if conf.Mode == "enforce" {
+			s.Logger.Log(logger.LogLevelWarn, "Rejected connection from %s: listed at %s", host, zone)
+			return false, zone
+		}
+		s.Logger.Log(logger.LogLevelInfo, "Connection from %s is listed at %s", host, zone)
+	}
+	return true, ""
+}
+
+// dnsblResponse returns the reply for a client listed at zone
+func (s *Server) dnsblResponse(zone string) string {
+	return strings.ReplaceAll(s.response("dnsbl_listed"), "{zone}", zone)
+}
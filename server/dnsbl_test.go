@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/dnsbl"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blocklist answers DNSBL queries for the addresses it lists and counts
+// every query
+type blocklist struct {
+	listed  map[string]bool
+	mu      sync.Mutex
+	queries int
+}
+
+func (b *blocklist) LookupHost(ctx context.Context, host string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queries++
+	if b.listed[host] {
+		return []string{"127.0.0.2"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (b *blocklist) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.queries
+}
+
+// startDNSBLServer starts a server behind a PROXY balancer, so clients can
+// claim public addresses, that asks bl for its DNSBL answers
+func startDNSBLServer(t *testing.T, mode string, bl *blocklist) config.Config {
+	t.Helper()
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.DNSBL = config.DNSBLConfig{Mode: mode, Zones: []string{"clean.test", "bl.test"}}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dnsblChecker = dnsbl.NewChecker(bl)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return cfg
+}
+
+func TestDNSBL(t *testing.T) {
+	bl := &blocklist{listed: map[string]bool{"66.2.0.192.bl.test": true}}
+	cfg := startDNSBLServer(t, "enforce", bl)
+	addr := listenerAddr(cfg, 0)
+
+	c := connect(t, addr)
+	fmt.Fprint(c.conn, "PROXY TCP4 192.0.2.66 192.0.2.254 40000 25\r\n")
+	if code, msg := c.reply(); code != 554 || msg != "Rejected - listed at bl.test" {
+		t.Fatalf("listed client got %d %q, want 554 Rejected - listed at bl.test", code, msg)
+	}
+	if !c.closed() {
+		t.Error("connection of a listed client was not closed")
+	}
+	waitFor(t, "the rejection in the log", func() bool {
+		return strings.Contains(readLog(t, cfg), "Rejected connection from 192.0.2.66: listed at bl.test")
+	})
+
+	c, code := proxyDial(t, addr, "192.0.2.1")
+	if code != 220 {
+		t.Fatalf("client that is not listed got %d, want 220", code)
+	}
+	c.cmd(221, "QUIT")
+
+	// Both zones were asked about each client, and asking again is
+	// answered from the cache
+	if n := bl.count(); n != 4 {
+		t.Fatalf("resolver was queried %d times, want 4", n)
+	}
+	proxyDial(t, addr, "192.0.2.66")
+	c, _ = proxyDial(t, addr, "192.0.2.1")
+	c.cmd(221, "QUIT")
+	if n := bl.count(); n != 4 {
+		t.Fatalf("resolver was queried %d times after repeated clients, want 4", n)
+	}
+
+	// Loopback clients are never looked up
+	c = connect(t, addr)
+	fmt.Fprint(c.conn, "PROXY UNKNOWN\r\n")
+	if code, _ = c.reply(); code != 220 || bl.count() != 4 {
+		t.Fatalf("loopback client got %d after %d queries", code, bl.count())
+	}
+}
+
+func TestDNSBLMonitor(t *testing.T) {
+	bl := &blocklist{listed: map[string]bool{"66.2.0.192.bl.test": true}}
+	cfg := startDNSBLServer(t, "monitor", bl)
+
+	c, code := proxyDial(t, listenerAddr(cfg, 0), "192.0.2.66")
+	if code != 220 {
+		t.Fatalf("listed client got %d in monitor mode, want 220", code)
+	}
+	c.cmd(221, "QUIT")
+	waitFor(t, "the listing in the log", func() bool {
+		return strings.Contains(readLog(t, cfg), "Connection from 192.0.2.66 is listed at bl.test")
+	})
+}
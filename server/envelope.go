@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errInvalidAddress is returned by parsePath for addresses containing
+// control characters, which could inject headers once the address is written
+// into an envelope or trace header
+var errInvalidAddress = errors.New("invalid address")
+
+// parsePath splits a MAIL FROM or RCPT TO command into the address between
+// the angle brackets and the ESMTP parameters that follow. The address is
+// returned as sent, so UTF-8 local parts and domains are preserved.
+func parsePath(line, prefix string) (string, []string, error) {
+	if len(line) < len(prefix) || !strings.EqualFold(line[:len(prefix)], prefix) {
+		return "", nil, fmt.Errorf("expected %s<address>", prefix)
+	}
+	rest := strings.TrimLeft(line[len(prefix):], " ")
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, fmt.Errorf("expected %s<address>", prefix)
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", nil, fmt.Errorf("unterminated address")
+	}
+	address := rest[1:end]
+	if !utf8.ValidString(address) {
+		return "", nil, fmt.Errorf("address is not valid UTF-8")
+	}
+	if strings.IndexFunc(address, unicode.IsControl) >= 0 {
+		return "", nil, errInvalidAddress
+	}
+	return address, strings.Fields(rest[end+1:]), nil
+}
+
+// normalizeAddress returns the form of an envelope address used for list
+// checks, routing and logging: surrounding spaces are trimmed and the domain
+// is lowercased without a trailing dot. The local part is lowercased too
+// when localPartCase is "lower"; otherwise it is kept, since RFC 5321 lets
+// the receiving domain treat it as case-sensitive.
+func normalizeAddress(address, localPartCase string) string {
+	address = strings.TrimSpace(address)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		if localPartCase == "lower" {
+			return strings.ToLower(address)
+		}
+		return address
+	}
+	local, domain := address[:at], strings.ToLower(strings.TrimSuffix(address[at+1:], "."))
+	if localPartCase == "lower" {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain
+}
+
+// mailParams holds the MAIL FROM parameters the server understands
+type mailParams struct {
+	body     string // "7BIT" or "8BITMIME", empty if not given
+	smtpUTF8 bool
+}
+
+// parseMailParams validates MAIL FROM parameters, accepting BODY=7BIT,
+// BODY=8BITMIME (RFC 6152) and SMTPUTF8 (RFC 6531)
+func parseMailParams(params []string) (mailParams, error) {
+	var parsed mailParams
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "BODY":
+			value = strings.ToUpper(value)
+			if value != "7BIT" && value != "8BITMIME" {
+				return parsed, fmt.Errorf("unsupported BODY value %q", value)
+			}
+			parsed.body = value
+		case "SMTPUTF8":
+			if value != "" {
+				return parsed, fmt.Errorf("SMTPUTF8 takes no value")
+			}
+			parsed.smtpUTF8 = true
+		default:
+			return parsed, fmt.Errorf("unrecognized parameter %q", key)
+		}
+	}
+	return parsed, nil
+}
+
+// isASCII reports whether s contains only 7-bit characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
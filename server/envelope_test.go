@@ -0,0 +1,213 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseMailParams(t *testing.T) {
+	for _, tt := range []struct {
+		params []string
+		want   mailParams
+		ok     bool
+	}{
+		{nil, mailParams{}, true},
+		{[]string{"BODY=8BITMIME"}, mailParams{body: "8BITMIME"}, true},
+		{[]string{"body=7bit"}, mailParams{body: "7BIT"}, true},
+		{[]string{"SMTPUTF8"}, mailParams{smtpUTF8: true}, true},
+		{[]string{"BODY=8BITMIME", "smtputf8"}, mailParams{body: "8BITMIME", smtpUTF8: true}, true},
+		{[]string{"BODY=BINARYMIME"}, mailParams{}, false},
+		{[]string{"SMTPUTF8=yes"}, mailParams{}, false},
+		{[]string{"SIZE=1000"}, mailParams{}, false},
+	} {
+		got, err := parseMailParams(tt.params)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseMailParams(%q) = %+v, %v, want %+v", tt.params, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("parseMailParams(%q) accepted invalid parameters", tt.params)
+		}
+	}
+}
+
+func TestUTF8Addresses(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	ehlo := c.cmd(250, "EHLO client.test")
+	for _, extension := range []string{"8BITMIME", "SMTPUTF8"} {
+		if !strings.Contains(ehlo, extension) {
+			t.Errorf("EHLO does not advertise %s: %q", extension, ehlo)
+		}
+	}
+
+	// UTF-8 addresses need SMTPUTF8 on the transaction
+	c.cmd(553, "MAIL FROM:<josé@example.com>")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(553, "RCPT TO:<пользователь@пример.рф>")
+	c.cmd(250, "RSET")
+	c.cmd(555, "MAIL FROM:<a@example.com> BODY=BINARYMIME")
+
+	c.cmd(250, "MAIL FROM:<josé@example.com> BODY=8BITMIME SMTPUTF8")
+	c.cmd(250, "RCPT TO:<пользователь@Пример.РФ>")
+	c.data(250, testMessage("utf8", "Grüße\r\n"))
+
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) == 1 })
+	msg := upstream.Messages()[0]
+	if msg.From != "josé@example.com" || len(msg.To) != 1 || msg.To[0] != "пользователь@пример.рф" {
+		t.Fatalf("relayed envelope %s -> %v, want the UTF-8 addresses with the domain lowercased", msg.From, msg.To)
+	}
+	if !strings.Contains(string(msg.Data), "Grüße") {
+		t.Errorf("8-bit body not preserved:\n%s", msg.Data)
+	}
+	// The extensions are passed on to the upstream, which supports them
+	for _, command := range upstream.Commands() {
+		if strings.HasPrefix(command, "MAIL") {
+			if !strings.Contains(command, "SMTPUTF8") || !strings.Contains(command, "BODY=8BITMIME") {
+				t.Errorf("upstream got %q, want SMTPUTF8 and BODY=8BITMIME", command)
+			}
+		}
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.MaxRecipients = 2
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(250, "RCPT TO:<c@example.org>")
+	if msg := c.cmd(452, "RCPT TO:<d@example.org>"); msg != "Too many recipients" {
+		t.Errorf("rejected with %q, want \"Too many recipients\"", msg)
+	}
+	c.cmd(452, "RCPT TO:<e@example.org>")
+	c.data(250, testMessage("max recipients", "Hello\r\n"))
+
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) == 1 })
+	if to := upstream.Messages()[0].To; !slices.Equal(to, []string{"b@example.org", "c@example.org"}) {
+		t.Fatalf("delivered to %v, want the accepted recipients", to)
+	}
+
+	// The limit is per transaction
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<f@example.org>")
+	c.cmd(250, "RCPT TO:<g@example.org>")
+}
+
+func TestParsePathControlCharacters(t *testing.T) {
+	for _, address := range []string{
+		"a@example.com\r\nX-Injected: yes",
+		"a@example.com\rX-Injected: yes",
+		"a@example.com\nX-Injected: yes",
+		"a\x00b@example.com",
+		"a\tb@example.com",
+		"a\x1b@example.com",
+		"a\x7f@example.com",
+		"a\u0085@example.com",
+	} {
+		for _, prefix := range []string{"MAIL FROM:", "RCPT TO:"} {
+			if _, _, err := parsePath(prefix+"<"+address+">", prefix); err != errInvalidAddress {
+				t.Errorf("parsePath(%q) returned %v, want errInvalidAddress", prefix+"<"+address+">", err)
+			}
+		}
+	}
+	if address, _, err := parsePath("RCPT TO:<\"a b\"@example.com>", "RCPT TO:"); err != nil || address != "\"a b\"@example.com" {
+		t.Errorf("quoted space rejected: %q, %v", address, err)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	// A bare CR stays inside the command line
+	c.cmd(501, "MAIL FROM:<a@example.com\rBcc: victim@example.net>")
+	c.cmd(250, "MAIL FROM:<injection@example.com>")
+	c.cmd(501, "RCPT TO:<b@example.org\rBcc: victim@example.net>")
+	c.cmd(501, "RCPT TO:<b\x00@example.org>")
+
+	// CRLF ends the command early: neither half is taken as an address
+	c.tp.W.WriteString("RCPT TO:<b@example.org\r\nBcc: victim@example.net>\r\n")
+	c.tp.W.Flush()
+	c.expect(501)
+	if code, _ := c.reply(); code/100 != 5 {
+		t.Errorf("injected header line answered %d, want an error", code)
+	}
+
+	// Nothing injected made it into the envelope
+	c.cmd(250, "RCPT TO:<c@example.org>")
+	c.data(250, testMessage("injection", "Body\r\n"))
+	messages := upstream.Messages()
+	if len(messages) != 1 || messages[0].From != "injection@example.com" || !slices.Equal(messages[0].To, []string{"c@example.org"}) {
+		t.Fatalf("upstream received %+v, want one message from injection@example.com to c@example.org", messages)
+	}
+	if strings.Contains(string(messages[0].Data), "victim") {
+		t.Errorf("injected header relayed:\n%s", messages[0].Data)
+	}
+	if !strings.Contains(readLog(t, cfg), "Rejected address with control characters") {
+		t.Error("rejected addresses were not logged")
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for _, tt := range []struct {
+		address, localPartCase, want string
+	}{
+		{"User@Example.COM", "", "User@example.com"},
+		{"User@Example.COM", "preserve", "User@example.com"},
+		{"User@Example.COM", "lower", "user@example.com"},
+		{"  padded@example.com  ", "", "padded@example.com"},
+		{"dot@Example.com.", "", "dot@example.com"},
+		{"\"Quoted@Local\"@Example.com", "", "\"Quoted@Local\"@example.com"},
+		{"Postmaster", "lower", "postmaster"},
+		{"Postmaster", "", "Postmaster"},
+		{"", "", ""},
+	} {
+		if got := normalizeAddress(tt.address, tt.localPartCase); got != tt.want {
+			t.Errorf("normalizeAddress(%q, %q) = %q, want %q", tt.address, tt.localPartCase, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizedEnvelope(t *testing.T) {
+	upstream := startUpstream(t)
+	routed := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.BlockList = []string{"blocked.example.com", "spam@example.com"}
+	cfg.DomainRouting = map[string]config.RelayList{"example.net": {routed.Addr}}
+	cfg.LocalPartCase = "lower"
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	// Mixed case, padding and a trailing dot do not get past the block list
+	for _, sender := range []string{"Someone@BLOCKED.Example.COM", " someone@blocked.example.com. ", "SPAM@Example.Com"} {
+		c.cmd(550, "MAIL FROM:<%s>", sender)
+	}
+
+	// Routing and delivery use the normalized addresses
+	c.cmd(250, "MAIL FROM:<Sender@Example.ORG>")
+	c.cmd(250, "RCPT TO:< Rcpt@EXAMPLE.NET. >")
+	c.data(250, testMessage("normalized", "Body\r\n"))
+	messages := routed.Messages()
+	if len(messages) != 1 || messages[0].From != "sender@example.org" || !slices.Equal(messages[0].To, []string{"rcpt@example.net"}) {
+		t.Fatalf("routed relay received %+v, want sender@example.org -> rcpt@example.net", messages)
+	}
+	if n := len(upstream.Messages()); n != 0 {
+		t.Errorf("default relay received %d messages", n)
+	}
+	if !strings.Contains(readLog(t, cfg), "From=sender@example.org") {
+		t.Error("log does not show the normalized sender")
+	}
+}
@@ -1,37 +1,71 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-relay-server/callout"
 	"go-relay-server/config"
 	"go-relay-server/logger"
-	"go-relay-server/relay"
+	"go-relay-server/spf"
+	"go-relay-server/spool"
+	"io"
 	"net"
+	"net/mail"
 	"net/textproto"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
+// requiredHeaders are the RFC 5322 headers checked by the header policy
+var requiredHeaders = []string{"Date", "From"}
+
+// relayTargetHeader lets trusted clients override routing for a message
+const relayTargetHeader = "X-Relay-Target"
+
+// spfTimeout bounds the DNS lookups of a single SPF check
+const spfTimeout = 10 * time.Second
+
 type RateLimitingConfig struct {
 	RequestsPerMinute int
 	BurstLimit        int
 	ExemptIPs         []string
 }
 
+// rateLimiter throttles connections with a token bucket per key. Each bucket
+// holds up to burst_limit connections and refills at requests_per_minute.
 type rateLimiter struct {
-	requests map[string]int
-	lastTime map[string]time.Time
-	mu       sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
 }
 
+// rateBucketIdle is how long a bucket may go unused before it is dropped.
+// As burst_limit cannot exceed requests_per_minute, an idle bucket has
+// refilled by then and dropping it changes nothing.
+const rateBucketIdle = time.Minute
+
 func newRateLimiter() *rateLimiter {
 	return &rateLimiter{
-		requests: make(map[string]int),
-		lastTime: make(map[string]time.Time),
+		buckets:   make(map[string]*rateBucket),
+		lastSweep: time.Now(),
 	}
 }
 
-func (rl *rateLimiter) allow(ip string, config RateLimitingConfig) bool {
+// allow counts a connection from ip against the limit. Connections are
+// counted per key, which is the IP or, for a listener with its own limits,
+// the listener and the IP.
+func (rl *rateLimiter) allow(key, ip string, config RateLimitingConfig) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -43,27 +77,73 @@ func (rl *rateLimiter) allow(ip string, config RateLimitingConfig) bool {
 	}
 
 	now := time.Now()
+	rl.sweep(now)
 
-	// Reset counter if window has passed
-	if now.Sub(rl.lastTime[ip]) > time.Minute {
-		rl.requests[ip] = 0
-		rl.lastTime[ip] = now
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &rateBucket{tokens: float64(config.BurstLimit), last: now}
+		rl.buckets[key] = bucket
 	}
+	bucket.tokens = min(float64(config.BurstLimit), bucket.tokens+now.Sub(bucket.last).Minutes()*float64(config.RequestsPerMinute))
+	bucket.last = now
 
 	// Check rate limit
-	if rl.requests[ip] >= config.RequestsPerMinute {
+	if bucket.tokens < 1 {
 		return false
 	}
-
-	rl.requests[ip]++
+	bucket.tokens--
 	return true
 }
 
-func (s *Server) handleConnection(conn net.Conn, cfg config.ListenerConfig) {
+// sweep drops the buckets of clients that have gone quiet, at most once per
+// idle period, so the limiter does not grow with every client ever seen
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateBucketIdle {
+		return
+	}
+	rl.lastSweep = now
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= rateBucketIdle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimit returns the rate limiter key and limits for a connection from
+// ip on listener cfg. A listener with its own rate_limiting is throttled
+// separately from the others, which share the global limits.
+func (s *Server) rateLimit(ip string, cfg config.ListenerConfig) (string, RateLimitingConfig) {
+	if cfg.RateLimiting != nil {
+		return cfg.Port + "/" + ip, RateLimitingConfig(*cfg.RateLimiting)
+	}
+	return ip, RateLimitingConfig(s.currentConfig().RateLimiting)
+}
+
+// handleConnection runs an SMTP session. Once ctx is cancelled blocking
+// waits are cut short and the session ends before its next command.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, cfg config.ListenerConfig) {
 	defer conn.Close()
 
+	// The connection is closed at its next command once the lifetime is over,
+	// however busy it is
+	var expires time.Time
+	if lifetime := s.connectionLifetime(); lifetime > 0 {
+		expires = time.Now().Add(lifetime)
+	}
+
 	// Parse remote address handling both IPv4 and IPv6
 	remoteAddr := conn.RemoteAddr().String()
+	if cfg.ProxyProtocol {
+		proxied, clientAddr, err := readProxyHeader(conn)
+		if err != nil {
+			s.Logger.Log(logger.LogLevelWarn, "Dropped connection from %s: %v", remoteAddr, err)
+			return
+		}
+		s.Logger.Log(logger.LogLevelInfo, "PROXY header from %s reports client %s", remoteAddr, clientAddr)
+		conn, remoteAddr = proxied, clientAddr
+	}
+	watch := watchIdle(ctx, conn)
+	defer watch.stop()
 	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
 		s.Logger.Log(logger.LogLevelError, "Error parsing remote address %s: %v", remoteAddr, err)
@@ -71,40 +151,113 @@ func (s *Server) handleConnection(conn net.Conn, cfg config.ListenerConfig) {
 		return
 	}
 
+	// Counted by client IP, which behind a PROXY protocol balancer is only
+	// known once the header has been read
+	if !s.connLimiter.acquireIP(host, s.currentConfig().MaxConnectionsPerIP) {
+		s.Logger.Log(logger.LogLevelWarn, "Too many connections from %s, rejected", host)
+		conn.Write([]byte(s.response("too_many_connections") + "\r\n"))
+		return
+	}
+	defer s.connLimiter.releaseIP(host)
+
 	s.Logger.Log(logger.LogLevelInfo, "New connection from %s", host)
 
+	// Only trusted clients may pick the upstream relay per message
+	targetHeader := s.currentConfig().RelayTargetHeader
+	trusted := targetHeader.Enabled && matchesList(host, targetHeader.TrustedClients)
+
 	// Check IP blocking
-	if s.isBlocked(host) {
+	if s.isBlocked(host, listIP) {
 		s.Logger.Log(logger.LogLevelWarn, "Blocked connection from %s", host)
-		conn.Write([]byte("550 Connection blocked\r\n"))
+		s.tarpit(ctx)
+		conn.Write([]byte(s.response("connection_blocked") + "\r\n"))
+		return
+	}
+
+	if ok, zone := s.checkDNSBL(ctx, host); !ok {
+		s.tarpit(ctx)
+		conn.Write([]byte(s.dnsblResponse(zone) + "\r\n"))
+		return
+	}
+
+	if !s.checkReverseDNS(ctx, host) {
+		s.tarpit(ctx)
+		conn.Write([]byte(s.response("no_reverse_dns") + "\r\n"))
+		return
+	}
+
+	// Check rate limiting
+	key, limits := s.rateLimit(host, cfg)
+	if !s.rateLimiter.allow(key, host, limits) {
+		s.rateLimited.Add(1)
+		s.Logger.Log(logger.LogLevelWarn, "Rate limited connection from %s", host)
+		s.tarpit(ctx)
+		conn.Write([]byte(s.response("rate_limited") + "\r\n"))
+		return
+	}
+
+	// Clients of implicit TLS listeners speak first with their handshake, so
+	// only plaintext greetings are delayed
+	if cfg.Encryption != "tls" && s.sentEarly(ctx, conn) {
+		s.Logger.Log(logger.LogLevelWarn, "Rejected connection from %s: sent data before the greeting", host)
+		conn.Write([]byte(s.response("early_talker") + "\r\n"))
 		return
 	}
 
 	// Handle STARTTLS command if configured
 	if cfg.Encryption == "starttls" {
 		tp := textproto.NewConn(conn)
-		tp.PrintfLine("220 Welcome to the SMTP Relay Server")
+		tp.PrintfLine("220 %s", s.greeting())
 
 		// Wait for STARTTLS command
 		for {
-			line, err := tp.ReadLine()
+			line, err := watch.readCommand(tp)
+			if ctx.Err() != nil {
+				s.shuttingDown(tp)
+				return
+			}
 			if err != nil {
 				s.Logger.Log(logger.LogLevelError, "Error reading from %s: %v", remoteAddr, err)
 				return
 			}
+			if expired(expires) {
+				s.Logger.Log(logger.LogLevelInfo, "Closing connection from %s: maximum lifetime reached", remoteAddr)
+				tp.PrintfLine("421 Closing connection")
+				return
+			}
 
 			if strings.ToUpper(line) == "STARTTLS" {
+				// Anything the client sent after STARTTLS arrived in plaintext
+				// and must not be processed as if it came over TLS
+				if n := discardPending(tp, conn); n > 0 {
+					s.Logger.Log(logger.LogLevelWarn, "Discarded %d bytes pipelined after STARTTLS from %s", n, remoteAddr)
+				}
 				tp.PrintfLine("220 Ready to start TLS")
-				conn = tls.Server(conn, s.tlsConfig)
+				conn = tls.Server(conn, s.listenerTLSConfig(cfg))
 				s.Logger.Log(logger.LogLevelInfo, "Upgraded connection to STARTTLS from %s", remoteAddr)
 				break
 			}
 
 			// Handle other commands before STARTTLS
-			cmd := strings.ToUpper(strings.Fields(line)[0])
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				tp.PrintfLine("500 Empty command")
+				continue
+			}
+			cmd := strings.ToUpper(fields[0])
+			if s.commandDisabled(cmd) {
+				tp.PrintfLine("502 Command disabled")
+				continue
+			}
 			switch cmd {
-			case "HELO", "EHLO":
-				tp.PrintfLine("250 Hello")
+			case "HELO":
+				tp.PrintfLine("250 %s", s.hostname())
+			case "EHLO":
+				tp.PrintfLine("250-%s", s.hostname())
+				tp.PrintfLine("250 STARTTLS")
+			case "AUTH":
+				s.Logger.Log(logger.LogLevelWarn, "Refused AUTH over unencrypted connection from %s", remoteAddr)
+				tp.PrintfLine("538 Encryption required for requested authentication mechanism")
 			case "QUIT":
 				tp.PrintfLine("221 Bye")
 				return
@@ -113,116 +266,697 @@ func (s *Server) handleConnection(conn net.Conn, cfg config.ListenerConfig) {
 			}
 		}
 	} else if cfg.Encryption == "tls" {
-		// Upgrade to TLS immediately for SMTPS
-		conn = tls.Server(conn, s.tlsConfig)
-		s.Logger.Log(logger.LogLevelInfo, "Upgraded connection to TLS from %s", remoteAddr)
+		// The listener performs implicit TLS for SMTPS, except behind a PROXY
+		// protocol balancer where the handshake follows the header
+		if cfg.ProxyProtocol {
+			conn = tls.Server(conn, s.listenerTLSConfig(cfg))
+		}
+		s.Logger.Log(logger.LogLevelInfo, "Accepted TLS connection from %s", remoteAddr)
 	}
 
-	// SMTP protocol handling
+	// Both starttls and tls listeners have completed the upgrade by now, and
+	// none of the session state below survives from before the upgrade
+	// (RFC 3207 section 4.2)
+	encrypted := cfg.Encryption == "starttls" || cfg.Encryption == "tls"
+
+	// A verified client certificate stands in for AUTH
+	var certUser string
+	if cfg.TLSClientCAFile != "" {
+		var ok bool
+		if certUser, ok = s.verifyClientCertificate(ctx, conn, remoteAddr); !ok {
+			return
+		}
+	}
+
+	// SMTP protocol handling. After STARTTLS the client expects no second
+	// greeting and continues with EHLO.
 	tp := textproto.NewConn(conn)
-	tp.PrintfLine("220 Welcome to the SMTP Relay Server")
+	if cfg.Encryption != "starttls" {
+		tp.PrintfLine("220 %s", s.greeting())
+	}
 
-	var from, to string
+	var from, helo string
+	authUser := certUser
+	var to []string
+	var smtpUTF8, esmtp bool
+	// greeted and inMail track the command order: HELO/EHLO, then MAIL, then RCPT
+	var greeted, inMail bool
+	// chunks collects the message of a BDAT transaction until its LAST chunk
+	var chunks *spool.Spool
+	defer func() {
+		if chunks != nil {
+			chunks.Close()
+		}
+	}()
 	for {
-		line, err := tp.ReadLine()
+		// Replies to pipelined commands go out together once the client
+		// has no more complete commands waiting
+		flushReplies(tp)
+		line, err := watch.readCommand(tp)
+		if ctx.Err() != nil {
+			s.shuttingDown(tp)
+			return
+		}
 		if err != nil {
 			s.Logger.Log(logger.LogLevelError, "Error reading from %s: %v", remoteAddr, err)
 			return
 		}
+		if expired(expires) {
+			s.Logger.Log(logger.LogLevelInfo, "Closing connection from %s: maximum lifetime reached", remoteAddr)
+			tp.PrintfLine("421 Closing connection")
+			return
+		}
 
-		cmd := strings.ToUpper(strings.Fields(line)[0])
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			reply(tp, "500 Empty command")
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		if s.commandDisabled(cmd) {
+			s.Logger.Log(logger.LogLevelWarn, "Rejected disabled command from %s: %s", remoteAddr, cmd)
+			reply(tp, "502 Command disabled")
+			continue
+		}
 		switch cmd {
 		case "HELO", "EHLO":
 			s.Logger.Log(logger.LogLevelInfo, "Received %s command from %s", cmd, remoteAddr)
-			tp.PrintfLine("250 Hello")
+			helo, esmtp = "", cmd == "EHLO"
+			// A greeting also aborts any transaction in progress
+			greeted, inMail, from, to = true, false, "", nil
+			if chunks != nil {
+				chunks.Close()
+				chunks = nil
+			}
+			if len(fields) > 1 {
+				helo = fields[1]
+			}
+			if cmd == "HELO" {
+				reply(tp, "250 %s", s.hostname())
+				continue
+			}
+			extensions := []string{s.hostname(), "PIPELINING", "8BITMIME", "SMTPUTF8"}
+			if !s.commandDisabled("BDAT") {
+				extensions = append(extensions, "CHUNKING")
+			}
+			if encrypted && s.authEnabled() && !s.commandDisabled("AUTH") {
+				extensions = append(extensions, "AUTH PLAIN LOGIN")
+			}
+			for i, extension := range extensions {
+				if i < len(extensions)-1 {
+					reply(tp, "250-%s", extension)
+				} else {
+					reply(tp, "250 %s", extension)
+				}
+			}
+		case "AUTH":
+			if !s.authEnabled() {
+				reply(tp, "502 Authentication not enabled")
+				continue
+			}
+			if !encrypted {
+				s.Logger.Log(logger.LogLevelWarn, "Refused AUTH over unencrypted connection from %s", remoteAddr)
+				reply(tp, "538 Encryption required for requested authentication mechanism")
+				continue
+			}
+			if authUser != "" {
+				reply(tp, "503 Already authenticated")
+				continue
+			}
+			authUser = s.handleAuth(tp, fields[1:])
+			if authUser != "" {
+				s.Logger.Log(logger.LogLevelInfo, "Authenticated %s as %s", remoteAddr, authUser)
+			} else {
+				s.Logger.Log(logger.LogLevelWarn, "Failed authentication from %s", remoteAddr)
+			}
 		case "MAIL":
-			from = strings.TrimPrefix(line, "MAIL FROM:<")
-			from = strings.TrimSuffix(from, ">")
+			if !greeted {
+				reply(tp, "503 Send HELO/EHLO first")
+				continue
+			}
+			// Recipients belong to the transaction, so a second MAIL would
+			// inherit the previous one's
+			if inMail {
+				reply(tp, "503 Nested MAIL command")
+				continue
+			}
+			if cfg.RequireAuth && authUser == "" {
+				reply(tp, "%s", s.response("auth_required"))
+				continue
+			}
+			address, args, err := parsePath(line, "MAIL FROM:")
+			if errors.Is(err, errInvalidAddress) {
+				s.Logger.Log(logger.LogLevelWarn, "Rejected address with control characters from %s: %q", remoteAddr, line)
+				reply(tp, "501 Invalid address")
+				continue
+			}
+			if err != nil {
+				reply(tp, "501 Syntax error: %v", err)
+				continue
+			}
+			address = normalizeAddress(address, s.currentConfig().LocalPartCase)
+			params, err := parseMailParams(args)
+			if err != nil {
+				reply(tp, "555 %v", err)
+				continue
+			}
+			if !params.smtpUTF8 && !isASCII(address) {
+				reply(tp, "553 Non-ASCII address requires SMTPUTF8")
+				continue
+			}
+			from, smtpUTF8 = address, params.smtpUTF8
 			s.Logger.Log(logger.LogLevelInfo, "Received MAIL command from %s: From=%s", remoteAddr, from)
-			tp.PrintfLine("250 OK")
+			if s.isBlocked(from, listSender) {
+				s.tarpit(ctx)
+				reply(tp, "%s", s.response("sender_blocked"))
+				s.Logger.Log(logger.LogLevelWarn, "Blocked email from %s", from)
+				from = ""
+				continue
+			}
+			if !s.isAllowed(from, listSender) {
+				reply(tp, "%s", s.response("sender_not_allowed"))
+				s.Logger.Log(logger.LogLevelWarn, "Rejected email from %s: not on allow list", from)
+				from = ""
+				continue
+			}
+			if !s.checkSPF(ctx, host, from) {
+				reply(tp, "%s", s.response("spf_fail"))
+				from = ""
+				continue
+			}
+			inMail = true
+			reply(tp, "250 OK")
 		case "RCPT":
-			to = strings.TrimPrefix(line, "RCPT TO:<")
-			to = strings.TrimSuffix(to, ">")
-			s.Logger.Log(logger.LogLevelInfo, "Received RCPT command from %s: To=%s", remoteAddr, to)
-			if s.isBlocked(to) {
-				tp.PrintfLine("550 Recipient blocked")
-				s.Logger.Log(logger.LogLevelWarn, "Blocked email to %s", to)
+			if !inMail {
+				reply(tp, "503 Need MAIL before RCPT")
+				continue
+			}
+			if limit := s.currentConfig().MaxRecipients; limit > 0 && len(to) >= limit {
+				s.Logger.Log(logger.LogLevelWarn, "Too many recipients from %s: limit %d", remoteAddr, limit)
+				reply(tp, "%s", s.response("too_many_recipients"))
+				continue
+			}
+			address, args, err := parsePath(line, "RCPT TO:")
+			if errors.Is(err, errInvalidAddress) {
+				s.Logger.Log(logger.LogLevelWarn, "Rejected address with control characters from %s: %q", remoteAddr, line)
+				reply(tp, "501 Invalid address")
+				continue
+			}
+			if err != nil {
+				reply(tp, "501 Syntax error: %v", err)
+				continue
+			}
+			address = normalizeAddress(address, s.currentConfig().LocalPartCase)
+			if len(args) > 0 {
+				reply(tp, "555 RCPT TO parameters not recognized")
+				continue
+			}
+			if !smtpUTF8 && !isASCII(address) {
+				reply(tp, "553 Non-ASCII address requires SMTPUTF8")
+				continue
+			}
+			s.Logger.Log(logger.LogLevelInfo, "Received RCPT command from %s: To=%s", remoteAddr, address)
+			if s.isBlocked(address, listRecipient) {
+				s.tarpit(ctx)
+				reply(tp, "%s", s.response("recipient_blocked"))
+				s.Logger.Log(logger.LogLevelWarn, "Blocked email to %s", address)
+				continue
+			}
+			if !s.isAllowed(address, listRecipient) {
+				reply(tp, "%s", s.response("recipient_not_allowed"))
+				s.Logger.Log(logger.LogLevelWarn, "Rejected email to %s: not on allow list", address)
+				continue
+			}
+			if s.greylist != nil && !s.greylist.Check(host, from, address) {
+				reply(tp, "%s", s.response("greylisted"))
+				s.Logger.Log(logger.LogLevelInfo, "Greylisted email from %s to %s via %s", from, address, host)
 				continue
 			}
-			tp.PrintfLine("250 OK")
+			if !s.checkCallout(ctx, address) {
+				reply(tp, "%s", s.response("no_such_user"))
+				continue
+			}
+			to = append(to, address)
+			reply(tp, "250 OK")
 		case "DATA":
+			if len(to) == 0 {
+				reply(tp, "503 Need RCPT before DATA")
+				continue
+			}
+			if chunks != nil {
+				reply(tp, "503 DATA not allowed after BDAT")
+				continue
+			}
 			s.Logger.Log(logger.LogLevelInfo, "Received DATA command from %s", remoteAddr)
 			tp.PrintfLine("354 Start mail input; end with <CRLF>.<CRLF>")
-			data, err := tp.ReadDotBytes()
+			// Large messages spill from memory to a temporary file
+			sp := s.newSpool()
+			data := s.withProgress(tp.DotReader(), remoteAddr)
+			if err := readData(sp, data, -1); err != nil {
+				received := sp.Size()
+				sp.Close()
+				if !s.dataFailed(tp, data, err, "DATA", received, remoteAddr) {
+					return
+				}
+				inMail, from, to = false, "", nil
+				continue
+			}
+			s.messagesReceived.Add(1)
+			trace := s.receivedHeader(helo, host, withProtocol(esmtp, encrypted, authUser != ""), to)
+			reply(tp, "%s", s.processMessage(ctx, sp, trace, from, to, trusted, remoteAddr))
+			inMail, from, to = false, "", nil
+		case "BDAT":
+			size, last, err := parseBDAT(fields[1:])
 			if err != nil {
-				s.Logger.Log(logger.LogLevelError, "Error reading data from %s: %v", remoteAddr, err)
+				// Without a size the chunk cannot be skipped, so the
+				// session cannot continue
+				tp.PrintfLine("501 Syntax error: %v", err)
 				return
 			}
-
-			// Extract subject from email data
-			subject := extractSubject(data)
-			s.Logger.Log(logger.LogLevelInfo, "Received email from %s: From=%s, To=%s, Subject=%s", remoteAddr, from, to, subject)
-			s.Logger.Log(logger.LogLevelInfo, "Email data: %s", string(data))
-			relay.RelayEmail(data, from, to, s.Config)
-			tp.PrintfLine("250 OK")
+			if len(to) == 0 {
+				// The chunk follows the command regardless and must not be
+				// read as commands
+				if _, err := io.CopyN(io.Discard, tp.R, size); err != nil {
+					return
+				}
+				reply(tp, "503 Need RCPT before BDAT")
+				continue
+			}
+			if chunks == nil {
+				s.Logger.Log(logger.LogLevelInfo, "Received BDAT command from %s", remoteAddr)
+				chunks = s.newSpool()
+			}
+			chunk := io.LimitReader(tp.R, size)
+			if err := readData(chunks, chunk, size); err != nil {
+				received := chunks.Size()
+				chunks.Close()
+				chunks = nil
+				if !s.dataFailed(tp, chunk, err, "BDAT", received, remoteAddr) {
+					return
+				}
+				inMail, from, to = false, "", nil
+				continue
+			}
+			if !last {
+				reply(tp, "250 %d octets received", size)
+				continue
+			}
+			s.messagesReceived.Add(1)
+			trace := s.receivedHeader(helo, host, withProtocol(esmtp, encrypted, authUser != ""), to)
+			reply(tp, "%s", s.processMessage(ctx, chunks, trace, from, to, trusted, remoteAddr))
+			inMail, from, to, chunks = false, "", nil, nil
+		case "NOOP":
+			reply(tp, "250 OK")
+		case "RSET":
+			// Aborts the transaction but keeps the greeting (RFC 5321 section 4.1.1.5)
+			inMail, from, to, smtpUTF8 = false, "", nil, false
+			if chunks != nil {
+				chunks.Close()
+				chunks = nil
+			}
+			reply(tp, "250 OK")
 		case "QUIT":
 			s.Logger.Log(logger.LogLevelInfo, "Received QUIT command from %s", remoteAddr)
 			tp.PrintfLine("221 Bye")
 			return
 		default:
 			s.Logger.Log(logger.LogLevelWarn, "Received unrecognized command from %s: %s", remoteAddr, line)
-			tp.PrintfLine("500 Unrecognized command")
+			reply(tp, "500 Unrecognized command")
 		}
 	}
 }
 
-func (s *Server) isBlocked(target string) bool {
+// discardPending drops input that has been read from the connection but not
+// yet consumed, returning the number of bytes dropped
+func discardPending(tp *textproto.Conn, conn net.Conn) int {
+	n, _ := tp.R.Discard(tp.R.Buffered())
+	if bc, ok := conn.(*bufferedConn); ok {
+		m, _ := bc.reader.Discard(bc.reader.Buffered())
+		n += m
+	}
+	return n
+}
+
+// isBlocked reports whether target, of the given list kind, is on the block
+// list, counting and logging the entry that matched
+func (s *Server) isBlocked(target, kind string) bool {
+	conf := s.currentConfig()
+	entry, ok := matchingEntry(target, conf.BlockList)
+	if !ok {
+		return false
+	}
+
+	// Resolve entries present on both lists using the configured precedence
+	if matchesList(target, conf.AllowList) {
+		if conf.ListPrecedence == "allow-wins" {
+			s.Logger.Log(logger.LogLevelWarn, "%s is on both allow_list and block_list, allowing (list_precedence=allow-wins)", target)
+			return false
+		}
+		s.Logger.Log(logger.LogLevelWarn, "%s is on both allow_list and block_list, blocking (list_precedence=block-wins)", target)
+	}
+	s.blockHits.add(kind)
+	s.Logger.Log(logger.LogLevelInfo, "%s %s matched block_list entry %q", kind, target, entry)
+	return true
+}
+
+// isAllowed reports whether an address passes the allow list. An allow list
+// without address entries permits every address, so IP and CIDR entries do
+// not lock down senders and recipients; otherwise only matching addresses
+// pass. The block list is checked first by isBlocked, so with the default
+// block-wins precedence an address on both lists is still rejected.
+func (s *Server) isAllowed(address, kind string) bool {
+	allowList := s.currentConfig().AllowList
+	if !slices.ContainsFunc(allowList, isAddressEntry) || matchesList(address, allowList) {
+		return true
+	}
+	s.allowRejections.add(kind)
+	return false
+}
+
+// matchesList reports whether target matches an entry of list
+func matchesList(target string, list []string) bool {
+	_, ok := matchingEntry(target, list)
+	return ok
+}
+
+// isAddressEntry reports whether a list entry applies to envelope addresses,
+// that is whether it is neither an IP address nor a CIDR range
+func isAddressEntry(entry string) bool {
+	if parseIP(entry) != nil {
+		return false
+	}
+	_, _, err := net.ParseCIDR(entry)
+	return err != nil
+}
+
+// matchingEntry returns the first entry of list that target matches. IP
+// targets are compared against IP and CIDR entries; other entries match as
+// substrings. Addresses are only compared against address entries.
+func matchingEntry(target string, list []string) (string, bool) {
 	// Parse target IP
-	targetIP := net.ParseIP(target)
+	targetIP := parseIP(target)
 	if targetIP == nil {
 		// Not an IP address, check as string
-		for _, blocked := range s.Config.BlockList {
-			if strings.Contains(target, blocked) {
-				return true
+		for _, entry := range list {
+			if isAddressEntry(entry) && strings.Contains(target, entry) {
+				return entry, true
 			}
 		}
-		return false
+		return "", false
 	}
 
-	// Check against block list
-	for _, blocked := range s.Config.BlockList {
+	// Check against the list
+	for _, entry := range list {
 		// Try parsing as IP
-		blockedIP := net.ParseIP(blocked)
-		if blockedIP != nil {
-			if blockedIP.Equal(targetIP) {
-				return true
+		entryIP := parseIP(entry)
+		if entryIP != nil {
+			if entryIP.Equal(targetIP) {
+				return entry, true
 			}
 			continue
 		}
 
 		// Try parsing as CIDR
-		_, blockedNet, err := net.ParseCIDR(blocked)
+		_, entryNet, err := net.ParseCIDR(entry)
 		if err == nil {
-			if blockedNet.Contains(targetIP) {
-				return true
+			if entryNet.Contains(targetIP) {
+				return entry, true
 			}
 			continue
 		}
 
 		// Fallback to string matching
-		if strings.Contains(target, blocked) {
-			return true
+		if strings.Contains(target, entry) {
+			return entry, true
 		}
 	}
-	return false
+	return "", false
+}
+
+// parseIP parses an IPv4 or IPv6 address in canonical form. Brackets and an
+// IPv6 zone ("fe80::1%eth0") are stripped, and IPv4-mapped IPv6 addresses
+// become plain IPv4.
+func parseIP(s string) net.IP {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// applyHeaderPolicy checks the message for the Date and From headers. In
+// strict mode a missing header is an error; in lenient mode the missing
+// headers are synthesized, using the envelope sender for From, or
+// MAILER-DAEMON at the relay's hostname for a null reverse-path.
+func (s *Server) applyHeaderPolicy(data []byte, from string) ([]byte, error) {
+	header, ok := parseHeader(data)
+
+	var missing []string
+	for _, name := range requiredHeaders {
+		if header.Get(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return data, nil
+	}
+
+	if s.currentConfig().HeaderPolicy == "strict" {
+		return nil, fmt.Errorf("missing required header: %s", strings.Join(missing, ", "))
+	}
+
+	var buf bytes.Buffer
+	for _, name := range missing {
+		switch name {
+		case "Date":
+			fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		case "From":
+			if from == "" {
+				from = "MAILER-DAEMON@" + s.hostname()
+			}
+			fmt.Fprintf(&buf, "From: <%s>\r\n", from)
+		}
+	}
+	// A message without a parsable header block gets one of its own
+	if !ok {
+		buf.WriteString("\r\n")
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// checkMessage applies the optional message checks to a spooled message
+// with the given header block and returns the SMTP reply to send when the
+// message is rejected
+func (s *Server) checkMessage(sp *spool.Spool, header []byte) (string, error) {
+	checks := s.currentConfig().MessageChecks
+
+	if checks.MaxLineLength > 0 {
+		// The DATA reader strips the CR, so allow for the CRLF separately
+		n, err := longLine(sp, checks.MaxLineLength-2)
+		if err != nil {
+			return "451 Requested action aborted: local error in processing", err
+		}
+		if n > 0 {
+			return "500 Line too long", fmt.Errorf("line %d exceeds %d octets", n, checks.MaxLineLength)
+		}
+	}
+
+	if checks.RequireHeaderSeparator && len(bytes.TrimSpace(header)) == 0 {
+		return "550 Malformed message: missing header/body separator", errors.New("message has no header block followed by a blank line")
+	}
+
+	if checks.RequireFrom {
+		parsed, _ := parseHeader(header)
+		from := parsed.Get("From")
+		if from == "" {
+			return "554 Missing From header", errors.New("message has no From header")
+		}
+		if _, err := mail.ParseAddressList(from); err != nil {
+			return "554 Invalid From header", fmt.Errorf("invalid From header %q: %v", from, err)
+		}
+	}
+
+	return "", nil
 }
 
-func extractSubject(data []byte) string {
-	lines := strings.Split(string(data), "\r\n")
-	for _, line := range lines {
-		if strings.HasPrefix(strings.ToUpper(line), "SUBJECT:") {
-			return strings.TrimSpace(line[len("Subject:"):])
+// longLine returns the number of the first line longer than limit octets,
+// excluding its line ending, or 0 if there is none
+func longLine(sp *spool.Spool, limit int) (int, error) {
+	r, err := sp.Open(0)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	n, length := 1, 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		length += len(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
 		}
+		if bytes.HasSuffix(chunk, []byte("\n")) {
+			length--
+			if bytes.HasSuffix(chunk, []byte("\r\n")) {
+				length--
+			}
+		}
+		if length > limit {
+			return n, nil
+		}
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read message: %w", err)
+		}
+		n, length = n+1, 0
 	}
-	return "(No Subject)"
+}
+
+// parseHeader reads the header block of a message. It reports false when
+// the message does not start with a well-formed header block.
+func parseHeader(data []byte) (textproto.MIMEHeader, bool) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil {
+		return textproto.MIMEHeader{}, false
+	}
+	return header, true
+}
+
+// relayTarget returns the upstream relay requested through the routing
+// header, or "" when normal routing applies. The header is only honoured for
+// trusted clients and only for targets on the configured allow list.
+func (s *Server) relayTarget(values []string, trusted bool, remoteAddr string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if !trusted {
+		s.Logger.Log(logger.LogLevelWarn, "Stripped %s header from untrusted client %s", relayTargetHeader, remoteAddr)
+		return ""
+	}
+
+	target := strings.TrimSpace(values[0])
+	for _, allowed := range s.currentConfig().RelayTargetHeader.AllowedTargets {
+		if strings.EqualFold(target, allowed) {
+			s.Logger.Log(logger.LogLevelInfo, "Routing email from %s via %s requested by %s header", remoteAddr, allowed, relayTargetHeader)
+			return allowed
+		}
+	}
+
+	s.Logger.Log(logger.LogLevelWarn, "Ignored %s header from %s: target %s is not allowed", relayTargetHeader, remoteAddr, target)
+	return ""
+}
+
+// removeHeader strips every occurrence of the named header, including folded
+// continuation lines, from the header block and returns the removed values.
+func removeHeader(data []byte, name string) ([]byte, []string) {
+	var out bytes.Buffer
+	var values []string
+	removing := false
+	inHeader := true
+
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		if inHeader {
+			trimmed := bytes.TrimRight(line, "\r\n")
+			switch {
+			case len(trimmed) == 0:
+				inHeader = false
+				removing = false
+			case trimmed[0] == ' ' || trimmed[0] == '\t':
+				if removing {
+					values[len(values)-1] += " " + strings.TrimSpace(string(trimmed))
+					continue
+				}
+			default:
+				removing = false
+				if colon := bytes.IndexByte(trimmed, ':'); colon > 0 &&
+					strings.EqualFold(strings.TrimSpace(string(trimmed[:colon])), name) {
+					removing = true
+					values = append(values, strings.TrimSpace(string(trimmed[colon+1:])))
+					continue
+				}
+			}
+		}
+		out.Write(line)
+	}
+
+	return out.Bytes(), values
+}
+
+// checkCallout verifies the recipient with its MX when callouts are enabled
+// for its domain, and reports whether it may be accepted. Recipients that
+// cannot be verified either way are accepted.
+func (s *Server) checkCallout(ctx context.Context, address string) bool {
+	if s.callout == nil {
+		return true
+	}
+	if domains := s.currentConfig().Callout.Domains; len(domains) > 0 {
+		domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+		matched := false
+		for _, rule := range domains {
+			rule = strings.ToLower(strings.Trim(rule, "."))
+			if domain == rule || strings.HasSuffix(domain, "."+rule) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return true
+		}
+	}
+
+	result, err := s.callout.Verify(ctx, address)
+	switch result {
+	case callout.Invalid:
+		s.Logger.Log(logger.LogLevelWarn, "Rejected email to %s: callout failed: %v", address, err)
+		return false
+	case callout.Unknown:
+		s.Logger.Log(logger.LogLevelWarn, "Could not verify %s by callout, accepting: %v", address, err)
+	}
+	return true
+}
+
+// checkSPF verifies the sender domain's SPF policy against the client IP.
+// It returns false only for a hard fail in enforcing mode; monitoring mode
+// and all other results just log.
+func (s *Server) checkSPF(ctx context.Context, host, from string) bool {
+	mode := s.currentConfig().SPF.Mode
+	if mode == "" || mode == "off" {
+		return true
+	}
+
+	at := strings.LastIndex(from, "@")
+	ip := net.ParseIP(host)
+	if at < 0 || ip == nil {
+		return true
+	}
+	domain := from[at+1:]
+
+	ctx, cancel := context.WithTimeout(ctx, spfTimeout)
+	defer cancel()
+	result, err := s.spfChecker.Check(ctx, ip, domain)
+	if err != nil {
+		s.Logger.Log(logger.LogLevelWarn, "SPF %s for %s from %s: %v", result, from, host, err)
+	} else {
+		s.Logger.Log(logger.LogLevelInfo, "SPF %s for %s from %s", result, from, host)
+	}
+
+	if result == spf.Fail && mode == "enforce" {
+		s.Logger.Log(logger.LogLevelWarn, "Rejected email from %s: SPF fail for %s", from, host)
+		return false
+	}
+	return true
 }
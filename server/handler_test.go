@@ -0,0 +1,745 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go-relay-server/callout"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"go-relay-server/spf"
+	"go-relay-server/spool"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandOrder(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	t.Run("MAIL before HELO", func(t *testing.T) {
+		c := dial(t, addr)
+		c.cmd(503, "MAIL FROM:<a@example.com>")
+	})
+	t.Run("RCPT before MAIL", func(t *testing.T) {
+		c := dial(t, addr)
+		c.cmd(250, "EHLO client.test")
+		c.cmd(503, "RCPT TO:<b@example.org>")
+	})
+	t.Run("DATA before RCPT", func(t *testing.T) {
+		c := dial(t, addr)
+		c.cmd(250, "EHLO client.test")
+		c.cmd(503, "DATA")
+		c.cmd(250, "MAIL FROM:<a@example.com>")
+		c.cmd(503, "DATA")
+	})
+	t.Run("nested MAIL", func(t *testing.T) {
+		c := dial(t, addr)
+		c.cmd(250, "EHLO client.test")
+		c.cmd(250, "MAIL FROM:<a@example.com>")
+		c.cmd(503, "MAIL FROM:<c@example.com>")
+	})
+	t.Run("HELO resets the transaction", func(t *testing.T) {
+		c := dial(t, addr)
+		c.cmd(250, "EHLO client.test")
+		c.cmd(250, "MAIL FROM:<a@example.com>")
+		c.cmd(250, "EHLO client.test")
+		c.cmd(503, "RCPT TO:<b@example.org>")
+	})
+}
+
+func TestRSETStartsNewTransaction(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<first@example.com>")
+	c.cmd(250, "RCPT TO:<dropped@example.org>")
+	c.cmd(250, "RSET")
+	// The recipients went with the transaction, but the greeting stays
+	c.cmd(503, "DATA")
+	c.cmd(250, "MAIL FROM:<second@example.com>")
+	c.cmd(250, "RCPT TO:<kept@example.org>")
+	c.data(250, testMessage("rset", "Hello\r\n"))
+	c.cmd(221, "QUIT")
+
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) == 1 })
+	msg := upstream.Messages()[0]
+	if msg.From != "second@example.com" || len(msg.To) != 1 || msg.To[0] != "kept@example.org" {
+		t.Fatalf("delivered envelope %s -> %v, want second@example.com -> [kept@example.org]", msg.From, msg.To)
+	}
+}
+
+func TestRSETDiscardsChunks(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.tp.PrintfLine("BDAT 7")
+	c.tp.W.WriteString("partial")
+	c.tp.W.Flush()
+	c.expect(250)
+	c.cmd(250, "RSET")
+
+	message := testMessage("chunks", "Whole\r\n")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.tp.PrintfLine("BDAT %d LAST", len(message))
+	c.tp.W.WriteString(message)
+	c.tp.W.Flush()
+	c.expect(250)
+
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) == 1 })
+	if data := string(upstream.Messages()[0].Data); !strings.Contains(data, "Whole") || strings.Contains(data, "partial") {
+		t.Fatalf("delivered message kept the chunk sent before RSET:\n%s", data)
+	}
+}
+
+func TestBDAT(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	if ehlo := c.cmd(250, "EHLO client.test"); !strings.Contains(ehlo, "\nCHUNKING") {
+		t.Fatalf("EHLO does not advertise CHUNKING:\n%s", ehlo)
+	}
+
+	// Chunks are taken as sent: a leading dot is not stuffing, and the
+	// split may fall anywhere, even inside a line ending
+	message := testMessage("two chunks", ".leading dot\r\n..two dots\r\nbinary \x00\x01\xff\r\nlast line\r\n")
+	split := strings.Index(message, "\r\n..two") + 1
+	chunks := []string{message[:split], message[split:]}
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	for i, chunk := range chunks {
+		last := ""
+		if i == len(chunks)-1 {
+			last = " LAST"
+		}
+		fmt.Fprintf(c.tp.W, "BDAT %d%s\r\n%s", len(chunk), last, chunk)
+		c.tp.W.Flush()
+		msg := c.expect(250)
+		if last == "" && msg != fmt.Sprintf("%d octets received", len(chunk)) {
+			t.Errorf("chunk %d acknowledged with %q", i, msg)
+		}
+	}
+
+	// An empty last chunk ends the next message
+	second := testMessage("empty last chunk", "Body\r\n")
+	fmt.Fprintf(c.tp.W, "MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nBDAT %d\r\n%sBDAT 0 LAST\r\n", len(second), second)
+	c.tp.W.Flush()
+	for _, code := range []int{250, 250, 250, 250} {
+		c.expect(code)
+	}
+
+	messages := upstream.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("upstream received %d messages, want 2", len(messages))
+	}
+	for i, want := range []string{message, second} {
+		if data := string(messages[i].Data); !strings.HasSuffix(data, want) {
+			t.Errorf("message %d was not reassembled:\n got %q\nwant suffix %q", i, data, want)
+		}
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.MaxConnectionLifetime = "300ms"
+	startServer(t, cfg)
+
+	// A client that never goes idle is still closed once its time is up
+	c := dial(t, listenerAddr(cfg, 0))
+	start := time.Now()
+	c.cmd(250, "EHLO client.test")
+	for {
+		code, msg := 0, ""
+		if err := c.tp.PrintfLine("NOOP"); err == nil {
+			code, msg = c.reply()
+		}
+		if code == 421 {
+			if msg != "Closing connection" {
+				t.Errorf("closed with %q, want \"Closing connection\"", msg)
+			}
+			break
+		}
+		if code != 250 {
+			t.Fatalf("NOOP got %d %s", code, msg)
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("connection outlived its maximum lifetime")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("connection closed after %v, before its 300ms lifetime", elapsed)
+	}
+	if !c.closed() {
+		t.Error("connection left open after 421")
+	}
+
+	// Each connection gets its own lifetime
+	c = dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+}
+
+func TestEmptyCommandLine(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners = append(cfg.Listeners, cfg.Listeners[0])
+	cfg.Listeners[1].Port = freePort(t)
+	cfg.Listeners[1].Encryption = "starttls"
+	withTLS(t, &cfg)
+	startServer(t, cfg)
+
+	for i, name := range []string{"none", "starttls"} {
+		t.Run(name, func(t *testing.T) {
+			c := dial(t, listenerAddr(cfg, i))
+			c.cmd(500, "")
+			c.cmd(500, "   ")
+			c.cmd(250, "EHLO client.test")
+			c.cmd(221, "QUIT")
+		})
+	}
+}
+
+func TestDotLinesRoundTrip(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	body := ".leading dot\r\n..two dots\r\n.\r\nmiddle . dot\r\n"
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("dots", body))
+
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) == 1 })
+	if data := string(upstream.Messages()[0].Data); !strings.HasSuffix(data, "\r\n\r\n"+body) {
+		t.Fatalf("body changed in transit, want it to end with %q:\n%q", body, data)
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	upstream := startUpstream(t)
+	for _, test := range []struct {
+		name      string
+		allowList []string
+		sender    int // Reply to MAIL from a@example.com
+		recipient int // Reply to RCPT to b@example.org
+	}{
+		{"empty", nil, 250, 250},
+		{"addresses", []string{"a@example.com", "@example.net"}, 250, 550},
+		{"sender domain only", []string{"example.org"}, 550, 250},
+		{"IP only", []string{"127.0.0.1", "10.0.0.0/8"}, 250, 250},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, upstream.Addr)
+			cfg.AllowList = test.allowList
+			startServer(t, cfg)
+
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.cmd(test.sender, "MAIL FROM:<a@example.com>")
+			if test.sender != 250 {
+				return
+			}
+			c.cmd(test.recipient, "RCPT TO:<b@example.org>")
+		})
+	}
+}
+
+func TestListPrecedence(t *testing.T) {
+	upstream := startUpstream(t)
+	for _, test := range []struct {
+		precedence string
+		greeting   int
+	}{
+		{"", 550},
+		{"block-wins", 550},
+		{"allow-wins", 220},
+	} {
+		name := test.precedence
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t, upstream.Addr)
+			cfg.AllowList = []string{"127.0.0.1"}
+			cfg.BlockList = []string{"127.0.0.0/8"}
+			cfg.ListPrecedence = test.precedence
+			startServer(t, cfg)
+
+			c := connect(t, listenerAddr(cfg, 0))
+			if code, _ := c.reply(); code != test.greeting {
+				t.Fatalf("greeting code %d, want %d", code, test.greeting)
+			}
+			if test.greeting == 220 {
+				// The IP entries leave the addresses unrestricted
+				c.cmd(250, "EHLO client.test")
+				c.cmd(250, "MAIL FROM:<a@example.com>")
+			}
+		})
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	upstream := startUpstream(t)
+	lenient := testConfig(t, upstream.Addr)
+	startServer(t, lenient)
+	strict := testConfig(t, upstream.Addr)
+	strict.HeaderPolicy = "strict"
+	startServer(t, strict)
+
+	for _, test := range []struct {
+		name   string
+		cfg    config.Config
+		sender string
+		code   int
+		from   string // From header the relay adds
+	}{
+		{"lenient", lenient, "a@example.com", 250, "From: <a@example.com>\r\n"},
+		{"lenient null sender", lenient, "", 250, "From: <MAILER-DAEMON@relay.test>\r\n"},
+		{"strict", strict, "a@example.com", 550, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(upstream.Messages())
+			c := dial(t, listenerAddr(test.cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.cmd(250, "MAIL FROM:<%s>", test.sender)
+			c.cmd(250, "RCPT TO:<b@example.org>")
+			c.data(test.code, "Subject: "+test.name+"\r\n\r\nNo Date or From\r\n")
+			if test.code != 250 {
+				return
+			}
+
+			waitFor(t, "delivery", func() bool { return len(upstream.Messages()) > before })
+			data := string(upstream.Messages()[before].Data)
+			if !strings.Contains(data, "\r\n"+test.from) || !strings.Contains(data, "\r\nDate: ") {
+				t.Fatalf("delivered message lacks %q or a Date header:\n%s", test.from, data)
+			}
+		})
+	}
+}
+
+func TestHeaderPolicyHeaderOnly(t *testing.T) {
+	upstream := startUpstream(t)
+	lenient := testConfig(t, upstream.Addr)
+	startServer(t, lenient)
+	strict := testConfig(t, upstream.Addr)
+	strict.HeaderPolicy = "strict"
+	strict.MessageChecks.RequireFrom = true
+	startServer(t, strict)
+
+	// RFC 5322 allows a message without a body or the blank line before it
+	for _, test := range []struct {
+		name string
+		cfg  config.Config
+	}{
+		{"lenient", lenient},
+		{"strict", strict},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(upstream.Messages())
+			c := dial(t, listenerAddr(test.cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.send("a@example.com", []string{"b@example.org"},
+				"From: a@example.com\r\nDate: Mon, 12 Oct 2026 10:00:00 +0000\r\nSubject: header only "+test.name+"\r\n")
+
+			waitFor(t, "delivery", func() bool { return len(upstream.Messages()) > before })
+			data := string(upstream.Messages()[before].Data)
+			if strings.Count(data, "\r\nFrom: ") != 1 || strings.Count(data, "\r\nDate: ") != 1 {
+				t.Errorf("delivered message has policy headers added:\n%s", data)
+			}
+			if !strings.HasSuffix(data, "\r\nSubject: header only "+test.name+"\r\n\r\n") {
+				t.Errorf("delivered message does not end with its header and an empty body:\n%q", data)
+			}
+		})
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, test := range []struct {
+		name, message, header string
+		offset                int64
+	}{
+		{"with body", "Subject: a\r\n\r\nHello\r\n", "Subject: a\r\n\r\n", 14},
+		{"header only", "From: a@x\r\nSubject: s\r\n", "From: a@x\r\nSubject: s\r\n\r\n", 23},
+		{"header only LF", "From: a@x\nSubject: s\n", "From: a@x\nSubject: s\n\n", 21},
+		{"no final newline", "From: a@x\r\nSubject: s", "From: a@x\r\nSubject: s\r\n\r\n", 21},
+		{"no header", "Hello there\r\n", "", 0},
+		{"empty", "", "", 0},
+	} {
+		sp := spool.New(t.TempDir(), 1<<20)
+		sp.Write([]byte(test.message))
+		header, offset, err := readHeader(sp)
+		sp.Close()
+		if err != nil || string(header) != test.header || offset != test.offset {
+			t.Errorf("%s: readHeader = %q, %d, %v, want %q, %d", test.name, header, offset, err, test.header, test.offset)
+		}
+	}
+}
+
+func TestListPrecedenceForAddresses(t *testing.T) {
+	upstream := startUpstream(t)
+	for _, test := range []struct {
+		precedence string
+		code       int
+		logged     string
+	}{
+		{"block-wins", 550, "blocking (list_precedence=block-wins)"},
+		{"allow-wins", 250, "allowing (list_precedence=allow-wins)"},
+	} {
+		t.Run(test.precedence, func(t *testing.T) {
+			cfg := testConfig(t, upstream.Addr)
+			cfg.AllowList = []string{"a@example.com"}
+			cfg.BlockList = []string{"example.com"}
+			cfg.ListPrecedence = test.precedence
+			startServer(t, cfg)
+
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.cmd(test.code, "MAIL FROM:<a@example.com>")
+			// Addresses on the block list alone are blocked either way
+			c.cmd(250, "RSET")
+			c.cmd(550, "MAIL FROM:<other@example.com>")
+
+			if log := readLog(t, cfg); !strings.Contains(log, "a@example.com is on both allow_list and block_list, "+test.logged) {
+				t.Fatalf("conflict not logged with its precedence:\n%s", log)
+			}
+		})
+	}
+}
+
+// spfRecords serves TXT records for SPF checks; other lookups find nothing
+type spfRecords map[string][]string
+
+func (r spfRecords) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r spfRecords) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r spfRecords) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// startSPFServer starts a server whose SPF checks resolve records
+func startSPFServer(t *testing.T, cfg config.Config, records spfRecords) {
+	t.Helper()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.spfChecker = spf.NewChecker(records)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+}
+
+func TestSPF(t *testing.T) {
+	records := spfRecords{
+		"pass.test":     {"v=spf1 ip4:127.0.0.1 -all"},
+		"fail.test":     {"v=spf1 ip4:192.0.2.1 -all"},
+		"softfail.test": {"v=spf1 ip4:192.0.2.1 ~all"},
+	}
+
+	for _, tt := range []struct {
+		mode   string
+		sender string
+		code   int
+	}{
+		{"enforce", "a@pass.test", 250},
+		{"enforce", "a@fail.test", 550},
+		{"enforce", "a@softfail.test", 250},
+		{"enforce", "a@none.test", 250},
+		{"monitor", "a@fail.test", 250},
+		{"off", "a@fail.test", 250},
+	} {
+		t.Run(tt.mode+" "+tt.sender, func(t *testing.T) {
+			upstream := startUpstream(t)
+			cfg := testConfig(t, upstream.Addr)
+			cfg.SPF.Mode = tt.mode
+			startSPFServer(t, cfg, records)
+
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			msg := c.cmd(tt.code, "MAIL FROM:<%s>", tt.sender)
+			if tt.code == 550 && msg != "SPF fail" {
+				t.Errorf("rejected with %q, want \"SPF fail\"", msg)
+			}
+		})
+	}
+
+	// Monitoring mode logs the result it lets through
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.SPF.Mode = "monitor"
+	startSPFServer(t, cfg, records)
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@fail.test>")
+	waitFor(t, "the SPF log line", func() bool {
+		return strings.Contains(readLog(t, cfg), "SPF fail for a@fail.test from 127.0.0.1")
+	})
+}
+
+func TestMessageChecks(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.MessageChecks.MaxLineLength = 1000
+	cfg.MessageChecks.RequireHeaderSeparator = true
+	startServer(t, cfg)
+
+	for _, tt := range []struct {
+		name    string
+		message string
+		code    int
+	}{
+		{"longest line", testMessage("longest", strings.Repeat("a", 998)+"\r\n"), 250},
+		{"line too long", testMessage("too long", strings.Repeat("b", 999)+"\r\n"), 500},
+		{"very long line", testMessage("very long", strings.Repeat("c", 10000)+"\r\n"), 500},
+		{"long last line", testMessage("last line", "short\r\n"+strings.Repeat("d", 999)), 500},
+		{"long header", "Subject: " + strings.Repeat("e", 1000) + "\r\n\r\nBody\r\n", 500},
+		{"header-less body", "Just a body without any header\r\n", 550},
+		{"body after a non-header line", "Hello,\r\n\r\nthere is no header here\r\n", 550},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.cmd(250, "MAIL FROM:<a@example.com>")
+			c.cmd(250, "RCPT TO:<b@example.org>")
+			msg := c.data(tt.code, tt.message)
+			if tt.code == 500 && msg != "Line too long" {
+				t.Errorf("rejected with %q, want \"Line too long\"", msg)
+			}
+			// The session goes on after a rejected message
+			c.cmd(250, "NOOP")
+		})
+	}
+	if n := len(upstream.Messages()); n != 1 {
+		t.Fatalf("%d messages relayed, want only the one within the limits", n)
+	}
+
+	// Both checks are optional
+	upstream = startUpstream(t)
+	cfg = testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("unchecked", strings.Repeat("f", 2000)+"\r\n"))
+	c.send("a@example.com", []string{"b@example.org"}, "Unchecked body without any header\r\n")
+}
+
+func TestRequireFrom(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.MessageChecks.RequireFrom = true
+	startServer(t, cfg)
+
+	for _, tt := range []struct {
+		name    string
+		message string
+		code    int
+		reply   string
+	}{
+		{"address", "From: a@example.com\r\nSubject: from address\r\n\r\nBody\r\n", 250, ""},
+		{"display name", "From: \"Sender, A\" <a@example.com>\r\nSubject: from name\r\n\r\nBody\r\n", 250, ""},
+		{"lower case", "from: a@example.com\r\nSubject: from lower\r\n\r\nBody\r\n", 250, ""},
+		{"absent", "Subject: no from\r\n\r\nBody\r\n", 554, "Missing From header"},
+		{"only in the body", "Subject: from in body\r\n\r\nFrom: a@example.com\r\n", 554, "Missing From header"},
+		{"empty", "From: \r\nSubject: empty from\r\n\r\nBody\r\n", 554, "Missing From header"},
+		{"malformed", "From: not an address\r\nSubject: bad from\r\n\r\nBody\r\n", 554, "Invalid From header"},
+		{"unterminated", "From: <a@example.com\r\nSubject: open from\r\n\r\nBody\r\n", 554, "Invalid From header"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.cmd(250, "MAIL FROM:<a@example.com>")
+			c.cmd(250, "RCPT TO:<b@example.org>")
+			if msg := c.data(tt.code, tt.message); tt.reply != "" && msg != tt.reply {
+				t.Errorf("rejected with %q, want %q", msg, tt.reply)
+			}
+		})
+	}
+	if n := len(upstream.Messages()); n != 3 {
+		t.Fatalf("%d messages relayed, want the 3 with a valid From header", n)
+	}
+}
+
+func TestMatchingEntryIPv6(t *testing.T) {
+	list := []string{"2001:db8::/32", "fe80::1", "::ffff:192.0.2.0/120", "203.0.113.7"}
+	for _, tt := range []struct {
+		target string
+		entry  string // Empty when nothing matches
+	}{
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:DB8:0:0:ffff::1", "2001:db8::/32"},
+		{"[2001:db8::1]", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		{"fe80::1%eth0", "fe80::1"},
+		{"fe80:0::0001", "fe80::1"},
+		{"fe80::2%eth0", ""},
+		{"192.0.2.10", "::ffff:192.0.2.0/120"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+	} {
+		entry, ok := matchingEntry(tt.target, list)
+		if ok != (tt.entry != "") || entry != tt.entry {
+			t.Errorf("matchingEntry(%q) = %q, %v, want %q", tt.target, entry, ok, tt.entry)
+		}
+	}
+}
+
+func TestBlockIPv6Client(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.BlockList = []string{"2001:db8::/32"}
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	for _, tt := range []struct {
+		client string
+		code   int
+	}{
+		{"2001:db8::25", 550},
+		{"2001:db8:ffff:ffff::1", 550},
+		{"2001:db9::25", 220},
+	} {
+		c := connect(t, addr)
+		fmt.Fprintf(c.conn, "PROXY TCP6 %s 2001:db8:1::1 40000 25\r\n", tt.client)
+		if code, _ := c.reply(); code != tt.code {
+			t.Errorf("client %s got %d, want %d", tt.client, code, tt.code)
+		}
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.BlockList = []string{"blocked@example.org"}
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	if ehlo := c.cmd(250, "EHLO client.test"); !strings.Contains(ehlo, "\nPIPELINING") {
+		t.Fatalf("EHLO does not advertise PIPELINING:\n%s", ehlo)
+	}
+
+	// The whole envelope in one write, including a recipient that is refused
+	c.tp.W.WriteString("MAIL FROM:<pipelined@example.com>\r\n" +
+		"RCPT TO:<b@example.org>\r\n" +
+		"RCPT TO:<blocked@example.org>\r\n" +
+		"RCPT TO:<c@example.org>\r\n" +
+		"DATA\r\n")
+	if err := c.tp.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{250, 250, 550, 250, 354} {
+		if code, msg := c.reply(); code != want {
+			t.Fatalf("reply %d: got %d %s, want %d", i, code, msg, want)
+		}
+	}
+
+	// DATA ends the batch; the message and the next transaction follow in
+	// a second write
+	c.tp.W.WriteString(testMessage("pipelined", "Body\r\n") + ".\r\n" +
+		"MAIL FROM:<pipelined-2@example.com>\r\n" +
+		"RCPT TO:<d@example.org>\r\n" +
+		"RSET\r\n" +
+		"NOOP\r\n" +
+		"QUIT\r\n")
+	if err := c.tp.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{250, 250, 250, 250, 250, 221} {
+		if code, msg := c.reply(); code != want {
+			t.Fatalf("reply %d after DATA: got %d %s, want %d", i, code, msg, want)
+		}
+	}
+
+	messages := upstream.Messages()
+	if len(messages) != 1 || messages[0].From != "pipelined@example.com" ||
+		strings.Join(messages[0].To, ",") != "b@example.org,c@example.org" {
+		t.Fatalf("upstream received %+v, want one message to b and c", messages)
+	}
+}
+
+// loopbackMX is a callout resolver that points every domain at 127.0.0.1
+type loopbackMX struct{}
+
+func (loopbackMX) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+}
+
+func (loopbackMX) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return []string{"127.0.0.1"}, nil
+}
+
+func TestCallout(t *testing.T) {
+	mx := smtptest.NewUnstartedServer()
+	mx.Reply = func(verb, line string) string {
+		if verb == "RCPT" && strings.Contains(line, "<unknown") {
+			return "550 No such user here"
+		}
+		return ""
+	}
+	mx.Start()
+	t.Cleanup(mx.Close)
+
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Callout = config.CalloutConfig{Enabled: true, Domains: []string{"example.org"}}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(mx.Addr)
+	s.callout = callout.NewVerifier(&callout.Config{
+		Hostname: "relay.test", Port: port, Timeout: 5 * time.Second,
+		CacheTTL: time.Hour, NegativeTTL: time.Hour, Resolver: loopbackMX{},
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	if msg := c.cmd(550, "RCPT TO:<unknown@example.org>"); msg != "No such user" {
+		t.Errorf("rejected recipient got %q", msg)
+	}
+	c.cmd(250, "RCPT TO:<user@example.org>")
+	c.cmd(250, "RCPT TO:<user@sub.example.org>")
+	// Domains not listed are not verified
+	c.cmd(250, "RCPT TO:<unknown@example.net>")
+	// A repeated recipient is answered from the cache
+	c.cmd(550, "RCPT TO:<unknown@example.org>")
+
+	var asked []string
+	for _, command := range mx.Commands() {
+		if strings.HasPrefix(command, "RCPT") {
+			asked = append(asked, command)
+		}
+	}
+	want := []string{"RCPT TO:<unknown@example.org>", "RCPT TO:<user@example.org>", "RCPT TO:<user@sub.example.org>"}
+	if strings.Join(asked, "\n") != strings.Join(want, "\n") {
+		t.Errorf("MX was asked %q, want %q", asked, want)
+	}
+}
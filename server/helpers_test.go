@@ -0,0 +1,237 @@
+package server
+
+import (
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testQueueDir holds the relay queue, which is shared by every server the
+// tests start because the relay package keeps a single queue per process
+var testQueueDir string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "smtp-relay-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	testQueueDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// freePort returns a loopback port that was free a moment ago
+func freePort(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// testConfig returns a valid config with one plaintext listener on a free
+// port that relays everything to upstream
+func testConfig(t testing.TB, upstream string) config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	// Unix socket paths are limited to about 100 bytes, too short for some
+	// test temp dirs
+	sockDir, err := os.MkdirTemp("", "srsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(sockDir) })
+
+	return config.Config{
+		Listeners:     []config.ListenerConfig{{Host: "127.0.0.1", Port: freePort(t), Encryption: "none"}},
+		DefaultRelay:  config.RelayList{upstream},
+		LogDir:        dir,
+		LogFile:       "smtp-relay",
+		LogLevel:      "debug",
+		PIDFile:       filepath.Join(dir, "smtp-relay.pid"),
+		ControlSocket: filepath.Join(sockDir, "c.sock"),
+		Hostname:      "relay.test",
+		RateLimiting:  config.RateLimiting{RequestsPerMinute: 10000, BurstLimit: 1000},
+		Queue: config.QueueConfig{
+			StoragePath:     testQueueDir,
+			MaxRetries:      3,
+			RetryInterval:   "1h",
+			MaxQueueSize:    1000,
+			PersistInterval: "1m",
+			// The queue is created by the first server, so every test runs
+			// with dedup and must not repeat another test's message
+			DedupWindow: "10m",
+		},
+	}
+}
+
+// startServer starts a server for cfg and stops it when the test ends
+func startServer(t testing.TB, cfg config.Config) *Server {
+	t.Helper()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// startUpstream starts a mock upstream relay that is closed when the test ends
+func startUpstream(t testing.TB) *smtptest.Server {
+	t.Helper()
+	upstream := smtptest.NewServer()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// listenerAddr returns the address of the i-th listener of cfg
+func listenerAddr(cfg config.Config, i int) string {
+	return net.JoinHostPort(cfg.Listeners[i].Host, cfg.Listeners[i].Port)
+}
+
+// readLog returns the server's log so far
+func readLog(t *testing.T, cfg config.Config) string {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(cfg.LogDir, cfg.LogFile+"-*.log"))
+	var b strings.Builder
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(data)
+	}
+	return b.String()
+}
+
+// waitFor polls cond until it holds or a few seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// client is a minimal SMTP client for driving the server under test
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	tp   *textproto.Conn
+}
+
+// dial connects to addr and reads the 220 greeting
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	c := connect(t, addr)
+	c.expect(220)
+	return c
+}
+
+// connect connects to addr without reading the greeting
+func connect(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return newClient(t, conn)
+}
+
+func newClient(t *testing.T, conn net.Conn) *client {
+	return &client{t: t, conn: conn, tp: textproto.NewConn(conn)}
+}
+
+// cmd sends a command and checks the reply code, returning the reply text
+func (c *client) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+	if err := c.tp.PrintfLine(format, args...); err != nil {
+		c.t.Fatalf("sending %q: %v", fmt.Sprintf(format, args...), err)
+	}
+	return c.expectFor(code, fmt.Sprintf(format, args...))
+}
+
+// expect reads a reply and checks its code
+func (c *client) expect(code int) string {
+	c.t.Helper()
+	return c.expectFor(code, "")
+}
+
+func (c *client) expectFor(code int, sent string) string {
+	c.t.Helper()
+	got, msg, err := c.tp.ReadResponse(0)
+	if err != nil && got == 0 {
+		c.t.Fatalf("reading reply to %q: %v", sent, err)
+	}
+	if got != code {
+		c.t.Fatalf("reply to %q: got %d %s, want %d", sent, got, msg, code)
+	}
+	return msg
+}
+
+// reply reads a reply and returns its code and text without checking them
+func (c *client) reply() (int, string) {
+	c.t.Helper()
+	code, msg, err := c.tp.ReadResponse(0)
+	if err != nil && code == 0 {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	return code, msg
+}
+
+// send runs a whole transaction, expecting every step to succeed
+func (c *client) send(from string, to []string, message string) {
+	c.t.Helper()
+	c.cmd(250, "MAIL FROM:<%s>", from)
+	for _, rcpt := range to {
+		c.cmd(250, "RCPT TO:<%s>", rcpt)
+	}
+	c.data(250, message)
+}
+
+// data sends DATA and the message, checking the final reply code
+func (c *client) data(code int, message string) string {
+	c.t.Helper()
+	c.cmd(354, "DATA")
+	w := c.tp.DotWriter()
+	if _, err := w.Write([]byte(message)); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expectFor(code, "message data")
+}
+
+// testMessage is a minimal valid message
+func testMessage(subject, body string) string {
+	return "From: sender@example.com\r\nTo: rcpt@example.org\r\nDate: Mon, 02 Jan 2006 15:04:05 +0000\r\nSubject: " +
+		subject + "\r\nMessage-ID: <" + subject + "@example.com>\r\n\r\n" + body
+}
+
+// closed reports whether the server closed the connection
+func (c *client) closed() bool {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.tp.ReadLine()
+	return err != nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatch ends a session that is waiting for its next command once the
+// server context is cancelled. Commands in progress, such as a DATA
+// transfer, are left to complete; the session ends at its next command.
+type idleWatch struct {
+	ctx  context.Context
+	idle atomic.Bool
+	stop func() bool
+}
+
+// watchIdle interrupts reads on conn when ctx is cancelled while the session
+// is idle. Call stop when the session ends.
+func watchIdle(ctx context.Context, conn net.Conn) *idleWatch {
+	w := &idleWatch{ctx: ctx}
+	w.stop = context.AfterFunc(ctx, func() {
+		if w.idle.Load() {
+			conn.SetReadDeadline(time.Now())
+		}
+	})
+	return w
+}
+
+// readCommand reads the next command line while marking the session idle.
+// It returns the context error if the server is stopping.
+func (w *idleWatch) readCommand(tp *textproto.Conn) (string, error) {
+	w.idle.Store(true)
+	defer w.idle.Store(false)
+
+	// Checked after marking the session idle, so a cancellation either is
+	// seen here or interrupts the read
+	if err := w.ctx.Err(); err != nil {
+		return "", err
+	}
+	line, err := tp.ReadLine()
+	if ctxErr := w.ctx.Err(); err != nil && ctxErr != nil {
+		return "", ctxErr
+	}
+	return line, err
+}
+
+// shuttingDown tells the client the session is ending because the server is
+// stopping
+func (s *Server) shuttingDown(tp *textproto.Conn) {
+	tp.PrintfLine("421 %s Service not available, closing transmission channel", s.hostname())
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"time"
+)
+
+// connectionLifetime returns the configured max_connection_lifetime, or 0
+// for no limit
+func (s *Server) connectionLifetime() time.Duration {
+	value := s.currentConfig().MaxConnectionLifetime
+	if value == "" {
+		return 0
+	}
+	lifetime, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return lifetime
+}
+
+// expired reports whether the deadline, if set, has passed
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
@@ -0,0 +1,37 @@
+package server
+
+import "sync/atomic"
+
+// What a block or allow list was checked against
+const (
+	listIP        = "ip"
+	listSender    = "sender"
+	listRecipient = "recipient"
+)
+
+// listKinds orders the kinds for the metrics endpoint
+var listKinds = []string{listIP, listSender, listRecipient}
+
+// listHits counts the rejections of a block or allow list by kind
+type listHits struct {
+	ip, sender, recipient atomic.Uint64
+}
+
+func (h *listHits) counter(kind string) *atomic.Uint64 {
+	switch kind {
+	case listIP:
+		return &h.ip
+	case listSender:
+		return &h.sender
+	default:
+		return &h.recipient
+	}
+}
+
+func (h *listHits) add(kind string) {
+	h.counter(kind).Add(1)
+}
+
+func (h *listHits) get(kind string) uint64 {
+	return h.counter(kind).Load()
+}
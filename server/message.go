@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-relay-server/logger"
+	"go-relay-server/queue"
+	"go-relay-server/relay"
+	"go-relay-server/spool"
+	"go-relay-server/utils"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxHeaderBytes bounds the header block held in memory; a larger one is
+// treated as part of the body
+const maxHeaderBytes = 1 << 20
+
+// spoolBody is the part of a spooled message after its header block
+type spoolBody struct {
+	sp     *spool.Spool
+	offset int64
+}
+
+func (b spoolBody) Open() (io.ReadCloser, error) {
+	return b.sp.Open(b.offset)
+}
+
+// newSpool returns a spool for one DATA transaction
+func (s *Server) newSpool() *spool.Spool {
+	conf := s.currentConfig().Spool
+	return spool.New(conf.Dir, conf.MemoryThreshold)
+}
+
+// processMessage applies the message policies to a spooled message and
+// relays it to each recipient, returning the reply for the client. The spool
+// is closed on return, which removes any temporary file.
+func (s *Server) processMessage(ctx context.Context, sp *spool.Spool, trace, from string, to []string, trusted bool, remoteAddr string) (reply string) {
+	defer func() {
+		if err := sp.Close(); err != nil {
+			s.Logger.Log(logger.LogLevelError, "%v", err)
+		}
+	}()
+
+	// Every message ends up in the access log, whatever happened to it
+	entry := logger.AccessEntry{From: from, To: to, Size: sp.Size(), Outcome: "rejected"}
+	entry.ClientIP, _, _ = net.SplitHostPort(remoteAddr)
+	defer func() {
+		entry.Reply = reply
+		s.recordAccess(entry)
+	}()
+
+	header, offset, err := readHeader(sp)
+	if err != nil {
+		s.Logger.Log(logger.LogLevelError, "Error reading spooled email from %s: %v", remoteAddr, err)
+		entry.Outcome = "failed"
+		return "451 Requested action aborted: local error in processing"
+	}
+	entry.Subject = utils.ExtractSubject(header)
+
+	// Reject structurally malformed messages when checks are enabled
+	if reply, err := s.checkMessage(sp, header); err != nil {
+		s.Logger.Log(logger.LogLevelWarn, "Rejected email from %s: %v", remoteAddr, err)
+		return reply
+	}
+
+	// Repeated transactions are recognized before anything is delivered or
+	// queued, comparing the message as the client sent it
+	claim, fresh, err := s.claimTransaction(sp, from, to)
+	if err != nil {
+		s.Logger.Log(logger.LogLevelError, "Error reading spooled email from %s: %v", remoteAddr, err)
+		entry.Outcome = "failed"
+		return "451 Requested action aborted: local error in processing"
+	}
+	if !fresh {
+		s.Logger.Log(logger.LogLevelInfo, "Duplicate email from %s already accepted: From=%s, To=%s", remoteAddr, from, strings.Join(to, ","))
+		entry.Outcome = "duplicate"
+		return "250 OK"
+	}
+	defer func() {
+		if claim != "" && !strings.HasPrefix(reply, "250") {
+			relay.GetQueue().Unclaim(claim)
+		}
+	}()
+
+	// Enforce the configured policy for required headers
+	header, err = s.applyHeaderPolicy(header, from)
+	if err != nil {
+		s.Logger.Log(logger.LogLevelWarn, "Rejected email from %s: %v", remoteAddr, err)
+		return "550 Missing required header"
+	}
+
+	// The routing header never leaves the relay, whoever sent it
+	header, targets := removeHeader(header, relayTargetHeader)
+	target := s.relayTarget(targets, trusted, remoteAddr)
+
+	header = append([]byte(trace), header...)
+
+	s.Logger.Log(logger.LogLevelInfo, "Received email from %s: From=%s, To=%s, Subject=%s, Size=%d", remoteAddr, from, strings.Join(to, ","), entry.Subject, sp.Size())
+	s.Logger.Log(logger.LogLevelInfo, "Email headers: %s", string(header))
+
+	msg := relay.Message{Header: header, Body: spoolBody{sp: sp, offset: offset}}
+	entry.Relay = s.routes(target, from, to)
+	entry.Outcome = s.deliver(ctx, msg, target, from, to, remoteAddr)
+	if entry.Outcome == "failed" {
+		return "451 Requested action aborted: try again later"
+	}
+	return "250 OK"
+}
+
+// claimTransaction records the transaction in the queue's dedup index,
+// returning its key and whether it is new
+func (s *Server) claimTransaction(sp *spool.Spool, from string, to []string) (string, bool, error) {
+	q := relay.GetQueue()
+	if q == nil {
+		return "", true, nil
+	}
+	r, err := sp.Open(0)
+	if err != nil {
+		return "", false, err
+	}
+	defer r.Close()
+	return q.Claim(from, to, r)
+}
+
+// deliver relays the message to its recipients and queues a retry for each
+// recipient the relay did not accept, so recipients that were delivered are
+// not sent the message again. A delivery cut short by cancelling ctx is
+// queued the same way. Recipients rejected permanently are not retried but
+// moved to the failed items and bounced. It returns "delivered", "queued" if
+// some recipients were queued, "bounced" if some were only bounced, or
+// "failed" if a recipient could not be queued either.
+func (s *Server) deliver(ctx context.Context, msg relay.Message, target, from string, to []string, remoteAddr string) string {
+	var results []relay.RecipientResult
+	if target != "" {
+		results = relay.RelayEmailVia(ctx, target, msg, from, to, s.currentConfig())
+	} else {
+		results = relay.RelayEmail(ctx, msg, from, to, s.currentConfig())
+	}
+
+	outcome := "delivered"
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if relay.IsPermanent(result.Err) {
+			s.Logger.Log(logger.LogLevelWarn, "Email rejected permanently, not retrying: From=%s, To=%s: %v", from, result.To, result.Err)
+			if err := relay.FailPermanently(ctx, msg, target, from, result.To, result.Err, s.currentConfig()); err != nil {
+				s.Logger.Log(logger.LogLevelError, "Failed to record permanently failed email from %s: %v", remoteAddr, err)
+				outcome = "failed"
+			} else if outcome == "delivered" {
+				outcome = "bounced"
+			}
+			continue
+		}
+		qerr := relay.QueueForRetry(msg, target, from, result.To)
+		switch {
+		case errors.Is(qerr, queue.ErrDuplicate):
+			s.Logger.Log(logger.LogLevelInfo, "Duplicate email from %s already queued: From=%s, To=%s", remoteAddr, from, result.To)
+		case qerr != nil:
+			s.Logger.Log(logger.LogLevelError, "Failed to queue email from %s: %v", remoteAddr, qerr)
+			outcome = "failed"
+			continue
+		default:
+			s.Logger.Log(logger.LogLevelWarn, "Queued email for retry: From=%s, To=%s: %v", from, result.To, result.Err)
+		}
+		if outcome == "delivered" || outcome == "bounced" {
+			outcome = "queued"
+		}
+	}
+	return outcome
+}
+
+// routes lists the distinct relays the recipients are routed to, with "mx"
+// standing for direct delivery
+func (s *Server) routes(target, from string, to []string) []string {
+	if target != "" {
+		return []string{target}
+	}
+	var routes []string
+	seen := make(map[string]bool)
+	for _, rcpt := range to {
+		relays := relay.Route(from, rcpt, s.currentConfig())
+		if len(relays) == 0 {
+			relays = []string{"mx"}
+		}
+		for _, r := range relays {
+			if !seen[r] {
+				seen[r] = true
+				routes = append(routes, r)
+			}
+		}
+	}
+	return routes
+}
+
+// recordAccess writes an access log entry if the access log is enabled
+func (s *Server) recordAccess(entry logger.AccessEntry) {
+	if s.accessLog == nil {
+		return
+	}
+	if err := s.accessLog.Record(entry); err != nil {
+		s.Logger.Log(logger.LogLevelError, "Error writing access log: %v", err)
+	}
+}
+
+// receivedHeader builds the RFC 5321 trace header recorded for a message,
+// e.g. "Received: from client.example ([192.0.2.1]) by relay.example with
+// ESMTPS for <user@example.org>; <date>". The "for" clause is only added for
+// a single recipient so that other recipients are not disclosed.
+func (s *Server) receivedHeader(helo, ip, protocol string, to []string) string {
+	if helo == "" {
+		helo = "unknown"
+	}
+	by := fmt.Sprintf("by %s with %s", s.hostname(), protocol)
+	if len(to) == 1 {
+		by += fmt.Sprintf("\r\n\tfor <%s>", to[0])
+	}
+	return fmt.Sprintf("Received: from %s ([%s])\r\n\t%s; %s\r\n",
+		helo, ip, by, time.Now().Format(time.RFC1123Z))
+}
+
+// withProtocol returns the "with" keyword of the Received header (RFC 3848)
+func withProtocol(esmtp, encrypted, authenticated bool) string {
+	if !esmtp {
+		return "SMTP"
+	}
+	protocol := "ESMTP"
+	if encrypted {
+		protocol += "S"
+	}
+	if authenticated {
+		protocol += "A"
+	}
+	return protocol
+}
+
+// hostname returns the configured hostname of the relay, defaulting to the
+// OS hostname
+func (s *Server) hostname() string {
+	if name := s.currentConfig().Hostname; name != "" {
+		return name
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
+}
+
+// greeting returns the 220 banner text, e.g. "relay.example ESMTP ready"
+func (s *Server) greeting() string {
+	text := s.currentConfig().Greeting
+	if text == "" {
+		text = "ESMTP ready"
+	}
+	return s.hostname() + " " + text
+}
+
+// readHeader returns the header block of a spooled message, including the
+// blank line that ends it, and the offset of the body. A message that does
+// not start with a well-formed header block has no header and the whole
+// message is body. A message that is all header, which RFC 5322 allows, gets
+// the blank line added and an empty body.
+func readHeader(sp *spool.Spool) ([]byte, int64, error) {
+	r, err := sp.Open(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	var header bytes.Buffer
+	br := bufio.NewReader(io.LimitReader(r, maxHeaderBytes))
+	for {
+		line, err := br.ReadBytes('\n')
+		header.Write(line)
+		if err == io.EOF {
+			// Stopping at the size limit leaves the header unfinished
+			if header.Len() == 0 || int64(header.Len()) < sp.Size() {
+				return nil, 0, nil
+			}
+			return endHeader(header.Bytes())
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read header: %w", err)
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	if _, ok := parseHeader(header.Bytes()); !ok {
+		return nil, 0, nil
+	}
+	return header.Bytes(), int64(header.Len()), nil
+}
+
+// endHeader completes the header block of a message that is all header with
+// the blank line ending it, in the message's line endings. The body is empty,
+// so its offset is the end of the message.
+func endHeader(data []byte) ([]byte, int64, error) {
+	size := int64(len(data))
+	newline := "\r\n"
+	if bytes.HasSuffix(data, []byte("\n")) && !bytes.HasSuffix(data, []byte("\r\n")) {
+		newline = "\n"
+	}
+	header := append([]byte{}, data...)
+	if !bytes.HasSuffix(header, []byte("\n")) {
+		header = append(header, newline...)
+	}
+	header = append(header, newline...)
+
+	if _, ok := parseHeader(header); !ok {
+		return nil, 0, nil
+	}
+	return header, size, nil
+}
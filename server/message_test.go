@@ -0,0 +1,395 @@
+package server
+
+import (
+	"encoding/json"
+	"go-relay-server/config"
+	"go-relay-server/logger"
+	"go-relay-server/relay"
+	"go-relay-server/smtptest"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicateTransaction(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	// Without Date and From the relay adds both, and the added Date must not
+	// make the repeated DATA look new
+	message := "To: rcpt@example.org\r\nSubject: duplicate\r\n\r\nBody\r\n"
+	for i := 0; i < 2; i++ {
+		c := dial(t, listenerAddr(cfg, 0))
+		c.cmd(250, "EHLO client.test")
+		c.send("dup@example.com", []string{"b@example.org", "c@example.org"}, message)
+		c.cmd(221, "QUIT")
+	}
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) >= 1 })
+
+	// A different recipient list is a new transaction
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("dup@example.com", []string{"b@example.org"}, message)
+	waitFor(t, "delivery", func() bool { return len(upstream.Messages()) >= 2 })
+
+	if n := len(upstream.Messages()); n != 2 {
+		t.Fatalf("upstream received %d messages, want 2", n)
+	}
+}
+
+func TestDuplicateOfQueuedTransaction(t *testing.T) {
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "DATA" {
+			return "451 Try again later"
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	message := "To: rcpt@example.org\r\nSubject: queued duplicate\r\n\r\nBody\r\n"
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			// The Date header the relay adds changes by the second
+			time.Sleep(time.Second)
+		}
+		c := dial(t, listenerAddr(cfg, 0))
+		c.cmd(250, "EHLO client.test")
+		c.send("queued-dup@example.com", []string{"b@example.org"}, message)
+		c.cmd(221, "QUIT")
+	}
+
+	queued := 0
+	for _, item := range relay.GetQueue().Items() {
+		if item.From == "queued-dup@example.com" {
+			queued++
+		}
+	}
+	if queued != 1 {
+		t.Fatalf("queue holds %d copies of the message, want 1", queued)
+	}
+}
+
+func TestRelayTargetHeader(t *testing.T) {
+	defaultRelay := startUpstream(t)
+	override := startUpstream(t)
+	other := startUpstream(t)
+
+	for _, test := range []struct {
+		name    string
+		trusted string
+		target  string
+		want    *smtptest.Server
+	}{
+		{"trusted", "127.0.0.0/8", override.Addr, override},
+		{"untrusted", "10.0.0.0/8", override.Addr, defaultRelay},
+		{"target not allowed", "127.0.0.1", other.Addr, defaultRelay},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, defaultRelay.Addr)
+			cfg.RelayTargetHeader = config.RelayTargetHeaderConfig{
+				Enabled:        true,
+				TrustedClients: []string{test.trusted},
+				AllowedTargets: []string{override.Addr},
+			}
+			startServer(t, cfg)
+
+			before := len(test.want.Messages())
+			c := dial(t, listenerAddr(cfg, 0))
+			c.cmd(250, "EHLO client.test")
+			c.send("a@example.com", []string{"b@example.org"},
+				"X-Relay-Target: "+test.target+"\r\n"+testMessage("relay target "+test.name, "Hello\r\n"))
+
+			messages := test.want.Messages()
+			if len(messages) != before+1 {
+				t.Fatalf("message not relayed through the expected relay")
+			}
+			if data := string(messages[before].Data); strings.Contains(data, "X-Relay-Target") {
+				t.Fatalf("routing header was relayed:\n%s", data)
+			}
+		})
+	}
+	if n := len(other.Messages()); n != 0 {
+		t.Fatalf("relay that is not allowed received %d messages", n)
+	}
+}
+
+func TestSpoolCleanup(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	spoolDir := t.TempDir()
+	cfg.Spool = config.SpoolConfig{Dir: spoolDir, MemoryThreshold: 1024}
+	cfg.MessageChecks.RequireFrom = true
+	startServer(t, cfg)
+
+	large := strings.Repeat("A large attachment line\r\n", 200)
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("small spool", "Hello\r\n"))
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("large spool", large))
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.data(554, "Subject: rejected spool\r\n\r\n"+large)
+
+	// The spilled message reached the upstream whole
+	messages := upstream.Messages()
+	if len(messages) != 2 || !strings.HasSuffix(string(messages[1].Data), large) {
+		t.Fatalf("upstream received %d messages, want both with their bodies intact", len(messages))
+	}
+	entries, err := os.ReadDir(spoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d spool files left after delivery and rejection", len(entries))
+	}
+}
+
+// receivedRE matches the Received header the relay prepends
+var receivedRE = regexp.MustCompile(`^Received: from (\S+) \(\[([^\]]+)\]\)\r\n\tby (\S+) with (\w+)(?:\r\n\tfor <([^>]+)>)?; ([^\r]+)\r\n`)
+
+func TestReceivedHeader(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	c := dial(t, addr)
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, "Received: from earlier.test\r\n"+testMessage("received esmtp", "Hello\r\n"))
+	c = dial(t, addr)
+	c.cmd(250, "HELO legacy.test")
+	c.send("a@example.com", []string{"b@example.org", "c@example.org"}, testMessage("received smtp", "Hello\r\n"))
+
+	messages := upstream.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("upstream received %d messages, want 2", len(messages))
+	}
+	for i, want := range [][]string{
+		{"client.test", "127.0.0.1", "relay.test", "ESMTP", "b@example.org"},
+		{"legacy.test", "127.0.0.1", "relay.test", "SMTP", ""},
+	} {
+		match := receivedRE.FindStringSubmatch(string(messages[i].Data))
+		if match == nil {
+			t.Fatalf("message %d does not start with a Received header:\n%s", i, messages[i].Data)
+		}
+		if got := match[1:6]; !slices.Equal(got, want) {
+			t.Errorf("message %d Received header has %q, want %q", i, got, want)
+		}
+		date, err := time.Parse(time.RFC1123Z, match[6])
+		if err != nil {
+			t.Errorf("message %d Received date %q: %v", i, match[6], err)
+		} else if time.Since(date) > time.Minute || time.Until(date) > time.Second {
+			t.Errorf("message %d Received date %v is not the time of receipt", i, date)
+		}
+	}
+	// The client's own trace headers follow the new one
+	if rest := receivedRE.ReplaceAllString(string(messages[0].Data), ""); !strings.HasPrefix(rest, "Received: from earlier.test\r\n") {
+		t.Errorf("existing Received header not kept below the new one:\n%s", messages[0].Data)
+	}
+}
+
+func TestHostnameDefault(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Hostname = ""
+	s := startServer(t, cfg)
+
+	want, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no OS hostname: %v", err)
+	}
+	if got := s.hostname(); got != want {
+		t.Fatalf("hostname %q, want the OS hostname %q", got, want)
+	}
+}
+
+func TestGreetingAndHostname(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Hostname = "mx.example.net"
+	cfg.Greeting = "Mail service ready"
+	withTLS(t, &cfg)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "starttls"})
+	startServer(t, cfg)
+
+	for i := range cfg.Listeners {
+		c := connect(t, listenerAddr(cfg, i))
+		if banner := c.expect(220); banner != "mx.example.net Mail service ready" {
+			t.Errorf("listener %d greeted with %q", i, banner)
+		}
+		if ehlo := c.cmd(250, "EHLO client.test"); !strings.HasPrefix(ehlo, "mx.example.net\n") {
+			t.Errorf("listener %d EHLO identity in %q, want mx.example.net", i, ehlo)
+		}
+		if helo := c.cmd(250, "HELO client.test"); helo != "mx.example.net" {
+			t.Errorf("listener %d HELO reply %q, want mx.example.net", i, helo)
+		}
+	}
+
+	// Without a greeting the banner says ESMTP ready
+	cfg = testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+	if banner := connect(t, listenerAddr(cfg, 0)).expect(220); banner != "relay.test ESMTP ready" {
+		t.Errorf("default greeting %q, want \"relay.test ESMTP ready\"", banner)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.DryRun = true
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("dry run", "Hello\r\n"))
+	c.cmd(221, "QUIT")
+
+	if n := upstream.Connections(); n != 0 {
+		t.Fatalf("dry run made %d upstream connections", n)
+	}
+}
+
+// readAccessLog returns the entries written to the access log at path
+func readAccessLog(t *testing.T, path string) []logger.AccessEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []logger.AccessEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry logger.AccessEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("access log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.AccessLog = filepath.Join(t.TempDir(), "access.log")
+	// The access log does not depend on the log level
+	cfg.LogLevel = "error"
+	cfg.MessageChecks.RequireFrom = true
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	first := testMessage("access-one", "First\r\n")
+	c.send("a@example.com", []string{"b@example.org"}, first)
+	c.send("c@example.com", []string{"d@example.org", "e@example.org"}, testMessage("access-two", "Second\r\n"))
+	c.cmd(250, "MAIL FROM:<f@example.com>")
+	c.cmd(250, "RCPT TO:<g@example.org>")
+	c.data(554, "Subject: access-three\r\n\r\nNo From\r\n")
+
+	entries := readAccessLog(t, cfg.AccessLog)
+	if len(entries) != 3 {
+		t.Fatalf("access log has %d entries, want 3: %+v", len(entries), entries)
+	}
+	for i, want := range []logger.AccessEntry{
+		{ClientIP: "127.0.0.1", From: "a@example.com", To: []string{"b@example.org"}, Subject: "access-one", Relay: []string{upstream.Addr}, Outcome: "delivered"},
+		{ClientIP: "127.0.0.1", From: "c@example.com", To: []string{"d@example.org", "e@example.org"}, Subject: "access-two", Relay: []string{upstream.Addr}, Outcome: "delivered"},
+		{ClientIP: "127.0.0.1", From: "f@example.com", To: []string{"g@example.org"}, Subject: "access-three", Outcome: "rejected"},
+	} {
+		got := entries[i]
+		if got.ClientIP != want.ClientIP || got.From != want.From || !slices.Equal(got.To, want.To) ||
+			got.Subject != want.Subject || !slices.Equal(got.Relay, want.Relay) || got.Outcome != want.Outcome {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want)
+		}
+		if got.Time.IsZero() || got.Reply == "" {
+			t.Errorf("entry %d has no time or reply: %+v", i, got)
+		}
+	}
+	// The size is counted after DATA has turned CRLF line endings into LF
+	if want := int64(len(strings.ReplaceAll(first, "\r\n", "\n"))); entries[0].Size != want {
+		t.Errorf("entry 0 size = %d, want %d", entries[0].Size, want)
+	}
+	if !strings.HasPrefix(entries[2].Reply, "554") {
+		t.Errorf("rejected entry reply = %q, want 554", entries[2].Reply)
+	}
+}
+
+func TestRelayTimeoutQueues(t *testing.T) {
+	// An upstream that accepts the connection and then says nothing
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	cfg := testConfig(t, listener.Addr().String())
+	cfg.RelayTimeout = config.RelayTimeoutConfig{Dial: "1s", Command: "200ms"}
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	start := time.Now()
+	c.send("timeout@example.com", []string{"b@example.org"}, testMessage("relay-timeout", "Stalled\r\n"))
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("message was queued after %v, want about the 200ms command timeout", elapsed)
+	}
+
+	queued := 0
+	for _, item := range relay.GetQueue().Items() {
+		if item.From == "timeout@example.com" {
+			queued++
+		}
+	}
+	if queued != 1 {
+		t.Fatalf("queue holds %d items for the timed out message, want 1", queued)
+	}
+}
+
+func TestPartialDeliveryQueuesFailedRecipients(t *testing.T) {
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "RCPT" && strings.Contains(line, "later@example.org") {
+			return "451 Try again later"
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	cfg := testConfig(t, upstream.Addr)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("partial@example.com", []string{"now@example.org", "later@example.org", "also-now@example.org"}, testMessage("partial", "Body\r\n"))
+
+	messages := upstream.Messages()
+	if len(messages) != 1 || !slices.Equal(messages[0].To, []string{"now@example.org", "also-now@example.org"}) {
+		t.Fatalf("upstream received %+v, want one message to the accepted recipients", messages)
+	}
+	var queued []string
+	for _, item := range relay.GetQueue().Items() {
+		if item.From == "partial@example.com" {
+			queued = append(queued, item.To)
+		}
+	}
+	if !slices.Equal(queued, []string{"later@example.org"}) {
+		t.Fatalf("queued recipients %q, want only the one the relay refused", queued)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"go-relay-server/relay"
+	"net/http"
+	"strings"
+)
+
+// handleMetrics serves the server counters in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	// The admin endpoint runs before the listeners are bound
+	s.mu.RLock()
+	allStats := s.listenerStats
+	s.mu.RUnlock()
+
+	writeMetricHeader(&b, "smtp_relay_connections_total", "counter", "Connections accepted per listener.")
+	for _, listenerCfg := range s.currentConfig().Listeners {
+		if stats, ok := allStats[listenerCfg.Port]; ok {
+			fmt.Fprintf(&b, "smtp_relay_connections_total{port=%q} %d\n", listenerCfg.Port, stats.total.Load())
+		}
+	}
+
+	writeMetricHeader(&b, "smtp_relay_connections_active", "gauge", "Connections currently open per listener.")
+	for _, listenerCfg := range s.currentConfig().Listeners {
+		if stats, ok := allStats[listenerCfg.Port]; ok {
+			fmt.Fprintf(&b, "smtp_relay_connections_active{port=%q} %d\n", listenerCfg.Port, stats.active.Load())
+		}
+	}
+
+	relayStats := relay.GetStats()
+	writeMetric(&b, "smtp_relay_messages_received_total", "counter", "Messages received over DATA.", s.messagesReceived.Load())
+	writeMetric(&b, "smtp_relay_messages_relayed_total", "counter", "Messages relayed successfully.", relayStats.Delivered)
+	writeMetric(&b, "smtp_relay_relay_failures_total", "counter", "Messages that failed to relay.", relayStats.Failed)
+	writeMetricHeader(&b, "smtp_relay_relay_attempts_total", "counter", "Delivery attempts per upstream relay and result.")
+	relays := relay.GetRelayStats()
+	for _, rs := range relays {
+		fmt.Fprintf(&b, "smtp_relay_relay_attempts_total{relay=%q,result=\"success\"} %d\n", rs.Relay, rs.Succeeded)
+		fmt.Fprintf(&b, "smtp_relay_relay_attempts_total{relay=%q,result=\"failure\"} %d\n", rs.Relay, rs.Failed)
+	}
+	writeMetricHeader(&b, "smtp_relay_relay_attempt_duration_seconds", "histogram", "Duration of delivery attempts per upstream relay.")
+	for _, rs := range relays {
+		writeHistogram(&b, "smtp_relay_relay_attempt_duration_seconds", fmt.Sprintf("relay=%q", rs.Relay), rs.Latency)
+	}
+	writeMetricHeader(&b, "smtp_relay_delivery_duration_seconds", "histogram", "Time from handing a message to the relay until an upstream accepted it.")
+	writeHistogram(&b, "smtp_relay_delivery_duration_seconds", "", relay.GetDeliveryLatency())
+	writeMetric(&b, "smtp_relay_rate_limited_total", "counter", "Connections rejected by rate limiting.", s.rateLimited.Load())
+	writeMetricHeader(&b, "smtp_relay_block_list_hits_total", "counter", "Client IPs, senders and recipients rejected by the block list.")
+	for _, kind := range listKinds {
+		fmt.Fprintf(&b, "smtp_relay_block_list_hits_total{type=%q} %d\n", kind, s.blockHits.get(kind))
+	}
+	writeMetricHeader(&b, "smtp_relay_allow_list_rejections_total", "counter", "Senders and recipients rejected for not being on the allow list.")
+	for _, kind := range listKinds[1:] {
+		fmt.Fprintf(&b, "smtp_relay_allow_list_rejections_total{type=%q} %d\n", kind, s.allowRejections.get(kind))
+	}
+
+	if q := relay.GetQueue(); q != nil {
+		stats := q.Stats()
+		writeMetric(&b, "smtp_relay_queue_depth", "gauge", "Messages waiting in the relay queue.", stats.Pending)
+		writeMetric(&b, "smtp_relay_queue_failed_items", "gauge", "Messages that exhausted their retries.", stats.Failed)
+		writeMetric(&b, "smtp_relay_queue_bytes", "gauge", "Total size of queued messages.", stats.Bytes)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+func writeMetricHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeHistogram writes the cumulative buckets, sum and count of h, with
+// labels added to every sample
+func writeHistogram(b *strings.Builder, name, labels string, h relay.Histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	var cumulative uint64
+	for i, bound := range relay.LatencyBuckets {
+		cumulative += h.Buckets[i]
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, bound, cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.Count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %g\n", name, labels, h.Sum)
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value interface{}) {
+	writeMetricHeader(b, name, kind, help)
+	fmt.Fprintf(b, "%s %v\n", name, value)
+}
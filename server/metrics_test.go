@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"go-relay-server/config"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	admin := withAdmin(t, &cfg)
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("a@example.com", []string{"b@example.org"}, testMessage("metrics", "Hello\r\n"))
+
+	code, body := httpGet(t, admin+"/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d %s", code, body)
+	}
+	metrics := string(body)
+	for _, name := range []string{
+		"smtp_relay_connections_total",
+		"smtp_relay_connections_active",
+		"smtp_relay_messages_received_total",
+		"smtp_relay_messages_relayed_total",
+		"smtp_relay_relay_failures_total",
+		"smtp_relay_rate_limited_total",
+		"smtp_relay_queue_depth",
+		"smtp_relay_relay_attempt_duration_seconds",
+		"smtp_relay_delivery_duration_seconds",
+	} {
+		if !strings.Contains(metrics, "# TYPE "+name+" ") {
+			t.Errorf("metric %s missing", name)
+		}
+	}
+	for _, sample := range []string{
+		fmt.Sprintf("smtp_relay_connections_total{port=%q} 1\n", cfg.Listeners[0].Port),
+		fmt.Sprintf("smtp_relay_connections_active{port=%q} 1\n", cfg.Listeners[0].Port),
+		"smtp_relay_messages_received_total 1\n",
+		"smtp_relay_rate_limited_total 0\n",
+		fmt.Sprintf("smtp_relay_relay_attempts_total{relay=%q,result=\"success\"} 1\n", upstream.Addr),
+		fmt.Sprintf("smtp_relay_relay_attempts_total{relay=%q,result=\"failure\"} 0\n", upstream.Addr),
+		fmt.Sprintf("smtp_relay_relay_attempt_duration_seconds_bucket{relay=%q,le=\"+Inf\"} 1\n", upstream.Addr),
+		fmt.Sprintf("smtp_relay_relay_attempt_duration_seconds_count{relay=%q} 1\n", upstream.Addr),
+	} {
+		if !strings.Contains(metrics, sample) {
+			t.Errorf("sample %q missing:\n%s", strings.TrimSpace(sample), metrics)
+		}
+	}
+}
+
+func TestListHitMetrics(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "none", ProxyProtocol: true})
+	cfg.BlockList = []string{"192.0.2.66", "spammer@", "blocked@"}
+	cfg.AllowList = []string{"example.com", "example.org"}
+	admin := withAdmin(t, &cfg)
+	startServer(t, cfg)
+
+	if _, code := proxyDial(t, listenerAddr(cfg, 1), "192.0.2.66"); code != 550 {
+		t.Fatalf("blocked client got %d, want 550", code)
+	}
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(550, "MAIL FROM:<spammer@example.com>")
+	c.cmd(550, "MAIL FROM:<a@other.test>")
+	c.cmd(550, "MAIL FROM:<a@elsewhere.test>")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(550, "RCPT TO:<blocked@example.org>")
+	c.cmd(550, "RCPT TO:<b@other.test>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+
+	_, body := httpGet(t, admin+"/metrics")
+	metrics := string(body)
+	for _, sample := range []string{
+		"smtp_relay_block_list_hits_total{type=\"ip\"} 1\n",
+		"smtp_relay_block_list_hits_total{type=\"sender\"} 1\n",
+		"smtp_relay_block_list_hits_total{type=\"recipient\"} 1\n",
+		"smtp_relay_allow_list_rejections_total{type=\"sender\"} 2\n",
+		"smtp_relay_allow_list_rejections_total{type=\"recipient\"} 1\n",
+	} {
+		if !strings.Contains(metrics, sample) {
+			t.Errorf("sample %q missing:\n%s", strings.TrimSpace(sample), metrics)
+		}
+	}
+	if strings.Contains(metrics, "smtp_relay_allow_list_rejections_total{type=\"ip\"}") {
+		t.Error("allow list rejections are reported for client IPs, which the allow list does not apply to")
+	}
+
+	// The block list names the entry that matched
+	log := readLog(t, cfg)
+	for _, line := range []string{
+		`ip 192.0.2.66 matched block_list entry "192.0.2.66"`,
+		`sender spammer@example.com matched block_list entry "spammer@"`,
+		`recipient blocked@example.org matched block_list entry "blocked@"`,
+	} {
+		if !strings.Contains(log, line) {
+			t.Errorf("log does not contain %q", line)
+		}
+	}
+}
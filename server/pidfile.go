@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultPIDFile is used when the config does not set pid_file
+const DefaultPIDFile = "smtp-relay.pid"
+
+// ErrNotRunning is returned when no live server process owns the PID file
+var ErrNotRunning = errors.New("server is not running")
+
+// pidFilePath returns the configured PID file path
+func (s *Server) pidFilePath() string {
+	if path := s.currentConfig().PIDFile; path != "" {
+		return path
+	}
+	return DefaultPIDFile
+}
+
+// WritePIDFile records the current process ID. It fails if the file already
+// belongs to another live process; a stale file is overwritten.
+func WritePIDFile(path string) error {
+	if pid, err := RunningPID(path); err == nil && pid != os.Getpid() {
+		return fmt.Errorf("server already running with PID %d", pid)
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write PID file: %v", err)
+	}
+	return nil
+}
+
+// ReadPIDFile returns the process ID stored in the PID file
+func ReadPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID file %s", path)
+	}
+	return pid, nil
+}
+
+// RunningPID returns the process ID from the PID file if that process is
+// still alive. A missing, invalid or stale PID file yields ErrNotRunning.
+func RunningPID(path string) (int, error) {
+	pid, err := ReadPIDFile(path)
+	if err != nil {
+		return 0, ErrNotRunning
+	}
+	if !processRunning(pid) {
+		return 0, ErrNotRunning
+	}
+	return pid, nil
+}
+
+// RemovePIDFile deletes the PID file, ignoring a file that is already gone
+func RemovePIDFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove PID file: %v", err)
+	}
+	return nil
+}
+
+// TerminateProcess asks the process to shut down gracefully
+func TerminateProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find process %d: %v", pid, err)
+	}
+	return terminate(process)
+}
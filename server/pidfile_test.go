@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// exitedPID returns the process ID of a process that has already exited
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.pid")
+	if err := WritePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := RunningPID(path); err != nil || pid != os.Getpid() {
+		t.Fatalf("RunningPID = %d, %v; want %d", pid, err, os.Getpid())
+	}
+	// Writing it again from the same process is fine
+	if err := WritePIDFile(path); err != nil {
+		t.Fatalf("rewriting own PID file: %v", err)
+	}
+
+	if err := RemovePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunningPID(path); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("RunningPID after removal returned %v, want ErrNotRunning", err)
+	}
+	if err := RemovePIDFile(path); err != nil {
+		t.Fatalf("removing a missing PID file: %v", err)
+	}
+}
+
+func TestWritePIDFileOfLiveProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.pid")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePIDFile(path); err == nil {
+		t.Fatal("WritePIDFile took over the PID file of a live process")
+	}
+}
+
+func TestStalePIDFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"exited process": strconv.Itoa(exitedPID(t)) + "\n",
+		"garbage":        "not a pid\n",
+		"empty":          "",
+		"negative":       "-1\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "relay.pid")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RunningPID(path); !errors.Is(err, ErrNotRunning) {
+				t.Fatalf("RunningPID returned %v, want ErrNotRunning", err)
+			}
+			// A stale file does not stop a new server from starting
+			if err := WritePIDFile(path); err != nil {
+				t.Fatalf("WritePIDFile over a stale file: %v", err)
+			}
+			if pid, _ := ReadPIDFile(path); pid != os.Getpid() {
+				t.Fatalf("PID file holds %d, want %d", pid, os.Getpid())
+			}
+		})
+	}
+}
+
+func TestServerPIDFile(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	s := startServer(t, cfg)
+
+	if pid, err := RunningPID(cfg.PIDFile); err != nil || pid != os.Getpid() {
+		t.Fatalf("running server: RunningPID = %d, %v; want %d", pid, err, os.Getpid())
+	}
+	s.Stop()
+	if _, err := os.Stat(cfg.PIDFile); !os.IsNotExist(err) {
+		t.Fatalf("PID file left behind after Stop: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package server
+
+import "os"
+
+func processRunning(pid int) bool {
+	// FindProcess opens a handle on Windows and fails for exited processes
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+func terminate(process *os.Process) error {
+	// Windows has no SIGTERM; the service manager is the graceful path
+	return process.Kill()
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/textproto"
+)
+
+// reply writes an SMTP reply line without flushing it, so that the replies
+// to a group of pipelined commands (RFC 2920) can be sent together
+func reply(tp *textproto.Conn, format string, args ...interface{}) {
+	fmt.Fprintf(tp.W, format, args...)
+	tp.W.WriteString("\r\n")
+}
+
+// flushReplies sends the pending replies unless another complete command is
+// already buffered. Flushing whenever the next read could block keeps a
+// client that waits for replies from deadlocking with a server waiting for
+// commands.
+func flushReplies(tp *textproto.Conn) {
+	if !lineBuffered(tp.R) {
+		tp.W.Flush()
+	}
+}
+
+// lineBuffered reports whether r holds a complete line that can be read
+// without blocking
+func lineBuffered(r *bufio.Reader) bool {
+	buffered, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
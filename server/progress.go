@@ -0,0 +1,49 @@
+package server
+
+import (
+	"go-relay-server/logger"
+	"io"
+	"time"
+)
+
+// progressReader counts the bytes of a DATA transfer and logs them at DEBUG
+// level each time another interval has arrived, so a slow or stuck transfer
+// of a large message shows how far it got
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	next     int64
+	interval int64
+	start    time.Time
+	log      func(n int64, elapsed time.Duration)
+}
+
+// withProgress wraps a DATA reader with progress logging when
+// spool.progress_interval is set
+func (s *Server) withProgress(r io.Reader, remoteAddr string) io.Reader {
+	interval := s.currentConfig().Spool.ProgressInterval
+	if interval <= 0 {
+		return r
+	}
+	return &progressReader{
+		r:        r,
+		next:     interval,
+		interval: interval,
+		start:    time.Now(),
+		log: func(n int64, elapsed time.Duration) {
+			s.Logger.Log(logger.LogLevelDebug, "Received %d bytes of DATA from %s in %s", n, remoteAddr, elapsed.Round(time.Millisecond))
+		},
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.n >= p.next {
+		p.log(p.n, time.Since(p.start))
+		for p.next <= p.n {
+			p.next += p.interval
+		}
+	}
+	return n, err
+}
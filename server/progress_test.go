@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		r    func(io.Reader) io.Reader
+		want []int64
+	}{
+		{"byte by byte", iotest.OneByteReader, []int64{1000, 2000, 3000, 4000, 5000}},
+		// A read that spans several intervals logs once
+		{"large reads", func(r io.Reader) io.Reader { return readSize(r, 2500) }, []int64{2500, 5000}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged []int64
+			p := &progressReader{
+				r:        tt.r(bytes.NewReader(make([]byte, 5500))),
+				next:     1000,
+				interval: 1000,
+				start:    time.Now(),
+				log:      func(n int64, elapsed time.Duration) { logged = append(logged, n) },
+			}
+			n, err := io.Copy(io.Discard, p)
+			if err != nil || n != 5500 {
+				t.Fatalf("copied %d bytes, %v", n, err)
+			}
+			if !slices.Equal(logged, tt.want) {
+				t.Errorf("progress logged at %v, want %v", logged, tt.want)
+			}
+		})
+	}
+}
+
+// readSize returns a reader that returns at most size bytes per read
+func readSize(r io.Reader, size int) io.Reader {
+	return readerFunc(func(b []byte) (int, error) {
+		if len(b) > size {
+			b = b[:size]
+		}
+		return r.Read(b)
+	})
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) { return f(b) }
+
+func TestDataProgressLog(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Spool.ProgressInterval = 16 * 1024
+	cfg.LogLevel = "DEBUG"
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.send("progress@example.com", []string{"b@example.org"}, testMessage("small progress", "Small\r\n"))
+	if strings.Contains(readLog(t, cfg), "bytes of DATA") {
+		t.Fatal("progress logged for a message below the interval")
+	}
+
+	body := strings.Repeat(strings.Repeat("x", 78)+"\r\n", 1300) // About 100KB
+	c.send("progress@example.com", []string{"b@example.org"}, testMessage("large progress", body))
+	var lines []string
+	for _, line := range strings.Split(readLog(t, cfg), "\n") {
+		if strings.Contains(line, "bytes of DATA from") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 3 || len(lines) > 7 {
+		t.Fatalf("%d progress lines for a 100KB message at 16KB intervals, want about 6:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "[DEBUG]") {
+			t.Errorf("progress logged above DEBUG: %s", line)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a client may take to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyHeaderLength is the longest valid PROXY protocol v1 line, CRLF included
+const maxProxyHeaderLength = 107
+
+// bufferedConn serves reads from a buffered reader that may already hold
+// bytes read past the PROXY header
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// readProxyHeader consumes a PROXY protocol v1 header from conn and returns
+// a connection positioned after it together with the real client address.
+// For "PROXY UNKNOWN" the balancer's own address is kept.
+func readProxyHeader(conn net.Conn) (net.Conn, string, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read PROXY header: %v", err)
+	}
+	if len(line) > maxProxyHeaderLength || !strings.HasSuffix(string(line), "\r\n") {
+		return nil, "", errors.New("malformed PROXY header")
+	}
+
+	addr, err := parseProxyHeader(strings.TrimSuffix(string(line), "\r\n"))
+	if err != nil {
+		return nil, "", err
+	}
+	if addr == "" {
+		addr = conn.RemoteAddr().String()
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, addr, nil
+}
+
+// parseProxyHeader parses "PROXY TCP4|TCP6 src dst sport dport" and returns
+// the source address, or "" for "PROXY UNKNOWN"
+func parseProxyHeader(line string) (string, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return "", errors.New("malformed PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return "", nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return "", errors.New("malformed PROXY header")
+	}
+
+	for _, ip := range fields[2:4] {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || (fields[1] == "TCP4") != (parsed.To4() != nil && !strings.Contains(ip, ":")) {
+			return "", fmt.Errorf("invalid address %q in PROXY header", ip)
+		}
+	}
+	for _, port := range fields[4:6] {
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 || (len(port) > 1 && port[0] == '0') {
+			return "", fmt.Errorf("invalid port %q in PROXY header", port)
+		}
+	}
+
+	return net.JoinHostPort(fields[2], fields[4]), nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 40000 25", "192.0.2.1:40000", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 40000 25", "[2001:db8::1]:40000", true},
+		{"PROXY UNKNOWN", "", true},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 40000 25", "", true},
+		{"", "", false},
+		{"EHLO client.test", "", false},
+		{"PROXY", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 40000", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 40000 25", "", false},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 40000 25", "", false},
+		{"PROXY TCP6 192.0.2.1 2001:db8::2 40000 25", "", false},
+		{"PROXY TCP4 192.0.2.300 198.51.100.1 40000 25", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 70000 25", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 040000 25", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 -1 25", "", false},
+		{"PROXY  TCP4 192.0.2.1 198.51.100.1 40000 25", "", false},
+	} {
+		got, err := parseProxyHeader(tt.line)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseProxyHeader(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("parseProxyHeader(%q) accepted a malformed header", tt.line)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.BlockList = []string{"192.0.2.66"}
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	// The block list applies to the client behind the balancer
+	if _, code := proxyDial(t, addr, "192.0.2.66"); code != 550 {
+		t.Fatalf("blocked client got %d, want 550", code)
+	}
+	c, code := proxyDial(t, addr, "192.0.2.1")
+	if code != 220 {
+		t.Fatalf("client got %d, want 220", code)
+	}
+	c.cmd(250, "EHLO client.test")
+	c.cmd(221, "QUIT")
+	waitFor(t, "the client address in the log", func() bool {
+		return strings.Contains(readLog(t, cfg), "192.0.2.1:40000")
+	})
+
+	for _, header := range []string{
+		"EHLO client.test\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.254 40000\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.254 40000 25\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + " 192.0.2.254 40000 25\r\n",
+	} {
+		c := connect(t, addr)
+		fmt.Fprint(c.conn, header)
+		if !c.closed() {
+			t.Errorf("connection with header %q was not dropped", header)
+		}
+	}
+}
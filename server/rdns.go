@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"go-relay-server/logger"
+	"net"
+	"time"
+)
+
+const (
+	// defaultReverseDNSTimeout bounds the reverse DNS lookups for one connection
+	defaultReverseDNSTimeout = 5 * time.Second
+	// defaultReverseDNSCacheTTL is how long a reverse DNS result is remembered
+	defaultReverseDNSCacheTTL = time.Hour
+)
+
+// checkReverseDNS looks up the client's PTR name, logs it, and reports
+// whether the connection may proceed. In enforce mode a client without a PTR
+// record, or with require set to fcrdns without a forward-confirmed one, is
+// refused. Loopback and private addresses are never looked up, and a failed
+// lookup lets the client through.
+func (s *Server) checkReverseDNS(ctx context.Context, host string) bool {
+	conf := s.currentConfig().ReverseDNS
+	if conf.Mode == "" || conf.Mode == "off" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return true
+	}
+
+	timeout, cacheTTL := defaultReverseDNSTimeout, defaultReverseDNSCacheTTL
+	if d, err := time.ParseDuration(conf.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	if d, err := time.ParseDuration(conf.CacheTTL); err == nil && d > 0 {
+		cacheTTL = d
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := s.rdnsChecker.Lookup(ctx, ip, cacheTTL)
+	if err != nil {
+		s.Logger.Log(logger.LogLevelWarn, "Reverse DNS check of %s failed: %v", host, err)
+		return true
+	}
+
+	var problem string
+	switch {
+	case len(result.Names) == 0:
+		s.Logger.Log(logger.LogLevelInfo, "Connection from %s has no PTR record", host)
+		problem = "no PTR record"
+	case result.Confirmed == "":
+		s.Logger.Log(logger.LogLevelInfo, "Connection from %s has PTR %s, not forward-confirmed", host, result.Name())
+		if conf.Require == "fcrdns" {
+			problem = "PTR " + result.Name() + " does not resolve back to it"
+		}
+	default:
+		s.Logger.Log(logger.LogLevelInfo, "Connection from %s has PTR %s (forward-confirmed)", host, result.Confirmed)
+	}
+
+	if problem != "" && conf.Mode == "enforce" {
+		s.Logger.Log(logger.LogLevelWarn, "Rejected connection from %s: %s", host, problem)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"go-relay-server/config"
+	"go-relay-server/rdns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ptrRecords answers reverse DNS lookups from a table and counts the PTR
+// lookups
+type ptrRecords struct {
+	ptr     map[string]string
+	hosts   map[string]string
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *ptrRecords) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	if name, ok := r.ptr[addr]; ok {
+		return []string{name + "."}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *ptrRecords) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addr, ok := r.hosts[host]; ok {
+		return []string{addr}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *ptrRecords) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// startReverseDNSServer starts a server behind a PROXY balancer, so clients
+// can claim public addresses, with its reverse DNS answered from records
+func startReverseDNSServer(t *testing.T, conf config.ReverseDNSConfig, records *ptrRecords) config.Config {
+	t.Helper()
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.ReverseDNS = conf
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.rdnsChecker = rdns.NewChecker(records)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return cfg
+}
+
+func TestReverseDNS(t *testing.T) {
+	// 192.0.2.1 is forward-confirmed, 192.0.2.2 has a PTR name resolving
+	// elsewhere and 192.0.2.3 has no PTR record
+	newRecords := func() *ptrRecords {
+		return &ptrRecords{
+			ptr:   map[string]string{"192.0.2.1": "mail.example.com", "192.0.2.2": "forged.example.com"},
+			hosts: map[string]string{"mail.example.com": "192.0.2.1", "forged.example.com": "198.51.100.1"},
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		conf config.ReverseDNSConfig
+		want [3]int // Greeting codes of the three clients
+	}{
+		{"monitor", config.ReverseDNSConfig{Mode: "monitor", Require: "fcrdns"}, [3]int{220, 220, 220}},
+		{"enforce ptr", config.ReverseDNSConfig{Mode: "enforce"}, [3]int{220, 220, 550}},
+		{"enforce fcrdns", config.ReverseDNSConfig{Mode: "enforce", Require: "fcrdns"}, [3]int{220, 550, 550}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			records := newRecords()
+			cfg := startReverseDNSServer(t, tt.conf, records)
+			addr := listenerAddr(cfg, 0)
+			for i, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+				c, code := proxyDial(t, addr, ip)
+				if code != tt.want[i] {
+					t.Errorf("client %s got %d, want %d", ip, code, tt.want[i])
+				}
+				if code == 220 {
+					c.cmd(221, "QUIT")
+				}
+			}
+
+			waitFor(t, "the PTR names in the log", func() bool {
+				log := readLog(t, cfg)
+				return strings.Contains(log, "Connection from 192.0.2.1 has PTR mail.example.com (forward-confirmed)") &&
+					strings.Contains(log, "Connection from 192.0.2.2 has PTR forged.example.com, not forward-confirmed") &&
+					strings.Contains(log, "Connection from 192.0.2.3 has no PTR record")
+			})
+			if tt.want[2] == 550 && !strings.Contains(readLog(t, cfg), "Rejected connection from 192.0.2.3: no PTR record") {
+				t.Error("rejection of the client without a PTR record is not logged")
+			}
+
+			// A returning client is answered from the cache
+			c, _ := proxyDial(t, addr, "192.0.2.1")
+			c.cmd(221, "QUIT")
+			if n := records.count(); n != 3 {
+				t.Errorf("resolver was queried %d times, want once per client", n)
+			}
+		})
+	}
+}
+
+func TestReverseDNSResponse(t *testing.T) {
+	cfg := startReverseDNSServer(t, config.ReverseDNSConfig{Mode: "enforce"}, &ptrRecords{})
+	c := connect(t, listenerAddr(cfg, 0))
+	c.conn.Write([]byte("PROXY TCP4 192.0.2.3 192.0.2.254 40000 25\r\n"))
+	if code, msg := c.reply(); code != 550 || msg != "Client host rejected: cannot find your hostname" {
+		t.Fatalf("client without a PTR record got %d %q", code, msg)
+	}
+	if !c.closed() {
+		t.Error("connection of a rejected client was not closed")
+	}
+}
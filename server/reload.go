@@ -0,0 +1,119 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"go-relay-server/logger"
+	"reflect"
+)
+
+// currentConfig returns the active configuration, which Reload may replace
+func (s *Server) currentConfig() config.Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.Config
+}
+
+// Reload applies the settings of newConfig that are safe to change while
+// running: lists, routing, relay credentials, rate and connection limits and message
+// policies. TLS certificates are reread from their files. Settings that need
+// new listeners or a new logger are kept as they are and logged as requiring
+// a restart.
+func (s *Server) Reload(newConfig config.Config) {
+	s.cfgMu.Lock()
+
+	old := s.Config
+	for _, setting := range restartRequired(old, newConfig) {
+		s.Logger.Log(logger.LogLevelWarn, "Config change to %s requires a restart and was not applied", setting)
+	}
+
+	updated := old
+	updated.DefaultRelay = newConfig.DefaultRelay
+	updated.DryRun = newConfig.DryRun
+	updated.AllowList = newConfig.AllowList
+	updated.BlockList = newConfig.BlockList
+	updated.DomainRouting = newConfig.DomainRouting
+	updated.SenderRouting = newConfig.SenderRouting
+	updated.SenderRewrite = newConfig.SenderRewrite
+	updated.RelayCredentials = newConfig.RelayCredentials
+	updated.RelayTargetHeader = newConfig.RelayTargetHeader
+	updated.ListPrecedence = newConfig.ListPrecedence
+	updated.LocalPartCase = newConfig.LocalPartCase
+	updated.DisabledCommands = newConfig.DisabledCommands
+	updated.HeaderPolicy = newConfig.HeaderPolicy
+	updated.MessageChecks = newConfig.MessageChecks
+	updated.SPF = newConfig.SPF
+	updated.DNSBL = newConfig.DNSBL
+	updated.ReverseDNS = newConfig.ReverseDNS
+	updated.DKIM = newConfig.DKIM
+	updated.Append = newConfig.Append
+	updated.RateLimiting = newConfig.RateLimiting
+	updated.Spool = newConfig.Spool
+	updated.Hostname = newConfig.Hostname
+	updated.Greeting = newConfig.Greeting
+	updated.UpstreamTLS = newConfig.UpstreamTLS
+	updated.RelayPool = newConfig.RelayPool
+	updated.RelayTimeout = newConfig.RelayTimeout
+	updated.RelayRetry = newConfig.RelayRetry
+	updated.MaxConnections = newConfig.MaxConnections
+	updated.MaxConnectionsPerIP = newConfig.MaxConnectionsPerIP
+	updated.MaxConnectionLifetime = newConfig.MaxConnectionLifetime
+	updated.MaxRecipients = newConfig.MaxRecipients
+	updated.MaxAcceptRate = newConfig.MaxAcceptRate
+	updated.TarpitDelay = newConfig.TarpitDelay
+	updated.BannerDelay = newConfig.BannerDelay
+	updated.Responses = newConfig.Responses
+	updated.AuthUsername = newConfig.AuthUsername
+	updated.AuthPassword = newConfig.AuthPassword
+	s.Config = updated
+	s.cfgMu.Unlock()
+
+	if s.certs.Load() != nil {
+		if err := s.ReloadCertificates(); err != nil {
+			s.Logger.Log(logger.LogLevelError, "Failed to reload TLS certificates, keeping the current ones: %v", err)
+		}
+	}
+
+	s.Logger.Log(logger.LogLevelInfo, "Configuration reloaded")
+}
+
+// restartRequired lists the settings that differ between old and new but
+// cannot be applied without restarting the server
+func restartRequired(old, new config.Config) []string {
+	var settings []string
+	if !reflect.DeepEqual(old.Listeners, new.Listeners) {
+		settings = append(settings, "listeners")
+	}
+	if old.TLSCertFile != new.TLSCertFile || old.TLSKeyFile != new.TLSKeyFile {
+		settings = append(settings, "tls_cert_file/tls_key_file")
+	}
+	if old.TLSMinVersion != new.TLSMinVersion || !reflect.DeepEqual(old.TLSCipherSuites, new.TLSCipherSuites) {
+		settings = append(settings, "tls_min_version/tls_cipher_suites")
+	}
+	if old.LogFile != new.LogFile || old.LogDir != new.LogDir || old.LogLevel != new.LogLevel ||
+		old.LogFormat != new.LogFormat || old.LogRetentionDays != new.LogRetentionDays || old.LogCompress != new.LogCompress ||
+		old.LogConsole != new.LogConsole {
+		settings = append(settings, "logging")
+	}
+	if old.Queue != new.Queue {
+		settings = append(settings, "queue")
+	}
+	if old.Greylist != new.Greylist {
+		settings = append(settings, "greylist")
+	}
+	if !reflect.DeepEqual(old.Callout, new.Callout) {
+		settings = append(settings, "callout")
+	}
+	if old.AdminAddr != new.AdminAddr {
+		settings = append(settings, "admin_addr")
+	}
+	if old.ControlSocket != new.ControlSocket {
+		settings = append(settings, "control_socket")
+	}
+	if old.PIDFile != new.PIDFile {
+		settings = append(settings, "pid_file")
+	}
+	if old.ShutdownTimeout != new.ShutdownTimeout {
+		settings = append(settings, "shutdown_timeout")
+	}
+	return settings
+}
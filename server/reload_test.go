@@ -0,0 +1,62 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"strings"
+	"testing"
+)
+
+func TestReloadBlockList(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	s := startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	before := dial(t, addr)
+	before.cmd(250, "EHLO client.test")
+
+	updated := cfg
+	updated.BlockList = []string{"127.0.0.1", "spammer@example.com"}
+	s.Reload(updated)
+
+	// New connections see the new list
+	if _, code := greetingCode(t, addr); code != 550 {
+		t.Fatalf("connection from a newly blocked IP got %d, want 550", code)
+	}
+	// The established session passed the IP check already, but later
+	// checks use the new list
+	before.cmd(550, "MAIL FROM:<spammer@example.com>")
+
+	s.Reload(cfg)
+	c := dial(t, addr)
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<spammer@example.com>")
+}
+
+func TestReloadRequiresRestart(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	s := startServer(t, cfg)
+
+	updated := cfg
+	updated.Listeners = append([]config.ListenerConfig{}, cfg.Listeners...)
+	updated.Listeners[0].Port = freePort(t)
+	updated.Queue.MaxRetries = 9
+	updated.Greeting = "reloaded"
+	s.Reload(updated)
+
+	// The greeting changes, the listener port and queue stay
+	c := connect(t, listenerAddr(cfg, 0))
+	if greeting := c.expect(220); greeting != "relay.test reloaded" {
+		t.Fatalf("greeting %q, want the reloaded one", greeting)
+	}
+	if s.currentConfig().Queue.MaxRetries != cfg.Queue.MaxRetries {
+		t.Fatal("queue settings were applied without a restart")
+	}
+	log := readLog(t, cfg)
+	for _, setting := range []string{"listeners", "queue"} {
+		if !strings.Contains(log, "Config change to "+setting+" requires a restart and was not applied") {
+			t.Errorf("change to %s not logged as requiring a restart:\n%s", setting, log)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"go-relay-server/replay"
+	"go-relay-server/smtptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	upstream := startUpstream(t)
+	routed := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.DomainRouting = map[string]config.RelayList{"example.net": {routed.Addr}}
+	cfg.BlockList = []string{"blocked@"}
+	startServer(t, cfg)
+
+	path := filepath.Join(t.TempDir(), "backup.eml")
+	message := "Return-Path: <bounces@example.com>\r\n" +
+		"From: alice@example.com\r\n" +
+		"To: bob@example.org, blocked@example.org\r\n" +
+		"Cc: dave@example.net\r\n" +
+		"Subject: replay through the relay\r\n\r\nHello\r\n"
+	if err := os.WriteFile(path, []byte(message), 0644); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := replay.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, rejected, err := replay.Submit(listenerAddr(cfg, 0), "replay.test", nil, msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(accepted, []string{"bob@example.org", "dave@example.net"}) {
+		t.Errorf("accepted %v, want the recipients that are not blocked", accepted)
+	}
+	if len(rejected) != 1 || !strings.Contains(rejected[0].Error(), "blocked@example.org") {
+		t.Errorf("rejected %v, want the blocked recipient", rejected)
+	}
+
+	// Each recipient is routed as for any received message
+	for _, tt := range []struct {
+		relay string
+		got   []string
+		want  string
+	}{
+		{"default", recipients(upstream.Messages()), "bob@example.org"},
+		{"routed", recipients(routed.Messages()), "dave@example.net"},
+	} {
+		if !slices.Equal(tt.got, []string{tt.want}) {
+			t.Errorf("%s relay received %v, want %s", tt.relay, tt.got, tt.want)
+		}
+	}
+	for _, m := range append(upstream.Messages(), routed.Messages()...) {
+		if m.From != "bounces@example.com" || !strings.HasSuffix(string(m.Data), message) {
+			t.Errorf("relayed %q from %s, want the replayed message from its Return-Path", m.Data, m.From)
+		}
+	}
+}
+
+// recipients returns the recipients of messages in order
+func recipients(messages []smtptest.Message) []string {
+	var to []string
+	for _, m := range messages {
+		to = append(to, m.To...)
+	}
+	return to
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"fmt"
+)
+
+// defaultResponses are the replies sent for each rejection reason unless
+// the config overrides them in responses
+var defaultResponses = map[string]string{
+	"connection_blocked":    "550 Connection blocked",
+	"dnsbl_listed":          "554 Rejected - listed at {zone}",
+	"no_reverse_dns":        "550 Client host rejected: cannot find your hostname",
+	"rate_limited":          "421 Rate limit exceeded, try again later",
+	"early_talker":          "554 Protocol violation: data sent before greeting",
+	"too_many_connections":  "421 Too many connections, try again later",
+	"sender_blocked":        "550 Sender blocked",
+	"sender_not_allowed":    "550 Sender not allowed",
+	"recipient_blocked":     "550 Recipient blocked",
+	"recipient_not_allowed": "550 Recipient not allowed",
+	"spf_fail":              "550 SPF fail",
+	"greylisted":            "451 Greylisted, try again later",
+	"no_such_user":          "550 No such user",
+	"too_many_recipients":   "452 Too many recipients",
+	"auth_required":         "530 Authentication required",
+	"auth_failed":           "535 Authentication credentials invalid",
+}
+
+// response returns the reply line for a rejection reason. A configured code
+// without a message keeps the default text.
+func (s *Server) response(reason string) string {
+	reply := defaultResponses[reason]
+	custom, ok := s.currentConfig().Responses[reason]
+	if !ok {
+		return reply
+	}
+	message := custom.Message
+	if message == "" {
+		message = reply[4:]
+	}
+	return fmt.Sprintf("%d %s", custom.Code, message)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"testing"
+)
+
+func TestDefaultResponses(t *testing.T) {
+	for _, reason := range config.ResponseReasons {
+		if _, ok := defaultResponses[reason]; !ok {
+			t.Errorf("no default response for %s", reason)
+		}
+	}
+	if len(defaultResponses) != len(config.ResponseReasons) {
+		t.Errorf("%d default responses for %d reasons", len(defaultResponses), len(config.ResponseReasons))
+	}
+}
+
+func TestCustomResponses(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.BlockList = []string{"spammer@example.com", "blocked@example.org"}
+	cfg.Responses = map[string]config.ResponseConfig{
+		"sender_blocked":    {Code: 554, Message: "Go away"},
+		"recipient_blocked": {Code: 553},
+	}
+	startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	if msg := c.cmd(554, "MAIL FROM:<spammer@example.com>"); msg != "Go away" {
+		t.Errorf("blocked sender got %q, want the custom message", msg)
+	}
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	// A code without a message keeps the default text
+	if msg := c.cmd(553, "RCPT TO:<blocked@example.org>"); msg != "Recipient blocked" {
+		t.Errorf("blocked recipient got %q, want the default text", msg)
+	}
+	// Reasons that are not configured keep their defaults
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(250, "RSET")
+
+	cfg = testConfig(t, upstream.Addr)
+	cfg.BlockList = []string{"127.0.0.1"}
+	cfg.Responses = map[string]config.ResponseConfig{"connection_blocked": {Code: 421, Message: "Not today"}}
+	startServer(t, cfg)
+	if code, msg := connect(t, listenerAddr(cfg, 0)).reply(); code != 421 || msg != "Not today" {
+		t.Errorf("blocked client got %d %q, want 421 Not today", code, msg)
+	}
+}
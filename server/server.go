@@ -1,168 +1,703 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"go-relay-server/callout"
 	"go-relay-server/config"
+	"go-relay-server/dnsbl"
+	"go-relay-server/greylist"
 	"go-relay-server/logger"
+	"go-relay-server/rdns"
+	"go-relay-server/relay"
+	"go-relay-server/spf"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// defaultShutdownTimeout is used when the config does not set shutdown_timeout
+const defaultShutdownTimeout = 30 * time.Second
+
+// defaultQueueDrainTimeout is used when the config does not set queue.drain_timeout
+const defaultQueueDrainTimeout = 10 * time.Second
+
+// forceCloseWait bounds how long Stop waits for connection handlers to
+// return after their connections were forcibly closed
+const forceCloseWait = 5 * time.Second
+
 type Server struct {
 	Config    config.Config
+	cfgMu     sync.RWMutex
 	Logger    *logger.Logger
+	accessLog *logger.AccessLog // nil unless access_log is set
 	wg        sync.WaitGroup
-	quit      chan struct{}
+	ctx       context.Context // Cancelled by Stop to abort blocking operations
+	cancel    context.CancelFunc
 	running   bool
+	prepared  bool // Set by Prepare
+	bound     bool // Set by ListenOnly
 	mu        sync.RWMutex
 	listeners []net.Listener
-	tlsConfig *tls.Config
+	// listenerConfigs holds the config of each listener, parallel to listeners
+	listenerConfigs []config.ListenerConfig
+	tlsConfig       *tls.Config
+	certs           atomic.Pointer[certSet]
+
+	shutdownTimeout time.Duration
+	connMu          sync.Mutex
+	conns           map[net.Conn]struct{}
+
+	greylist     *greylist.Greylist
+	spfChecker   *spf.Checker
+	dnsblChecker *dnsbl.Checker
+	rdnsChecker  *rdns.Checker
+	callout      *callout.Verifier
+
+	rateLimiter      *rateLimiter
+	messagesReceived atomic.Uint64
+	rateLimited      atomic.Uint64
+	blockHits        listHits // Rejections by the block list
+	allowRejections  listHits // Rejections for not being on the allow list
+
+	connLimiter    *connLimiter
+	acceptThrottle acceptThrottle
+
+	// ready is set once all listeners are bound
+	ready atomic.Bool
+
+	startedAt     time.Time
+	listenerStats map[string]*listenerStats
+	adminServer   *http.Server
+
+	controlListener net.Listener
+
+	// ConfigPath is the file or URL reread by the control socket reload command
+	ConfigPath string
+}
+
+// listenerStats counts connections accepted on a single listener
+type listenerStats struct {
+	active atomic.Int64
+	total  atomic.Uint64
 }
 
 func NewServer(config config.Config) (*Server, error) {
 	server := &Server{
-		Config: config,
-		quit:   make(chan struct{}),
+		Config:          config,
+		shutdownTimeout: defaultShutdownTimeout,
+		conns:           make(map[net.Conn]struct{}),
+		rateLimiter:     newRateLimiter(),
+		connLimiter:     newConnLimiter(),
 	}
 
-	// Convert config.LogLevel to logger.LogLevel
-	logLevel := logger.LogLevel(config.LogLevel)
+	if config.ShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(config.ShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shutdown timeout: %v", err)
+		}
+		server.shutdownTimeout = timeout
+	}
 
 	// Initialize the logger
-	loggerInstance, err := logger.NewLogger(config.LogFile, logLevel)
+	loggerInstance, err := logger.NewLogger(logger.Config{
+		LogFile:       config.LogFile,
+		LogDir:        config.LogDir,
+		LogLevel:      logger.LogLevel(config.LogLevel),
+		LogFormat:     logger.LogFormat(config.LogFormat),
+		RetentionDays: config.LogRetentionDays,
+		Compress:      config.LogCompress,
+		Console:       config.LogConsole,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup logger: %v", err)
 	}
 	server.Logger = loggerInstance
 
-	// Start log rotation
-	go server.Logger.DailyLogRotation()
+	if config.AccessLog != "" {
+		server.accessLog, err = logger.NewAccessLog(config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Greylist.Enabled {
+		greylistInstance, err := newGreylist(config, loggerInstance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup greylist: %v", err)
+		}
+		server.greylist = greylistInstance
+	}
+
+	if config.Callout.Enabled {
+		server.callout = newCallout(config, server.hostname())
+	}
+
+	// Created regardless of mode so a reload can switch SPF, DNSBL or
+	// reverse DNS checks on
+	server.spfChecker = spf.NewChecker(nil)
+	server.dnsblChecker = dnsbl.NewChecker(nil)
+	server.rdnsChecker = rdns.NewChecker(nil)
 
 	return server, nil
 }
 
+func newGreylist(cfg config.Config, log *logger.Logger) (*greylist.Greylist, error) {
+	storagePath := cfg.Greylist.StoragePath
+	if storagePath == "" {
+		storagePath = cfg.Queue.StoragePath
+	}
+	persistValue := cfg.Greylist.PersistInterval
+	if persistValue == "" {
+		persistValue = cfg.Queue.PersistInterval
+	}
+
+	initialDelay, err := time.ParseDuration(cfg.Greylist.InitialDelay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid initial delay: %v", err)
+	}
+	whitelistPeriod, err := time.ParseDuration(cfg.Greylist.WhitelistPeriod)
+	if err != nil {
+		return nil, fmt.Errorf("invalid whitelist period: %v", err)
+	}
+	persistInterval, err := time.ParseDuration(persistValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid persist interval: %v", err)
+	}
+
+	return greylist.NewGreylist(&greylist.Config{
+		StoragePath:     storagePath,
+		InitialDelay:    initialDelay,
+		WhitelistPeriod: whitelistPeriod,
+		PersistInterval: persistInterval,
+		Logger:          log,
+	})
+}
+
+func newCallout(cfg config.Config, hostname string) *callout.Verifier {
+	durations := map[string]time.Duration{"timeout": 30 * time.Second, "cache_ttl": 24 * time.Hour, "negative_cache_ttl": time.Hour}
+	for name, value := range map[string]string{"timeout": cfg.Callout.Timeout, "cache_ttl": cfg.Callout.CacheTTL, "negative_cache_ttl": cfg.Callout.NegativeCacheTTL} {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			durations[name] = d
+		}
+	}
+
+	return callout.NewVerifier(&callout.Config{
+		Hostname:    hostname,
+		Timeout:     durations["timeout"],
+		CacheTTL:    durations["cache_ttl"],
+		NegativeTTL: durations["negative_cache_ttl"],
+	})
+}
+
+// certSet holds the loaded certificates. Reloading builds a new set and
+// swaps it in, so handshakes in progress keep the set they started with.
+type certSet struct {
+	listeners map[string]*listenerCerts // Keyed by listener port
+	clientCAs map[string]*x509.CertPool // Keyed by tls_client_ca_file
+}
+
+// listenerCerts holds the certificates a single listener can present: its
+// own and the global one. A listener never serves another's certificate.
+type listenerCerts struct {
+	byName map[string]*tls.Certificate
+	def    *tls.Certificate // The listener's own certificate, else the global one
+}
+
 func (s *Server) loadTLSConfig() error {
-	cert, err := tls.LoadX509KeyPair(s.Config.TLSCertFile, s.Config.TLSKeyFile)
+	certs, err := loadCertificates(s.currentConfig())
 	if err != nil {
-		return fmt.Errorf("failed to load TLS certificate: %v", err)
+		return err
 	}
+	s.certs.Store(certs)
 
+	// Both were checked when the config was validated
+	minVersion, _ := config.TLSMinVersion(s.currentConfig())
+	cipherSuites, _ := config.TLSCipherSuites(s.currentConfig())
 	s.tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
 	}
 	return nil
 }
 
-func (s *Server) Start() error {
+// loadCertificates reads the global and per-listener certificate files of conf
+func loadCertificates(conf config.Config) (*certSet, error) {
+	certs := &certSet{listeners: make(map[string]*listenerCerts), clientCAs: make(map[string]*x509.CertPool)}
+
+	// Load the global certificate, used by listeners without their own and
+	// for SNI names it covers
+	var global *tls.Certificate
+	var globalNames []string
+	if conf.TLSCertFile != "" && conf.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		if globalNames, err = certificateNames(&cert); err != nil {
+			return nil, fmt.Errorf("failed to parse TLS certificate: %v", err)
+		}
+		global = &cert
+	}
+
+	for _, listenerCfg := range conf.Listeners {
+		if path := listenerCfg.TLSClientCAFile; path != "" && certs.clientCAs[path] == nil {
+			pool, err := loadClientCAs(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client CAs for port %s: %v", listenerCfg.Port, err)
+			}
+			certs.clientCAs[path] = pool
+		}
+		if listenerCfg.Encryption != "tls" && listenerCfg.Encryption != "starttls" {
+			continue
+		}
+
+		// Index the listener's certificates by the names they cover, its
+		// own taking precedence over the global one
+		lc := &listenerCerts{byName: make(map[string]*tls.Certificate), def: global}
+		for _, name := range globalNames {
+			lc.byName[name] = global
+		}
+		if listenerCfg.TLSCertFile != "" && listenerCfg.TLSKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(listenerCfg.TLSCertFile, listenerCfg.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS certificate for port %s: %v", listenerCfg.Port, err)
+			}
+			names, err := certificateNames(&cert)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse TLS certificate for port %s: %v", listenerCfg.Port, err)
+			}
+			for _, name := range names {
+				lc.byName[name] = &cert
+			}
+			lc.def = &cert
+		}
+		if lc.def == nil {
+			return nil, fmt.Errorf("failed to load TLS certificate for port %s: no certificate configured", listenerCfg.Port)
+		}
+		certs.listeners[listenerCfg.Port] = lc
+	}
+	return certs, nil
+}
+
+// ReloadCertificates rereads the certificate and key files, e.g. after a
+// renewal. New handshakes use the new certificates; established connections
+// are not affected. On error the current certificates stay in use.
+func (s *Server) ReloadCertificates() error {
+	if s.certs.Load() == nil {
+		return errors.New("TLS is not enabled")
+	}
+	certs, err := loadCertificates(s.currentConfig())
+	if err != nil {
+		return err
+	}
+	s.certs.Store(certs)
+	s.Logger.Log(logger.LogLevelInfo, "TLS certificates reloaded")
+	return nil
+}
+
+// listenerCertificate returns the certificate selector for the listener on
+// port. It picks a certificate of the current set by SNI name, trying an
+// exact match first, then a wildcard match, then falling back to the
+// listener's own certificate and finally the global one.
+func (s *Server) listenerCertificate(port string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certs, ok := s.certs.Load().listeners[port]
+		if !ok {
+			return nil, fmt.Errorf("no certificate for port %s", port)
+		}
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if name != "" {
+			if cert, ok := certs.byName[name]; ok {
+				return cert, nil
+			}
+			if i := strings.Index(name, "."); i > 0 {
+				if cert, ok := certs.byName["*"+name[i:]]; ok {
+					return cert, nil
+				}
+			}
+		}
+		return certs.def, nil
+	}
+}
+
+// certificateNames returns the lowercased DNS names and common name of a certificate.
+func certificateNames(cert *tls.Certificate) ([]string, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names, nil
+}
+
+// Prepare validates the config, loads the TLS certificates and initializes
+// the queue without binding any listener, so a standby instance can fail
+// early. Start calls it if it has not been called.
+func (s *Server) Prepare() error {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.running {
-		s.mu.Unlock()
 		return fmt.Errorf("server is already running")
 	}
-	s.running = true
-	s.mu.Unlock()
+	return s.prepareLocked()
+}
+
+func (s *Server) prepareLocked() error {
+	if s.prepared {
+		return nil
+	}
+
+	cfg := s.currentConfig()
+	if err := config.Validate(cfg); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	// The health endpoints come up first so probers see the server as not
+	// ready, rather than refused, until it accepts connections
+	if err := s.startAdmin(); err != nil {
+		return err
+	}
 
 	// Load TLS config if needed
-	for _, listenerCfg := range s.Config.Listeners {
+	for _, listenerCfg := range cfg.Listeners {
 		if listenerCfg.Encryption == "tls" || listenerCfg.Encryption == "starttls" {
 			if err := s.loadTLSConfig(); err != nil {
+				s.stopAdmin()
 				return err
 			}
 			break
 		}
 	}
 
-	// Start listeners
-	for _, listenerCfg := range s.Config.Listeners {
+	if err := relay.InitializeQueue(cfg, s.Logger); err != nil {
+		s.stopAdmin()
+		return err
+	}
+	s.prepared = true
+	return nil
+}
+
+// ListenOnly binds the listeners, preparing the server first if needed, but
+// does not accept connections until Start is called. Clients connecting in
+// the meantime wait in the listen backlog. If a listener cannot be bound,
+// those already bound are closed again.
+func (s *Server) ListenOnly() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return fmt.Errorf("server is already running")
+	}
+	return s.bindLocked()
+}
+
+func (s *Server) bindLocked() error {
+	if s.bound {
+		return nil
+	}
+	if err := s.prepareLocked(); err != nil {
+		return err
+	}
+
+	listeners := s.currentConfig().Listeners
+	s.listenerStats = make(map[string]*listenerStats)
+	for _, listenerCfg := range listeners {
+		s.listenerStats[listenerCfg.Port] = &listenerStats{}
+	}
+	for _, listenerCfg := range listeners {
 		listener, err := s.createListener(listenerCfg)
 		if err != nil {
-			s.Stop()
+			s.closeListeners()
 			return fmt.Errorf("failed to start listener on port %s: %v", listenerCfg.Port, err)
 		}
 		s.listeners = append(s.listeners, listener)
-		go s.acceptConnections(listener, listenerCfg)
+		s.listenerConfigs = append(s.listenerConfigs, listenerCfg)
 	}
-
+	s.bound = true
 	return nil
 }
 
-func (s *Server) createListener(cfg config.ListenerConfig) (net.Listener, error) {
-	// Listen on all interfaces for both IPv4 and IPv6
-	addr := ":" + cfg.Port
-	network := "tcp"
+// closeListeners closes the bound listeners
+func (s *Server) closeListeners() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+	s.listenerConfigs = nil
+	s.bound = false
+}
 
-	// Try listening on dual stack first
-	listener, err := net.Listen(network, addr)
-	if err == nil {
-		return listener, nil
+// Start runs the server: it prepares the server and binds the listeners
+// unless Prepare and ListenOnly have already done so, then starts the queue
+// worker and accepts connections.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return fmt.Errorf("server is already running")
+	}
+	if err := s.bindLocked(); err != nil {
+		s.mu.Unlock()
+		return err
 	}
 
-	// If dual stack fails, try IPv4 only
-	network = "tcp4"
-	listener, err = net.Listen(network, addr)
-	if err == nil {
-		return listener, nil
+	if err := WritePIDFile(s.pidFilePath()); err != nil {
+		s.mu.Unlock()
+		return err
 	}
+	s.running = true
+	s.startedAt = time.Now()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mu.Unlock()
 
-	// If IPv4 fails, try IPv6 only
-	network = "tcp6"
-	listener, err = net.Listen(network, addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create listener: %v", err)
+	relay.StartQueueWorker(s.currentConfig)
+
+	for i, listener := range s.listeners {
+		listenerCfg := s.listenerConfigs[i]
+		s.Logger.Log(logger.LogLevelInfo, "Server started on port %s (%s)", listenerCfg.Port, listenerCfg.Encryption)
+		for i := 0; i < max(listenerCfg.Acceptors, 1); i++ {
+			s.wg.Add(1)
+			go s.acceptConnections(listener, listenerCfg)
+		}
 	}
+	s.ready.Store(true)
 
-	if cfg.Encryption == "tls" {
-		return tls.Listen(network, addr, s.tlsConfig)
+	if err := s.startControl(); err != nil {
+		s.Stop()
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) createListener(cfg config.ListenerConfig) (net.Listener, error) {
+	// Under systemd socket activation the socket is inherited instead
+	listener := takeActivatedListener(cfg.Host, cfg.Port)
+	if listener != nil {
+		s.Logger.Log(logger.LogLevelInfo, "Using socket-activated listener for port %s", cfg.Port)
+	} else {
+		// Without a host, listen on all interfaces for both IPv4 and IPv6
+		addr := net.JoinHostPort(cfg.Host, cfg.Port)
+
+		// Try dual stack first, then fall back to IPv4 only and IPv6 only
+		var err error
+		for _, network := range []string{"tcp", "tcp4", "tcp6"} {
+			listener, err = net.Listen(network, addr)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create listener: %v", err)
+		}
+	}
+
+	// Wrap the listener for implicit TLS (SMTPS) regardless of the stack used.
+	// Behind a PROXY protocol balancer the handshake follows the header, so
+	// the handler upgrades the connection itself.
+	if cfg.Encryption == "tls" && !cfg.ProxyProtocol {
+		return tls.NewListener(listener, s.listenerTLSConfig(cfg)), nil
 	}
 	return listener, nil
 }
 
 func (s *Server) acceptConnections(listener net.Listener, cfg config.ListenerConfig) {
-	s.Logger.Log(logger.LogLevelInfo, "Server started on port %s (%s)", cfg.Port, cfg.Encryption)
+	defer s.wg.Done()
 
 	for {
 		select {
-		case <-s.quit:
+		case <-s.ctx.Done():
 			return
 		default:
+			if !s.acceptThrottle.wait(s.ctx, s.currentConfig().MaxAcceptRate) {
+				return
+			}
 			conn, err := listener.Accept()
 			if err != nil {
+				// The listener was closed by Stop
+				if s.ctx.Err() != nil {
+					return
+				}
 				s.Logger.Log(logger.LogLevelError, "Error accepting connection on port %s: %v", cfg.Port, err)
 				continue
 			}
 
+			stats := s.listenerStats[cfg.Port]
+			stats.total.Add(1)
+
+			ip := connIP(conn)
+			current := s.currentConfig()
+			if !s.connLimiter.acquire(current.MaxConnections) {
+				s.Logger.Log(logger.LogLevelWarn, "Too many connections, rejected %s", ip)
+				go rejectConn(conn, s.response("too_many_connections"))
+				continue
+			}
+			stats.active.Add(1)
+
+			s.trackConn(conn)
 			s.wg.Add(1)
 			go func() {
 				defer s.wg.Done()
-				s.handleConnection(conn, cfg)
+				defer s.connLimiter.release()
+				defer stats.active.Add(-1)
+				defer s.untrackConn(conn)
+				defer func() {
+					if r := recover(); r != nil {
+						s.Logger.Log(logger.LogLevelError, "Panic handling connection from %s: %v", ip, r)
+					}
+				}()
+				s.handleConnection(s.ctx, conn, cfg)
 			}()
 		}
 	}
 }
 
+// connIP returns the peer IP of conn, which for PROXY protocol listeners is
+// the load balancer rather than the client. Per-IP limits are applied in
+// handleConnection once the client address is known.
+func connIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// rejectConn writes a final reply to a connection that will not be served
+func rejectConn(conn net.Conn, reply string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(reply + "\r\n"))
+}
+
+// Stop shuts the server down. On a server that was only prepared or bound
+// it just closes the listeners.
 func (s *Server) Stop() {
 	s.mu.Lock()
+	s.prepared = false
 	if !s.running {
+		s.closeListeners()
+		s.stopAdmin()
 		s.mu.Unlock()
 		return
 	}
 	s.running = false
 	s.mu.Unlock()
 
-	close(s.quit)
+	s.ready.Store(false)
+	s.cancel()
 
 	// Close all listeners
 	for _, listener := range s.listeners {
 		listener.Close()
 	}
+	s.stopControl()
 
-	s.wg.Wait()
-	s.listeners = nil
+	s.drain()
+	s.mu.Lock()
+	s.closeListeners()
+	s.mu.Unlock()
+	relay.StopQueueWorker(queueDrainTimeout(s.currentConfig()))
+	if err := relay.CloseQueue(); err != nil {
+		s.Logger.Log(logger.LogLevelError, "Error saving queue: %v", err)
+	}
+
+	if s.greylist != nil {
+		if err := s.greylist.Persist(); err != nil {
+			s.Logger.Log(logger.LogLevelError, "Error saving greylist: %v", err)
+		}
+	}
+
+	if err := RemovePIDFile(s.pidFilePath()); err != nil {
+		s.Logger.Log(logger.LogLevelError, "%v", err)
+	}
+	// The health endpoints answer 503 throughout the shutdown and go last
+	s.stopAdmin()
 	s.Logger.Log(logger.LogLevelInfo, "Server stopped")
 }
 
+// queueDrainTimeout returns how long queue deliveries in progress may
+// finish on shutdown
+func queueDrainTimeout(cfg config.Config) time.Duration {
+	if timeout, err := time.ParseDuration(cfg.Queue.DrainTimeout); err == nil && timeout >= 0 {
+		return timeout
+	}
+	return defaultQueueDrainTimeout
+}
+
+// StopTimeout returns the longest Stop may wait on a server running with cfg:
+// the shutdown timeout, the wait for force closed connections and the queue
+// drain timeout
+func StopTimeout(cfg config.Config) time.Duration {
+	shutdown := defaultShutdownTimeout
+	if timeout, err := time.ParseDuration(cfg.ShutdownTimeout); err == nil {
+		shutdown = timeout
+	}
+	return shutdown + forceCloseWait + queueDrainTimeout(cfg)
+}
+
+// drain waits for active connections to finish, forcibly closing any that
+// are still open once the shutdown timeout has elapsed. The handlers of
+// closed connections are then given a moment to return, so that none is
+// still using the queue when Stop closes it.
+func (s *Server) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(s.shutdownTimeout):
+	}
+
+	s.connMu.Lock()
+	s.Logger.Log(logger.LogLevelWarn, "Shutdown timeout of %s reached, force closing %d active connections", s.shutdownTimeout, len(s.conns))
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(forceCloseWait):
+		s.Logger.Log(logger.LogLevelWarn, "Connection handlers still running %s after force closing, stopping anyway", forceCloseWait)
+	}
+}
+
+func (s *Server) trackConn(conn net.Conn) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	delete(s.conns, conn)
+}
+
 func (s *Server) Status() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -176,9 +711,8 @@ func (s *Server) Status() string {
 func (s *Server) Restart() error {
 	s.Stop()
 
-	// Reset quit channel and running state
+	// Reset running state; Start creates a new context
 	s.mu.Lock()
-	s.quit = make(chan struct{})
 	s.running = false
 	s.mu.Unlock()
 
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go-relay-server/config"
+	"go-relay-server/smtptest"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTLS gives cfg a certificate for relay.test and the loopback addresses
+func withTLS(t *testing.T, cfg *config.Config) *smtptest.Cert {
+	t.Helper()
+	cert := smtptest.SelfSigned("relay.test", "127.0.0.1", "::1")
+	cfg.TLSCertFile, cfg.TLSKeyFile = cert.WriteFiles(t.TempDir(), "relay")
+	return cert
+}
+
+func TestImplicitTLSListener(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		t.Run(host, func(t *testing.T) {
+			if probe, err := net.Listen("tcp", net.JoinHostPort(host, "0")); err != nil {
+				t.Skipf("%s not available: %v", host, err)
+			} else {
+				probe.Close()
+			}
+
+			upstream := startUpstream(t)
+			cfg := testConfig(t, upstream.Addr)
+			cfg.Listeners[0].Host = host
+			cfg.Listeners[0].Encryption = "tls"
+			cert := withTLS(t, &cfg)
+			startServer(t, cfg)
+
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listenerAddr(cfg, 0),
+				&tls.Config{RootCAs: cert.Pool(), ServerName: "relay.test"})
+			if err != nil {
+				t.Fatalf("TLS handshake failed: %v", err)
+			}
+			c := newClient(t, conn)
+			defer conn.Close()
+			c.expect(220)
+			c.cmd(250, "EHLO client.test")
+			c.cmd(221, "QUIT")
+		})
+	}
+}
+
+// handlersDone reports whether every connection handler of s has returned
+func handlersDone(s *Server) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(10 * time.Millisecond):
+		return false
+	}
+}
+
+func TestStopForceClosesStalledConnection(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.ShutdownTimeout = "200ms"
+	s := startServer(t, cfg)
+
+	// A client that stops halfway through DATA keeps its handler busy
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(354, "DATA")
+	c.tp.W.WriteString("Subject: stalled\r\n")
+	c.tp.W.Flush()
+
+	start := time.Now()
+	s.Stop()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > forceCloseWait {
+		t.Fatalf("Stop took %s, want the 200ms shutdown timeout", elapsed)
+	}
+	if !handlersDone(s) {
+		t.Fatal("connection handler still running after Stop")
+	}
+	if !c.closed() {
+		t.Fatal("stalled connection was not closed")
+	}
+	if log := readLog(t, cfg); !strings.Contains(log, "force closing 1 active connections") {
+		t.Fatalf("force close not logged:\n%s", log)
+	}
+}
+
+func TestDrainWaitsForForceClosedHandlers(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.ShutdownTimeout = "100ms"
+	s := startServer(t, cfg)
+
+	// Only the force close gets a handler out of a stalled DATA
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(354, "DATA")
+
+	// Stop the accept loops as Stop does; the handler must then return, and
+	// untrack its connection, before drain does
+	s.cancel()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.drain()
+	s.connMu.Lock()
+	active := len(s.conns)
+	s.connMu.Unlock()
+	if active != 0 {
+		t.Fatalf("%d connections still tracked after drain", active)
+	}
+}
+
+// serverCertificate completes a TLS handshake with addr sending serverName
+// and returns the common name of the certificate the server presented
+func serverCertificate(t *testing.T, addr, serverName string) string {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr,
+		&tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake for %q failed: %v", serverName, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestSNICertificates(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	withTLS(t, &cfg)
+	dir := t.TempDir()
+	cfg.Listeners[0].Encryption = "tls"
+	cfg.Listeners[0].TLSCertFile, cfg.Listeners[0].TLSKeyFile = smtptest.SelfSigned("mail.a.test").WriteFiles(dir, "a")
+	second := config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "tls"}
+	second.TLSCertFile, second.TLSKeyFile = smtptest.SelfSigned("*.b.test").WriteFiles(dir, "b")
+	cfg.Listeners = append(cfg.Listeners, second)
+	startServer(t, cfg)
+
+	// Each listener picks by name among its own and the global certificate,
+	// falling back to its own
+	for i, names := range []map[string]string{
+		{
+			"mail.a.test":    "mail.a.test",
+			"MAIL.A.TEST.":   "mail.a.test",
+			"relay.test":     "relay.test",
+			"mx.b.test":      "mail.a.test",
+			"other.test":     "mail.a.test",
+			"deep.mx.b.test": "mail.a.test",
+			"":               "mail.a.test",
+		},
+		{
+			"mx.b.test":      "*.b.test",
+			"MX.B.TEST.":     "*.b.test",
+			"relay.test":     "relay.test",
+			"mail.a.test":    "*.b.test",
+			"deep.mx.b.test": "*.b.test",
+			"":               "*.b.test",
+		},
+	} {
+		addr := listenerAddr(cfg, i)
+		for name, want := range names {
+			if got := serverCertificate(t, addr, name); got != want {
+				t.Errorf("%s: SNI %q got the certificate for %s, want %s", addr, name, got, want)
+			}
+		}
+	}
+}
+
+func TestListenerCertificateOnly(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	dir := t.TempDir()
+	cfg.Listeners[0].Encryption = "tls"
+	cfg.Listeners[0].TLSCertFile, cfg.Listeners[0].TLSKeyFile = smtptest.SelfSigned("mail.a.test").WriteFiles(dir, "a")
+	second := config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "tls"}
+	second.TLSCertFile, second.TLSKeyFile = smtptest.SelfSigned("mail.b.test").WriteFiles(dir, "b")
+	cfg.Listeners = append(cfg.Listeners, second)
+	startServer(t, cfg)
+
+	// Without a global certificate, clients sending no or another name get
+	// the certificate of the listener they dialed
+	for i, want := range []string{"mail.a.test", "mail.b.test"} {
+		for _, name := range []string{"", "other.test", want} {
+			if got := serverCertificate(t, listenerAddr(cfg, i), name); got != want {
+				t.Errorf("listener %d: SNI %q got the certificate for %s, want %s", i, name, got, want)
+			}
+		}
+	}
+}
+
+// externalAddr returns a local address other than loopback, skipping the
+// test when the machine has none
+func externalAddr(t *testing.T) string {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skipf("listing interface addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			return ipNet.IP.String()
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return ""
+}
+
+func TestListenerHost(t *testing.T) {
+	external := externalAddr(t)
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Port: freePort(t), Encryption: "none"})
+	startServer(t, cfg)
+
+	reachable := func(host, port string) bool {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	loopback := cfg.Listeners[0].Port
+	if !reachable("127.0.0.1", loopback) {
+		t.Error("listener bound to 127.0.0.1 is not reachable on loopback")
+	}
+	if reachable(external, loopback) {
+		t.Errorf("listener bound to 127.0.0.1 is reachable on %s", external)
+	}
+
+	// An empty host keeps listening on every interface
+	all := cfg.Listeners[1].Port
+	for _, host := range []string{"127.0.0.1", external} {
+		if !reachable(host, all) {
+			t.Errorf("listener without a host is not reachable on %s", host)
+		}
+	}
+}
+
+// peerCert completes a TLS handshake with addr, trusting pool, and returns
+// the connection and the certificate the server presented
+func peerCert(t *testing.T, addr string, pool *x509.CertPool) (*tls.Conn, *x509.Certificate) {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr,
+		&tls.Config{RootCAs: pool, ServerName: "relay.test"})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestReloadCertificates(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].Encryption = "tls"
+	dir := t.TempDir()
+	first := smtptest.SelfSigned("relay.test")
+	cfg.TLSCertFile, cfg.TLSKeyFile = first.WriteFiles(dir, "relay")
+	s := startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	pool := first.Pool()
+	conn, cert := peerCert(t, addr, pool)
+	if !cert.Equal(first.X509) {
+		t.Fatal("server did not present its certificate")
+	}
+	old := newClient(t, conn)
+	old.expect(220)
+
+	// A renewal replaces the files in place
+	second := smtptest.SelfSigned("relay.test")
+	second.WriteFiles(dir, "relay")
+	pool.AddCert(second.X509)
+	if output, err := QueryControl(cfg.ControlSocket, "certs reload"); err != nil || !strings.Contains(output, "certificates reloaded") {
+		t.Fatalf("certs reload returned %q, %v", output, err)
+	}
+	if _, cert := peerCert(t, addr, pool); !cert.Equal(second.X509) {
+		t.Error("new handshake after the reload did not present the renewed certificate")
+	}
+	// The connection made before the reload carries on with its certificate
+	old.cmd(250, "EHLO client.test")
+	if !conn.ConnectionState().PeerCertificates[0].Equal(first.X509) {
+		t.Error("established connection changed certificate")
+	}
+
+	// Broken files keep the current certificate in use
+	if err := os.WriteFile(cfg.TLSKeyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := QueryControl(cfg.ControlSocket, "certs reload"); err == nil || !strings.Contains(err.Error(), "failed to reload certificates") {
+		t.Errorf("reload with a broken key returned %v, want an error", err)
+	}
+	if _, cert := peerCert(t, addr, pool); !cert.Equal(second.X509) {
+		t.Error("failed reload replaced the certificate")
+	}
+
+	// A config reload, as on SIGHUP, rereads the files too
+	third := smtptest.SelfSigned("relay.test")
+	third.WriteFiles(dir, "relay")
+	pool.AddCert(third.X509)
+	s.Reload(cfg)
+	if _, cert := peerCert(t, addr, pool); !cert.Equal(third.X509) {
+		t.Error("config reload did not pick up the renewed certificate")
+	}
+}
+
+func TestStopCancelsRelay(t *testing.T) {
+	// An upstream that takes the message data and never answers it
+	release := make(chan struct{})
+	defer close(release)
+	inData := make(chan struct{}, 1)
+	upstream := smtptest.NewUnstartedServer()
+	upstream.Reply = func(verb, line string) string {
+		if verb == "DATA" {
+			inData <- struct{}{}
+			<-release
+		}
+		return ""
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	cfg := testConfig(t, upstream.Addr)
+	cfg.ShutdownTimeout = "30s"
+	s := startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<cancelled@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.org>")
+	c.cmd(354, "DATA")
+	w := c.tp.DotWriter()
+	w.Write([]byte(testMessage("cancelled", "Body\r\n")))
+	w.Close()
+	select {
+	case <-inData:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message never reached the upstream")
+	}
+
+	// The handler is relaying; Stop cancels it instead of waiting out the
+	// shutdown timeout or the relay's command timeout
+	start := time.Now()
+	s.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Stop took %v with a relay in progress", elapsed)
+	}
+	if !handlersDone(s) {
+		t.Fatal("connection handler still running after Stop")
+	}
+	if log := readLog(t, cfg); strings.Contains(log, "force closing") {
+		t.Errorf("handler had to be force closed instead of observing cancellation:\n%s", log)
+	}
+}
+
+func TestMultipleAcceptors(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].Acceptors = 4
+	s := startServer(t, cfg)
+
+	// Every acceptor hands its connections to a handler
+	const n = 40
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = dial(t, listenerAddr(cfg, 0))
+	}
+	for _, c := range clients {
+		c.cmd(250, "EHLO client.test")
+	}
+
+	// Stop ends every accept loop along with the handlers
+	s.Stop()
+	if !handlersDone(s) {
+		t.Fatal("accept loops or handlers still running after Stop")
+	}
+	if _, err := net.DialTimeout("tcp", listenerAddr(cfg, 0), time.Second); err == nil {
+		t.Error("listener still accepting after Stop")
+	}
+}
+
+// BenchmarkAcceptors measures how fast connections are accepted and greeted
+// with one and with several accept loops on a listener
+func BenchmarkAcceptors(b *testing.B) {
+	for _, acceptors := range []int{1, 4} {
+		b.Run(fmt.Sprintf("acceptors=%d", acceptors), func(b *testing.B) {
+			upstream := startUpstream(b)
+			cfg := testConfig(b, upstream.Addr)
+			cfg.Listeners[0].Acceptors = acceptors
+			cfg.LogLevel = "error"
+			cfg.RateLimiting = config.RateLimiting{RequestsPerMinute: 1 << 30, BurstLimit: 1 << 30}
+			startServer(b, cfg)
+			addr := listenerAddr(cfg, 0)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, 512)
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := conn.Read(buf); err != nil {
+						b.Error(err)
+					}
+					conn.Close()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"go-relay-server/config"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server for cfg without starting it and stops it
+// when the test ends
+func newTestServer(t *testing.T, cfg config.Config) *Server {
+	t.Helper()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// refused reports whether nothing accepts connections at addr
+func refused(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+func TestStartupPhases(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	s := newTestServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if !refused(addr) {
+		t.Fatal("prepared server is listening")
+	}
+
+	if err := s.ListenOnly(); err != nil {
+		t.Fatal(err)
+	}
+	// The connection waits in the backlog without a greeting
+	c := connect(t, addr)
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.tp.ReadLine(); err == nil {
+		t.Fatal("bound server greeted a client before Start")
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(220)
+	c.cmd(221, "QUIT")
+
+	for name, phase := range map[string]func() error{"Prepare": s.Prepare, "ListenOnly": s.ListenOnly, "Start": s.Start} {
+		if err := phase(); err == nil || !strings.Contains(err.Error(), "already running") {
+			t.Errorf("%s on a running server: got %v", name, err)
+		}
+	}
+}
+
+func TestStartRunsEveryPhase(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	s := newTestServer(t, cfg)
+
+	// Repeating a phase that is done already is harmless
+	for _, phase := range []func() error{s.Prepare, s.Prepare, s.ListenOnly, s.ListenOnly, s.Start} {
+		if err := phase(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, code := greetingCode(t, listenerAddr(cfg, 0))
+	if code != 220 {
+		t.Fatalf("got %d, want 220", code)
+	}
+}
+
+func TestPrepareErrors(t *testing.T) {
+	upstream := startUpstream(t)
+
+	t.Run("invalid config", func(t *testing.T) {
+		cfg := testConfig(t, upstream.Addr)
+		cfg.RateLimiting.BurstLimit = 0
+		s := newTestServer(t, cfg)
+		if err := s.Prepare(); err == nil || !strings.Contains(err.Error(), "invalid config") {
+			t.Fatalf("Prepare with an invalid config: got %v", err)
+		}
+		if err := s.Start(); err == nil {
+			t.Fatal("Start succeeded with an invalid config")
+		}
+		if !refused(listenerAddr(cfg, 0)) {
+			t.Fatal("server with an invalid config is listening")
+		}
+	})
+
+	t.Run("missing certificate", func(t *testing.T) {
+		cfg := testConfig(t, upstream.Addr)
+		cfg.Listeners[0].Encryption = "starttls"
+		cfg.TLSCertFile, cfg.TLSKeyFile = "missing.crt", "missing.key"
+		s := newTestServer(t, cfg)
+		if err := s.Prepare(); err == nil {
+			t.Fatal("Prepare succeeded without the certificate")
+		}
+		if err := s.ListenOnly(); err == nil {
+			t.Fatal("ListenOnly succeeded without the certificate")
+		}
+		if !refused(listenerAddr(cfg, 0)) {
+			t.Fatal("server without its certificate is listening")
+		}
+	})
+}
+
+func TestListenOnlyErrors(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "none"})
+	taken, err := net.Listen("tcp", listenerAddr(cfg, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	s := newTestServer(t, cfg)
+	if err := s.ListenOnly(); err == nil || !strings.Contains(err.Error(), "port "+cfg.Listeners[1].Port) {
+		t.Fatalf("ListenOnly with a port in use: got %v", err)
+	}
+	// The listener bound before the failure is closed again
+	if !refused(listenerAddr(cfg, 0)) {
+		t.Fatal("first listener is still bound after the failure")
+	}
+
+	// Once the port is free the server can bind and start
+	taken.Close()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_, code := greetingCode(t, listenerAddr(cfg, 1))
+	if code != 220 {
+		t.Fatalf("got %d, want 220", code)
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	s := newTestServer(t, cfg)
+	if err := s.ListenOnly(); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+	if !refused(listenerAddr(cfg, 0)) {
+		t.Fatal("bound server is still listening after Stop")
+	}
+
+	// A stopped server can be started again from scratch
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_, code := greetingCode(t, listenerAddr(cfg, 0))
+	if code != 220 {
+		t.Fatalf("got %d, want 220", code)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// tarpit delays the reply to a misbehaving client by the configured
+// tarpit_delay, tying up the client instead of letting it retry at once.
+// Only the calling connection waits, and cancelling ctx cuts the delay short.
+func (s *Server) tarpit(ctx context.Context) {
+	delay := s.tarpitDelay()
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func (s *Server) tarpitDelay() time.Duration {
+	value := s.currentConfig().TarpitDelay
+	if value == "" {
+		return 0
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return delay
+}
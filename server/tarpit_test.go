@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTarpit(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.TarpitDelay = "300ms"
+	cfg.BlockList = []string{"spammer@example.com"}
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	spammer := dial(t, addr)
+	spammer.cmd(250, "EHLO client.test")
+	other := dial(t, addr)
+	other.cmd(250, "EHLO client.test")
+
+	start := time.Now()
+	if err := spammer.tp.PrintfLine("MAIL FROM:<spammer@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	// Other clients are served while the spammer waits
+	other.cmd(250, "NOOP")
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("other connection waited %v for the tarpit", elapsed)
+	}
+	spammer.expect(550)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("blocked sender answered after %v, want about 300ms", elapsed)
+	}
+
+	// Well-behaved commands are not delayed
+	start = time.Now()
+	other.cmd(250, "MAIL FROM:<a@example.com>")
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("allowed sender answered after %v", elapsed)
+	}
+}
+
+func TestTarpitEndsOnStop(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.TarpitDelay = "1m"
+	cfg.BlockList = []string{"spammer@example.com"}
+	s := startServer(t, cfg)
+
+	c := dial(t, listenerAddr(cfg, 0))
+	c.cmd(250, "EHLO client.test")
+	if err := c.tp.PrintfLine("MAIL FROM:<spammer@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	s.Stop()
+	if elapsed := time.Since(start); elapsed > forceCloseWait {
+		t.Fatalf("Stop took %v with a tarpitted connection", elapsed)
+	}
+}
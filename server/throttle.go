@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// acceptThrottle is a token bucket shared by all listeners that paces how
+// fast new connections are accepted. Connections beyond the rate wait in the
+// listen backlog instead of each getting a goroutine.
+type acceptThrottle struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until a connection may be accepted at rate per second, with
+// bursts up to rate. It returns false if ctx is cancelled first. A rate of 0
+// means unlimited.
+func (t *acceptThrottle) wait(ctx context.Context, rate int) bool {
+	if rate <= 0 {
+		return true
+	}
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		if t.last.IsZero() {
+			t.tokens = float64(rate)
+		} else {
+			t.tokens += now.Sub(t.last).Seconds() * float64(rate)
+			if t.tokens > float64(rate) {
+				t.tokens = float64(rate)
+			}
+		}
+		t.last = now
+		if t.tokens >= 1 {
+			t.tokens--
+			t.mu.Unlock()
+			return true
+		}
+		delay := time.Duration((1 - t.tokens) / float64(rate) * float64(time.Second))
+		t.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
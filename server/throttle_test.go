@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"go-relay-server/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcceptThrottle(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.MaxAcceptRate = 10
+	startServer(t, cfg)
+	addr := listenerAddr(cfg, 0)
+
+	// A burst of twice the rate: the first ten are greeted at once and the
+	// rest at ten per second
+	const n = 20
+	start := time.Now()
+	greeted := make([]time.Duration, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := connect(t, addr)
+			if code, _, err := c.tp.ReadResponse(0); err != nil || code != 220 {
+				t.Errorf("connection %d: got %d, %v, want 220", i, code, err)
+			}
+			greeted[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	early := 0
+	last := time.Duration(0)
+	for _, d := range greeted {
+		if d < 300*time.Millisecond {
+			early++
+		}
+		last = max(last, d)
+	}
+	if early < 5 || early > 12 {
+		t.Errorf("%d of %d connections were accepted in the first 300ms, want about 10", early, n)
+	}
+	if last < 800*time.Millisecond || last > 3*time.Second {
+		t.Errorf("last connection was accepted after %v, want about 1s", last)
+	}
+}
+
+func TestAcceptThrottleCancel(t *testing.T) {
+	var throttle acceptThrottle
+	ctx, cancel := context.WithCancel(context.Background())
+	if !throttle.wait(ctx, 1) {
+		t.Fatal("first connection was throttled")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if throttle.wait(ctx, 1) {
+		t.Fatal("second connection was accepted within the same second")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cancelled wait returned after %v", elapsed)
+	}
+
+	// No limit never waits
+	if !throttle.wait(ctx, 0) {
+		t.Error("unlimited rate was throttled")
+	}
+}
+
+func TestListenerRateLimits(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.RateLimiting = config.RateLimiting{RequestsPerMinute: 2, BurstLimit: 2}
+	cfg.Listeners = nil
+	for _, limit := range []*config.RateLimiting{nil, nil, {RequestsPerMinute: 3, BurstLimit: 3}, {RequestsPerMinute: 1, BurstLimit: 1}} {
+		cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Host: "127.0.0.1", Port: freePort(t), Encryption: "none", RateLimiting: limit})
+	}
+	startServer(t, cfg)
+
+	// Listeners without their own limits share the global count, the others
+	// are throttled independently at their own rates
+	for _, tt := range []struct {
+		listener int
+		want     int
+	}{
+		{0, 220}, {1, 220}, {0, 421}, {1, 421},
+		{2, 220}, {2, 220}, {2, 220}, {2, 421},
+		{3, 220}, {3, 421},
+	} {
+		if _, code := greetingCode(t, listenerAddr(cfg, tt.listener)); code != tt.want {
+			t.Errorf("connection to listener %d got %d, want %d", tt.listener, code, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	rl := newRateLimiter()
+	limits := RateLimitingConfig{RequestsPerMinute: 60, BurstLimit: 3, ExemptIPs: []string{"10.0.0.9"}}
+
+	// A burst up to the limit goes through, then one connection per second
+	for i := 0; i < 3; i++ {
+		if !rl.allow("10.0.0.1", "10.0.0.1", limits) {
+			t.Fatalf("connection %d of the burst refused", i+1)
+		}
+	}
+	if rl.allow("10.0.0.1", "10.0.0.1", limits) {
+		t.Fatal("connection past the burst allowed")
+	}
+	rl.buckets["10.0.0.1"].last = rl.buckets["10.0.0.1"].last.Add(-time.Second)
+	if !rl.allow("10.0.0.1", "10.0.0.1", limits) {
+		t.Fatal("connection refused after the bucket refilled one token")
+	}
+	if rl.allow("10.0.0.1", "10.0.0.1", limits) {
+		t.Fatal("second connection allowed after one token refilled")
+	}
+
+	// Exempt clients are never counted
+	for i := 0; i < 10; i++ {
+		if !rl.allow("10.0.0.9", "10.0.0.9", limits) {
+			t.Fatal("exempt client refused")
+		}
+	}
+	if _, ok := rl.buckets["10.0.0.9"]; ok {
+		t.Error("exempt client has a bucket")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	rl := newRateLimiter()
+	limits := RateLimitingConfig{RequestsPerMinute: 1, BurstLimit: 1}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		rl.allow(ip, ip, limits)
+	}
+
+	// Buckets idle for the window are dropped on the next sweep, the active
+	// one is kept with its count
+	rl.lastSweep = rl.lastSweep.Add(-rateBucketIdle)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		rl.buckets[ip].last = rl.buckets[ip].last.Add(-rateBucketIdle)
+	}
+	if rl.allow("10.0.0.3", "10.0.0.3", limits) {
+		t.Error("active client allowed past its limit")
+	}
+	if len(rl.buckets) != 1 || rl.buckets["10.0.0.3"] == nil {
+		t.Errorf("got buckets %v, want only 10.0.0.3", rl.buckets)
+	}
+	if !rl.allow("10.0.0.1", "10.0.0.1", limits) {
+		t.Error("evicted client refused")
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshake completes a TLS handshake with the implicit TLS listener at
+// addr, limited to client's versions and cipher suites
+func handshake(t *testing.T, addr string, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, client)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestTLSSettings(t *testing.T) {
+	upstream := startUpstream(t)
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg := testConfig(t, upstream.Addr)
+		cfg.Listeners[0].Encryption = "tls"
+		withTLS(t, &cfg)
+		s := startServer(t, cfg)
+		if s.tlsConfig.MinVersion != tls.VersionTLS12 || s.tlsConfig.CipherSuites != nil {
+			t.Errorf("TLS config has version %x and suites %v, want TLS 1.2 and the defaults", s.tlsConfig.MinVersion, s.tlsConfig.CipherSuites)
+		}
+	})
+
+	t.Run("TLS 1.3 only", func(t *testing.T) {
+		cfg := testConfig(t, upstream.Addr)
+		cfg.Listeners[0].Encryption = "tls"
+		cfg.TLSMinVersion = "1.3"
+		cert := withTLS(t, &cfg)
+		s := startServer(t, cfg)
+		if s.tlsConfig.MinVersion != tls.VersionTLS13 {
+			t.Errorf("TLS config has version %x, want TLS 1.3", s.tlsConfig.MinVersion)
+		}
+
+		addr := listenerAddr(cfg, 0)
+		client := &tls.Config{RootCAs: cert.Pool(), ServerName: "relay.test"}
+		if state, err := handshake(t, addr, client); err != nil || state.Version != tls.VersionTLS13 {
+			t.Errorf("TLS 1.3 client negotiated %x, %v", state.Version, err)
+		}
+		client.MaxVersion = tls.VersionTLS12
+		if _, err := handshake(t, addr, client); err == nil {
+			t.Error("TLS 1.2 client was accepted by a TLS 1.3 only listener")
+		}
+	})
+
+	t.Run("cipher suites", func(t *testing.T) {
+		cfg := testConfig(t, upstream.Addr)
+		cfg.Listeners[0].Encryption = "tls"
+		cfg.TLSMinVersion = "1.2"
+		cfg.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}
+		cert := withTLS(t, &cfg)
+		s := startServer(t, cfg)
+		want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+		if !slices.Equal(s.tlsConfig.CipherSuites, want) {
+			t.Errorf("TLS config has suites %v, want %v", s.tlsConfig.CipherSuites, want)
+		}
+
+		// TLS 1.2 clients are held to the list
+		addr := listenerAddr(cfg, 0)
+		client := &tls.Config{RootCAs: cert.Pool(), ServerName: "relay.test", MaxVersion: tls.VersionTLS12}
+		client.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+		if state, err := handshake(t, addr, client); err != nil || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+			t.Errorf("client offering a listed suite negotiated %s, %v", tls.CipherSuiteName(state.CipherSuite), err)
+		}
+		client.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+		if _, err := handshake(t, addr, client); err == nil {
+			t.Error("client offering only an unlisted suite was accepted")
+		}
+	})
+}
+
+func TestReloadTLSSettings(t *testing.T) {
+	upstream := startUpstream(t)
+	cfg := testConfig(t, upstream.Addr)
+	cfg.Listeners[0].Encryption = "tls"
+	withTLS(t, &cfg)
+	s := startServer(t, cfg)
+
+	updated := cfg
+	updated.TLSMinVersion = "1.3"
+	s.Reload(updated)
+	if s.tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Error("tls_min_version was applied without a restart")
+	}
+	if !strings.Contains(readLog(t, cfg), "Config change to tls_min_version/tls_cipher_suites requires a restart and was not applied") {
+		t.Error("change to tls_min_version not logged as requiring a restart")
+	}
+}
@@ -0,0 +1,119 @@
+package smtptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cert is a generated certificate and its key
+type Cert struct {
+	TLS     tls.Certificate
+	X509    *x509.Certificate
+	CertPEM []byte
+	KeyPEM  []byte
+	key     *ecdsa.PrivateKey
+}
+
+// SelfSigned returns a self-signed certificate for names, which may be DNS
+// names or IP addresses. The first name is also the common name. The
+// certificate can issue other server certificates, so it doubles as a test CA.
+func SelfSigned(names ...string) *Cert {
+	return issue(nil, names, x509.ExtKeyUsageServerAuth)
+}
+
+// NewCA returns a self-signed CA named cn whose certificates may be used for
+// any purpose, e.g. as client certificates
+func NewCA(cn string) *Cert {
+	return issue(nil, []string{cn}, x509.ExtKeyUsageAny)
+}
+
+// Issue returns a certificate for cn signed by c with the given extended key
+// usage, e.g. x509.ExtKeyUsageClientAuth for a client certificate
+func (c *Cert) Issue(cn string, usage x509.ExtKeyUsage) *Cert {
+	return issue(c, []string{cn}, usage)
+}
+
+// WriteFiles writes the certificate and key as PEM files named <name>.pem
+// and <name>.key in dir and returns their paths
+func (c *Cert) WriteFiles(dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, c.CertPEM, 0600); err != nil {
+		panic("smtptest: " + err.Error())
+	}
+	if err := os.WriteFile(keyFile, c.KeyPEM, 0600); err != nil {
+		panic("smtptest: " + err.Error())
+	}
+	return certFile, keyFile
+}
+
+// Pool returns a cert pool holding just c
+func (c *Cert) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.X509)
+	return pool
+}
+
+func issue(parent *Cert, names []string, usage x509.ExtKeyUsage) *Cert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("smtptest: " + err.Error())
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		panic("smtptest: " + err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.X509, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		panic("smtptest: " + err.Error())
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic("smtptest: " + err.Error())
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic("smtptest: " + err.Error())
+	}
+
+	c := &Cert{
+		X509:    leaf,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		key:     key,
+	}
+	c.TLS = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return c
+}
@@ -0,0 +1,233 @@
+// Package smtptest provides an in-process SMTP server for tests, in the
+// spirit of net/http/httptest. It records the transactions it receives and
+// lets a test override individual replies.
+package smtptest
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Message is a transaction the server accepted
+type Message struct {
+	From string
+	To   []string
+	Data []byte // Dot-unstuffed, with CRLF line endings
+}
+
+// Server is an SMTP server listening on a loopback address
+type Server struct {
+	// Addr is the host:port the server listens on, set by Start
+	Addr string
+	// TLS enables STARTTLS with this config when set
+	TLS *tls.Config
+	// Auth advertises AUTH PLAIN and LOGIN and accepts any credentials
+	Auth bool
+	// Reply may return a reply line for a command, overriding the default.
+	// It is called with the upper-cased verb and the full command line; an
+	// empty string keeps the default reply.
+	Reply func(verb, line string) string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	messages []Message
+	commands []string
+	conns    atomic.Int64
+	active   map[net.Conn]struct{}
+}
+
+// NewServer starts a server with the default behaviour: it accepts every
+// sender, recipient and message
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server that can be configured before Start
+func NewUnstartedServer() *Server {
+	return &Server{active: make(map[net.Conn]struct{})}
+}
+
+// Start listens on a free loopback port and serves connections
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("smtptest: failed to listen: " + err.Error())
+	}
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			s.mu.Lock()
+			s.active[conn] = struct{}{}
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+				s.mu.Lock()
+				delete(s.active, conn)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+}
+
+// Close stops the server and closes open connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.active {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Messages returns the transactions accepted so far
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Commands returns every command line received so far, in order
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Connections returns the number of connections accepted so far
+func (s *Server) Connections() int {
+	return int(s.conns.Load())
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 smtptest ESMTP")
+
+	var msg Message
+	encrypted := false
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		verb := strings.ToUpper(line)
+		if i := strings.IndexAny(verb, " :"); i >= 0 {
+			verb = verb[:i]
+		}
+		if s.Reply != nil {
+			if reply := s.Reply(verb, line); reply != "" {
+				tp.PrintfLine("%s", reply)
+				if strings.HasPrefix(reply, "421") {
+					return
+				}
+				continue
+			}
+		}
+
+		switch verb {
+		case "EHLO":
+			extensions := []string{"smtptest", "PIPELINING", "8BITMIME", "SMTPUTF8"}
+			if s.TLS != nil && !encrypted {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if s.Auth {
+				extensions = append(extensions, "AUTH PLAIN LOGIN")
+			}
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				tp.PrintfLine("250%s%s", separator, extension)
+			}
+		case "HELO", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "STARTTLS":
+			if s.TLS == nil || encrypted {
+				tp.PrintfLine("502 Not supported")
+				continue
+			}
+			tp.PrintfLine("220 Ready to start TLS")
+			conn = tls.Server(conn, s.TLS)
+			tp = textproto.NewConn(conn)
+			encrypted = true
+			msg = Message{}
+		case "AUTH":
+			if !s.Auth {
+				tp.PrintfLine("502 Not supported")
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.EqualFold(fields[1], "LOGIN") {
+				// Username and password prompts
+				tp.PrintfLine("334 VXNlcm5hbWU6")
+				tp.ReadLine()
+				tp.PrintfLine("334 UGFzc3dvcmQ6")
+				tp.ReadLine()
+			} else if len(fields) == 2 {
+				tp.PrintfLine("334 ")
+				tp.ReadLine()
+			}
+			tp.PrintfLine("235 Authentication successful")
+		case "MAIL":
+			msg = Message{From: path(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, path(line))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = []byte(strings.ReplaceAll(string(data), "\n", "\r\n"))
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			msg = Message{}
+			tp.PrintfLine("250 Queued")
+		case "RSET":
+			msg = Message{}
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("500 Unrecognized command")
+		}
+	}
+}
+
+// path returns the address between the angle brackets of a MAIL or RCPT line
+func path(line string) string {
+	start := strings.Index(line, "<")
+	end := strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
@@ -0,0 +1,277 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type Result string
+
+const (
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	Neutral   Result = "neutral"
+	None      Result = "none"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// maxLookups is the RFC 7208 limit on DNS-querying terms per check
+const maxLookups = 10
+
+// Resolver is the subset of *net.Resolver used for SPF evaluation
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type Checker struct {
+	resolver Resolver
+}
+
+func NewChecker(resolver Resolver) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Checker{resolver: resolver}
+}
+
+// Check evaluates the SPF policy of domain for a message from ip. Macros
+// and the deprecated ptr and exists mechanisms are not supported and never match.
+func (c *Checker) Check(ctx context.Context, ip net.IP, domain string) (Result, error) {
+	lookups := 0
+	return c.checkHost(ctx, ip, strings.ToLower(strings.TrimSuffix(domain, ".")), &lookups)
+}
+
+func (c *Checker) checkHost(ctx context.Context, ip net.IP, domain string, lookups *int) (Result, error) {
+	record, err := c.lookupRecord(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return None, nil
+		}
+		if errors.Is(err, errMultipleRecords) {
+			return PermError, err
+		}
+		return TempError, err
+	}
+	if record == "" {
+		return None, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		term = strings.ToLower(term)
+
+		// Modifiers carry "=" before any ":" or "/"
+		if eq := strings.Index(term, "="); eq > 0 && !strings.ContainsAny(term[:eq], ":/") {
+			if term[:eq] == "redirect" {
+				redirect = term[eq+1:]
+			}
+			continue
+		}
+
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+
+		matched, result, err := c.matchMechanism(ctx, ip, domain, term, lookups)
+		if err != nil {
+			return result, err
+		}
+		if matched {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if *lookups++; *lookups > maxLookups {
+			return PermError, errors.New("too many DNS lookups")
+		}
+		result, err := c.checkHost(ctx, ip, redirect, lookups)
+		if result == None {
+			return PermError, fmt.Errorf("redirect domain %s has no SPF record", redirect)
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+var errMultipleRecords = errors.New("multiple SPF records")
+
+func (c *Checker) lookupRecord(ctx context.Context, domain string) (string, error) {
+	records, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+
+	var found string
+	for _, record := range records {
+		if record == "v=spf1" || strings.HasPrefix(strings.ToLower(record), "v=spf1 ") {
+			if found != "" {
+				return "", errMultipleRecords
+			}
+			found = record
+		}
+	}
+	return found, nil
+}
+
+// matchMechanism reports whether a single mechanism matches ip. A non-nil
+// error carries the result that ends the evaluation.
+func (c *Checker) matchMechanism(ctx context.Context, ip net.IP, domain, term string, lookups *int) (bool, Result, error) {
+	name, value := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, value = term[:i], term[i:]
+	}
+
+	switch name {
+	case "all":
+		return true, "", nil
+	case "ip4", "ip6":
+		network := strings.TrimPrefix(value, ":")
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, PermError, fmt.Errorf("invalid %s mechanism %q", name, term)
+		}
+		return ipNet.Contains(ip), "", nil
+	case "a", "mx":
+		if *lookups++; *lookups > maxLookups {
+			return false, PermError, errors.New("too many DNS lookups")
+		}
+		target, cidr4, cidr6, err := parseDomainCIDR(value, domain)
+		if err != nil {
+			return false, PermError, err
+		}
+		if strings.Contains(target, "%") {
+			return false, "", nil
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			records, err := c.resolver.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, TempError, err
+			}
+			hosts = hosts[:0]
+			for _, record := range records {
+				hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return false, TempError, err
+			}
+			for _, addr := range addrs {
+				if matchCIDR(ip, addr.IP, cidr4, cidr6) {
+					return true, "", nil
+				}
+			}
+		}
+		return false, "", nil
+	case "include":
+		if *lookups++; *lookups > maxLookups {
+			return false, PermError, errors.New("too many DNS lookups")
+		}
+		target := strings.TrimPrefix(value, ":")
+		if target == "" || strings.Contains(target, "%") {
+			return false, "", nil
+		}
+		result, err := c.checkHost(ctx, ip, target, lookups)
+		switch result {
+		case Pass:
+			return true, "", nil
+		case Fail, SoftFail, Neutral:
+			return false, "", nil
+		case None:
+			return false, PermError, fmt.Errorf("included domain %s has no SPF record", target)
+		default:
+			return false, result, err
+		}
+	case "ptr", "exists":
+		if *lookups++; *lookups > maxLookups {
+			return false, PermError, errors.New("too many DNS lookups")
+		}
+		return false, "", nil
+	default:
+		return false, PermError, fmt.Errorf("unknown mechanism %q", term)
+	}
+}
+
+// parseDomainCIDR splits ":domain/cidr4//cidr6" as used by the a and mx mechanisms
+func parseDomainCIDR(value, domain string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+	target := domain
+
+	if strings.HasPrefix(value, ":") {
+		value = value[1:]
+		if i := strings.Index(value, "/"); i >= 0 {
+			target, value = value[:i], value[i:]
+		} else {
+			target, value = value, ""
+		}
+	}
+
+	if value != "" {
+		parts := strings.SplitN(strings.TrimPrefix(value, "/"), "//", 2)
+		var err error
+		if parts[0] != "" {
+			if cidr4, err = strconv.Atoi(parts[0]); err != nil || cidr4 < 0 || cidr4 > 32 {
+				return "", 0, 0, fmt.Errorf("invalid ip4 prefix length in %q", value)
+			}
+		}
+		if len(parts) == 2 {
+			if cidr6, err = strconv.Atoi(parts[1]); err != nil || cidr6 < 0 || cidr6 > 128 {
+				return "", 0, 0, fmt.Errorf("invalid ip6 prefix length in %q", value)
+			}
+		}
+	}
+	return target, cidr4, cidr6, nil
+}
+
+func matchCIDR(ip, addr net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		addr4 := addr.To4()
+		if addr4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(cidr4, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return ip.Mask(mask).Equal(addr.Mask(mask))
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
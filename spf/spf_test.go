@@ -0,0 +1,120 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeResolver answers lookups from maps; names missing from them are not
+// found
+type fakeResolver struct {
+	txt   map[string][]string
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error // Returned by every TXT lookup when set
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	var ips []net.IPAddr
+	for _, addr := range addrs {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ips, nil
+}
+
+func TestCheck(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"pass.test":     {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"fail.test":     {"v=spf1 ip4:198.51.100.1 -all"},
+			"softfail.test": {"v=spf1 ip4:198.51.100.1 ~all"},
+			"neutral.test":  {"v=spf1 ?all"},
+			"other.test":    {"google-site-verification=abc"},
+			"a.test":        {"v=spf1 a -all"},
+			"mx.test":       {"v=spf1 mx/24 -all"},
+			"include.test":  {"v=spf1 include:pass.test -all"},
+			"redirect.test": {"v=spf1 redirect=fail.test"},
+			"ip6.test":      {"v=spf1 ip6:2001:db8::/32 -all"},
+			"twice.test":    {"v=spf1 -all", "v=spf1 +all"},
+			"unknown.test":  {"v=spf1 bogus -all"},
+			"loop.test":     {"v=spf1 include:loop.test -all"},
+		},
+		mx: map[string][]*net.MX{
+			"mx.test": {{Host: "mail.mx.test.", Pref: 10}},
+		},
+		hosts: map[string][]string{
+			"a.test":       {"192.0.2.10"},
+			"mail.mx.test": {"192.0.2.200"},
+		},
+	}
+	checker := NewChecker(resolver)
+
+	for _, tt := range []struct {
+		domain string
+		ip     string
+		want   Result
+	}{
+		{"pass.test", "192.0.2.1", Pass},
+		{"pass.test", "203.0.113.1", Fail},
+		{"fail.test", "192.0.2.1", Fail},
+		{"softfail.test", "192.0.2.1", SoftFail},
+		{"softfail.test", "198.51.100.1", Pass},
+		{"neutral.test", "192.0.2.1", Neutral},
+		{"missing.test", "192.0.2.1", None},
+		{"other.test", "192.0.2.1", None},
+		{"a.test", "192.0.2.10", Pass},
+		{"a.test", "192.0.2.11", Fail},
+		{"mx.test", "192.0.2.1", Pass},
+		{"mx.test", "192.0.3.1", Fail},
+		{"include.test", "192.0.2.1", Pass},
+		{"include.test", "203.0.113.1", Fail},
+		{"redirect.test", "198.51.100.1", Pass},
+		{"redirect.test", "192.0.2.1", Fail},
+		{"ip6.test", "2001:db8::1", Pass},
+		{"ip6.test", "192.0.2.1", Fail},
+		{"Pass.Test.", "192.0.2.1", Pass},
+		{"twice.test", "192.0.2.1", PermError},
+		{"unknown.test", "192.0.2.1", PermError},
+		{"loop.test", "192.0.2.1", PermError},
+	} {
+		got, _ := checker.Check(context.Background(), net.ParseIP(tt.ip), tt.domain)
+		if got != tt.want {
+			t.Errorf("Check(%s, %s) = %s, want %s", tt.ip, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestCheckLookupFailure(t *testing.T) {
+	checker := NewChecker(&fakeResolver{err: errors.New("server misbehaving")})
+	result, err := checker.Check(context.Background(), net.ParseIP("192.0.2.1"), "example.com")
+	if result != TempError || err == nil {
+		t.Fatalf("Check = %s, %v, want temperror with an error", result, err)
+	}
+}
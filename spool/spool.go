@@ -0,0 +1,111 @@
+package spool
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultThreshold is the size above which a spool moves to disk
+const DefaultThreshold = 10 << 20
+
+// Spool buffers a message in memory and spills it to a temporary file once
+// it grows beyond the threshold. Close must be called to remove the file.
+type Spool struct {
+	dir       string
+	threshold int64
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+// New returns an empty spool. Temporary files are created in dir, or the
+// system temp directory when dir is empty; threshold <= 0 uses DefaultThreshold.
+func New(dir string, threshold int64) *Spool {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	return &Spool{dir: dir, threshold: threshold}
+}
+
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.threshold {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// spill moves the buffered data to a new temporary file
+func (s *Spool) spill() error {
+	file, err := os.CreateTemp(s.dir, "smtp-relay-spool-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	if _, err := file.Write(s.buf.Bytes()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	s.file = file
+	s.buf = bytes.Buffer{}
+	return nil
+}
+
+// Size returns the number of bytes written
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// OnDisk reports whether the spool has spilled to a temporary file
+func (s *Spool) OnDisk() bool {
+	return s.file != nil
+}
+
+// Open returns a reader over the spooled data starting at offset. Each call
+// returns an independent reader, so the data can be read more than once.
+func (s *Spool) Open(offset int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > s.size {
+		return nil, fmt.Errorf("spool offset %d out of range", offset)
+	}
+	if s.file == nil {
+		return io.NopCloser(bytes.NewReader(s.buf.Bytes()[offset:])), nil
+	}
+
+	file, err := os.Open(s.file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek spool file: %w", err)
+	}
+	return file, nil
+}
+
+// Close releases the spool, removing its temporary file if there is one
+func (s *Spool) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	s.file.Close()
+	s.file = nil
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spool file: %w", err)
+	}
+	return nil
+}
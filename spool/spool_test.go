@@ -0,0 +1,106 @@
+package spool
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func readAll(t *testing.T, s *Spool, offset int64) []byte {
+	t.Helper()
+	r, err := s.Open(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func spoolFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSmallMessageStaysInMemory(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, 100)
+	data := []byte("Subject: small\r\n\r\nBody\r\n")
+	if _, err := s.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.OnDisk() || spoolFiles(t, dir) != 0 {
+		t.Fatal("small message spilled to disk")
+	}
+	if s.Size() != int64(len(data)) {
+		t.Errorf("size %d, want %d", s.Size(), len(data))
+	}
+	if got := readAll(t, s, 0); !bytes.Equal(got, data) {
+		t.Errorf("read %q, want %q", got, data)
+	}
+	if got := readAll(t, s, 9); !bytes.Equal(got, data[9:]) {
+		t.Errorf("read %q from offset 9, want %q", got, data[9:])
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLargeMessageSpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, 100)
+	var data []byte
+	for i := 0; i < 50; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 10)
+		data = append(data, chunk...)
+		if _, err := s.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !s.OnDisk() || spoolFiles(t, dir) != 1 {
+		t.Fatal("large message not spilled to a file in the spool directory")
+	}
+	if s.Size() != int64(len(data)) {
+		t.Errorf("size %d, want %d", s.Size(), len(data))
+	}
+	// Every reader sees the whole message, the part written before the
+	// spill included
+	for i := 0; i < 2; i++ {
+		if got := readAll(t, s, 0); !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes that differ from the %d written", len(got), len(data))
+		}
+	}
+	if got := readAll(t, s, 450); !bytes.Equal(got, data[450:]) {
+		t.Errorf("read %q from offset 450, want %q", got, data[450:])
+	}
+	if _, err := s.Open(int64(len(data)) + 1); err == nil {
+		t.Error("Open past the end succeeded")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolFiles(t, dir); n != 0 {
+		t.Fatalf("%d spool files left after Close", n)
+	}
+}
+
+func TestSpillFailure(t *testing.T) {
+	s := New(t.TempDir()+"/missing", 10)
+	if _, err := s.Write(bytes.Repeat([]byte("x"), 20)); err == nil {
+		t.Fatal("Write succeeded without a spool directory")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
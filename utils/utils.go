@@ -2,12 +2,30 @@ package utils
 
 import "strings"
 
+// ExtractSubject returns the Subject header of a message, or "(No Subject)".
+// Lines may end in CRLF or LF, and a folded subject is unfolded into one line.
+// Only the header block, up to the first blank line, is searched.
 func ExtractSubject(data []byte) string {
-	lines := strings.Split(string(data), "\r\n")
-	for _, line := range lines {
-		if strings.HasPrefix(strings.ToUpper(line), "SUBJECT:") {
-			return strings.TrimSpace(line[len("Subject:"):])
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if line == "" {
+			break
 		}
+		if !strings.HasPrefix(strings.ToUpper(line), "SUBJECT:") {
+			continue
+		}
+
+		subject := line[len("Subject:"):]
+		for i+1 < len(lines) {
+			next := strings.TrimSuffix(lines[i+1], "\r")
+			if next == "" || (next[0] != ' ' && next[0] != '\t') {
+				break
+			}
+			subject += " " + strings.TrimSpace(next)
+			i++
+		}
+		return strings.TrimSpace(subject)
 	}
 	return "(No Subject)"
 }
\ No newline at end of file
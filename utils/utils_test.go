@@ -0,0 +1,27 @@
+package utils
+
+import "testing"
+
+func TestExtractSubject(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"CRLF", "From: a@example.com\r\nSubject: Hello\r\n\r\nBody\r\n", "Hello"},
+		{"LF only", "From: a@example.com\nSubject: Hello\n\nBody\n", "Hello"},
+		{"case", "SUBJECT:Hello\r\n\r\n", "Hello"},
+		{"folded", "Subject: A long\r\n subject\r\n\tover three lines\r\nTo: b@example.org\r\n\r\n", "A long subject over three lines"},
+		{"folded LF only", "Subject: A long\n  subject\nTo: b@example.org\n\n", "A long subject"},
+		{"folded last header", "Subject: Ends\r\n here\r\n\r\n continued body\r\n", "Ends here"},
+		{"no line ending", "Subject: Only header", "Only header"},
+		{"empty", "Subject:\r\n\r\n", ""},
+		{"missing", "From: a@example.com\r\n\r\nBody\r\n", "(No Subject)"},
+		{"in the body", "From: a@example.com\r\n\r\nSubject: not a header\r\n", "(No Subject)"},
+		{"other header", "X-Subject: nope\r\n\r\n", "(No Subject)"},
+	} {
+		if got := ExtractSubject([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s: ExtractSubject(%q) = %q, want %q", tt.name, tt.data, got, tt.want)
+		}
+	}
+}